@@ -54,6 +54,8 @@ generate-fast/files += $(OSS_HOME)/CHANGELOG.md
 generate-fast/files += $(OSS_HOME)/pkg/api/getambassador.io/v2/zz_generated.conversion.go
 generate-fast/files += $(OSS_HOME)/pkg/api/getambassador.io/v2/zz_generated.conversion-spoke.go
 generate-fast/files += $(OSS_HOME)/pkg/api/getambassador.io/v3alpha1/zz_generated.conversion-hub.go
+generate-fast/files += $(OSS_HOME)/pkg/api/gateway.networking.k8s.io/v1/zz_generated.deepcopy.go
+generate-fast/files += $(OSS_HOME)/pkg/api/gateway.networking.k8s.io/v1beta1/zz_generated.deepcopy.go
 # Individual files: YAML
 generate-fast/files += $(OSS_HOME)/manifests/emissary/emissary-crds.yaml.in
 generate-fast/files += $(OSS_HOME)/manifests/emissary/emissary-emissaryns.yaml.in
@@ -278,6 +280,11 @@ $(OSS_HOME)/_generate.tmp/crds: $(tools/controller-gen) build-aux/copyright-boil
 	  $(foreach varname,$(sort $(filter controller-gen/output/%,$(.VARIABLES))), $(call joinlist,:,output $(patsubst controller-gen/output/%,%,$(varname)) $($(varname))) ) \
 	  $(foreach p,$(wildcard ./pkg/api/getambassador.io/v*/),paths=$p...)
 
+# The Gateway API types get deepcopy functions, but no CRDs; the CRDs come from upstream.
+$(OSS_HOME)/pkg/api/gateway.networking.k8s.io/%/zz_generated.deepcopy.go: $(tools/controller-gen) build-aux/copyright-boilerplate.go.txt FORCE
+	rm -f $@
+	cd $(OSS_HOME) && $(tools/controller-gen) object:$(call joinlist,$(comma),$(controller-gen/options/object)) paths=$(patsubst $(OSS_HOME)/%,./%,$(@D))/...
+
 $(OSS_HOME)/%/zz_generated.conversion.go: $(tools/conversion-gen) build-aux/copyright-boilerplate.go.txt FORCE
 	rm -f $@ $(@D)/*.scaffold.go
 	GOPATH= GOFLAGS=-mod=mod $(tools/conversion-gen) \
@@ -0,0 +1,296 @@
+package ambex
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/status"
+
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+)
+
+// An XdsStatus is what we know about whether one Envoy node has accepted the configuration we
+// sent it for one xDS resource type.
+type XdsStatus struct {
+	Node    string `json:"node"`
+	Group   string `json:"group"`
+	TypeURL string `json:"typeUrl"`
+
+	// AckedVersion is the last version of the resources that the node accepted.
+	AckedVersion string    `json:"ackedVersion,omitempty"`
+	AckedAt      time.Time `json:"ackedAt,omitempty"`
+
+	// Rejected is set if the node's latest answer was a rejection.
+	Rejected bool `json:"rejected"`
+
+	// NackedVersion is the last version of the resources that the node rejected, and Error is
+	// Envoy's explanation of why.
+	NackedVersion string    `json:"nackedVersion,omitempty"`
+	NackedAt      time.Time `json:"nackedAt,omitempty"`
+	Error         string    `json:"error,omitempty"`
+
+	// Nacks counts every rejection from this node for this type.
+	Nacks int `json:"nacks"`
+}
+
+type ackStream struct {
+	node  string
+	group string
+	// nonces maps the nonce of each response on the stream that Envoy hasn't answered yet to the
+	// response, since incremental xDS requests don't repeat the version that they're (N)ACKing.
+	nonces map[string]sentResponse
+	sent   int
+}
+
+// A sentResponse is a response that we sent on a stream.
+type sentResponse struct {
+	typeURL string
+	version string
+	// seq orders the responses on a stream.
+	seq int
+}
+
+// An AckTracker watches the requests that Envoy sends us to work out which versions of the
+// configuration each node has accepted or rejected (ACKed or NACKed, in xDS terms).
+//
+// It also keeps track of the last known good version for each node group: the latest version that
+// some node in the group accepted for every type, and that no node in the group rejected.
+type AckTracker struct {
+	hasher HasherV3
+	onNack func(group, version string)
+
+	mu       sync.Mutex
+	streams  map[int64]*ackStream
+	statuses map[string]map[string]*XdsStatus // node -> type URL -> status
+	lastGood map[string]string                // group -> version
+	nacked   map[string]map[string]bool       // group -> version -> whether any node NACKed it
+	now      func() time.Time
+}
+
+// NewAckTracker returns an AckTracker that uses the given hasher to find each node's group, and
+// that calls onNack (if it's not nil) whenever a node rejects a version. onNack is called
+// synchronously from the xDS server, so it must not block.
+func NewAckTracker(hasher HasherV3, onNack func(group, version string)) *AckTracker {
+	return &AckTracker{
+		hasher:   hasher,
+		onNack:   onNack,
+		streams:  map[int64]*ackStream{},
+		statuses: map[string]map[string]*XdsStatus{},
+		lastGood: map[string]string{},
+		nacked:   map[string]map[string]bool{},
+		now:      time.Now,
+	}
+}
+
+func (t *AckTracker) stream(sid int64, node *v3core.Node) *ackStream {
+	s, ok := t.streams[sid]
+	if !ok {
+		s = &ackStream{nonces: map[string]sentResponse{}}
+		t.streams[sid] = s
+	}
+	if node != nil {
+		s.node = node.Id
+		s.group = t.hasher.ID(node)
+	}
+	return s
+}
+
+// Request records a request from Envoy. Requests that don't answer one of our responses (the
+// first request for each type on a stream) only tell us which node is on the other end, and which
+// types it wants.
+func (t *AckTracker) Request(sid int64, node *v3core.Node, typeURL, version, nonce string, errorDetail *status.Status) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	s := t.stream(sid, node)
+	if s.node == "" {
+		t.mu.Unlock()
+		return
+	}
+	st := t.status(s, typeURL)
+	if nonce == "" {
+		t.mu.Unlock()
+		return
+	}
+	if res, ok := s.nonces[nonce]; ok {
+		version = res.version
+		// A request answers the latest response of its type that Envoy got, so Envoy won't
+		// answer any earlier response of that type that it skipped over.
+		for n, r := range s.nonces {
+			if r.typeURL == res.typeURL && r.seq <= res.seq {
+				delete(s.nonces, n)
+			}
+		}
+	} else if errorDetail != nil {
+		// The version in a rejection is the last version that Envoy accepted, not the one that
+		// it's rejecting, so without the nonce we can't tell which version was rejected.
+		version = ""
+	}
+	if version == "" {
+		t.mu.Unlock()
+		return
+	}
+
+	now := t.now()
+	var nackedGroup string
+	if errorDetail != nil {
+		st.Rejected = true
+		st.NackedVersion = version
+		st.NackedAt = now
+		st.Error = errorDetail.GetMessage()
+		st.Nacks++
+		if t.nacked[s.group] == nil {
+			t.nacked[s.group] = map[string]bool{}
+		}
+		t.nacked[s.group][version] = true
+		if t.lastGood[s.group] == version {
+			// Some other node must have accepted it before this one got around to asking for
+			// everything.
+			delete(t.lastGood, s.group)
+		}
+		nackedGroup = s.group
+	} else {
+		st.AckedVersion = version
+		st.AckedAt = now
+		st.Rejected = false
+		t.updateLastGood(s, version)
+	}
+	t.mu.Unlock()
+
+	if nackedGroup != "" && t.onNack != nil {
+		t.onNack(nackedGroup, version)
+	}
+}
+
+// Response records the version carried by a response of the given type that we're about to send.
+func (t *AckTracker) Response(sid int64, typeURL, version, nonce string) {
+	if t == nil || nonce == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.stream(sid, nil)
+	s.sent++
+	s.nonces[nonce] = sentResponse{typeURL: typeURL, version: version, seq: s.sent}
+}
+
+// StreamClosed forgets about a stream. What we learned about the node from it is kept.
+func (t *AckTracker) StreamClosed(sid int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.streams, sid)
+}
+
+func (t *AckTracker) status(s *ackStream, typeURL string) *XdsStatus {
+	types, ok := t.statuses[s.node]
+	if !ok {
+		types = map[string]*XdsStatus{}
+		t.statuses[s.node] = types
+	}
+	st, ok := types[typeURL]
+	if !ok {
+		st = &XdsStatus{Node: s.node, TypeURL: typeURL}
+		types[typeURL] = st
+	}
+	st.Group = s.group
+	return st
+}
+
+func (t *AckTracker) updateLastGood(s *ackStream, version string) {
+	if t.nacked[s.group][version] {
+		return
+	}
+	for _, st := range t.statuses[s.node] {
+		if st.AckedVersion != version {
+			return
+		}
+	}
+	t.lastGood[s.group] = version
+}
+
+// LastGood returns the last known good version for a node group, or "" if there isn't one.
+func (t *AckTracker) LastGood(group string) string {
+	if t == nil {
+		return ""
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastGood[group]
+}
+
+// Answered returns whether every node that's connected to us has ACKed or NACKed the given version
+// for at least one type. That's true if no nodes are connected.
+func (t *AckTracker) Answered(version string) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.streams {
+		if s.node == "" {
+			continue
+		}
+		answered := false
+		for _, st := range t.statuses[s.node] {
+			if st.AckedVersion == version || st.NackedVersion == version {
+				answered = true
+				break
+			}
+		}
+		if !answered {
+			return false
+		}
+	}
+	return true
+}
+
+// Statuses returns the status of every node and type that we know about, sorted by node and type.
+func (t *AckTracker) Statuses() []XdsStatus {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := []XdsStatus{}
+	for _, types := range t.statuses {
+		for _, st := range types {
+			result = append(result, *st)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Node != result[j].Node {
+			return result[i].Node < result[j].Node
+		}
+		return result[i].TypeURL < result[j].TypeURL
+	})
+	return result
+}
+
+// WriteMetrics writes the tracker's metrics in the Prometheus text exposition format.
+func (t *AckTracker) WriteMetrics(w io.Writer) {
+	statuses := t.Statuses()
+
+	fmt.Fprintln(w, "# HELP ambex_xds_nacks_total Number of times an Envoy node rejected a configuration update.")
+	fmt.Fprintln(w, "# TYPE ambex_xds_nacks_total counter")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "ambex_xds_nacks_total{node=%q,group=%q,type_url=%q} %d\n", st.Node, st.Group, st.TypeURL, st.Nacks)
+	}
+
+	fmt.Fprintln(w, "# HELP ambex_xds_rejected Whether an Envoy node's latest response to a configuration update was a rejection.")
+	fmt.Fprintln(w, "# TYPE ambex_xds_rejected gauge")
+	for _, st := range statuses {
+		rejected := 0
+		if st.Rejected {
+			rejected = 1
+		}
+		fmt.Fprintf(w, "ambex_xds_rejected{node=%q,group=%q,type_url=%q} %d\n", st.Node, st.Group, st.TypeURL, rejected)
+	}
+}
@@ -0,0 +1,89 @@
+package ambex
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/rpc/status"
+
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+)
+
+func TestAckTracker(t *testing.T) {
+	type nack struct{ group, version string }
+	var nacks []nack
+	acks := NewAckTracker(HasherV3{}, func(group, version string) {
+		nacks = append(nacks, nack{group, version})
+	})
+	node := &v3core.Node{Id: "envoy"}
+	types := []string{ecp_v3_resource.ClusterType, ecp_v3_resource.ListenerType}
+
+	// Envoy accepts v1 for every type it asked for, which makes v1 good.
+	for i, typeURL := range types {
+		acks.Request(1, node, typeURL, "", "", nil)
+		acks.Response(1, typeURL, "v1", string(rune('a'+i)))
+	}
+	acks.Request(1, nil, ecp_v3_resource.ClusterType, "v1", "a", nil)
+	assert.Equal(t, "", acks.LastGood("envoy"))
+	acks.Request(1, nil, ecp_v3_resource.ListenerType, "v1", "b", nil)
+	assert.Equal(t, "v1", acks.LastGood("envoy"))
+
+	// Envoy accepts the v2 clusters, but rejects the v2 listeners. The rejection carries the
+	// last version that Envoy accepted, but the nonce tells us which version it's rejecting.
+	acks.Response(1, ecp_v3_resource.ClusterType, "v2", "c")
+	acks.Response(1, ecp_v3_resource.ListenerType, "v2", "d")
+	acks.Request(1, nil, ecp_v3_resource.ClusterType, "v2", "c", nil)
+	acks.Request(1, nil, ecp_v3_resource.ListenerType, "v1", "d", &status.Status{Message: "bad listener"})
+	assert.Equal(t, []nack{{"envoy", "v2"}}, nacks)
+	assert.Equal(t, "v1", acks.LastGood("envoy"))
+
+	statuses := acks.Statuses()
+	assert.Len(t, statuses, 2)
+	listeners := statuses[1]
+	assert.Equal(t, ecp_v3_resource.ListenerType, listeners.TypeURL)
+	assert.Equal(t, "v1", listeners.AckedVersion)
+	assert.Equal(t, "v2", listeners.NackedVersion)
+	assert.Equal(t, "bad listener", listeners.Error)
+	assert.True(t, listeners.Rejected)
+	assert.Equal(t, 1, listeners.Nacks)
+
+	var metrics bytes.Buffer
+	acks.WriteMetrics(&metrics)
+	assert.Contains(t, metrics.String(), `ambex_xds_rejected{node="envoy",group="envoy",type_url="`+ecp_v3_resource.ListenerType+`"} 1`)
+
+	// The package's metrics, which entrypoint serves, include the running tracker's.
+	setRunningAcks(acks)
+	defer setRunningAcks(nil)
+	metrics.Reset()
+	WriteMetrics(&metrics)
+	assert.Contains(t, metrics.String(), `ambex_xds_nacks_total{node="envoy",group="envoy",type_url="`+ecp_v3_resource.ListenerType+`"} 1`)
+
+	// A delta stream doesn't carry versions at all. Accepting v3 everywhere clears the rejection.
+	acks.StreamClosed(1)
+	for i, typeURL := range types {
+		nonce := string(rune('e' + i))
+		acks.Request(2, node, typeURL, "", "", nil)
+		acks.Response(2, typeURL, "v3", nonce)
+		acks.Request(2, nil, typeURL, "", nonce, nil)
+	}
+	assert.Equal(t, "v3", acks.LastGood("envoy"))
+	assert.False(t, acks.Statuses()[1].Rejected)
+}
+
+func TestAckTrackerSupersededNonces(t *testing.T) {
+	acks := NewAckTracker(HasherV3{}, nil)
+	acks.Request(1, &v3core.Node{Id: "envoy"}, ecp_v3_resource.ClusterType, "", "", nil)
+
+	// v2 replaces v1 before Envoy answers v1, so Envoy only ever answers v2. That forgets v1
+	// too, but not the listeners that Envoy hasn't answered yet.
+	acks.Response(1, ecp_v3_resource.ClusterType, "v1", "a")
+	acks.Response(1, ecp_v3_resource.ListenerType, "v1", "b")
+	acks.Response(1, ecp_v3_resource.ClusterType, "v2", "c")
+	acks.Request(1, nil, ecp_v3_resource.ClusterType, "v2", "c", nil)
+	assert.Equal(t, map[string]sentResponse{"b": {ecp_v3_resource.ListenerType, "v1", 2}}, acks.streams[1].nonces)
+
+	acks.Request(1, nil, ecp_v3_resource.ListenerType, "v1", "b", nil)
+	assert.Empty(t, acks.streams[1].nonces)
+}
@@ -0,0 +1,299 @@
+package ambex
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/datawire/dlib/dlog"
+)
+
+// An AdmissionPolicy decides when the Updater may push an update to Envoy. The Updater only ever
+// calls it from one goroutine, so implementations don't need to lock anything that only the
+// Updater touches.
+type AdmissionPolicy interface {
+	// Admit says whether the update with the given version may be pushed now. If it says no, the
+	// Updater asks again on its next tick, or when a newer update arrives (which replaces this
+	// one).
+	Admit(ctx context.Context, now time.Time, version string) bool
+
+	// Pushed tells the policy that the Updater pushed an update that it admitted.
+	Pushed(now time.Time, version string)
+
+	// Interval is how often the policy wants to be asked again while it's holding an update back.
+	Interval() time.Duration
+}
+
+// allPolicies admits an update only if every one of its policies admits it.
+type allPolicies []AdmissionPolicy
+
+func (ps allPolicies) Admit(ctx context.Context, now time.Time, version string) bool {
+	for _, p := range ps {
+		if !p.Admit(ctx, now, version) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ps allPolicies) Pushed(now time.Time, version string) {
+	for _, p := range ps {
+		p.Pushed(now, version)
+	}
+}
+
+func (ps allPolicies) Interval() time.Duration {
+	var result time.Duration
+	for _, p := range ps {
+		if d := p.Interval(); d > 0 && (result == 0 || d < result) {
+			result = d
+		}
+	}
+	if result == 0 {
+		result = time.Minute
+	}
+	return result
+}
+
+// tokenBucketPolicy admits at most rate updates per minute on average, with bursts of up to burst
+// updates.
+type tokenBucketPolicy struct {
+	rate  float64 // tokens per minute
+	burst float64
+
+	tokens    float64
+	refilled  time.Time
+	throttled string // the last version we held back, so we only log once per version
+}
+
+func (p *tokenBucketPolicy) refill(now time.Time) {
+	if !p.refilled.IsZero() {
+		p.tokens = math.Min(p.burst, p.tokens+now.Sub(p.refilled).Minutes()*p.rate)
+	}
+	p.refilled = now
+}
+
+func (p *tokenBucketPolicy) Admit(ctx context.Context, now time.Time, version string) bool {
+	p.refill(now)
+	if p.tokens < 1 {
+		if version != p.throttled {
+			dlog.Infof(ctx, "Update policy: holding reconfig %s back, more than %g updates per minute", version, p.rate)
+			p.throttled = version
+		}
+		return false
+	}
+	return true
+}
+
+func (p *tokenBucketPolicy) Pushed(now time.Time, version string) {
+	p.refill(now)
+	p.tokens--
+}
+
+// Interval is how long it takes to get another token.
+func (p *tokenBucketPolicy) Interval() time.Duration {
+	return time.Duration(float64(time.Minute) / p.rate)
+}
+
+// maintenanceWindowPolicy freezes the configuration for duration every day, starting at start
+// (which is the time since midnight in location). Updates that arrive during the window are pushed
+// when it ends.
+type maintenanceWindowPolicy struct {
+	start    time.Duration
+	duration time.Duration
+	location *time.Location
+
+	throttled string // the last version we held back, so we only log once per version
+}
+
+// end returns when the window that now is in ends, or the zero time if now isn't in a window.
+func (p *maintenanceWindowPolicy) end(now time.Time) time.Time {
+	local := now.In(p.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, p.location)
+	// A window that started yesterday might not be over yet.
+	for _, day := range []int{-1, 0} {
+		start := midnight.AddDate(0, 0, day).Add(p.start)
+		if end := start.Add(p.duration); !now.Before(start) && now.Before(end) {
+			return end
+		}
+	}
+	return time.Time{}
+}
+
+func (p *maintenanceWindowPolicy) Admit(ctx context.Context, now time.Time, version string) bool {
+	end := p.end(now)
+	if end.IsZero() {
+		return true
+	}
+	if version != p.throttled {
+		dlog.Infof(ctx, "Update policy: holding reconfig %s back until the maintenance window ends at %s", version, end.Format(time.RFC3339))
+		p.throttled = version
+	}
+	return false
+}
+
+func (p *maintenanceWindowPolicy) Pushed(now time.Time, version string) {}
+
+func (p *maintenanceWindowPolicy) Interval() time.Duration {
+	return time.Minute
+}
+
+// waitForAckPolicy doesn't push an update until every connected Envoy has answered (ACKed or
+// NACKed) the last one, or until timeout has passed since it was pushed, so that a single stuck
+// Envoy can't freeze the configuration forever.
+type waitForAckPolicy struct {
+	acks    *AckTracker
+	timeout time.Duration
+
+	waitingFor string // the version we last pushed, if we haven't heard back about it yet
+	pushedAt   time.Time
+	throttled  string // the last version we held back, so we only log once per version
+}
+
+func (p *waitForAckPolicy) Admit(ctx context.Context, now time.Time, version string) bool {
+	switch {
+	case p.waitingFor == "":
+		return true
+	case p.acks.Answered(p.waitingFor):
+		p.waitingFor = ""
+		return true
+	case now.Sub(p.pushedAt) >= p.timeout:
+		dlog.Warnf(ctx, "Update policy: Envoy still hasn't answered reconfig %s after %v, pushing reconfig %s anyway",
+			p.waitingFor, p.timeout, version)
+		p.waitingFor = ""
+		return true
+	}
+	if version != p.throttled {
+		dlog.Infof(ctx, "Update policy: holding reconfig %s back until Envoy answers reconfig %s", version, p.waitingFor)
+		p.throttled = version
+	}
+	return false
+}
+
+func (p *waitForAckPolicy) Pushed(now time.Time, version string) {
+	p.waitingFor = version
+	p.pushedAt = now
+}
+
+func (p *waitForAckPolicy) Interval() time.Duration {
+	return time.Second
+}
+
+// policyEnv is what parseAdmissionPolicy needs to build policies with.
+type policyEnv struct {
+	getUsage  MemoryGetter
+	drainTime time.Duration
+	acks      *AckTracker
+	metrics   *UpdaterMetrics
+}
+
+// parseAdmissionPolicy builds the AdmissionPolicy described by spec, which is a semicolon-separated
+// list of policies that all have to admit an update for it to be pushed. Each policy is a name,
+// optionally followed by a colon and comma-separated key=value parameters:
+//
+//   - memory: limit the number of stale configs that Envoy is draining as memory usage goes up
+//     (the default).
+//   - token-bucket:rate=N[,burst=N]: push at most rate updates per minute on average, in bursts of
+//     up to burst (default 1).
+//   - maintenance-window:start=HH:MM,duration=D[,tz=ZONE]: don't push anything for duration (a Go
+//     duration, like "2h") every day from start, in time zone tz (default UTC).
+//   - wait-for-ack[:timeout=D]: don't push an update until every connected Envoy has ACKed or
+//     NACKed the last one, or until timeout (default 1m) has passed.
+func parseAdmissionPolicy(ctx context.Context, spec string, env policyEnv) (AdmissionPolicy, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = "memory"
+	}
+
+	var policies allPolicies
+	for _, item := range strings.Split(spec, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, paramStr := item, ""
+		if i := strings.Index(item, ":"); i >= 0 {
+			name, paramStr = item[:i], item[i+1:]
+		}
+		params := map[string]string{}
+		for _, param := range strings.Split(paramStr, ",") {
+			if param == "" {
+				continue
+			}
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("update policy %q: parameter %q isn't key=value", name, param)
+			}
+			params[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+
+		policy, err := newAdmissionPolicy(ctx, name, params, env)
+		if err != nil {
+			return nil, fmt.Errorf("update policy %q: %w", name, err)
+		}
+		if len(params) > 0 {
+			return nil, fmt.Errorf("update policy %q: unknown parameters %v", name, params)
+		}
+		policies = append(policies, policy)
+	}
+
+	if len(policies) == 1 {
+		return policies[0], nil
+	}
+	return policies, nil
+}
+
+// newAdmissionPolicy builds one policy, deleting the parameters that it uses from params.
+func newAdmissionPolicy(ctx context.Context, name string, params map[string]string, env policyEnv) (AdmissionPolicy, error) {
+	take := func(key, dflt string) string {
+		value, ok := params[key]
+		delete(params, key)
+		if !ok {
+			return dflt
+		}
+		return value
+	}
+
+	switch name {
+	case "memory":
+		return newMemoryPolicy(ctx, env.getUsage, env.drainTime, env.metrics), nil
+	case "token-bucket":
+		rate, err := strconv.ParseFloat(take("rate", ""), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("rate must be a positive number of updates per minute")
+		}
+		burst, err := strconv.Atoi(take("burst", "1"))
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("burst must be a positive number of updates")
+		}
+		return &tokenBucketPolicy{rate: rate, burst: float64(burst), tokens: float64(burst)}, nil
+	case "maintenance-window":
+		start, err := time.Parse("15:04", take("start", ""))
+		if err != nil {
+			return nil, fmt.Errorf("start must be a time of day, like 22:30")
+		}
+		duration, err := time.ParseDuration(take("duration", ""))
+		if err != nil || duration <= 0 || duration >= 24*time.Hour {
+			return nil, fmt.Errorf("duration must be a duration between 0 and 24h, like 2h")
+		}
+		location, err := time.LoadLocation(take("tz", "UTC"))
+		if err != nil {
+			return nil, err
+		}
+		return &maintenanceWindowPolicy{
+			start:    time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute,
+			duration: duration,
+			location: location,
+		}, nil
+	case "wait-for-ack":
+		timeout, err := time.ParseDuration(take("timeout", "1m"))
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be a positive duration, like 30s")
+		}
+		return &waitForAckPolicy{acks: env.acks, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown policy (expected memory, token-bucket, maintenance-window, or wait-for-ack)")
+	}
+}
@@ -0,0 +1,147 @@
+package ambex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/status"
+
+	"github.com/datawire/dlib/dlog"
+
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+)
+
+func TestTokenBucketPolicy(t *testing.T) {
+	h := newHarnessWithPolicy(t, func(context.Context, *harness) AdmissionPolicy {
+		return &tokenBucketPolicy{rate: 6, burst: 3, tokens: 3}
+	})
+
+	// The first three updates use up the burst; the rest have to wait for tokens.
+	for i := 0; i < 10; i++ {
+		h.update(0)
+	}
+	h.expectUntil(3)
+	h.expectNone()
+
+	// At six per minute, there's another token every ten seconds.
+	h.tick(5 * time.Second)
+	h.expectNone()
+	h.tick(5 * time.Second)
+	h.expectExact(10)
+
+	// The bucket fills up again, but no further than the burst.
+	h.advance(time.Hour)
+	for i := 0; i < 4; i++ {
+		h.update(0)
+	}
+	h.expectUntil(13)
+	h.expectNone()
+	h.tick(10 * time.Second)
+	h.expectExact(14)
+}
+
+func TestMaintenanceWindowPolicy(t *testing.T) {
+	h := newHarnessWithPolicy(t, func(context.Context, *harness) AdmissionPolicy {
+		return &maintenanceWindowPolicy{start: 23 * time.Hour, duration: 2 * time.Hour, location: time.UTC}
+	})
+	h.mutex.Lock()
+	h.clock = time.Date(2022, 3, 1, 22, 0, 0, 0, time.UTC)
+	h.mutex.Unlock()
+
+	h.update(0)
+	h.expectExact(1)
+
+	// The window runs from 23:00 until 01:00 the next day.
+	h.update(time.Hour)
+	h.update(time.Minute)
+	h.expectNone()
+	h.tick(time.Hour)
+	h.expectNone()
+	h.tick(time.Hour)
+	h.expectExact(3)
+
+	h.update(0)
+	h.expectExact(4)
+}
+
+func TestWaitForAckPolicy(t *testing.T) {
+	acks := NewAckTracker(HasherV3{}, nil)
+	h := newHarnessWithPolicy(t, func(context.Context, *harness) AdmissionPolicy {
+		return &waitForAckPolicy{acks: acks, timeout: time.Minute}
+	})
+	node := &v3core.Node{Id: "envoy"}
+	acks.Request(1, node, ecp_v3_resource.ListenerType, "", "", nil)
+
+	// Nothing has been pushed yet, so there's nothing to wait for.
+	h.update(0)
+	h.expectExact(1)
+
+	// Envoy hasn't answered 1 yet, so 2 and 3 wait, and 3 is pushed once it has.
+	acks.Response(1, ecp_v3_resource.ListenerType, "1", "a")
+	h.update(0)
+	h.update(0)
+	h.expectNone()
+	acks.Request(1, nil, ecp_v3_resource.ListenerType, "1", "a", nil)
+	h.tick(time.Second)
+	h.expectExact(3)
+
+	// Envoy never answers 3, but the timeout lets 4 through anyway.
+	h.update(0)
+	h.expectNone()
+	h.tick(time.Minute)
+	h.expectExact(4)
+
+	// A NACK is an answer too.
+	h.update(0)
+	h.expectNone()
+	acks.Response(1, ecp_v3_resource.ListenerType, "4", "b")
+	acks.Request(1, nil, ecp_v3_resource.ListenerType, "1", "b", &status.Status{Message: "bad listener"})
+	h.update(0)
+	h.expectExact(6)
+}
+
+func TestParseAdmissionPolicy(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	env := policyEnv{
+		getUsage:  func() int { return 0 },
+		drainTime: drainTime,
+		metrics:   NewUpdaterMetrics(),
+	}
+
+	policy, err := parseAdmissionPolicy(ctx, "", env)
+	require.NoError(t, err)
+	assert.IsType(t, &memoryPolicy{}, policy)
+	assert.Equal(t, drainTime, policy.Interval())
+
+	policy, err = parseAdmissionPolicy(ctx, "memory; token-bucket:rate=30,burst=5; maintenance-window:start=22:30,duration=2h,tz=America/New_York; wait-for-ack:timeout=30s", env)
+	require.NoError(t, err)
+	require.IsType(t, allPolicies{}, policy)
+	policies := policy.(allPolicies)
+	require.Len(t, policies, 4)
+	assert.Equal(t, &tokenBucketPolicy{rate: 30, burst: 5, tokens: 5}, policies[1])
+	window := policies[2].(*maintenanceWindowPolicy)
+	assert.Equal(t, 22*time.Hour+30*time.Minute, window.start)
+	assert.Equal(t, 2*time.Hour, window.duration)
+	assert.Equal(t, "America/New_York", window.location.String())
+	assert.Equal(t, 30*time.Second, policies[3].(*waitForAckPolicy).timeout)
+	assert.Equal(t, time.Second, policy.Interval())
+
+	for spec, msg := range map[string]string{
+		"nonsense":                           `update policy "nonsense": unknown policy`,
+		"token-bucket":                       `update policy "token-bucket": rate must be`,
+		"token-bucket:rate=10,burst":         `update policy "token-bucket": parameter "burst" isn't key=value`,
+		"wait-for-ack:timeout=1m,retries=3":  `update policy "wait-for-ack": unknown parameters`,
+		"maintenance-window:start=25:00":     `update policy "maintenance-window": start must be`,
+		"maintenance-window:start=1:00,d=2h": `update policy "maintenance-window": duration must be`,
+		"maintenance-window:start=01:00,duration=1h,tz=Nowhere/Special": `update policy "maintenance-window": unknown time zone`,
+	} {
+		_, err := parseAdmissionPolicy(ctx, spec, env)
+		if assert.Error(t, err, spec) {
+			assert.Contains(t, err.Error(), msg, spec)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"sort"
 	"strings"
 
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
 	v2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
 	v2core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
 	v2endpoint "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/endpoint"
@@ -27,6 +29,9 @@ func (e *Endpoints) RoutesString() string {
 		var addrs []string
 		for _, ep := range eps {
 			addr := fmt.Sprintf("%s:%s:%d", ep.Protocol, ep.Ip, ep.Port)
+			if ep.Health != Healthy {
+				addr += fmt.Sprintf(" (%s)", ep.Health)
+			}
 			addrs = append(addrs, addr)
 		}
 		routes = append(routes, fmt.Sprintf("%s=[%s]", k, strings.Join(addrs, ", ")))
@@ -39,13 +44,20 @@ func (e *Endpoints) RoutesString() string {
 func (e *Endpoints) ToMap_v2() map[string]*v2.ClusterLoadAssignment {
 	result := map[string]*v2.ClusterLoadAssignment{}
 	for name, eps := range e.Entries {
-		var endpoints []*v2endpoint.LbEndpoint
-		for _, ep := range eps {
-			endpoints = append(endpoints, ep.ToLbEndpoint_v2())
-		}
-		loadAssignment := &v2.ClusterLoadAssignment{
-			ClusterName: name,
-			Endpoints:   []*v2endpoint.LocalityLbEndpoints{{LbEndpoints: endpoints}},
+		loadAssignment := &v2.ClusterLoadAssignment{ClusterName: name}
+		for _, group := range groupByLocality(eps) {
+			localityEndpoints := &v2endpoint.LocalityLbEndpoints{Priority: group.priority}
+			if group.locality != (Locality{}) {
+				localityEndpoints.Locality = &v2core.Locality{
+					Region:  group.locality.Region,
+					Zone:    group.locality.Zone,
+					SubZone: group.locality.SubZone,
+				}
+			}
+			for _, ep := range group.endpoints {
+				localityEndpoints.LbEndpoints = append(localityEndpoints.LbEndpoints, ep.ToLbEndpoint_v2())
+			}
+			loadAssignment.Endpoints = append(loadAssignment.Endpoints, localityEndpoints)
 		}
 		result[name] = loadAssignment
 	}
@@ -56,30 +68,155 @@ func (e *Endpoints) ToMap_v2() map[string]*v2.ClusterLoadAssignment {
 func (e *Endpoints) ToMap_v3() map[string]*v3endpointconfig.ClusterLoadAssignment {
 	result := map[string]*v3endpointconfig.ClusterLoadAssignment{}
 	for name, eps := range e.Entries {
-		var endpoints []*v3endpoint.LbEndpoint
-		for _, ep := range eps {
-			endpoints = append(endpoints, ep.ToLbEndpoint_v3())
-		}
-		loadAssignment := &v3endpointconfig.ClusterLoadAssignment{
-			ClusterName: name,
-			Endpoints:   []*v3endpointconfig.LocalityLbEndpoints{{LbEndpoints: endpoints}},
+		loadAssignment := &v3endpointconfig.ClusterLoadAssignment{ClusterName: name}
+		for _, group := range groupByLocality(eps) {
+			localityEndpoints := &v3endpointconfig.LocalityLbEndpoints{Priority: group.priority}
+			if group.locality != (Locality{}) {
+				localityEndpoints.Locality = &v3core.Locality{
+					Region:  group.locality.Region,
+					Zone:    group.locality.Zone,
+					SubZone: group.locality.SubZone,
+				}
+			}
+			for _, ep := range group.endpoints {
+				localityEndpoints.LbEndpoints = append(localityEndpoints.LbEndpoints, ep.ToLbEndpoint_v3())
+			}
+			loadAssignment.Endpoints = append(loadAssignment.Endpoints, localityEndpoints)
 		}
 		result[name] = loadAssignment
 	}
 	return result
 }
 
+// localityGroup is the endpoints of a cluster that have the same locality and priority.
+type localityGroup struct {
+	locality  Locality
+	priority  uint32
+	endpoints []*Endpoint
+}
+
+// groupByLocality groups endpoints by locality and priority, ordered by priority and then by
+// locality, keeping the order of the endpoints within each group. The groups get no load balancing
+// weight, since the clusters that we generate don't use locality weighted load balancing: the
+// localities are only there for priority failover, and envoy balances across all the endpoints of
+// a priority by their own weights.
+func groupByLocality(eps []*Endpoint) []*localityGroup {
+	type groupKey struct {
+		locality Locality
+		priority uint32
+	}
+	groups := map[groupKey]*localityGroup{}
+	var result []*localityGroup
+	for _, ep := range eps {
+		key := groupKey{ep.Locality, ep.Priority}
+		group, ok := groups[key]
+		if !ok {
+			group = &localityGroup{locality: ep.Locality, priority: ep.Priority}
+			groups[key] = group
+			result = append(result, group)
+		}
+		group.endpoints = append(group.endpoints, ep)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		if a.locality.Region != b.locality.Region {
+			return a.locality.Region < b.locality.Region
+		}
+		if a.locality.Zone != b.locality.Zone {
+			return a.locality.Zone < b.locality.Zone
+		}
+		return a.locality.SubZone < b.locality.SubZone
+	})
+	return result
+}
+
+// Locality is where an endpoint runs, as far as that's known. The zero Locality means it's not
+// known at all.
+type Locality struct {
+	Region  string
+	Zone    string
+	SubZone string
+}
+
 // Endpoint contains the subset of fields we bother to expose.
 type Endpoint struct {
 	ClusterName string
 	Ip          string
 	Port        uint32
 	Protocol    string
+
+	// Locality is where the endpoint runs. Priority is the priority of the endpoint's locality,
+	// where 0 is the highest: envoy only fails over to a locality with a lower priority when those
+	// with higher priorities don't have enough healthy endpoints.
+	Locality Locality
+	Priority uint32
+
+	// Weight is the endpoint's share of the traffic, relative to the other endpoints with the
+	// same priority. Zero means the default weight of 1.
+	Weight uint32
+
+	// Health is whether the endpoint should get traffic.
+	Health HealthStatus
+}
+
+// HealthStatus is the health of an endpoint, as far as the source of the endpoint knows. The
+// statuses are ordered from healthiest to least healthy.
+type HealthStatus int
+
+const (
+	// Healthy endpoints get traffic. This is the zero value, since most sources of endpoints
+	// only know about healthy ones.
+	Healthy HealthStatus = iota
+
+	// Draining endpoints are shutting down. Envoy sends them no new requests, but lets the
+	// requests and connections that they already have finish.
+	Draining
+
+	// Unhealthy endpoints get no traffic.
+	Unhealthy
+)
+
+func (h HealthStatus) String() string {
+	switch h {
+	case Healthy:
+		return "healthy"
+	case Draining:
+		return "draining"
+	case Unhealthy:
+		return "unhealthy"
+	default:
+		return fmt.Sprintf("HealthStatus(%d)", int(h))
+	}
+}
+
+func (h HealthStatus) toV2() v2core.HealthStatus {
+	switch h {
+	case Draining:
+		return v2core.HealthStatus_DRAINING
+	case Unhealthy:
+		return v2core.HealthStatus_UNHEALTHY
+	default:
+		return v2core.HealthStatus_HEALTHY
+	}
+}
+
+func (h HealthStatus) toV3() v3core.HealthStatus {
+	switch h {
+	case Draining:
+		return v3core.HealthStatus_DRAINING
+	case Unhealthy:
+		return v3core.HealthStatus_UNHEALTHY
+	default:
+		return v3core.HealthStatus_HEALTHY
+	}
 }
 
 // ToLBEndpoint_v2 translates to envoy v2 frinedly form of the Endpoint data.
 func (e *Endpoint) ToLbEndpoint_v2() *v2endpoint.LbEndpoint {
-	return &v2endpoint.LbEndpoint{
+	lbEndpoint := &v2endpoint.LbEndpoint{
 		HostIdentifier: &v2endpoint.LbEndpoint_Endpoint{
 			Endpoint: &v2endpoint.Endpoint{
 				Address: &v2core.Address{
@@ -96,12 +233,17 @@ func (e *Endpoint) ToLbEndpoint_v2() *v2endpoint.LbEndpoint {
 				},
 			},
 		},
+		HealthStatus: e.Health.toV2(),
 	}
+	if e.Weight != 0 {
+		lbEndpoint.LoadBalancingWeight = wrapperspb.UInt32(e.Weight)
+	}
+	return lbEndpoint
 }
 
 // ToLBEndpoint_v3 translates to envoy v3 frinedly form of the Endpoint data.
 func (e *Endpoint) ToLbEndpoint_v3() *v3endpoint.LbEndpoint {
-	return &v3endpoint.LbEndpoint{
+	lbEndpoint := &v3endpoint.LbEndpoint{
 		HostIdentifier: &v3endpoint.LbEndpoint_Endpoint{
 			Endpoint: &v3endpoint.Endpoint{
 				Address: &v3core.Address{
@@ -118,5 +260,10 @@ func (e *Endpoint) ToLbEndpoint_v3() *v3endpoint.LbEndpoint {
 				},
 			},
 		},
+		HealthStatus: e.Health.toV3(),
+	}
+	if e.Weight != 0 {
+		lbEndpoint.LoadBalancingWeight = wrapperspb.UInt32(e.Weight)
 	}
+	return lbEndpoint
 }
@@ -0,0 +1,88 @@
+package ambex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v2core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+)
+
+func TestEndpointsToMapHealth(t *testing.T) {
+	endpoint := func(ip string, health HealthStatus) *Endpoint {
+		return &Endpoint{ClusterName: "k8s/default/foo", Ip: ip, Port: 8080, Protocol: "TCP", Health: health}
+	}
+	endpoints := &Endpoints{Entries: map[string][]*Endpoint{
+		"k8s/default/foo": {
+			endpoint("1.2.3.4", Healthy),
+			endpoint("1.2.3.5", Draining),
+			endpoint("1.2.3.6", Unhealthy),
+		},
+	}}
+
+	// Endpoints that shouldn't get traffic are still sent to envoy, so that it can let the
+	// connections that they already have finish.
+	lbEndpoints := endpoints.ToMap_v3()["k8s/default/foo"].Endpoints[0].LbEndpoints
+	require.Len(t, lbEndpoints, 3)
+	assert.Equal(t, v3core.HealthStatus_HEALTHY, lbEndpoints[0].HealthStatus)
+	assert.Equal(t, v3core.HealthStatus_DRAINING, lbEndpoints[1].HealthStatus)
+	assert.Equal(t, v3core.HealthStatus_UNHEALTHY, lbEndpoints[2].HealthStatus)
+
+	v2LbEndpoints := endpoints.ToMap_v2()["k8s/default/foo"].Endpoints[0].LbEndpoints
+	require.Len(t, v2LbEndpoints, 3)
+	assert.Equal(t, v2core.HealthStatus_HEALTHY, v2LbEndpoints[0].HealthStatus)
+	assert.Equal(t, v2core.HealthStatus_DRAINING, v2LbEndpoints[1].HealthStatus)
+	assert.Equal(t, v2core.HealthStatus_UNHEALTHY, v2LbEndpoints[2].HealthStatus)
+
+	assert.Equal(t, "k8s/default/foo=[TCP:1.2.3.4:8080, TCP:1.2.3.5:8080 (draining), TCP:1.2.3.6:8080 (unhealthy)]",
+		endpoints.RoutesString())
+}
+
+func TestEndpointsToMapLocality(t *testing.T) {
+	endpoint := func(ip, zone string, priority, weight uint32) *Endpoint {
+		return &Endpoint{
+			ClusterName: "k8s/default/foo",
+			Ip:          ip,
+			Port:        8080,
+			Protocol:    "TCP",
+			Locality:    Locality{Region: "us-east-1", Zone: zone},
+			Priority:    priority,
+			Weight:      weight,
+		}
+	}
+	endpoints := &Endpoints{Entries: map[string][]*Endpoint{
+		"k8s/default/foo": {
+			endpoint("1.2.3.4", "us-east-1b", 1, 0),
+			endpoint("1.2.3.5", "us-east-1a", 0, 3),
+			endpoint("1.2.3.6", "us-east-1b", 1, 0),
+			{ClusterName: "k8s/default/foo", Ip: "1.2.3.7", Port: 8080, Protocol: "TCP"},
+		},
+	}}
+
+	localities := endpoints.ToMap_v3()["k8s/default/foo"].Endpoints
+	require.Len(t, localities, 3)
+
+	// Endpoints whose locality isn't known sort first among those with the same priority, and
+	// their group has no locality. No group has a weight, since the localities are only used for
+	// priority failover.
+	assert.Nil(t, localities[0].Locality)
+	assert.Nil(t, localities[0].LoadBalancingWeight)
+	require.Len(t, localities[0].LbEndpoints, 1)
+	assert.Nil(t, localities[0].LbEndpoints[0].LoadBalancingWeight)
+
+	assert.Equal(t, "us-east-1", localities[1].Locality.Region)
+	assert.Equal(t, "us-east-1a", localities[1].Locality.Zone)
+	assert.Equal(t, uint32(0), localities[1].Priority)
+	assert.Nil(t, localities[1].LoadBalancingWeight)
+	require.Len(t, localities[1].LbEndpoints, 1)
+	assert.Equal(t, uint32(3), localities[1].LbEndpoints[0].LoadBalancingWeight.GetValue())
+
+	assert.Equal(t, "us-east-1b", localities[2].Locality.Zone)
+	assert.Equal(t, uint32(1), localities[2].Priority)
+	assert.Nil(t, localities[2].LoadBalancingWeight)
+	require.Len(t, localities[2].LbEndpoints, 2)
+	assert.Equal(t, "1.2.3.4", localities[2].LbEndpoints[0].GetEndpoint().Address.GetSocketAddress().Address)
+	assert.Equal(t, "1.2.3.6", localities[2].LbEndpoints[1].GetEndpoint().Address.GetSocketAddress().Address)
+}
@@ -1,11 +1,16 @@
 package ambex
 
 import (
-	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
 )
 
 // FastpathSnapshot holds envoy configuration that bypasses python.
 type FastpathSnapshot struct {
-	Snapshot  *ecp_v2_cache.Snapshot
+	// Snapshot is merged into the V3 snapshot; envoy no longer speaks V2.
+	Snapshot  *ecp_v3_cache.Snapshot
 	Endpoints *Endpoints
+	// Secrets are served over SDS, so that a new certificate doesn't have to change (and drain)
+	// the listeners that use it.
+	Secrets []*v3tls.Secret
 }
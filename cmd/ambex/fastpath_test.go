@@ -0,0 +1,63 @@
+package ambex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v3cluster "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3endpointconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/endpoint/v3"
+	v3listener "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+func TestFastpathSnapshot(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+
+	cluster := func(name string) *v3cluster.Cluster {
+		return &v3cluster.Cluster{
+			Name:                 name,
+			ClusterDiscoveryType: &v3cluster.Cluster_Type{Type: v3cluster.Cluster_EDS},
+			EdsClusterConfig: &v3cluster.Cluster_EdsClusterConfig{
+				EdsConfig: &v3core.ConfigSource{
+					ConfigSourceSpecifier: &v3core.ConfigSource_Ads{Ads: &v3core.AggregatedConfigSource{}},
+					ResourceApiVersion:    v3core.ApiVersion_V3,
+				},
+				ServiceName: "k8s/default/" + name,
+			},
+		}
+	}
+	fastpath := ecp_v3_cache.NewSnapshot("ignored",
+		nil,
+		[]ecp_cache_types.Resource{cluster("found"), cluster("missing")},
+		nil,
+		[]ecp_cache_types.Resource{&v3listener.Listener{Name: "gateway"}},
+		nil)
+	edsEndpointsV3 := map[string]*v3endpointconfig.ClusterLoadAssignment{
+		"k8s/default/found": {
+			ClusterName: "k8s/default/found",
+			Endpoints:   []*v3endpointconfig.LocalityLbEndpoints{{}},
+		},
+	}
+
+	snapshot, snapshotv3, err := buildSnapshots(ctx, "v1", &resourceSet{}, nil, edsEndpointsV3, &FastpathSnapshot{Snapshot: &fastpath})
+	require.NoError(t, err)
+
+	// The fastpath resources only go to envoy over V3...
+	assert.Empty(t, snapshot.Resources[ecp_cache_types.Listener].Items)
+	assert.Empty(t, snapshot.Resources[ecp_cache_types.Cluster].Items)
+	assert.Contains(t, snapshotv3.GetResources(ecp_v3_resource.ListenerType), "gateway")
+	assert.Contains(t, snapshotv3.GetResources(ecp_v3_resource.ClusterType), "found")
+	assert.Contains(t, snapshotv3.GetResources(ecp_v3_resource.ClusterType), "missing")
+
+	// ...along with endpoints for their clusters, empty for the ones that have none yet.
+	endpoints := snapshotv3.GetResources(ecp_v3_resource.EndpointType)
+	require.Len(t, endpoints, 2)
+	assert.Len(t, endpoints["k8s/default/found"].(*v3endpointconfig.ClusterLoadAssignment).Endpoints, 1)
+	assert.Empty(t, endpoints["k8s/default/missing"].(*v3endpointconfig.ClusterLoadAssignment).Endpoints)
+}
@@ -0,0 +1,81 @@
+package ambex
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+// A snapshotHistory is the ambex-N.json files that csDump writes, which is how we go back to an
+// earlier snapshot. The default node group's files are in the snapshot directory itself, as they
+// always have been; every other group's are in a groups/NAME subdirectory of it.
+type snapshotHistory struct {
+	snapdirPath string
+	numsnaps    int
+	deltas      bool
+}
+
+func newSnapshotHistory(snapdirPath string, numsnaps int, deltas bool) *snapshotHistory {
+	return &snapshotHistory{snapdirPath: snapdirPath, numsnaps: numsnaps, deltas: deltas}
+}
+
+func (h *snapshotHistory) dir(group string) string {
+	if group == DefaultNodeGroup {
+		return h.snapdirPath
+	}
+	return filepath.Join(h.snapdirPath, "groups", group)
+}
+
+// Dump writes a node group's snapshots to its ambex-1.json, rotating the older files.
+func (h *snapshotHistory) Dump(ctx context.Context, group string, generation int, v2snap *ecp_v2_cache.Snapshot, v3snap *ecp_v3_cache.Snapshot) {
+	if h.numsnaps <= 0 {
+		return
+	}
+	dir := h.dir(group)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		dlog.Errorf(ctx, "CSNAP: node group %q: %v", group, err)
+		return
+	}
+	csDump(ctx, dir, h.numsnaps, h.deltas, generation, v2snap, v3snap)
+}
+
+// Get returns a node group's V3 snapshot at a given version, and the number N of the ambex-N.json
+// file that it came from. It returns nil if that version is no longer on disk.
+//
+// The files never have the secrets' keys in them, so neither do the secrets of the snapshot.
+func (h *snapshotHistory) Get(group, version string) (*ecp_v3_cache.Snapshot, int, error) {
+	for n := 1; n <= h.numsnaps; n++ {
+		filename := filepath.Join(h.dir(group), fmt.Sprintf("ambex-%d.json", n))
+		// A delta has the version of the snapshot that it gets to, so there's no need to apply it
+		// unless it's the one we want.
+		raw, err := readRawSnapshotFile(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return nil, 0, err
+		}
+		if raw.Version != version {
+			continue
+		}
+		cs, err := LoadSnapshotFile(filename)
+		if err != nil {
+			return nil, 0, err
+		}
+		snapshot := &ecp_v3_cache.Snapshot{}
+		snapshot.Resources[ecp_cache_types.Endpoint] = cs.V3.Endpoints
+		snapshot.Resources[ecp_cache_types.Cluster] = cs.V3.Clusters
+		snapshot.Resources[ecp_cache_types.Route] = cs.V3.Routes
+		snapshot.Resources[ecp_cache_types.Listener] = cs.V3.Listeners
+		snapshot.Resources[ecp_cache_types.Runtime] = cs.V3.Runtimes
+		snapshot.Resources[ecp_cache_types.Secret] = cs.V3.Secrets
+		return snapshot, n, nil
+	}
+	return nil, 0, nil
+}
@@ -0,0 +1,89 @@
+package ambex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v3clusterconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+func historySnapshot(version string, clusterNames ...string) *ecp_v3_cache.Snapshot {
+	var clusters []ecp_cache_types.Resource
+	for _, name := range clusterNames {
+		clusters = append(clusters, &v3clusterconfig.Cluster{Name: name})
+	}
+	snapshot := ecp_v3_cache.NewSnapshot(version, nil, clusters, nil, nil, nil)
+	snapshot.Resources[ecp_cache_types.Secret] = ecp_v3_cache.NewResources(version, []ecp_cache_types.Resource{
+		&v3tls.Secret{Name: "s", Type: &v3tls.Secret_TlsCertificate{TlsCertificate: &v3tls.TlsCertificate{
+			PrivateKey: &v3core.DataSource{Specifier: &v3core.DataSource_InlineString{InlineString: "key-" + version}},
+		}}},
+	})
+	return &snapshot
+}
+
+func TestSnapshotHistory(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	history := newSnapshotHistory(t.TempDir(), 2, true)
+	v2snap := ecp_v2_cache.NewSnapshot("v0", nil, nil, nil, nil, nil)
+	for i, version := range []string{"v1", "v2", "v3"} {
+		history.Dump(ctx, DefaultNodeGroup, i+1, &v2snap, historySnapshot(version, "a", version))
+	}
+	history.Dump(ctx, "canary", 3, &v2snap, historySnapshot("v3", "canary"))
+
+	// ambex-2.json is a delta, which gets applied to ambex-1.json.
+	snapshot, n, err := history.Get(DefaultNodeGroup, "v2")
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+	assert.Equal(t, 2, n)
+	clusters := snapshot.GetResources(ecp_v3_resource.ClusterType)
+	assert.Len(t, clusters, 2)
+	assert.Contains(t, clusters, "v2")
+	assert.Equal(t, "v2", snapshot.GetVersion(ecp_v3_resource.ClusterType))
+
+	snapshot, _, err = history.Get(DefaultNodeGroup, "v1")
+	require.NoError(t, err)
+	assert.Nil(t, snapshot)
+
+	snapshot, n, err = history.Get("canary", "v3")
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+	assert.Equal(t, 1, n)
+	assert.Contains(t, snapshot.GetResources(ecp_v3_resource.ClusterType), "canary")
+}
+
+func TestRollback(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	history := newSnapshotHistory(t.TempDir(), 5, false)
+	v2snap := ecp_v2_cache.NewSnapshot("v0", nil, nil, nil, nil, nil)
+	good := historySnapshot("v1", "a")
+	bad := historySnapshot("v2", "b")
+	history.Dump(ctx, DefaultNodeGroup, 1, &v2snap, good)
+	history.Dump(ctx, DefaultNodeGroup, 2, &v2snap, bad)
+
+	acks := NewAckTracker(HasherV3{}, nil)
+	node := &v3core.Node{Id: DefaultNodeGroup}
+	acks.Request(1, node, ecp_v3_resource.ClusterType, "", "", nil)
+	acks.Response(1, ecp_v3_resource.ClusterType, "v1", "a")
+	acks.Request(1, nil, ecp_v3_resource.ClusterType, "v1", "a", nil)
+	require.Equal(t, "v1", acks.LastGood(DefaultNodeGroup))
+
+	configv3 := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, nil)
+	require.NoError(t, configv3.SetSnapshot(DefaultNodeGroup, *bad))
+	rollback(ctx, configv3, acks, history, DefaultNodeGroup, "v2")
+
+	current, err := configv3.GetSnapshot(DefaultNodeGroup)
+	require.NoError(t, err)
+	assert.Equal(t, "v1", current.GetVersion(ecp_v3_resource.ClusterType))
+	assert.Contains(t, current.GetResources(ecp_v3_resource.ClusterType), "a")
+	// The snapshot files have redacted secrets, so the current ones stay in place.
+	assert.Equal(t, bad.Resources[ecp_cache_types.Secret], current.Resources[ecp_cache_types.Secret])
+}
@@ -74,8 +74,7 @@ import (
 	// Be sure to import the package of any types that're referenced with "@type" in our
 	// generated Envoy config, even if that package is otherwise not used by ambex.
 	v2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
-	_ "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/auth"
-	v2core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
+	v2auth "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/auth"
 	_ "github.com/datawire/ambassador/v2/pkg/api/envoy/config/accesslog/v2"
 	v2bootstrap "github.com/datawire/ambassador/v2/pkg/api/envoy/config/bootstrap/v2"
 	_ "github.com/datawire/ambassador/v2/pkg/api/envoy/config/filter/http/buffer/v2"
@@ -95,7 +94,6 @@ import (
 	_ "github.com/datawire/ambassador/v2/pkg/api/envoy/config/accesslog/v3"
 	v3bootstrap "github.com/datawire/ambassador/v2/pkg/api/envoy/config/bootstrap/v3"
 	v3clusterconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
-	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
 	v3endpointconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/endpoint/v3"
 	v3listenerconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
 	v3routeconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
@@ -114,12 +112,14 @@ import (
 	_ "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/http/router/v3"
 	_ "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/http_connection_manager/v3"
 	_ "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/tcp_proxy/v3"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
 	v3cluster "github.com/datawire/ambassador/v2/pkg/api/envoy/service/cluster/v3"
 	v3discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
 	v3endpoint "github.com/datawire/ambassador/v2/pkg/api/envoy/service/endpoint/v3"
 	v3listener "github.com/datawire/ambassador/v2/pkg/api/envoy/service/listener/v3"
 	v3route "github.com/datawire/ambassador/v2/pkg/api/envoy/service/route/v3"
 	v3runtime "github.com/datawire/ambassador/v2/pkg/api/envoy/service/runtime/v3"
+	v3secret "github.com/datawire/ambassador/v2/pkg/api/envoy/service/secret/v3"
 
 	// first-party libraries
 	"github.com/datawire/ambassador/v2/pkg/busy"
@@ -134,6 +134,16 @@ type Args struct {
 
 	adsNetwork string
 	adsAddress string
+	adsTLS     ADSTLSArgs
+
+	nodeGroupsFile string
+
+	statusAddress  string
+	rollbackOnNack bool
+
+	strictValidation bool
+
+	updatePolicy string
 
 	dirs []string
 }
@@ -149,6 +159,21 @@ func parseArgs(rawArgs ...string) (*Args, error) {
 	flagset.StringVar(&args.adsNetwork, "ads-listen-network", "tcp", "network for ADS to listen on")
 	flagset.StringVar(&args.adsAddress, "ads-listen-address", ":18000", "address (on --ads-listen-network) for ADS to listen on")
 
+	flagset.StringVar(&args.adsTLS.CertFile, "ads-tls-cert", "", "PEM certificate file to serve ADS over TLS with (plaintext if empty)")
+	flagset.StringVar(&args.adsTLS.KeyFile, "ads-tls-key", "", "PEM private key file for --ads-tls-cert")
+	flagset.StringVar(&args.adsTLS.ClientCAFile, "ads-tls-client-ca", "", "PEM CA certificate file to verify Envoy's client certificates with")
+	flagset.BoolVar(&args.adsTLS.RequireClientCert, "ads-tls-require-client-cert", false, "Require Envoy to present a client certificate signed by --ads-tls-client-ca")
+	flagset.StringVar(&args.adsTLS.NodeIdentitiesFile, "ads-tls-node-identities", "", "YAML or JSON file of the client certificate identities allowed to use each Envoy node ID")
+
+	flagset.StringVar(&args.nodeGroupsFile, "node-groups", "", "YAML or JSON file of node groups, to give groups of Envoys their own snapshots")
+
+	flagset.StringVar(&args.statusAddress, "status-listen-address", "", "address to serve the xDS status and debug API on (disabled if empty)")
+	flagset.BoolVar(&args.rollbackOnNack, "rollback-on-nack", false, "Go back to the last snapshot that Envoy fully accepted when it rejects a newer one")
+
+	flagset.BoolVar(&args.strictValidation, "strict-validation", false, "Reject snapshots that fail validation, rather than just logging the problems")
+
+	flagset.StringVar(&args.updatePolicy, "update-policy", "memory", "when to push updates to Envoy: a semicolon-separated list of memory, token-bucket:rate=N[,burst=N], maintenance-window:start=HH:MM,duration=D[,tz=ZONE], and wait-for-ack[:timeout=D]")
+
 	var legacyAdsPort uint
 	flagset.UintVar(&legacyAdsPort, "ads", 0, "port number for ADS to listen on--deprecated, use --ads-listen-address=:1234 instead")
 
@@ -168,36 +193,28 @@ func parseArgs(rawArgs ...string) (*Args, error) {
 	return &args, nil
 }
 
-// Hasher returns node ID as an ID
-type HasherV2 struct {
-}
-
-// ID function
-func (h HasherV2) ID(node *v2core.Node) string {
-	if node == nil {
-		return "unknown"
-	}
-	return node.Id
-}
-
-// Hasher returns node ID as an ID
-type HasherV3 struct {
-}
-
-// ID function
-func (h HasherV3) ID(node *v3core.Node) string {
-	if node == nil {
-		return "unknown"
-	}
-	return node.Id
-}
-
-// end Hasher stuff
-
 // run stuff
 // RunManagementServer starts an xDS server at the given port.
-func runManagementServer(ctx context.Context, server ecp_v2_server.Server, serverv3 ecp_v3_server.Server, adsNetwork, adsAddress string) error {
-	grpcServer := grpc.NewServer()
+func runManagementServer(ctx context.Context, server ecp_v2_server.Server, serverv3 ecp_v3_server.Server, adsNetwork, adsAddress string, tlsArgs ADSTLSArgs, nodeGroups *NodeGroups) error {
+	// TLS is handled by the HTTP server below rather than by gRPC, but gRPC still sees the client
+	// certificate, so the authorization of node IDs is a pair of gRPC interceptors: one for the
+	// streams, and one for the unary Fetch calls.
+	var adsTLS *adsTLS
+	var grpcOpts []grpc.ServerOption
+	if tlsArgs.CertFile != "" {
+		var err error
+		adsTLS, err = newADSTLS(tlsArgs, nodeGroups)
+		if err != nil {
+			return fmt.Errorf("ADS TLS: %w", err)
+		}
+		if err := adsTLS.watch(ctx); err != nil {
+			return fmt.Errorf("ADS TLS: %w", err)
+		}
+		grpcOpts = append(grpcOpts,
+			grpc.StreamInterceptor(adsTLS.StreamInterceptor()),
+			grpc.UnaryInterceptor(adsTLS.UnaryInterceptor()))
+	}
+	grpcServer := grpc.NewServer(grpcOpts...)
 
 	lis, err := net.Listen(adsNetwork, adsAddress)
 	if err != nil {
@@ -210,19 +227,30 @@ func runManagementServer(ctx context.Context, server ecp_v2_server.Server, serve
 	v2.RegisterClusterDiscoveryServiceServer(grpcServer, server)
 	v2.RegisterRouteDiscoveryServiceServer(grpcServer, server)
 	v2.RegisterListenerDiscoveryServiceServer(grpcServer, server)
+	v2discovery.RegisterSecretDiscoveryServiceServer(grpcServer, server)
 
+	// The v3 services serve both the state-of-the-world and the incremental ("delta") variants
+	// of each protocol; Envoy picks one with the api_type of its ADS config source.
 	v3discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, serverv3)
 	v3endpoint.RegisterEndpointDiscoveryServiceServer(grpcServer, serverv3)
 	v3cluster.RegisterClusterDiscoveryServiceServer(grpcServer, serverv3)
 	v3route.RegisterRouteDiscoveryServiceServer(grpcServer, serverv3)
 	v3listener.RegisterListenerDiscoveryServiceServer(grpcServer, serverv3)
+	v3secret.RegisterSecretDiscoveryServiceServer(grpcServer, serverv3)
 
 	dlog.Infof(ctx, "Listening on %s:%s", adsNetwork, adsAddress)
 	go func() {
 		sc := &dhttp.ServerConfig{
 			Handler: grpcServer,
 		}
-		if err := sc.Serve(ctx, lis); err != nil {
+		var err error
+		if adsTLS != nil {
+			sc.TLSConfig = adsTLS.Config()
+			err = sc.ServeTLS(ctx, lis, "", "")
+		} else {
+			err = sc.Serve(ctx, lis)
+		}
+		if err != nil {
 			dlog.Errorf(ctx, "Management server exited: %v", err)
 		}
 	}()
@@ -290,6 +318,7 @@ type v2ExpandedSnapshot struct {
 	Routes    ecp_v2_cache.Resources `json:"routes"`
 	Listeners ecp_v2_cache.Resources `json:"listeners"`
 	Runtimes  ecp_v2_cache.Resources `json:"runtimes"`
+	Secrets   ecp_v2_cache.Resources `json:"secrets"`
 }
 
 func NewV2ExpandedSnapshot(v2snap *ecp_v2_cache.Snapshot) v2ExpandedSnapshot {
@@ -299,6 +328,7 @@ func NewV2ExpandedSnapshot(v2snap *ecp_v2_cache.Snapshot) v2ExpandedSnapshot {
 		Routes:    v2snap.Resources[ecp_cache_types.Route],
 		Listeners: v2snap.Resources[ecp_cache_types.Listener],
 		Runtimes:  v2snap.Resources[ecp_cache_types.Runtime],
+		Secrets:   redactSecretsV2(v2snap.Resources[ecp_cache_types.Secret]),
 	}
 }
 
@@ -308,6 +338,7 @@ type v3ExpandedSnapshot struct {
 	Routes    ecp_v3_cache.Resources `json:"routes"`
 	Listeners ecp_v3_cache.Resources `json:"listeners"`
 	Runtimes  ecp_v3_cache.Resources `json:"runtimes"`
+	Secrets   ecp_v3_cache.Resources `json:"secrets"`
 }
 
 func NewV3ExpandedSnapshot(v3snap *ecp_v3_cache.Snapshot) v3ExpandedSnapshot {
@@ -317,6 +348,7 @@ func NewV3ExpandedSnapshot(v3snap *ecp_v3_cache.Snapshot) v3ExpandedSnapshot {
 		Routes:    v3snap.Resources[ecp_cache_types.Route],
 		Listeners: v3snap.Resources[ecp_cache_types.Listener],
 		Runtimes:  v3snap.Resources[ecp_cache_types.Runtime],
+		Secrets:   redactSecretsV3(v3snap.Resources[ecp_cache_types.Secret]),
 	}
 }
 
@@ -331,8 +363,9 @@ type combinedSnapshot struct {
 // dumps the combinedSnapshot to disk. Only numsnaps snapshots are kept: ambex-1.json
 // is the newest, then ambex-2.json, etc., so ambex-$numsnaps.json is the oldest.
 // Every time we write a new one, we rename all the older ones, ditching the oldest
-// after we've written numsnaps snapshots.
-func csDump(ctx context.Context, snapdirPath string, numsnaps int, generation int, v2snap *ecp_v2_cache.Snapshot, v3snap *ecp_v3_cache.Snapshot) {
+// after we've written numsnaps snapshots. If deltas is set, we replace the previous
+// newest snapshot with a delta from the new one before renaming it, to save space.
+func csDump(ctx context.Context, snapdirPath string, numsnaps int, deltas bool, generation int, v2snap *ecp_v2_cache.Snapshot, v3snap *ecp_v3_cache.Snapshot) {
 	if numsnaps <= 0 {
 		// Don't do snapshotting at all.
 		return
@@ -369,6 +402,12 @@ func csDump(ctx context.Context, snapdirPath string, numsnaps int, generation in
 		dlog.Infof(ctx, "Saved snapshot %s", version)
 	}
 
+	if deltas {
+		if err := csDelta(snapdirPath, bs); err != nil && !os.IsNotExist(err) {
+			dlog.Errorf(ctx, "CSNAP: delta failure, keeping the whole previous snapshot: %s", err)
+		}
+	}
+
 	// Rotate everything one file down. This includes renaming the just-written
 	// ambex-0 to ambex-1.
 	for i := numsnaps; i > 0; i-- {
@@ -385,29 +424,41 @@ func csDump(ctx context.Context, snapdirPath string, numsnaps int, generation in
 	}
 }
 
-// Get an updated snapshot going.
-func update(
-	ctx context.Context,
-	snapdirPath string,
-	numsnaps int,
-	config ecp_v2_cache.SnapshotCache,
-	configv3 ecp_v3_cache.SnapshotCache,
-	generation *int,
-	dirs []string,
-	edsEndpoints map[string]*v2.ClusterLoadAssignment,
-	edsEndpointsV3 map[string]*v3endpointconfig.ClusterLoadAssignment,
-	fastpathSnapshot *FastpathSnapshot,
-	updates chan<- Update,
-) error {
-	clusters := []ecp_cache_types.Resource{}  // v2.Cluster
-	routes := []ecp_cache_types.Resource{}    // v2.RouteConfiguration
-	listeners := []ecp_cache_types.Resource{} // v2.Listener
-	runtimes := []ecp_cache_types.Resource{}  // discovery.Runtime
+// A resourceSet holds the Envoy resources loaded from a set of directories.
+type resourceSet struct {
+	clusters  []ecp_cache_types.Resource // v2.Cluster
+	routes    []ecp_cache_types.Resource // v2.RouteConfiguration
+	listeners []ecp_cache_types.Resource // v2.Listener
+	runtimes  []ecp_cache_types.Resource // discovery.Runtime
+	secrets   []ecp_cache_types.Resource // auth.Secret
+
+	clustersv3  []ecp_cache_types.Resource // v3.Cluster
+	routesv3    []ecp_cache_types.Resource // v3.RouteConfiguration
+	listenersv3 []ecp_cache_types.Resource // v3.Listener
+	runtimesv3  []ecp_cache_types.Resource // v3.Runtime
+	secretsv3   []ecp_cache_types.Resource // v3.Secret
+
+	// sources has the file that each resource came from.
+	sources map[ecp_cache_types.Resource]string
+}
 
-	clustersv3 := []ecp_cache_types.Resource{}  // v3.Cluster
-	routesv3 := []ecp_cache_types.Resource{}    // v3.RouteConfiguration
-	listenersv3 := []ecp_cache_types.Resource{} // v3.Listener
-	runtimesv3 := []ecp_cache_types.Resource{}  // v3.Runtime
+// loadResources decodes all the Envoy resources in the given directories.
+func loadResources(ctx context.Context, dirs []string) *resourceSet {
+	rs := &resourceSet{
+		clusters:  []ecp_cache_types.Resource{},
+		routes:    []ecp_cache_types.Resource{},
+		listeners: []ecp_cache_types.Resource{},
+		runtimes:  []ecp_cache_types.Resource{},
+		secrets:   []ecp_cache_types.Resource{},
+
+		clustersv3:  []ecp_cache_types.Resource{},
+		routesv3:    []ecp_cache_types.Resource{},
+		listenersv3: []ecp_cache_types.Resource{},
+		runtimesv3:  []ecp_cache_types.Resource{},
+		secretsv3:   []ecp_cache_types.Resource{},
+
+		sources: map[ecp_cache_types.Resource]string{},
+	}
 
 	var filenames []string
 
@@ -431,16 +482,22 @@ func update(
 			dlog.Warnf(ctx, "%s: %v", name, e)
 			continue
 		}
+		add := func(dst *[]ecp_cache_types.Resource, res ecp_cache_types.Resource) {
+			*dst = append(*dst, res)
+			rs.sources[res] = name
+		}
 		var dst *[]ecp_cache_types.Resource
 		switch m.(type) {
 		case *v2.Cluster:
-			dst = &clusters
+			dst = &rs.clusters
 		case *v2.RouteConfiguration:
-			dst = &routes
+			dst = &rs.routes
 		case *v2.Listener:
-			dst = &listeners
+			dst = &rs.listeners
 		case *v2discovery.Runtime:
-			dst = &runtimes
+			dst = &rs.runtimes
+		case *v2auth.Secret:
+			dst = &rs.secrets
 		case *v2bootstrap.Bootstrap:
 			bs := m.(*v2bootstrap.Bootstrap)
 			sr := bs.StaticResources
@@ -455,27 +512,29 @@ func update(
 				rdsListener, routeConfigs, err := ListenerToRdsListener(lst)
 				if err != nil {
 					dlog.Errorf(ctx, "Error converting listener to RDS: %+v", err)
-					listeners = append(listeners, proto.Clone(lst).(ecp_cache_types.Resource))
+					add(&rs.listeners, proto.Clone(lst).(ecp_cache_types.Resource))
 					continue
 				}
-				listeners = append(listeners, rdsListener)
+				add(&rs.listeners, rdsListener)
 				for _, rc := range routeConfigs {
 					// These routes will get included in the configuration snapshot created below.
-					routes = append(routes, rc)
+					add(&rs.routes, rc)
 				}
 			}
 			for _, cls := range sr.Clusters {
-				clusters = append(clusters, proto.Clone(cls).(ecp_cache_types.Resource))
+				add(&rs.clusters, proto.Clone(cls).(ecp_cache_types.Resource))
 			}
 			continue
 		case *v3clusterconfig.Cluster:
-			dst = &clustersv3
+			dst = &rs.clustersv3
 		case *v3routeconfig.RouteConfiguration:
-			dst = &routesv3
+			dst = &rs.routesv3
 		case *v3listenerconfig.Listener:
-			dst = &listenersv3
+			dst = &rs.listenersv3
 		case *v3runtime.Runtime:
-			dst = &runtimesv3
+			dst = &rs.runtimesv3
+		case *v3tls.Secret:
+			dst = &rs.secretsv3
 		case *v3bootstrap.Bootstrap:
 			bs := m.(*v3bootstrap.Bootstrap)
 			sr := bs.StaticResources
@@ -490,38 +549,109 @@ func update(
 				rdsListener, routeConfigs, err := V3ListenerToRdsListener(lst)
 				if err != nil {
 					dlog.Errorf(ctx, "Error converting listener to RDS: %+v", err)
-					listenersv3 = append(listenersv3, proto.Clone(lst).(ecp_cache_types.Resource))
+					add(&rs.listenersv3, proto.Clone(lst).(ecp_cache_types.Resource))
 					continue
 				}
-				listenersv3 = append(listenersv3, rdsListener)
+				add(&rs.listenersv3, rdsListener)
 				for _, rc := range routeConfigs {
 					// These routes will get included in the configuration snapshot created below.
-					routesv3 = append(routesv3, rc)
+					add(&rs.routesv3, rc)
 				}
 			}
 			for _, cls := range sr.Clusters {
-				clustersv3 = append(clustersv3, proto.Clone(cls).(ecp_cache_types.Resource))
+				add(&rs.clustersv3, proto.Clone(cls).(ecp_cache_types.Resource))
 			}
 			continue
 		default:
 			dlog.Warnf(ctx, "Unrecognized resource %s: %v", name, e)
 			continue
 		}
-		*dst = append(*dst, m.(ecp_cache_types.Resource))
+		add(dst, m.(ecp_cache_types.Resource))
 	}
 
+	return rs
+}
+
+// overlay returns a new resourceSet with the resources of both sets. Where both sets have a
+// resource with the same type and name, the one from the overlay wins.
+func (rs *resourceSet) overlay(o *resourceSet) *resourceSet {
+	return &resourceSet{
+		clusters:  overlayResources(rs.clusters, o.clusters, ecp_v2_cache.GetResourceName),
+		routes:    overlayResources(rs.routes, o.routes, ecp_v2_cache.GetResourceName),
+		listeners: overlayResources(rs.listeners, o.listeners, ecp_v2_cache.GetResourceName),
+		runtimes:  overlayResources(rs.runtimes, o.runtimes, ecp_v2_cache.GetResourceName),
+		secrets:   overlayResources(rs.secrets, o.secrets, ecp_v2_cache.GetResourceName),
+
+		clustersv3:  overlayResources(rs.clustersv3, o.clustersv3, ecp_v3_cache.GetResourceName),
+		routesv3:    overlayResources(rs.routesv3, o.routesv3, ecp_v3_cache.GetResourceName),
+		listenersv3: overlayResources(rs.listenersv3, o.listenersv3, ecp_v3_cache.GetResourceName),
+		runtimesv3:  overlayResources(rs.runtimesv3, o.runtimesv3, ecp_v3_cache.GetResourceName),
+		secretsv3:   overlayResources(rs.secretsv3, o.secretsv3, ecp_v3_cache.GetResourceName),
+
+		sources: overlaySources(rs.sources, o.sources),
+	}
+}
+
+func overlaySources(base, overlay map[ecp_cache_types.Resource]string) map[ecp_cache_types.Resource]string {
+	result := make(map[ecp_cache_types.Resource]string, len(base)+len(overlay))
+	for res, source := range base {
+		result[res] = source
+	}
+	for res, source := range overlay {
+		result[res] = source
+	}
+	return result
+}
+
+func overlayResources(base, overlay []ecp_cache_types.Resource, name func(ecp_cache_types.Resource) string) []ecp_cache_types.Resource {
+	replaced := map[string]bool{}
+	for _, res := range overlay {
+		replaced[name(res)] = true
+	}
+	result := make([]ecp_cache_types.Resource, 0, len(base)+len(overlay))
+	for _, res := range base {
+		if !replaced[name(res)] {
+			result = append(result, res)
+		}
+	}
+	return append(result, overlay...)
+}
+
+// buildSnapshots turns a resourceSet, plus the fastpath resources and endpoints, into a pair of
+// internally consistent V2 and V3 snapshots.
+func buildSnapshots(
+	ctx context.Context,
+	version string,
+	rs *resourceSet,
+	edsEndpoints map[string]*v2.ClusterLoadAssignment,
+	edsEndpointsV3 map[string]*v3endpointconfig.ClusterLoadAssignment,
+	fastpathSnapshot *FastpathSnapshot,
+) (*ecp_v2_cache.Snapshot, *ecp_v3_cache.Snapshot, error) {
+	clustersv3 := append([]ecp_cache_types.Resource{}, rs.clustersv3...)
+	routesv3 := append([]ecp_cache_types.Resource{}, rs.routesv3...)
+	listenersv3 := append([]ecp_cache_types.Resource{}, rs.listenersv3...)
+	secretsv3 := rs.secretsv3
+
 	if fastpathSnapshot != nil && fastpathSnapshot.Snapshot != nil {
 		for _, lst := range fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Listener].Items {
-			listeners = append(listeners, lst)
+			listenersv3 = append(listenersv3, lst)
 		}
 		for _, route := range fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Route].Items {
-			routes = append(routes, route)
+			routesv3 = append(routesv3, route)
 		}
 		for _, clu := range fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Cluster].Items {
-			clusters = append(clusters, clu)
+			clustersv3 = append(clustersv3, clu)
 		}
 		// We intentionally omit endpoints since those are carried separately.
 	}
+	if fastpathSnapshot != nil && len(fastpathSnapshot.Secrets) > 0 {
+		// Secrets from the fastpath are newer than any on disk with the same name.
+		fastpathSecrets := make([]ecp_cache_types.Resource, 0, len(fastpathSnapshot.Secrets))
+		for _, secret := range fastpathSnapshot.Secrets {
+			fastpathSecrets = append(fastpathSecrets, secret)
+		}
+		secretsv3 = overlayResources(secretsv3, fastpathSecrets, ecp_v3_cache.GetResourceName)
+	}
 
 	// The configuration data that reaches us here arrives via two parallel paths that race each
 	// other. The endpoint data comes in realtime directly from the golang watcher in the entrypoint
@@ -546,26 +676,22 @@ func update(
 	// warmup sequence in scenarios where the endpoint data for a cluster is really flapping into
 	// and out of existence. In that circumstance we want to faithfully relay to envoy that the
 	// cluster exists but currently has no endpoints.
-	endpoints := JoinEdsClusters(ctx, clusters, edsEndpoints)
+	endpoints := JoinEdsClusters(ctx, rs.clusters, edsEndpoints)
 	endpointsv3 := JoinEdsClustersV3(ctx, clustersv3, edsEndpointsV3)
 
-	// Create a new configuration snapshot from everything we have just loaded from disk.
-	curgen := *generation
-	*generation++
-
-	version := fmt.Sprintf("v%d", curgen)
 	snapshot := ecp_v2_cache.NewSnapshot(
 		version,
 		endpoints,
-		clusters,
-		routes,
-		listeners,
-		runtimes)
+		rs.clusters,
+		rs.routes,
+		rs.listeners,
+		rs.runtimes)
+	// NewSnapshot predates SDS, so it doesn't take secrets.
+	snapshot.Resources[ecp_cache_types.Secret] = ecp_v2_cache.NewResources(version, rs.secrets)
 
 	if err := snapshot.Consistent(); err != nil {
-		bs, _ := json.Marshal(snapshot)
-		dlog.Errorf(ctx, "V2 Snapshot inconsistency: %v: %s", err, bs)
-		return nil // TODO: should we return the error, rather than just logging it?
+		bs, _ := json.Marshal(NewV2ExpandedSnapshot(&snapshot))
+		return nil, nil, fmt.Errorf("V2 Snapshot inconsistency: %w: %s", err, bs)
 	}
 
 	snapshotv3 := ecp_v3_cache.NewSnapshot(
@@ -574,34 +700,131 @@ func update(
 		clustersv3,
 		routesv3,
 		listenersv3,
-		runtimesv3)
+		rs.runtimesv3)
+	snapshotv3.Resources[ecp_cache_types.Secret] = ecp_v3_cache.NewResources(version, secretsv3)
 
 	if err := snapshotv3.Consistent(); err != nil {
-		bs, _ := json.Marshal(snapshotv3)
-		dlog.Errorf(ctx, "V3 Snapshot inconsistency: %v: %s", err, bs)
+		bs, _ := json.Marshal(NewV3ExpandedSnapshot(&snapshotv3))
+		return nil, nil, fmt.Errorf("V3 Snapshot inconsistency: %w: %s", err, bs)
+	}
+
+	return &snapshot, &snapshotv3, nil
+}
+
+// Get an updated snapshot going.
+func update(
+	ctx context.Context,
+	strictValidation bool,
+	config ecp_v2_cache.SnapshotCache,
+	configv3 ecp_v3_cache.SnapshotCache,
+	generation *int,
+	dirs []string,
+	nodeGroups *NodeGroups,
+	watchDir func(string) error,
+	history *snapshotHistory,
+	edsEndpoints map[string]*v2.ClusterLoadAssignment,
+	edsEndpointsV3 map[string]*v3endpointconfig.ClusterLoadAssignment,
+	fastpathSnapshot *FastpathSnapshot,
+	updates chan<- Update,
+) error {
+	// The node groups file lives alongside the rest of our configuration, so pick up any changes
+	// to it along with everything else. Groups that it adds may well bring directories that we
+	// aren't watching yet.
+	prevGroups := nodeGroups.Config()
+	if err := nodeGroups.Reload(); err != nil {
+		dlog.Errorf(ctx, "Error loading node groups, keeping the previous ones: %v", err)
+	}
+	if watchDir != nil {
+		for _, dir := range nodeGroups.Config().NewDirs(prevGroups) {
+			if err := watchDir(dir); err != nil {
+				dlog.Errorf(ctx, "Error watching %s: %v", dir, err)
+			}
+		}
+	}
+
+	base := loadResources(ctx, dirs)
+
+	// Create a new configuration snapshot from everything we have just loaded from disk.
+	curgen := *generation
+	*generation++
+
+	version := fmt.Sprintf("v%d", curgen)
+	snapshot, snapshotv3, err := buildSnapshots(ctx, version, base, edsEndpoints, edsEndpointsV3, fastpathSnapshot)
+	if err != nil {
+		dlog.Errorf(ctx, "%v", err)
 		return nil // TODO: should we return the error, rather than just logging it?
 	}
+	if err := checkSnapshotV3(ctx, DefaultNodeGroup, strictValidation, snapshotv3, base.sources); err != nil {
+		dlog.Errorf(ctx, "Rejecting snapshot: %v", err)
+		return nil
+	}
+
+	// Each node group gets its own snapshot, built from the shared resources with the group's own
+	// resources overlaid on top (or from the group's resources alone). A group whose snapshot is
+	// inconsistent keeps whatever snapshot it had before, rather than holding up every other
+	// group.
+	groupSnapshots := map[string]*ecp_v2_cache.Snapshot{}
+	groupSnapshotsV3 := map[string]*ecp_v3_cache.Snapshot{}
+	for _, group := range nodeGroups.Config().Groups {
+		rs := loadResources(ctx, group.Dirs)
+		if !group.Replace {
+			rs = base.overlay(rs)
+		}
+		gsnap, gsnapv3, err := buildSnapshots(ctx, version, rs, edsEndpoints, edsEndpointsV3, fastpathSnapshot)
+		if err != nil {
+			dlog.Errorf(ctx, "Node group %q: %v", group.Name, err)
+			continue
+		}
+		if err := checkSnapshotV3(ctx, group.Name, strictValidation, gsnapv3, rs.sources); err != nil {
+			dlog.Errorf(ctx, "Node group %q: rejecting snapshot: %v", group.Name, err)
+			continue
+		}
+		groupSnapshots[group.Name] = gsnap
+		groupSnapshotsV3[group.Name] = gsnapv3
+	}
 
 	// This used to just directly update envoy. Since we want ratelimiting, we now send an
 	// Update object down the channel with a function that knows how to do the update if/when
 	// the ratelimiting logic decides.
 
 	dlog.Debugf(ctx, "Created snapshot %s", version)
-	csDump(ctx, snapdirPath, numsnaps, curgen, &snapshot, &snapshotv3)
+	history.Dump(ctx, DefaultNodeGroup, curgen, snapshot, snapshotv3)
+	for name, gsnap := range groupSnapshots {
+		history.Dump(ctx, name, curgen, gsnap, groupSnapshotsV3[name])
+	}
 
 	update := Update{version, func() error {
 		dlog.Debugf(ctx, "Accepting snapshot %s", version)
 
-		err := config.SetSnapshot("test-id", snapshot)
+		err := config.SetSnapshot(DefaultNodeGroup, *snapshot)
 		if err != nil {
 			return fmt.Errorf("V2 Snapshot error %q for %+v", err, snapshot)
 		}
 
-		err = configv3.SetSnapshot("test-id", snapshotv3)
+		err = configv3.SetSnapshot(DefaultNodeGroup, *snapshotv3)
 		if err != nil {
 			return fmt.Errorf("V3 Snapshot error %q for %+v", err, snapshotv3)
 		}
 
+		for name, gsnap := range groupSnapshots {
+			if err := config.SetSnapshot(name, *gsnap); err != nil {
+				return fmt.Errorf("V2 Snapshot error %q for node group %q", err, name)
+			}
+		}
+
+		for name, gsnapv3 := range groupSnapshotsV3 {
+			if err := configv3.SetSnapshot(name, *gsnapv3); err != nil {
+				return fmt.Errorf("V3 Snapshot error %q for node group %q", err, name)
+			}
+		}
+
+		// Envoys in a group that has gone away now belong to some other group, so there's no
+		// need to hang on to its snapshots.
+		for _, name := range nodeGroups.Removed() {
+			config.ClearSnapshot(name)
+			configv3.ClearSnapshot(name)
+		}
+
 		return nil
 	}}
 
@@ -615,6 +838,39 @@ func update(
 	return nil
 }
 
+// rollback goes back to the last known good snapshot for a node group, after one of its Envoys
+// rejected a newer one. Rollbacks skip the Updater: they don't add to the configurations that
+// Envoy is draining, and they mustn't replace an update that the Updater is holding back.
+func rollback(ctx context.Context, configv3 ecp_v3_cache.SnapshotCache, acks *AckTracker, history *snapshotHistory, group, badVersion string) {
+	current, err := configv3.GetSnapshot(group)
+	if err != nil || current.Resources[ecp_cache_types.Listener].Version != badVersion {
+		// We've moved on since Envoy saw badVersion, maybe with an earlier rollback.
+		return
+	}
+
+	good := acks.LastGood(group)
+	if good == "" {
+		dlog.Errorf(ctx, "Node group %q rejected snapshot %s, but there's no known good snapshot to go back to", group, badVersion)
+		return
+	}
+	snapshot, n, err := history.Get(group, good)
+	if err != nil {
+		dlog.Errorf(ctx, "Node group %q rejected snapshot %s, but the last known good snapshot %s can't be read: %v", group, badVersion, good, err)
+		return
+	}
+	if snapshot == nil {
+		dlog.Errorf(ctx, "Node group %q rejected snapshot %s, but the last known good snapshot %s is no longer in the snapshot history", group, badVersion, good)
+		return
+	}
+	// The snapshot files don't have the secrets' keys, so we keep serving the current secrets.
+	snapshot.Resources[ecp_cache_types.Secret] = current.Resources[ecp_cache_types.Secret]
+
+	dlog.Warnf(ctx, "Node group %q rejected snapshot %s, rolling back to snapshot %s (ambex-%d.json)", group, badVersion, good, n)
+	if err := configv3.SetSnapshot(group, *snapshot); err != nil {
+		dlog.Errorf(ctx, "V3 Snapshot error %q rolling back node group %q", err, group)
+	}
+}
+
 func warn(ctx context.Context, err error) bool {
 	if err != nil {
 		dlog.Warn(ctx, err)
@@ -637,9 +893,11 @@ var _ ecp_log.Logger = logAdapterV2{}
 
 type logAdapterV3 struct {
 	logAdapterBase
+	acks *AckTracker
 }
 
 var _ ecp_v3_server.Callbacks = logAdapterV3{}
+var _ ecp_v3_server.DeltaCallbacks = logAdapterV3{}
 var _ ecp_log.Logger = logAdapterV3{}
 
 // Debugf implements ecp_log.Logger.
@@ -680,10 +938,21 @@ func (l logAdapterV2) OnStreamRequest(sid int64, req *v2.DiscoveryRequest) error
 	return nil
 }
 
+// OnStreamClosed implements ecp_v3_server.Callbacks.
+func (l logAdapterV3) OnStreamClosed(sid int64) {
+	l.logAdapterBase.OnStreamClosed(sid)
+	l.acks.StreamClosed(sid)
+}
+
 // OnStreamRequest implements ecp_v3_server.Callbacks.
 func (l logAdapterV3) OnStreamRequest(sid int64, req *v3discovery.DiscoveryRequest) error {
 	dlog.Debugf(context.TODO(), "V3 Stream request[%v] for type %s: requesting %d resources", sid, req.TypeUrl, len(req.ResourceNames))
 	dlog.Debugf(context.TODO(), "V3 Stream request[%v] dump: %v", sid, req)
+	if req.ErrorDetail != nil {
+		dlog.Errorf(context.TODO(), "V3 Stream request[%v] for type %s: Envoy %q rejected the response with nonce %q: %s",
+			sid, req.TypeUrl, req.GetNode().GetId(), req.ResponseNonce, req.ErrorDetail.GetMessage())
+	}
+	l.acks.Request(sid, req.Node, req.TypeUrl, req.VersionInfo, req.ResponseNonce, req.ErrorDetail)
 	return nil
 }
 
@@ -697,6 +966,40 @@ func (l logAdapterV2) OnStreamResponse(sid int64, req *v2.DiscoveryRequest, res
 func (l logAdapterV3) OnStreamResponse(sid int64, req *v3discovery.DiscoveryRequest, res *v3discovery.DiscoveryResponse) {
 	dlog.Debugf(context.TODO(), "V3 Stream response[%v] for type %s: returning %d resources", sid, res.TypeUrl, len(res.Resources))
 	dlog.Debugf(context.TODO(), "V3 Stream dump response[%v]: %v -> %v", sid, req, res)
+	l.acks.Response(sid, res.TypeUrl, res.VersionInfo, res.Nonce)
+}
+
+// OnDeltaStreamOpen implements ecp_v3_server.DeltaCallbacks.
+func (l logAdapterV3) OnDeltaStreamOpen(ctx context.Context, sid int64, stype string) error {
+	dlog.Debugf(ctx, "%v Delta stream open[%v]: %v", l.prefix, sid, stype)
+	return nil
+}
+
+// OnDeltaStreamClosed implements ecp_v3_server.DeltaCallbacks.
+func (l logAdapterV3) OnDeltaStreamClosed(sid int64) {
+	dlog.Debugf(context.TODO(), "%v Delta stream closed[%v]", l.prefix, sid)
+	l.acks.StreamClosed(sid)
+}
+
+// OnStreamDeltaRequest implements ecp_v3_server.DeltaCallbacks.
+func (l logAdapterV3) OnStreamDeltaRequest(sid int64, req *v3discovery.DeltaDiscoveryRequest) error {
+	dlog.Debugf(context.TODO(), "V3 Delta stream request[%v] for type %s: subscribing %d resources, unsubscribing %d resources",
+		sid, req.TypeUrl, len(req.ResourceNamesSubscribe), len(req.ResourceNamesUnsubscribe))
+	dlog.Debugf(context.TODO(), "V3 Delta stream request[%v] dump: %v", sid, req)
+	if req.ErrorDetail != nil {
+		dlog.Errorf(context.TODO(), "V3 Delta stream request[%v] for type %s: Envoy %q rejected the response with nonce %q: %s",
+			sid, req.TypeUrl, req.GetNode().GetId(), req.ResponseNonce, req.ErrorDetail.GetMessage())
+	}
+	l.acks.Request(sid, req.Node, req.TypeUrl, "", req.ResponseNonce, req.ErrorDetail)
+	return nil
+}
+
+// OnStreamDeltaResponse implements ecp_v3_server.DeltaCallbacks.
+func (l logAdapterV3) OnStreamDeltaResponse(sid int64, req *v3discovery.DeltaDiscoveryRequest, res *v3discovery.DeltaDiscoveryResponse) {
+	dlog.Debugf(context.TODO(), "V3 Delta stream response[%v] for type %s: returning %d resources, removing %d resources",
+		sid, res.TypeUrl, len(res.Resources), len(res.RemovedResources))
+	dlog.Debugf(context.TODO(), "V3 Delta stream dump response[%v]: %v -> %v", sid, req, res)
+	l.acks.Response(sid, res.TypeUrl, res.SystemVersionInfo, res.Nonce)
 }
 
 // OnFetchRequest implements ecp_v2_server.Callbacks.
@@ -729,6 +1032,26 @@ func Main(ctx context.Context, Version string, rawArgs ...string) error {
 	return Main2(ctx, Version, usage.PercentUsed, make(chan *FastpathSnapshot), rawArgs...)
 }
 
+// defaultSnapdirPath returns where ambex logs its own snapshots.
+//
+// ambex logs its own snapshots, separately from the ones provided by the Python
+// side of the world, in $rootdir/snapshots/ambex-#.json, where rootdir is taken
+// from $AMBASSADOR_CONFIG_BASE_DIR if set, else $ambassador_root if set, else
+// whatever, set rootdir to /ambassador.
+func defaultSnapdirPath() string {
+	snapdirPath := os.Getenv("AMBASSADOR_CONFIG_BASE_DIR")
+
+	if snapdirPath == "" {
+		snapdirPath = os.Getenv("ambassador_root")
+	}
+
+	if snapdirPath == "" {
+		snapdirPath = "/ambassador"
+	}
+
+	return path.Join(snapdirPath, "snapshots")
+}
+
 func Main2(
 	ctx context.Context,
 	Version string,
@@ -747,22 +1070,7 @@ func Main2(
 		busy.SetLogLevel(logrusInfoLevel)
 	}
 
-	// ambex logs its own snapshots, separately from the ones provided by the Python
-	// side of the world, in $rootdir/snapshots/ambex-#.json, where rootdir is taken
-	// from $AMBASSADOR_CONFIG_BASE_DIR if set, else $ambassador_root if set, else
-	// whatever, set rootdir to /ambassador.
-
-	snapdirPath := os.Getenv("AMBASSADOR_CONFIG_BASE_DIR")
-
-	if snapdirPath == "" {
-		snapdirPath = os.Getenv("ambassador_root")
-	}
-
-	if snapdirPath == "" {
-		snapdirPath = "/ambassador"
-	}
-
-	snapdirPath = path.Join(snapdirPath, "snapshots")
+	snapdirPath := defaultSnapdirPath()
 
 	// We'll keep $AMBASSADOR_AMBEX_SNAPSHOT_COUNT snapshots. If unset, or set to
 	// something we can't treat as an int, use 30 (which Flynn just made up, so don't
@@ -781,6 +1089,10 @@ func Main2(
 		dlog.Errorf(ctx, "Invalid AMBASSADOR_AMBEX_SNAPSHOT_COUNT: %s, using %d", numsnapStr, numsnaps)
 	}
 
+	// If $AMBASSADOR_AMBEX_SNAPSHOT_DELTAS is set, only the newest snapshot is kept whole, and
+	// the older ones are just what changed. `ambex-diff` knows how to read them.
+	snapshotDeltas, _ := strconv.ParseBool(os.Getenv("AMBASSADOR_AMBEX_SNAPSHOT_DELTAS"))
+
 	dlog.Infof(ctx, "Ambex %s starting, snapdirPath %s", Version, snapdirPath)
 
 	watcher, err := fsnotify.NewWatcher()
@@ -789,12 +1101,27 @@ func Main2(
 	}
 	defer watcher.Close()
 
+	nodeGroups := NewNodeGroups(args.nodeGroupsFile)
+	if err := nodeGroups.Reload(); err != nil {
+		return err
+	}
+
+	// update watches the directories of groups that are added to the node groups file later on.
+	var watchDir func(string) error
 	if args.watch {
+		watchDir = watcher.Add
 		for _, d := range args.dirs {
 			if err := watcher.Add(d); err != nil {
 				return err
 			}
 		}
+		for _, group := range nodeGroups.Config().Groups {
+			for _, d := range group.Dirs {
+				if err := watcher.Add(d); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
 	// The golang signal package does not block when it writes to the channel. We therefore need a
@@ -811,15 +1138,56 @@ func Main2(
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	config := ecp_v2_cache.NewSnapshotCache(true, HasherV2{}, logAdapterV2{logAdapterBase{"V2"}})
-	configv3 := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, logAdapterV3{logAdapterBase{"V3"}})
+	// When an Envoy rejects a snapshot, the AckTracker tells the main loop below (if we're
+	// rolling back at all) which node group should go back to its last known good snapshot.
+	type rejection struct{ group, version string }
+	rejections := make(chan rejection, 100)
+	acks := NewAckTracker(nodeGroups.V3(), func(group, version string) {
+		if !args.rollbackOnNack {
+			return
+		}
+		select {
+		case rejections <- rejection{group, version}:
+		default:
+			// The main loop is behind. Whatever it's doing will either roll back, or replace the
+			// rejected snapshot with a new one.
+		}
+	})
+	setRunningAcks(acks)
+	defer setRunningAcks(nil)
+	history := newSnapshotHistory(snapdirPath, numsnaps, snapshotDeltas)
+
+	policy, err := parseAdmissionPolicy(ctx, args.updatePolicy, policyEnv{
+		getUsage:  getUsage,
+		drainTime: GetAmbassadorDrainTime(ctx),
+		acks:      acks,
+		metrics:   updaterMetrics,
+	})
+	if err != nil {
+		return err
+	}
+
+	config := ecp_v2_cache.NewSnapshotCache(true, nodeGroups.V2(), logAdapterV2{logAdapterBase{"V2"}})
+	configv3 := ecp_v3_cache.NewSnapshotCache(true, nodeGroups.V3(), logAdapterV3{logAdapterBase{"V3"}, acks})
 	server := ecp_v2_server.NewServer(ctx, config, logAdapterV2{logAdapterBase{"V2"}})
-	serverv3 := ecp_v3_server.NewServer(ctx, configv3, logAdapterV3{logAdapterBase{"V3"}})
+	serverv3 := ecp_v3_server.NewServer(ctx, configv3, logAdapterV3{logAdapterBase{"V3"}, acks})
 
-	if err := runManagementServer(ctx, server, serverv3, args.adsNetwork, args.adsAddress); err != nil {
+	if err := runManagementServer(ctx, server, serverv3, args.adsNetwork, args.adsAddress, args.adsTLS, nodeGroups); err != nil {
 		return err
 	}
 
+	if args.statusAddress != "" {
+		status := &statusServer{
+			acks:     acks,
+			configv3: configv3,
+			hasher:   nodeGroups.V3(),
+			history:  history,
+		}
+		if err := runStatusServer(ctx, args.statusAddress, status); err != nil {
+			return err
+		}
+	}
+
 	pid := os.Getpid()
 	file := "ambex.pid"
 	if !warn(ctx, ioutil.WriteFile(file, []byte(fmt.Sprintf("%v", pid)), 0644)) {
@@ -832,7 +1200,7 @@ func Main2(
 	envoyUpdaterDone := make(chan struct{})
 	go func() {
 		defer close(envoyUpdaterDone)
-		if err := Updater(ctx, updates, getUsage); err != nil {
+		if err := UpdaterWithPolicy(ctx, updates, policy); err != nil {
 			panic(err) // TODO: Find a better way of reporting errors from goroutines.
 		}
 	}()
@@ -848,12 +1216,14 @@ func Main2(
 	// we have a real configuration...
 	err = update(
 		ctx,
-		snapdirPath,
-		numsnaps,
+		args.strictValidation,
 		config,
 		configv3,
 		&generation,
 		args.dirs,
+		nodeGroups,
+		watchDir,
+		history,
 		edsEndpoints,
 		edsEndpointsV3,
 		fastpathSnapshot,
@@ -877,12 +1247,14 @@ OUTER:
 			case syscall.SIGHUP:
 				err := update(
 					ctx,
-					snapdirPath,
-					numsnaps,
+					args.strictValidation,
 					config,
 					configv3,
 					&generation,
 					args.dirs,
+					nodeGroups,
+					watchDir,
+					history,
 					edsEndpoints,
 					edsEndpointsV3,
 					fastpathSnapshot,
@@ -903,12 +1275,14 @@ OUTER:
 			fastpathSnapshot = fpSnap
 			err := update(
 				ctx,
-				snapdirPath,
-				numsnaps,
+				args.strictValidation,
 				config,
 				configv3,
 				&generation,
 				args.dirs,
+				nodeGroups,
+				watchDir,
+				history,
 				edsEndpoints,
 				edsEndpointsV3,
 				fastpathSnapshot,
@@ -921,12 +1295,14 @@ OUTER:
 			// Non-fastpath update. Just update.
 			err := update(
 				ctx,
-				snapdirPath,
-				numsnaps,
+				args.strictValidation,
 				config,
 				configv3,
 				&generation,
 				args.dirs,
+				nodeGroups,
+				watchDir,
+				history,
 				edsEndpoints,
 				edsEndpointsV3,
 				fastpathSnapshot,
@@ -935,6 +1311,8 @@ OUTER:
 			if err != nil {
 				return err
 			}
+		case r := <-rejections:
+			rollback(ctx, configv3, acks, history, r.group, r.version)
 		case err := <-watcher.Errors:
 			// Something went wrong, so scream about that.
 			dlog.Warnf(ctx, "Watcher error: %v", err)
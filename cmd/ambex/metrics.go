@@ -0,0 +1,192 @@
+package ambex
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// UpdaterMetrics counts what the Updater does with the updates that it gets, so that updates that
+// are held back (because of memory pressure, or by some other AdmissionPolicy) are visible from
+// outside.
+type UpdaterMetrics struct {
+	mu sync.Mutex
+
+	queued    uint64 // updates the Updater has received
+	coalesced uint64 // updates replaced by a newer one before they were applied
+	dropped   uint64 // updates that were never applied, because they failed or ambex shut down
+	applied   uint64 // updates applied to the snapshot cache
+	throttled uint64 // times an update was held back by the AdmissionPolicy
+
+	drainTime          time.Duration
+	memoryPercent      int
+	staleReconfigs     int
+	maxStaleReconfigs  int
+	disableRatelimiter bool
+	pending            bool
+
+	// wait is a histogram of how long each applied update waited after the Updater received it.
+	waitBuckets []uint64 // counts for each of updateWaitBuckets, plus +Inf
+	waitSum     time.Duration
+	waitCount   uint64
+}
+
+// updateWaitBuckets are the bucket boundaries, in seconds, for the ambex_update_wait_seconds
+// histogram. The default drain time is 10 minutes, so that's the interesting range.
+var updateWaitBuckets = []float64{0.1, 1, 5, 15, 30, 60, 120, 300, 600, 1200}
+
+// NewUpdaterMetrics returns an empty UpdaterMetrics.
+func NewUpdaterMetrics() *UpdaterMetrics {
+	return &UpdaterMetrics{waitBuckets: make([]uint64, len(updateWaitBuckets)+1)}
+}
+
+// updaterMetrics is for the Updater that ambex runs. There's only ever one.
+var updaterMetrics = NewUpdaterMetrics()
+
+// runningAcks is the AckTracker of the ambex that's running, if any.
+var runningAcks struct {
+	sync.Mutex
+	acks *AckTracker
+}
+
+func setRunningAcks(acks *AckTracker) {
+	runningAcks.Lock()
+	defer runningAcks.Unlock()
+	runningAcks.acks = acks
+}
+
+func (m *UpdaterMetrics) queue(coalesced bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued++
+	if coalesced {
+		m.coalesced++
+	}
+	m.pending = true
+}
+
+func (m *UpdaterMetrics) throttle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.throttled++
+}
+
+func (m *UpdaterMetrics) memory(usagePercent, staleReconfigs, maxStaleReconfigs int, disableRatelimiter bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.memoryPercent = usagePercent
+	m.staleReconfigs = staleReconfigs
+	m.maxStaleReconfigs = maxStaleReconfigs
+	m.disableRatelimiter = disableRatelimiter
+}
+
+func (m *UpdaterMetrics) apply(wait time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = false
+	if err != nil {
+		m.dropped++
+		return
+	}
+	m.applied++
+	m.waitSum += wait
+	m.waitCount++
+	i := 0
+	for i < len(updateWaitBuckets) && wait.Seconds() > updateWaitBuckets[i] {
+		i++
+	}
+	m.waitBuckets[i]++
+}
+
+func (m *UpdaterMetrics) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending {
+		m.dropped++
+		m.pending = false
+	}
+}
+
+func (m *UpdaterMetrics) setDrainTime(drainTime time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drainTime = drainTime
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format.
+func (m *UpdaterMetrics) WriteMetrics(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ambex_updates_total Number of configuration updates the ambex Updater has handled, by outcome.")
+	fmt.Fprintln(w, "# TYPE ambex_updates_total counter")
+	for _, outcome := range []struct {
+		name  string
+		count uint64
+	}{
+		{"queued", m.queued},
+		{"coalesced", m.coalesced},
+		{"dropped", m.dropped},
+		{"applied", m.applied},
+	} {
+		fmt.Fprintf(w, "ambex_updates_total{outcome=%q} %d\n", outcome.name, outcome.count)
+	}
+
+	fmt.Fprintln(w, "# HELP ambex_updates_throttled_total Number of times the ambex Updater's update policy held back an update.")
+	fmt.Fprintln(w, "# TYPE ambex_updates_throttled_total counter")
+	fmt.Fprintf(w, "ambex_updates_throttled_total %d\n", m.throttled)
+
+	fmt.Fprintln(w, "# HELP ambex_update_pending Whether the ambex Updater has an update that it hasn't applied yet.")
+	fmt.Fprintln(w, "# TYPE ambex_update_pending gauge")
+	fmt.Fprintf(w, "ambex_update_pending %d\n", boolMetric(m.pending))
+
+	fmt.Fprintln(w, "# HELP ambex_drain_time_seconds How long Envoy takes to drain a stale configuration (AMBASSADOR_DRAIN_TIME).")
+	fmt.Fprintln(w, "# TYPE ambex_drain_time_seconds gauge")
+	fmt.Fprintf(w, "ambex_drain_time_seconds %g\n", m.drainTime.Seconds())
+
+	fmt.Fprintln(w, "# HELP ambex_memory_usage_percent Memory usage that the ambex Updater last saw.")
+	fmt.Fprintln(w, "# TYPE ambex_memory_usage_percent gauge")
+	fmt.Fprintf(w, "ambex_memory_usage_percent %d\n", m.memoryPercent)
+
+	fmt.Fprintln(w, "# HELP ambex_stale_reconfigs Number of updates applied within the last drain time, whose configurations Envoy may still be draining.")
+	fmt.Fprintln(w, "# TYPE ambex_stale_reconfigs gauge")
+	fmt.Fprintf(w, "ambex_stale_reconfigs %d\n", m.staleReconfigs)
+
+	fmt.Fprintln(w, "# HELP ambex_stale_reconfigs_max Number of stale reconfigs allowed at the current memory usage (0 means no limit).")
+	fmt.Fprintln(w, "# TYPE ambex_stale_reconfigs_max gauge")
+	fmt.Fprintf(w, "ambex_stale_reconfigs_max %d\n", m.maxStaleReconfigs)
+
+	fmt.Fprintln(w, "# HELP ambex_ratelimiter_disabled Whether the ambex Updater's rate limiter is disabled (AMBASSADOR_AMBEX_NO_RATELIMIT).")
+	fmt.Fprintln(w, "# TYPE ambex_ratelimiter_disabled gauge")
+	fmt.Fprintf(w, "ambex_ratelimiter_disabled %d\n", boolMetric(m.disableRatelimiter))
+
+	fmt.Fprintln(w, "# HELP ambex_update_wait_seconds How long each applied update waited after the ambex Updater got it.")
+	fmt.Fprintln(w, "# TYPE ambex_update_wait_seconds histogram")
+	var cumulative uint64
+	for i, le := range updateWaitBuckets {
+		cumulative += m.waitBuckets[i]
+		fmt.Fprintf(w, "ambex_update_wait_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	cumulative += m.waitBuckets[len(updateWaitBuckets)]
+	fmt.Fprintf(w, "ambex_update_wait_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "ambex_update_wait_seconds_sum %g\n", m.waitSum.Seconds())
+	fmt.Fprintf(w, "ambex_update_wait_seconds_count %d\n", m.waitCount)
+}
+
+// WriteMetrics writes the metrics for the Updater that ambex runs, and for the ACKs and NACKs that
+// it has seen from Envoy, in the Prometheus text format.
+func WriteMetrics(w io.Writer) {
+	updaterMetrics.WriteMetrics(w)
+	runningAcks.Lock()
+	acks := runningAcks.acks
+	runningAcks.Unlock()
+	acks.WriteMetrics(w)
+}
@@ -0,0 +1,280 @@
+package ambex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"sigs.k8s.io/yaml"
+
+	v2core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+)
+
+// DefaultNodeGroup is the node group that every Envoy belongs to unless a configured NodeGroup
+// matches it. It's also the node ID that our Envoy bootstrap configuration uses, so that a single
+// Envoy without any node groups configured behaves exactly like it always has.
+const DefaultNodeGroup = "test-id"
+
+// NodeGroupsConfig is the on-disk format of the --node-groups file, which may be either YAML or
+// JSON. For example:
+//
+//	groups:
+//	- name: canary
+//	  match:
+//	    id: "canary-*"
+//	    metadata:
+//	      zone: us-east-1a
+//	  dirs:
+//	  - /ambassador/envoy-canary
+//
+// Groups are matched in order; the first one that matches an Envoy node wins.
+type NodeGroupsConfig struct {
+	Groups []NodeGroup `json:"groups"`
+}
+
+// A NodeGroup is a set of Envoys that share a configuration snapshot.
+type NodeGroup struct {
+	// Name is the key of the group's snapshot in the snapshot cache.
+	Name string `json:"name"`
+
+	// Match selects the Envoy nodes that belong to the group.
+	Match NodeMatch `json:"match"`
+
+	// Dirs are additional directories of Envoy resources for the group. By default they're
+	// overlaid on the resources shared by all groups: a resource with the same type and name
+	// replaces the shared one, anything else is added.
+	Dirs []string `json:"dirs,omitempty"`
+
+	// Replace, if set, builds the group's snapshot from its own Dirs only, rather than
+	// overlaying them on the shared resources. Fastpath resources and endpoints are still
+	// included.
+	Replace bool `json:"replace,omitempty"`
+}
+
+// NodeMatch selects Envoy nodes by their node ID, cluster and metadata. Empty fields match
+// anything; the ID and Cluster may be shell patterns as understood by filepath.Match.
+type NodeMatch struct {
+	ID       string            `json:"id,omitempty"`
+	Cluster  string            `json:"cluster,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Matches returns whether a node with the given ID, cluster and metadata is selected.
+func (m NodeMatch) Matches(id, cluster string, metadata *structpb.Struct) bool {
+	if !globMatch(m.ID, id) || !globMatch(m.Cluster, cluster) {
+		return false
+	}
+	for key, want := range m.Metadata {
+		got, ok := metadata.GetFields()[key]
+		if !ok {
+			return false
+		}
+		if s, isString := got.GetKind().(*structpb.Value_StringValue); !isString || s.StringValue != want {
+			return false
+		}
+	}
+	return true
+}
+
+func globMatch(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	// filepath.Match only fails for a malformed pattern, which was already rejected when the
+	// config was loaded.
+	ok, _ := filepath.Match(pattern, value)
+	return ok
+}
+
+// LoadNodeGroups reads and validates a node groups file. A nonexistent file is not an error, it
+// just means that there are no node groups beyond the default one.
+func LoadNodeGroups(filename string) (*NodeGroupsConfig, error) {
+	cfg := &NodeGroupsConfig{}
+	if filename == "" {
+		return cfg, nil
+	}
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	if err := yaml.Unmarshal(bs, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	seen := map[string]bool{DefaultNodeGroup: true}
+	for _, group := range cfg.Groups {
+		if group.Name == "" {
+			return nil, fmt.Errorf("%s: node group without a name", filename)
+		}
+		// The group's snapshots are dumped to a directory named after it.
+		if group.Name == "." || group.Name == ".." || strings.ContainsAny(group.Name, `/\`) {
+			return nil, fmt.Errorf("%s: invalid node group name %q", filename, group.Name)
+		}
+		if seen[group.Name] {
+			return nil, fmt.Errorf("%s: duplicate node group %q", filename, group.Name)
+		}
+		seen[group.Name] = true
+		for _, pattern := range []string{group.Match.ID, group.Match.Cluster} {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: node group %q: invalid pattern %q: %w", filename, group.Name, pattern, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Group returns the name of the group that a node with the given ID, cluster and metadata
+// belongs to.
+func (cfg *NodeGroupsConfig) Group(id, cluster string, metadata *structpb.Struct) string {
+	if cfg != nil {
+		for _, group := range cfg.Groups {
+			if group.Match.Matches(id, cluster, metadata) {
+				return group.Name
+			}
+		}
+	}
+	return DefaultNodeGroup
+}
+
+// NodeGroups holds the current node group configuration, and implements the NodeHash interfaces
+// of the v2 and v3 snapshot caches by mapping each Envoy to its node group.
+type NodeGroups struct {
+	filename string
+
+	mu  sync.RWMutex
+	cfg *NodeGroupsConfig
+	// removed holds the groups that a reload dropped, so that their snapshots can be cleared.
+	removed map[string]bool
+}
+
+// NewNodeGroups returns NodeGroups that are (re)loaded from the given file; an empty filename
+// means that every Envoy is in the default group.
+func NewNodeGroups(filename string) *NodeGroups {
+	return &NodeGroups{filename: filename}
+}
+
+// Reload re-reads the node groups file. On error, the previous configuration remains in effect.
+func (ng *NodeGroups) Reload() error {
+	cfg, err := LoadNodeGroups(ng.filename)
+	if err != nil {
+		return err
+	}
+	ng.mu.Lock()
+	defer ng.mu.Unlock()
+	if ng.removed == nil {
+		ng.removed = make(map[string]bool)
+	}
+	for _, name := range ng.cfg.Names() {
+		ng.removed[name] = true
+	}
+	for _, name := range cfg.Names() {
+		delete(ng.removed, name)
+	}
+	ng.cfg = cfg
+	return nil
+}
+
+// Removed returns the names of the groups that were in an earlier configuration, but aren't in
+// the current one.
+func (ng *NodeGroups) Removed() []string {
+	ng.mu.RLock()
+	defer ng.mu.RUnlock()
+	names := make([]string, 0, len(ng.removed))
+	for name := range ng.removed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Config returns the current node group configuration.
+func (ng *NodeGroups) Config() *NodeGroupsConfig {
+	ng.mu.RLock()
+	defer ng.mu.RUnlock()
+	return ng.cfg
+}
+
+// V2 returns a NodeHash for the v2 snapshot cache.
+func (ng *NodeGroups) V2() HasherV2 {
+	return HasherV2{groups: ng}
+}
+
+// V3 returns a NodeHash for the v3 snapshot cache.
+func (ng *NodeGroups) V3() HasherV3 {
+	return HasherV3{groups: ng}
+}
+
+// Names returns the names of all the node groups, starting with the default one.
+func (cfg *NodeGroupsConfig) Names() []string {
+	names := []string{DefaultNodeGroup}
+	if cfg != nil {
+		for _, group := range cfg.Groups {
+			names = append(names, group.Name)
+		}
+	}
+	return names
+}
+
+// NewDirs returns the directories of the groups in cfg that none of the groups in prev have.
+func (cfg *NodeGroupsConfig) NewDirs(prev *NodeGroupsConfig) []string {
+	seen := map[string]bool{}
+	if prev != nil {
+		for _, group := range prev.Groups {
+			for _, dir := range group.Dirs {
+				seen[dir] = true
+			}
+		}
+	}
+	var dirs []string
+	if cfg != nil {
+		for _, group := range cfg.Groups {
+			for _, dir := range group.Dirs {
+				if !seen[dir] {
+					seen[dir] = true
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+	}
+	return dirs
+}
+
+// HasherV2 maps a v2 Envoy node to its node group. The zero HasherV2 uses the node ID.
+type HasherV2 struct {
+	groups *NodeGroups
+}
+
+// ID function
+func (h HasherV2) ID(node *v2core.Node) string {
+	if node == nil {
+		return "unknown"
+	}
+	if h.groups == nil {
+		return node.Id
+	}
+	return h.groups.Config().Group(node.Id, node.Cluster, node.Metadata)
+}
+
+// HasherV3 maps a v3 Envoy node to its node group. The zero HasherV3 uses the node ID.
+type HasherV3 struct {
+	groups *NodeGroups
+}
+
+// ID function
+func (h HasherV3) ID(node *v3core.Node) string {
+	if node == nil {
+		return "unknown"
+	}
+	if h.groups == nil {
+		return node.Id
+	}
+	return h.groups.Config().Group(node.Id, node.Cluster, node.Metadata)
+}
@@ -0,0 +1,156 @@
+package ambex
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	v2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
+	v3clusterconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3endpointconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/endpoint/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+func writeNodeGroups(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "node-groups.yaml")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	return filename
+}
+
+func TestNodeGroups(t *testing.T) {
+	ng := NewNodeGroups(writeNodeGroups(t, `
+groups:
+- name: canary
+  match:
+    id: "canary-*"
+- name: east
+  match:
+    metadata:
+      zone: us-east-1a
+`))
+	require.NoError(t, ng.Reload())
+
+	east, err := structpb.NewStruct(map[string]interface{}{"zone": "us-east-1a"})
+	require.NoError(t, err)
+
+	hasher := ng.V3()
+	assert.Equal(t, "canary", hasher.ID(&v3core.Node{Id: "canary-1", Metadata: east}))
+	assert.Equal(t, "east", hasher.ID(&v3core.Node{Id: "envoy-1", Metadata: east}))
+	assert.Equal(t, DefaultNodeGroup, hasher.ID(&v3core.Node{Id: "envoy-1"}))
+	assert.Equal(t, DefaultNodeGroup, hasher.ID(&v3core.Node{Id: DefaultNodeGroup}))
+	assert.Equal(t, "unknown", hasher.ID(nil))
+	assert.Equal(t, []string{DefaultNodeGroup, "canary", "east"}, ng.Config().Names())
+
+	// A bad file leaves the previous groups in place.
+	ng.filename = writeNodeGroups(t, "groups:\n- name: canary\n- name: canary\n")
+	assert.Error(t, ng.Reload())
+	assert.Equal(t, "canary", hasher.ID(&v3core.Node{Id: "canary-1"}))
+
+	// No file means no groups.
+	ng.filename = filepath.Join(t.TempDir(), "missing.yaml")
+	require.NoError(t, ng.Reload())
+	assert.Equal(t, DefaultNodeGroup, hasher.ID(&v3core.Node{Id: "canary-1"}))
+}
+
+func TestNodeGroupsReload(t *testing.T) {
+	ng := NewNodeGroups(writeNodeGroups(t, `
+groups:
+- name: canary
+  dirs: [/canary]
+- name: east
+  dirs: [/east, /shared]
+`))
+	require.NoError(t, ng.Reload())
+	prev := ng.Config()
+	assert.Empty(t, ng.Removed())
+
+	ng.filename = writeNodeGroups(t, `
+groups:
+- name: east
+  dirs: [/east, /shared]
+- name: west
+  dirs: [/shared, /west]
+`)
+	require.NoError(t, ng.Reload())
+	assert.Equal(t, []string{"canary"}, ng.Removed())
+	assert.Equal(t, []string{"/west"}, ng.Config().NewDirs(prev))
+
+	// A group that comes back is no longer removed.
+	ng.filename = writeNodeGroups(t, "groups:\n- name: canary\n")
+	require.NoError(t, ng.Reload())
+	assert.Equal(t, []string{"east", "west"}, ng.Removed())
+}
+
+func TestUpdateNodeGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	canaryDir := t.TempDir()
+	eastDir := t.TempDir()
+	ng := NewNodeGroups(writeNodeGroups(t, "groups:\n- name: canary\n  dirs: ["+canaryDir+"]\n"))
+	require.NoError(t, ng.Reload())
+
+	config := ecp_v2_cache.NewSnapshotCache(true, ng.V2(), nil)
+	configv3 := ecp_v3_cache.NewSnapshotCache(true, ng.V3(), nil)
+	generation := 0
+	var watched []string
+	updates := make(chan Update, 1)
+	runUpdate := func() {
+		require.NoError(t, update(ctx, false, config, configv3, &generation,
+			[]string{t.TempDir()}, ng, func(dir string) error {
+				watched = append(watched, dir)
+				return nil
+			}, newSnapshotHistory(t.TempDir(), 5, false),
+			map[string]*v2.ClusterLoadAssignment{}, map[string]*v3endpointconfig.ClusterLoadAssignment{},
+			nil, updates))
+		require.NoError(t, (<-updates).Update())
+	}
+
+	runUpdate()
+	_, err := configv3.GetSnapshot("canary")
+	assert.NoError(t, err)
+	assert.Empty(t, watched)
+
+	// Replacing the canary group with another one watches the new group's directory, and drops
+	// the canary group's snapshots.
+	ng.filename = writeNodeGroups(t, "groups:\n- name: east\n  dirs: ["+eastDir+"]\n")
+	runUpdate()
+	assert.Equal(t, []string{eastDir}, watched)
+	_, err = configv3.GetSnapshot("canary")
+	assert.Error(t, err)
+	_, err = config.GetSnapshot("canary")
+	assert.Error(t, err)
+	_, err = configv3.GetSnapshot("east")
+	assert.NoError(t, err)
+}
+
+func TestResourceSetOverlay(t *testing.T) {
+	base := &resourceSet{clustersv3: []ecp_cache_types.Resource{
+		&v3clusterconfig.Cluster{Name: "a"},
+		&v3clusterconfig.Cluster{Name: "b"},
+	}}
+	group := &resourceSet{clustersv3: []ecp_cache_types.Resource{
+		&v3clusterconfig.Cluster{Name: "b", AltStatName: "group"},
+		&v3clusterconfig.Cluster{Name: "c"},
+	}}
+
+	merged := base.overlay(group)
+	var names []string
+	for _, res := range merged.clustersv3 {
+		cluster := res.(*v3clusterconfig.Cluster)
+		names = append(names, cluster.Name)
+		if cluster.Name == "b" {
+			assert.Equal(t, "group", cluster.AltStatName)
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/datawire/ambassador/v2/pkg/debug"
@@ -26,10 +27,16 @@ type MemoryGetter func() int
 // time. The function assumes updates are cumulative and it will drop old queued updates if a new
 // update arrives.
 func Updater(ctx context.Context, updates <-chan Update, getUsage MemoryGetter) error {
-	drainTime := GetAmbassadorDrainTime(ctx)
-	ticker := time.NewTicker(drainTime)
+	return UpdaterWithPolicy(ctx, updates, newMemoryPolicy(ctx, getUsage, GetAmbassadorDrainTime(ctx), updaterMetrics))
+}
+
+// UpdaterWithPolicy is like Updater, but the policy decides when updates may be pushed, rather
+// than memory usage. While the policy is holding an update back, it gets asked again every
+// policy.Interval(), and whenever a newer update arrives.
+func UpdaterWithPolicy(ctx context.Context, updates <-chan Update, policy AdmissionPolicy) error {
+	ticker := time.NewTicker(policy.Interval())
 	defer ticker.Stop()
-	return updaterWithTicker(ctx, updates, getUsage, drainTime, ticker, time.Now)
+	return updaterWithTicker(ctx, updates, policy, ticker, time.Now, updaterMetrics)
 }
 
 type debugInfo struct {
@@ -40,51 +47,36 @@ type debugInfo struct {
 	DisableRatelimiter bool        `json:"disableRatelimiter"`
 }
 
-func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage MemoryGetter,
-	drainTime time.Duration, ticker *time.Ticker, clock func() time.Time) error {
-
-	dbg := debug.FromContext(ctx)
-	info := dbg.Value("envoyReconfigs")
-
-	// Is the rate-limiter meant to be active at all?
-	disableRatelimiter, err := strconv.ParseBool(os.Getenv("AMBASSADOR_AMBEX_NO_RATELIMIT"))
-
-	if err != nil {
-		disableRatelimiter = false
-	}
-
-	if disableRatelimiter {
-		dlog.Info(ctx, "snapshot ratelimiter DISABLED")
-	}
+func updaterWithTicker(ctx context.Context, updates <-chan Update, policy AdmissionPolicy,
+	ticker *time.Ticker, clock func() time.Time, metrics *UpdaterMetrics) error {
 
-	// This slice holds the times of any updates we have made. This lets us compute how many stale
-	// configs are being held in memory since we can filter this list down to just those times that
-	// are between now - drain-time and now, i.e. we keep only the events that are more recent than
-	// drain-time ago.
-	updateTimes := []time.Time{}
+	defer metrics.stop()
 
-	// This variable holds the most recent desired configuration.
+	// This variable holds the most recent desired configuration, and when we got it.
 	var latest Update
+	var latestAt time.Time
 	gotFirst := false
 	pushed := false
 	for {
 		// The basic idea here is that we wakeup whenever we either a) get a new snapshot to update,
 		// or b) the timer ticks. In case a) we update the "latest" variable so that it always holds
-		// the most recent desired Update. In either case, we filter the list of updateTimes so we
-		// know exactly how many updates are in memory, and then based on that we decide whether we
-		// can do another reconfig or whether we should wait until the next (tick|update) whichever
-		// happens first.
+		// the most recent desired Update. In either case, we ask the policy whether we can push
+		// it now, or whether we should wait until the next (tick|update) whichever happens first.
 
 		var now time.Time
 		tick := false
 		select {
 		case up := <-updates:
+			// If the previous update hasn't been pushed yet, it never will be.
+			metrics.queue(gotFirst && !pushed)
 			latest = up
 			pushed = false
 			gotFirst = true
 			now = clock()
+			latestAt = now
 		case now = <-ticker.C:
-			if pushed {
+			// This is just in case we get a timer tick before the first update actually arrives.
+			if pushed || !gotFirst {
 				continue
 			}
 			tick = true
@@ -92,77 +84,147 @@ func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage Memo
 			return nil
 		}
 
-		// Remove updates that were longer than drain-time ago
-		updateTimes = gcUpdateTimes(updateTimes, now, drainTime)
-
-		usagePercent := getUsage()
-
-		if disableRatelimiter {
-			usagePercent = 0
-		}
-
-		var maxStaleReconfigs int
-		switch {
-		case usagePercent >= 90:
-			// With the default 10 minute drain time this works out to an average of one reconfig
-			// every 10 minutes. This will guarantee the minimum possible memory usage due to stale
-			// configs.
-			maxStaleReconfigs = 1
-		case usagePercent >= 80:
-			// With the default 10 minute drain time this works out to one reconfig every 40
-			// seconds on average within the window. (They could all happen in one burst.)
-			maxStaleReconfigs = 15
-		case usagePercent >= 70:
-			// With the default 10 minute drain time this works out to one reconfig every 20
-			// seconds on average within the window. (They could all happen in one burst.)
-			maxStaleReconfigs = 30
-		case usagePercent >= 60:
-			// With the default 10 minute drain time this works out to one reconfig every 10
-			// seconds on average within the window. (They could all happen in one burst.)
-			maxStaleReconfigs = 60
-		case usagePercent >= 50:
-			// With the default 10 minute drain time this works out to one reconfig every 5 seconds
-			// on average within the window. (They could all happen in one burst.)
-			maxStaleReconfigs = 120
-		default:
-			// Zero means no limit. This is what we want by default when memory usage is in the 0 to
-			// 50 range.
-			maxStaleReconfigs = 0
-		}
-
-		staleReconfigs := len(updateTimes)
-
-		info.Store(debugInfo{updateTimes, staleReconfigs, maxStaleReconfigs, pushed, disableRatelimiter})
-
-		// Decide if we have enough capacity left to perform a reconfig.
-		if maxStaleReconfigs > 0 && staleReconfigs >= maxStaleReconfigs {
+		if !policy.Admit(ctx, now, latest.Version) {
 			if !tick {
-				dlog.Warnf(ctx, "Memory Usage: throttling reconfig %+v due to constrained memory with %d stale reconfigs (%d max)",
-					latest.Version, staleReconfigs, maxStaleReconfigs)
+				metrics.throttle()
 			}
 			continue
 		}
 
-		// This is just in case we get a timer tick before the first update actually arrives.
-		if !gotFirst {
-			continue
-		}
-
 		// This is going to do the actual work of pushing an update.
 		err := latest.Update()
+		metrics.apply(now.Sub(latestAt), err)
 		if err != nil {
 			return err
 		}
 
-		// Since we just pushed an update, we add the current time to the set of update times.
-		updateTimes = append(updateTimes, now)
 		dlog.Infof(ctx, "Pushing snapshot %+v", latest.Version)
 		pushed = true
+		policy.Pushed(now, latest.Version)
+	}
+}
 
-		info.Store(debugInfo{updateTimes, staleReconfigs, maxStaleReconfigs, pushed, disableRatelimiter})
+// memoryPolicy is the default AdmissionPolicy. It keeps track of the times of the updates it has
+// admitted, so that it knows how many stale configs Envoy is holding in memory while it drains
+// them, and limits that number more and more as memory usage goes up.
+type memoryPolicy struct {
+	getUsage           MemoryGetter
+	drainTime          time.Duration
+	disableRatelimiter bool
+	metrics            *UpdaterMetrics
+	info               *atomic.Value
+
+	// This slice holds the times of any updates we have made. This lets us compute how many stale
+	// configs are being held in memory since we can filter this list down to just those times that
+	// are between now - drain-time and now, i.e. we keep only the events that are more recent than
+	// drain-time ago.
+	updateTimes []time.Time
+
+	usagePercent      int
+	maxStaleReconfigs int
+	throttled         string // the last version we throttled, so we only complain once per version
+}
+
+func newMemoryPolicy(ctx context.Context, getUsage MemoryGetter, drainTime time.Duration, metrics *UpdaterMetrics) *memoryPolicy {
+	dbg := debug.FromContext(ctx)
+
+	// Is the rate-limiter meant to be active at all?
+	disableRatelimiter, err := strconv.ParseBool(os.Getenv("AMBASSADOR_AMBEX_NO_RATELIMIT"))
+
+	if err != nil {
+		disableRatelimiter = false
+	}
+
+	if disableRatelimiter {
+		dlog.Info(ctx, "snapshot ratelimiter DISABLED")
+	}
+
+	metrics.setDrainTime(drainTime)
+
+	return &memoryPolicy{
+		getUsage:           getUsage,
+		drainTime:          drainTime,
+		disableRatelimiter: disableRatelimiter,
+		metrics:            metrics,
+		info:               dbg.Value("envoyReconfigs"),
+		updateTimes:        []time.Time{},
 	}
 }
 
+func (p *memoryPolicy) Admit(ctx context.Context, now time.Time, version string) bool {
+	// Remove updates that were longer than drain-time ago
+	p.updateTimes = gcUpdateTimes(p.updateTimes, now, p.drainTime)
+
+	p.usagePercent = p.getUsage()
+	usagePercent := p.usagePercent
+
+	if p.disableRatelimiter {
+		usagePercent = 0
+	}
+
+	switch {
+	case usagePercent >= 90:
+		// With the default 10 minute drain time this works out to an average of one reconfig
+		// every 10 minutes. This will guarantee the minimum possible memory usage due to stale
+		// configs.
+		p.maxStaleReconfigs = 1
+	case usagePercent >= 80:
+		// With the default 10 minute drain time this works out to one reconfig every 40
+		// seconds on average within the window. (They could all happen in one burst.)
+		p.maxStaleReconfigs = 15
+	case usagePercent >= 70:
+		// With the default 10 minute drain time this works out to one reconfig every 20
+		// seconds on average within the window. (They could all happen in one burst.)
+		p.maxStaleReconfigs = 30
+	case usagePercent >= 60:
+		// With the default 10 minute drain time this works out to one reconfig every 10
+		// seconds on average within the window. (They could all happen in one burst.)
+		p.maxStaleReconfigs = 60
+	case usagePercent >= 50:
+		// With the default 10 minute drain time this works out to one reconfig every 5 seconds
+		// on average within the window. (They could all happen in one burst.)
+		p.maxStaleReconfigs = 120
+	default:
+		// Zero means no limit. This is what we want by default when memory usage is in the 0 to
+		// 50 range.
+		p.maxStaleReconfigs = 0
+	}
+
+	staleReconfigs := p.record(false)
+
+	// Decide if we have enough capacity left to perform a reconfig.
+	if p.maxStaleReconfigs > 0 && staleReconfigs >= p.maxStaleReconfigs {
+		if version != p.throttled {
+			dlog.Warnf(ctx, "Memory Usage: throttling reconfig %+v due to constrained memory with %d stale reconfigs (%d max)",
+				version, staleReconfigs, p.maxStaleReconfigs)
+			p.throttled = version
+		}
+		return false
+	}
+	return true
+}
+
+func (p *memoryPolicy) Pushed(now time.Time, version string) {
+	// Since we just pushed an update, we add the current time to the set of update times.
+	p.updateTimes = append(p.updateTimes, now)
+	p.record(true)
+}
+
+// record publishes what we know to the debug endpoint and the metrics, and returns the number of
+// stale reconfigs.
+func (p *memoryPolicy) record(synced bool) int {
+	staleReconfigs := len(p.updateTimes)
+	p.info.Store(debugInfo{p.updateTimes, staleReconfigs, p.maxStaleReconfigs, synced, p.disableRatelimiter})
+	p.metrics.memory(p.usagePercent, staleReconfigs, p.maxStaleReconfigs, p.disableRatelimiter)
+	return staleReconfigs
+}
+
+// Interval is the drain time: the number of stale reconfigs only goes down when one of them has
+// been draining for that long.
+func (p *memoryPolicy) Interval() time.Duration {
+	return p.drainTime
+}
+
 // The gcUpdateTimes function filters out timestamps that should have drained by now.
 func gcUpdateTimes(updateTimes []time.Time, now time.Time, drainTime time.Duration) []time.Time {
 	result := []time.Time{}
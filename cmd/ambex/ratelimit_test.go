@@ -1,7 +1,9 @@
 package ambex
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -22,15 +24,25 @@ type harness struct {
 	mutex sync.Mutex // to proect the clock and usage
 	usage int        // simulated memory usage
 	clock time.Time  // current simulated time
+
+	metrics *UpdaterMetrics
 }
 
 var drainTime = 10 * time.Minute
 
 func newHarness(t *testing.T) *harness {
+	return newHarnessWithPolicy(t, func(ctx context.Context, h *harness) AdmissionPolicy {
+		return newMemoryPolicy(ctx, h.getUsage, drainTime, h.metrics)
+	})
+}
+
+func newHarnessWithPolicy(t *testing.T, policy func(context.Context, *harness) AdmissionPolicy) *harness {
 	C := make(chan time.Time)
-	h := &harness{t, C, 0, make(chan Update), make(chan int, 10000), 1, sync.Mutex{}, 0, time.Now()}
+	h := &harness{t, C, 0, make(chan Update), make(chan int, 10000), 1, sync.Mutex{}, 0, time.Now(), NewUpdaterMetrics()}
+	ctx := dlog.NewTestContext(t, false)
+	p := policy(ctx, h)
 	go func() {
-		assert.NoError(t, updaterWithTicker(dlog.NewTestContext(t, false), h.updates, h.getUsage, drainTime, &time.Ticker{C: C}, h.time))
+		assert.NoError(t, updaterWithTicker(ctx, h.updates, p, &time.Ticker{C: C}, h.time, h.metrics))
 	}()
 	return h
 }
@@ -194,3 +206,43 @@ func TestConstrained(t *testing.T) {
 	}
 	h.expectUntil(6000)
 }
+
+// Check that the metrics say what the Updater did with the updates it got.
+func TestUpdaterMetrics(t *testing.T) {
+	h := newHarness(t)
+
+	// Above 90% memory usage only one update gets through before we're throttled; the rest get
+	// coalesced into the last one.
+	h.setUsage(95)
+	for i := 0; i < 10; i++ {
+		h.update(0)
+	}
+	h.expectExact(1)
+	h.expectNone()
+	h.tick(time.Minute)
+	h.expectNone()
+	h.tick(drainTime)
+	h.expectExact(10)
+
+	var out strings.Builder
+	h.metrics.WriteMetrics(&out)
+	text := out.String()
+	for _, line := range []string{
+		`ambex_updates_total{outcome="queued"} 10`,
+		`ambex_updates_total{outcome="coalesced"} 8`,
+		`ambex_updates_total{outcome="dropped"} 0`,
+		`ambex_updates_total{outcome="applied"} 2`,
+		`ambex_update_pending 0`,
+		`ambex_drain_time_seconds 600`,
+		`ambex_memory_usage_percent 95`,
+		`ambex_stale_reconfigs_max 1`,
+		`ambex_ratelimiter_disabled 0`,
+		`ambex_update_wait_seconds_bucket{le="0.1"} 1`,
+		`ambex_update_wait_seconds_bucket{le="600"} 1`,
+		`ambex_update_wait_seconds_bucket{le="1200"} 2`,
+		`ambex_update_wait_seconds_count 2`,
+	} {
+		assert.Contains(t, text, line+"\n")
+	}
+	assert.Regexp(t, `(?m)^ambex_updates_throttled_total [1-9][0-9]*$`, text)
+}
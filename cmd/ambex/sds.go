@@ -0,0 +1,93 @@
+package ambex
+
+import (
+	"google.golang.org/protobuf/proto"
+
+	v2auth "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/auth"
+	v2core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+)
+
+// Secrets are served over SDS, rather than being inlined in the listeners and clusters that use
+// them, so that rotating a certificate only changes the Secret: the listener stays exactly the
+// same, and Envoy doesn't drain its connections.
+//
+// Everything that shows snapshots to humans (the ambex-N.json files, the debug API, error
+// messages) shows secrets with their private parts redacted.
+
+const redacted = "[REDACTED]"
+
+func redactDataSourceV2(ds *v2core.DataSource) {
+	switch ds.GetSpecifier().(type) {
+	case *v2core.DataSource_InlineBytes, *v2core.DataSource_InlineString:
+		ds.Specifier = &v2core.DataSource_InlineString{InlineString: redacted}
+	}
+}
+
+func redactDataSourceV3(ds *v3core.DataSource) {
+	switch ds.GetSpecifier().(type) {
+	case *v3core.DataSource_InlineBytes, *v3core.DataSource_InlineString:
+		ds.Specifier = &v3core.DataSource_InlineString{InlineString: redacted}
+	}
+}
+
+// redactSecretV2 returns a copy of a V2 Secret without its private keys, passwords, and session
+// ticket keys. Filenames are left alone: they aren't secret.
+func redactSecretV2(secret *v2auth.Secret) *v2auth.Secret {
+	secret = proto.Clone(secret).(*v2auth.Secret)
+	if cert := secret.GetTlsCertificate(); cert != nil {
+		redactDataSourceV2(cert.PrivateKey)
+		redactDataSourceV2(cert.Password)
+	}
+	for _, key := range secret.GetSessionTicketKeys().GetKeys() {
+		redactDataSourceV2(key)
+	}
+	return secret
+}
+
+// redactSecretV3 returns a copy of a V3 Secret without its private keys, passwords, session ticket
+// keys, and generic secrets. Filenames are left alone: they aren't secret.
+func redactSecretV3(secret *v3tls.Secret) *v3tls.Secret {
+	secret = proto.Clone(secret).(*v3tls.Secret)
+	if cert := secret.GetTlsCertificate(); cert != nil {
+		redactDataSourceV3(cert.PrivateKey)
+		redactDataSourceV3(cert.Password)
+	}
+	for _, key := range secret.GetSessionTicketKeys().GetKeys() {
+		redactDataSourceV3(key)
+	}
+	redactDataSourceV3(secret.GetGenericSecret().GetSecret())
+	return secret
+}
+
+// redactResource redacts a resource if it's a Secret.
+func redactResource(res ecp_cache_types.Resource) ecp_cache_types.Resource {
+	switch secret := res.(type) {
+	case *v2auth.Secret:
+		return redactSecretV2(secret)
+	case *v3tls.Secret:
+		return redactSecretV3(secret)
+	default:
+		return res
+	}
+}
+
+func redactSecretsV2(secrets ecp_v2_cache.Resources) ecp_v2_cache.Resources {
+	result := ecp_v2_cache.Resources{Version: secrets.Version, Items: make(map[string]ecp_cache_types.Resource, len(secrets.Items))}
+	for name, secret := range secrets.Items {
+		result.Items[name] = redactSecretV2(secret.(*v2auth.Secret))
+	}
+	return result
+}
+
+func redactSecretsV3(secrets ecp_v3_cache.Resources) ecp_v3_cache.Resources {
+	result := ecp_v3_cache.Resources{Version: secrets.Version, Items: make(map[string]ecp_cache_types.Resource, len(secrets.Items))}
+	for name, secret := range secrets.Items {
+		result.Items[name] = redactSecretV3(secret.(*v3tls.Secret))
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package ambex
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	v3discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	ecp_v3_server "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/server/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+func testSecret(name, cert, key string) *v3tls.Secret {
+	return &v3tls.Secret{
+		Name: name,
+		Type: &v3tls.Secret_TlsCertificate{TlsCertificate: &v3tls.TlsCertificate{
+			CertificateChain: &v3core.DataSource{Specifier: &v3core.DataSource_InlineString{InlineString: cert}},
+			PrivateKey:       &v3core.DataSource{Specifier: &v3core.DataSource_InlineString{InlineString: key}},
+		}},
+	}
+}
+
+func TestSDS(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+
+	// A listener that gets its certificate over SDS...
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "listener.json"), []byte(`{
+		"@type": "/envoy.config.listener.v3.Listener",
+		"name": "https",
+		"address": {"socket_address": {"address": "0.0.0.0", "port_value": 8443}},
+		"filter_chains": [{
+			"transport_socket": {
+				"name": "envoy.transport_sockets.tls",
+				"typed_config": {
+					"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+					"common_tls_context": {
+						"tls_certificate_sds_secret_configs": [
+							{"name": "disk.default", "sds_config": {"ads": {}, "resource_api_version": "V3"}},
+							{"name": "fastpath.default", "sds_config": {"ads": {}, "resource_api_version": "V3"}}
+						]
+					}
+				}
+			}
+		}]
+	}`), 0600))
+	// ...and one of the secrets, on disk.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{
+		"@type": "/envoy.extensions.transport_sockets.tls.v3.Secret",
+		"name": "disk.default",
+		"tls_certificate": {
+			"certificate_chain": {"inline_string": "DISK CERT"},
+			"private_key": {"inline_string": "DISK KEY"}
+		}
+	}`), 0600))
+
+	rs := loadResources(ctx, []string{dir})
+	build := func(version string, secrets ...*v3tls.Secret) *ecp_v3_cache.Snapshot {
+		_, snapshot, err := buildSnapshots(ctx, version, rs, nil, nil, &FastpathSnapshot{Secrets: secrets})
+		require.NoError(t, err)
+		return snapshot
+	}
+
+	// The other secret comes from the fastpath, and then the snapshot passes validation.
+	v1 := build("v1")
+	assert.Len(t, validateSnapshotV3(v1, rs.sources), 1)
+	v1 = build("v1", testSecret("fastpath.default", "CERT 1", "KEY 1"))
+	assert.Empty(t, validateSnapshotV3(v1, rs.sources))
+	assert.Len(t, v1.GetResources(ecp_v3_resource.SecretType), 2)
+
+	// Envoy can get the secrets over SDS.
+	configv3 := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, nil)
+	require.NoError(t, configv3.SetSnapshot(DefaultNodeGroup, *v1))
+	resp, err := ecp_v3_server.NewServer(ctx, configv3, nil).FetchSecrets(context.Background(), &v3discovery.DiscoveryRequest{
+		Node:          &v3core.Node{Id: DefaultNodeGroup},
+		ResourceNames: []string{"fastpath.default"},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Resources, 1)
+	var secret v3tls.Secret
+	require.NoError(t, resp.Resources[0].UnmarshalTo(&secret))
+	assert.Equal(t, "KEY 1", secret.GetTlsCertificate().GetPrivateKey().GetInlineString())
+
+	// Rotating a certificate only changes the secret, not the listener that uses it.
+	v2 := build("v2", testSecret("fastpath.default", "CERT 2", "KEY 2"))
+	diff := DiffSnapshots(
+		&combinedSnapshot{Version: "v1", V3: NewV3ExpandedSnapshot(v1)},
+		&combinedSnapshot{Version: "v2", V3: NewV3ExpandedSnapshot(v2)},
+	)
+	require.Len(t, diff.Resources, 1)
+	assert.Equal(t, ResourceDiff{API: "v3", Type: "secrets", Name: "fastpath.default", Change: Modified, Fields: []FieldDiff{
+		{Path: "tls_certificate.certificate_chain.inline_string", Old: json.RawMessage(`"CERT 1"`), New: json.RawMessage(`"CERT 2"`)},
+	}}, diff.Resources[0])
+
+	// Private keys never make it into the snapshots that we show people.
+	bs, err := json.Marshal(NewV3ExpandedSnapshot(v2))
+	require.NoError(t, err)
+	assert.NotContains(t, string(bs), "KEY 2")
+	assert.NotContains(t, string(bs), "DISK KEY")
+	assert.Contains(t, string(bs), "CERT 2")
+	assert.Equal(t, "KEY 2", v2.GetResources(ecp_v3_resource.SecretType)["fastpath.default"].(*v3tls.Secret).GetTlsCertificate().GetPrivateKey().GetInlineString())
+}
@@ -0,0 +1,371 @@
+package ambex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	protoV1 "github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+)
+
+// A ChangeKind says what happened to a resource between two snapshots.
+type ChangeKind string
+
+const (
+	Added    ChangeKind = "added"
+	Removed  ChangeKind = "removed"
+	Modified ChangeKind = "modified"
+)
+
+// A SnapshotDiff is what changed between two snapshots.
+type SnapshotDiff struct {
+	From      string         `json:"from"`
+	To        string         `json:"to"`
+	Resources []ResourceDiff `json:"resources"`
+}
+
+// A ResourceDiff is what happened to one resource between two snapshots.
+type ResourceDiff struct {
+	API    string     `json:"api"`  // "v2" or "v3"
+	Type   string     `json:"type"` // "clusters", "listeners", etc.
+	Name   string     `json:"name"`
+	Change ChangeKind `json:"change"`
+
+	// Fields are the fields that changed in a modified resource.
+	Fields []FieldDiff `json:"fields,omitempty"`
+
+	// Drain, if set, says why the change makes Envoy drain a listener's connections.
+	Drain string `json:"drain,omitempty"`
+}
+
+// A FieldDiff is a change to one field of a resource. Old and New are the JSON of the field's value
+// before and after, and are empty if the field wasn't set before or isn't set after.
+type FieldDiff struct {
+	Path string          `json:"path"`
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+// DiffSnapshots compares two combinedSnapshots.
+func DiffSnapshots(from, to *combinedSnapshot) *SnapshotDiff {
+	diff := &SnapshotDiff{From: from.Version, To: to.Version, Resources: []ResourceDiff{}}
+	for _, api := range []struct {
+		name     string
+		from, to []expandedField
+	}{
+		{"v2", from.V2.fields(), to.V2.fields()},
+		{"v3", from.V3.fields(), to.V3.fields()},
+	} {
+		for i, field := range api.from {
+			diff.Resources = append(diff.Resources, DiffResources(api.name, field.name, *field.items, *api.to[i].items)...)
+		}
+	}
+	return diff
+}
+
+// DiffResources compares two sets of resources of the same type, indexed by name.
+func DiffResources(api, typeName string, from, to map[string]ecp_cache_types.Resource) []ResourceDiff {
+	var names []string
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, ok := from[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var diffs []ResourceDiff
+	for _, name := range names {
+		old, inFrom := from[name]
+		res, inTo := to[name]
+		diff := ResourceDiff{API: api, Type: typeName, Name: name}
+		switch {
+		case !inTo:
+			diff.Change = Removed
+		case !inFrom:
+			diff.Change = Added
+		default:
+			diff.Fields = DiffMessages(protoV1.MessageV2(redactResource(old)), protoV1.MessageV2(redactResource(res)))
+			if len(diff.Fields) == 0 {
+				continue
+			}
+			diff.Change = Modified
+		}
+		if typeName == "listeners" {
+			diff.Drain = listenerDrain(diff)
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs
+}
+
+// listenerDrain says why a change to a listener makes Envoy drain its connections, if it does.
+func listenerDrain(diff ResourceDiff) string {
+	switch diff.Change {
+	case Added:
+		return ""
+	case Removed:
+		return "the listener was removed, so all of its connections are drained"
+	}
+	filterChainsOnly := true
+	for _, field := range diff.Fields {
+		if strings.Contains(field.Path, ".route_config") {
+			return "an inline route configuration changed, so the whole listener is drained (use RDS to avoid this)"
+		}
+		if !strings.HasPrefix(field.Path, "filter_chains") && !strings.HasPrefix(field.Path, "default_filter_chain") {
+			filterChainsOnly = false
+		}
+	}
+	if filterChainsOnly {
+		return "filter chains changed, so the connections on the changed filter chains are drained"
+	}
+	return "the listener changed, so the whole listener is drained"
+}
+
+// DiffMessages compares two messages of the same type field by field. Messages inside an Any are
+// compared field by field too, if their type is known.
+func DiffMessages(from, to proto.Message) []FieldDiff {
+	var diffs []FieldDiff
+	diffMessage("", from.ProtoReflect(), to.ProtoReflect(), &diffs)
+	return diffs
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func diffMessage(path string, from, to protoreflect.Message, diffs *[]FieldDiff) {
+	if from.Descriptor().FullName() != to.Descriptor().FullName() {
+		*diffs = append(*diffs, FieldDiff{Path: path, Old: messageJSON(from), New: messageJSON(to)})
+		return
+	}
+
+	if fromAny, ok := from.Interface().(*anypb.Any); ok {
+		toAny := to.Interface().(*anypb.Any)
+		fromMsg, fromErr := fromAny.UnmarshalNew()
+		toMsg, toErr := toAny.UnmarshalNew()
+		if fromErr == nil && toErr == nil {
+			diffMessage(path, fromMsg.ProtoReflect(), toMsg.ProtoReflect(), diffs)
+			return
+		}
+		// We don't know the type, so we can only compare the bytes.
+	}
+
+	fields := from.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		fieldPath := joinPath(path, string(fd.Name()))
+		hasFrom, hasTo := from.Has(fd), to.Has(fd)
+		switch {
+		case !hasFrom && !hasTo:
+			continue
+		case !hasFrom:
+			*diffs = append(*diffs, FieldDiff{Path: fieldPath, New: fieldJSON(fd, to.Get(fd))})
+		case !hasTo:
+			*diffs = append(*diffs, FieldDiff{Path: fieldPath, Old: fieldJSON(fd, from.Get(fd))})
+		case fd.IsList():
+			diffList(fieldPath, fd, from.Get(fd).List(), to.Get(fd).List(), diffs)
+		case fd.IsMap():
+			diffMap(fieldPath, fd, from.Get(fd).Map(), to.Get(fd).Map(), diffs)
+		case fd.Message() != nil:
+			diffMessage(fieldPath, from.Get(fd).Message(), to.Get(fd).Message(), diffs)
+		default:
+			diffValue(fieldPath, fd, from.Get(fd), to.Get(fd), diffs)
+		}
+	}
+}
+
+func diffValue(path string, fd protoreflect.FieldDescriptor, from, to protoreflect.Value, diffs *[]FieldDiff) {
+	if fd.Message() != nil {
+		diffMessage(path, from.Message(), to.Message(), diffs)
+		return
+	}
+	equal := false
+	if fd.Kind() == protoreflect.BytesKind {
+		equal = bytes.Equal(from.Bytes(), to.Bytes())
+	} else {
+		equal = from.Interface() == to.Interface()
+	}
+	if !equal {
+		*diffs = append(*diffs, FieldDiff{Path: path, Old: valueJSON(fd, from), New: valueJSON(fd, to)})
+	}
+}
+
+func diffList(path string, fd protoreflect.FieldDescriptor, from, to protoreflect.List, diffs *[]FieldDiff) {
+	for i := 0; i < from.Len() || i < to.Len(); i++ {
+		elemPath := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= to.Len():
+			*diffs = append(*diffs, FieldDiff{Path: elemPath, Old: valueJSON(fd, from.Get(i))})
+		case i >= from.Len():
+			*diffs = append(*diffs, FieldDiff{Path: elemPath, New: valueJSON(fd, to.Get(i))})
+		default:
+			diffValue(elemPath, fd, from.Get(i), to.Get(i), diffs)
+		}
+	}
+}
+
+func diffMap(path string, fd protoreflect.FieldDescriptor, from, to protoreflect.Map, diffs *[]FieldDiff) {
+	var keys []protoreflect.MapKey
+	from.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, k)
+		return true
+	})
+	to.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		if !from.Has(k) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	valueFd := fd.MapValue()
+	for _, k := range keys {
+		elemPath := fmt.Sprintf("%s[%s]", path, k.String())
+		switch {
+		case !to.Has(k):
+			*diffs = append(*diffs, FieldDiff{Path: elemPath, Old: valueJSON(valueFd, from.Get(k))})
+		case !from.Has(k):
+			*diffs = append(*diffs, FieldDiff{Path: elemPath, New: valueJSON(valueFd, to.Get(k))})
+		default:
+			diffValue(elemPath, valueFd, from.Get(k), to.Get(k), diffs)
+		}
+	}
+}
+
+func messageJSON(m protoreflect.Message) json.RawMessage {
+	bs, err := protojsonOptions.Marshal(m.Interface())
+	if err != nil {
+		bs, _ = json.Marshal(err.Error())
+	}
+	return bs
+}
+
+// fieldJSON returns the JSON of a whole field, which may be a list or a map.
+func fieldJSON(fd protoreflect.FieldDescriptor, v protoreflect.Value) json.RawMessage {
+	switch {
+	case fd.IsList():
+		var elems []json.RawMessage
+		for i := 0; i < v.List().Len(); i++ {
+			elems = append(elems, valueJSON(fd, v.List().Get(i)))
+		}
+		bs, _ := json.Marshal(elems)
+		return bs
+	case fd.IsMap():
+		elems := map[string]json.RawMessage{}
+		v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			elems[k.String()] = valueJSON(fd.MapValue(), v)
+			return true
+		})
+		bs, _ := json.Marshal(elems)
+		return bs
+	default:
+		return valueJSON(fd, v)
+	}
+}
+
+// valueJSON returns the JSON of a single value of a field.
+func valueJSON(fd protoreflect.FieldDescriptor, v protoreflect.Value) json.RawMessage {
+	var x interface{}
+	switch {
+	case fd.Message() != nil:
+		return messageJSON(v.Message())
+	case fd.Enum() != nil:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			x = string(ev.Name())
+		} else {
+			x = int32(v.Enum())
+		}
+	default:
+		x = v.Interface()
+	}
+	bs, err := json.Marshal(x)
+	if err != nil {
+		bs, _ = json.Marshal(fmt.Sprint(x))
+	}
+	return bs
+}
+
+// WriteText writes a SnapshotDiff for humans to read.
+func (d *SnapshotDiff) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", d.From, d.To)
+	for _, res := range d.Resources {
+		fmt.Fprintf(w, "%s %s %q: %s\n", res.API, res.Type, res.Name, res.Change)
+		if res.Drain != "" {
+			fmt.Fprintf(w, "    DRAIN: %s\n", res.Drain)
+		}
+		for _, field := range res.Fields {
+			old, new := string(field.Old), string(field.New)
+			if old == "" {
+				old = "(unset)"
+			}
+			if new == "" {
+				new = "(unset)"
+			}
+			fmt.Fprintf(w, "    %s: %s -> %s\n", field.Path, old, new)
+		}
+	}
+}
+
+// DiffMain is the ambex-diff command, which shows what changed between two snapshots that ambex
+// wrote. Each snapshot is either the path to an ambex-N.json file, or just N.
+func DiffMain(ctx context.Context, Version string, rawArgs ...string) error {
+	return diffMain(os.Stdout, rawArgs...)
+}
+
+func diffMain(stdout io.Writer, rawArgs ...string) error {
+	flagset := flag.NewFlagSet("ambex-diff", flag.ContinueOnError)
+	jsonOutput := flagset.Bool("json", false, "Write the diff as JSON")
+	snapdirPath := flagset.String("snapdir", defaultSnapdirPath(), "Directory to find ambex-N.json in, for snapshots given as just N")
+	flagset.Usage = func() {
+		fmt.Fprintf(flagset.Output(), "Usage: ambex-diff [flags] FROM TO\n\nFROM and TO are ambex-N.json files, or just N.\n\n")
+		flagset.PrintDefaults()
+	}
+	if err := flagset.Parse(rawArgs); err != nil {
+		return err
+	}
+	if flagset.NArg() != 2 {
+		flagset.Usage()
+		return fmt.Errorf("expected 2 snapshots, got %d", flagset.NArg())
+	}
+
+	var snapshots []*combinedSnapshot
+	for _, arg := range flagset.Args() {
+		filename := arg
+		if _, err := strconv.Atoi(arg); err == nil {
+			filename = filepath.Join(*snapdirPath, fmt.Sprintf("ambex-%s.json", arg))
+		}
+		snapshot, err := LoadSnapshotFile(filename)
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	diff := DiffSnapshots(snapshots[0], snapshots[1])
+	if *jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	diff.WriteText(stdout)
+	return nil
+}
@@ -0,0 +1,176 @@
+package ambex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	v3clusterconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	v3listenerconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	v3routeconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
+	v3httpman "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/http_connection_manager/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+// testListener makes a listener with one filter chain per server name, each with an HTTP
+// connection manager that has an inline route configuration.
+func testListener(t *testing.T, name string, routeName string, serverNames ...string) *v3listenerconfig.Listener {
+	listener := &v3listenerconfig.Listener{Name: name}
+	for _, serverName := range serverNames {
+		hcm, err := anypb.New(&v3httpman.HttpConnectionManager{
+			StatPrefix: serverName,
+			RouteSpecifier: &v3httpman.HttpConnectionManager_RouteConfig{
+				RouteConfig: &v3routeconfig.RouteConfiguration{Name: routeName},
+			},
+		})
+		require.NoError(t, err)
+		listener.FilterChains = append(listener.FilterChains, &v3listenerconfig.FilterChain{
+			FilterChainMatch: &v3listenerconfig.FilterChainMatch{ServerNames: []string{serverName}},
+			Filters: []*v3listenerconfig.Filter{{
+				Name:       "envoy.filters.network.http_connection_manager",
+				ConfigType: &v3listenerconfig.Filter_TypedConfig{TypedConfig: hcm},
+			}},
+		})
+	}
+	return listener
+}
+
+func TestDiffResources(t *testing.T) {
+	from := map[string]ecp_cache_types.Resource{
+		"a": &v3clusterconfig.Cluster{Name: "a", LbPolicy: v3clusterconfig.Cluster_ROUND_ROBIN},
+		"b": &v3clusterconfig.Cluster{Name: "b"},
+		"c": &v3clusterconfig.Cluster{Name: "c"},
+	}
+	to := map[string]ecp_cache_types.Resource{
+		"a": &v3clusterconfig.Cluster{Name: "a", LbPolicy: v3clusterconfig.Cluster_LEAST_REQUEST, AltStatName: "alt"},
+		"b": &v3clusterconfig.Cluster{Name: "b"},
+		"d": &v3clusterconfig.Cluster{Name: "d"},
+	}
+	assert.Equal(t, []ResourceDiff{
+		{API: "v3", Type: "clusters", Name: "a", Change: Modified, Fields: []FieldDiff{
+			{Path: "alt_stat_name", New: json.RawMessage(`"alt"`)},
+			{Path: "lb_policy", New: json.RawMessage(`"LEAST_REQUEST"`)},
+		}},
+		{API: "v3", Type: "clusters", Name: "c", Change: Removed},
+		{API: "v3", Type: "clusters", Name: "d", Change: Added},
+	}, DiffResources("v3", "clusters", from, to))
+}
+
+func TestListenerDrain(t *testing.T) {
+	diff := func(from, to *v3listenerconfig.Listener) []ResourceDiff {
+		fromMap := map[string]ecp_cache_types.Resource{}
+		toMap := map[string]ecp_cache_types.Resource{}
+		if from != nil {
+			fromMap[from.Name] = from
+		}
+		if to != nil {
+			toMap[to.Name] = to
+		}
+		return DiffResources("v3", "listeners", fromMap, toMap)
+	}
+
+	// Nothing changed, nothing drains.
+	assert.Empty(t, diff(testListener(t, "l", "r", "a.example.com"), testListener(t, "l", "r", "a.example.com")))
+
+	// Adding a listener doesn't drain anything...
+	diffs := diff(nil, testListener(t, "l", "r", "a.example.com"))
+	require.Len(t, diffs, 1)
+	assert.Empty(t, diffs[0].Drain)
+
+	// ...but removing one does.
+	diffs = diff(testListener(t, "l", "r", "a.example.com"), nil)
+	require.Len(t, diffs, 1)
+	assert.Contains(t, diffs[0].Drain, "removed")
+
+	// Adding a filter chain only drains filter chains, and the diff looks inside the Any.
+	diffs = diff(testListener(t, "l", "r", "a.example.com"), testListener(t, "l", "r", "a.example.com", "b.example.com"))
+	require.Len(t, diffs, 1)
+	assert.Contains(t, diffs[0].Drain, "filter chains")
+	require.Len(t, diffs[0].Fields, 1)
+	assert.Equal(t, "filter_chains[1]", diffs[0].Fields[0].Path)
+
+	// Changing an inline route configuration drains the whole listener.
+	diffs = diff(testListener(t, "l", "r", "a.example.com"), testListener(t, "l", "r2", "a.example.com"))
+	require.Len(t, diffs, 1)
+	assert.Contains(t, diffs[0].Drain, "RDS")
+	require.Len(t, diffs[0].Fields, 1)
+	assert.Equal(t, "filter_chains[0].filters[0].typed_config.route_config.name", diffs[0].Fields[0].Path)
+	assert.JSONEq(t, `"r"`, string(diffs[0].Fields[0].Old))
+	assert.JSONEq(t, `"r2"`, string(diffs[0].Fields[0].New))
+
+	// Changing anything else drains the whole listener.
+	changed := testListener(t, "l", "r", "a.example.com")
+	changed.ContinueOnListenerFiltersTimeout = true
+	diffs = diff(testListener(t, "l", "r", "a.example.com"), changed)
+	require.Len(t, diffs, 1)
+	assert.Contains(t, diffs[0].Drain, "whole listener")
+}
+
+func TestSnapshotDeltas(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+
+	snapshots := []ecp_v3_cache.Snapshot{
+		ecp_v3_cache.NewSnapshot("v1", nil,
+			[]ecp_cache_types.Resource{&v3clusterconfig.Cluster{Name: "a"}, &v3clusterconfig.Cluster{Name: "b"}},
+			nil, []ecp_cache_types.Resource{testListener(t, "l", "r", "a.example.com")}, nil),
+		ecp_v3_cache.NewSnapshot("v2", nil,
+			[]ecp_cache_types.Resource{&v3clusterconfig.Cluster{Name: "a", AltStatName: "alt"}, &v3clusterconfig.Cluster{Name: "b"}},
+			nil, []ecp_cache_types.Resource{testListener(t, "l", "r", "a.example.com")}, nil),
+		ecp_v3_cache.NewSnapshot("v3", nil,
+			[]ecp_cache_types.Resource{&v3clusterconfig.Cluster{Name: "c"}},
+			nil, nil, nil),
+	}
+	v2snap := ecp_v2_cache.NewSnapshot("v0", nil, nil, nil, nil, nil)
+	for i := range snapshots {
+		csDump(ctx, dir, 10, true, i+1, &v2snap, &snapshots[i])
+	}
+
+	// Only the newest snapshot is whole.
+	for n, delta := range map[int]bool{1: false, 2: true, 3: true} {
+		raw, err := readRawSnapshotFile(filepath.Join(dir, fmt.Sprintf("ambex-%d.json", n)))
+		require.NoError(t, err)
+		assert.Equal(t, delta, raw.Delta, "ambex-%d.json", n)
+	}
+
+	// The unchanged listener isn't repeated in the delta between v2 and v1.
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "ambex-3.json"))
+	require.NoError(t, err)
+	var raw rawSnapshotFile
+	require.NoError(t, json.Unmarshal(bs, &raw))
+	assert.Empty(t, raw.V3["listeners"].Items)
+	assert.Contains(t, raw.V3["clusters"].Items, "a")
+	assert.NotContains(t, raw.V3["clusters"].Items, "b")
+
+	// Every snapshot can still be loaded whole.
+	for n, snapshot := range map[int]*ecp_v3_cache.Snapshot{1: &snapshots[2], 2: &snapshots[1], 3: &snapshots[0]} {
+		cs, err := LoadSnapshotFile(filepath.Join(dir, fmt.Sprintf("ambex-%d.json", n)))
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("v%d", 4-n), cs.Version)
+		assert.Empty(t, DiffSnapshots(&combinedSnapshot{
+			Version: cs.Version,
+			V2:      NewV2ExpandedSnapshot(&v2snap),
+			V3:      NewV3ExpandedSnapshot(snapshot),
+		}, cs).Resources, "ambex-%d.json", n)
+	}
+
+	// And ambex-diff can diff them.
+	var out bytes.Buffer
+	require.NoError(t, diffMain(&out, "--json", "--snapdir", dir, "3", "1"))
+	var diff SnapshotDiff
+	require.NoError(t, json.Unmarshal(out.Bytes(), &diff))
+	assert.Equal(t, "v1", diff.From)
+	assert.Equal(t, "v3", diff.To)
+	assert.Len(t, diff.Resources, 4)
+	assert.Error(t, diffMain(&out, "--snapdir", dir, "3", "7"))
+}
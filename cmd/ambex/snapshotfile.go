@@ -0,0 +1,302 @@
+package ambex
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	protoV1 "github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	v2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
+	v2auth "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/auth"
+	v3clusterconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	v3endpointconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/endpoint/v3"
+	v3listenerconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	v3routeconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	v2discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v2"
+	v3runtime "github.com/datawire/ambassador/v2/pkg/api/envoy/service/runtime/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+)
+
+// The ambex-N.json files that csDump writes used to be marshaled with encoding/json, which
+// doesn't know how to unmarshal protobufs again. Now each resource is marshaled with protojson (with
+// the field names from the .proto files, so the files read much like they always have), so that
+// the files can be read back, to diff them.
+
+// An expandedField is one type of resource in an expanded snapshot.
+type expandedField struct {
+	name       string
+	version    *string
+	items      *map[string]ecp_cache_types.Resource
+	newMessage func() ecp_cache_types.Resource
+}
+
+func (s *v2ExpandedSnapshot) fields() []expandedField {
+	return []expandedField{
+		{"endpoints", &s.Endpoints.Version, &s.Endpoints.Items, func() ecp_cache_types.Resource { return &v2.ClusterLoadAssignment{} }},
+		{"clusters", &s.Clusters.Version, &s.Clusters.Items, func() ecp_cache_types.Resource { return &v2.Cluster{} }},
+		{"routes", &s.Routes.Version, &s.Routes.Items, func() ecp_cache_types.Resource { return &v2.RouteConfiguration{} }},
+		{"listeners", &s.Listeners.Version, &s.Listeners.Items, func() ecp_cache_types.Resource { return &v2.Listener{} }},
+		{"runtimes", &s.Runtimes.Version, &s.Runtimes.Items, func() ecp_cache_types.Resource { return &v2discovery.Runtime{} }},
+		{"secrets", &s.Secrets.Version, &s.Secrets.Items, func() ecp_cache_types.Resource { return &v2auth.Secret{} }},
+	}
+}
+
+func (s *v3ExpandedSnapshot) fields() []expandedField {
+	return []expandedField{
+		{"endpoints", &s.Endpoints.Version, &s.Endpoints.Items, func() ecp_cache_types.Resource { return &v3endpointconfig.ClusterLoadAssignment{} }},
+		{"clusters", &s.Clusters.Version, &s.Clusters.Items, func() ecp_cache_types.Resource { return &v3clusterconfig.Cluster{} }},
+		{"routes", &s.Routes.Version, &s.Routes.Items, func() ecp_cache_types.Resource { return &v3routeconfig.RouteConfiguration{} }},
+		{"listeners", &s.Listeners.Version, &s.Listeners.Items, func() ecp_cache_types.Resource { return &v3listenerconfig.Listener{} }},
+		{"runtimes", &s.Runtimes.Version, &s.Runtimes.Items, func() ecp_cache_types.Resource { return &v3runtime.Runtime{} }},
+		{"secrets", &s.Secrets.Version, &s.Secrets.Items, func() ecp_cache_types.Resource { return &v3tls.Secret{} }},
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s v2ExpandedSnapshot) MarshalJSON() ([]byte, error) {
+	return marshalExpanded(s.fields())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *v2ExpandedSnapshot) UnmarshalJSON(bs []byte) error {
+	return unmarshalExpanded(bs, s.fields())
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s v3ExpandedSnapshot) MarshalJSON() ([]byte, error) {
+	return marshalExpanded(s.fields())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *v3ExpandedSnapshot) UnmarshalJSON(bs []byte) error {
+	return unmarshalExpanded(bs, s.fields())
+}
+
+// rawResources is how one type of resource is written to an ambex-N.json file.
+type rawResources struct {
+	Version string                     `json:"Version"`
+	Items   map[string]json.RawMessage `json:"Items"`
+	// Removed is only used in deltas: see rawSnapshotFile.
+	Removed []string `json:"Removed,omitempty"`
+}
+
+var protojsonOptions = protojson.MarshalOptions{UseProtoNames: true}
+
+func marshalExpanded(fields []expandedField) ([]byte, error) {
+	result := map[string]rawResources{}
+	for _, field := range fields {
+		raw := rawResources{Version: *field.version, Items: map[string]json.RawMessage{}}
+		for name, res := range *field.items {
+			bs, err := protojsonOptions.Marshal(protoV1.MessageV2(res))
+			if err != nil {
+				return nil, fmt.Errorf("%s %q: %w", field.name, name, err)
+			}
+			raw.Items[name] = bs
+		}
+		result[field.name] = raw
+	}
+	return json.Marshal(result)
+}
+
+func unmarshalExpanded(bs []byte, fields []expandedField) error {
+	var raw map[string]rawResources
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		return err
+	}
+	for _, field := range fields {
+		*field.version = raw[field.name].Version
+		*field.items = map[string]ecp_cache_types.Resource{}
+		for name, item := range raw[field.name].Items {
+			res := field.newMessage()
+			if err := protojson.Unmarshal(item, protoV1.MessageV2(res)); err != nil {
+				return fmt.Errorf("%s %q: %w", field.name, name, err)
+			}
+			(*field.items)[name] = res
+		}
+	}
+	return nil
+}
+
+// rawSnapshotFile is an ambex-N.json file, without unmarshaling the resources themselves.
+//
+// When AMBASSADOR_AMBEX_SNAPSHOT_DELTAS is set, only the newest file (ambex-1.json) has the whole
+// snapshot: every older file is a delta, which only has what's different from the next newer file.
+// For each type that changed, Items has the resources that are new or different, and Removed has
+// the names of the resources that aren't there at all.
+type rawSnapshotFile struct {
+	Version string                  `json:"version"`
+	Delta   bool                    `json:"delta,omitempty"`
+	V2      map[string]rawResources `json:"v2"`
+	V3      map[string]rawResources `json:"v3"`
+}
+
+// deltaResources returns what's needed to get from the newer resources to the older ones, or nil
+// if they're the same.
+func deltaResources(newer, older rawResources) *rawResources {
+	delta := rawResources{Version: older.Version, Items: map[string]json.RawMessage{}}
+	for name, item := range older.Items {
+		if newItem, ok := newer.Items[name]; !ok || !jsonEqual(newItem, item) {
+			delta.Items[name] = item
+		}
+	}
+	for name := range newer.Items {
+		if _, ok := older.Items[name]; !ok {
+			delta.Removed = append(delta.Removed, name)
+		}
+	}
+	if len(delta.Items) == 0 && len(delta.Removed) == 0 && older.Version == newer.Version {
+		return nil
+	}
+	sort.Strings(delta.Removed)
+	return &delta
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// applyResources applies a delta from deltaResources to the newer resources.
+func applyResources(newer rawResources, delta rawResources) rawResources {
+	older := rawResources{Version: delta.Version, Items: map[string]json.RawMessage{}}
+	for name, item := range newer.Items {
+		older.Items[name] = item
+	}
+	for _, name := range delta.Removed {
+		delete(older.Items, name)
+	}
+	for name, item := range delta.Items {
+		older.Items[name] = item
+	}
+	return older
+}
+
+// deltaSnapshotFile returns the delta that gets from a full newer file to a full older file.
+func deltaSnapshotFile(newer, older *rawSnapshotFile) *rawSnapshotFile {
+	delta := &rawSnapshotFile{Version: older.Version, Delta: true, V2: map[string]rawResources{}, V3: map[string]rawResources{}}
+	for _, api := range []struct{ newer, older, delta map[string]rawResources }{
+		{newer.V2, older.V2, delta.V2},
+		{newer.V3, older.V3, delta.V3},
+	} {
+		for name, olderResources := range api.older {
+			if d := deltaResources(api.newer[name], olderResources); d != nil {
+				api.delta[name] = *d
+			}
+		}
+		for name, newerResources := range api.newer {
+			if _, ok := api.older[name]; !ok {
+				removed := rawResources{Items: map[string]json.RawMessage{}}
+				for item := range newerResources.Items {
+					removed.Removed = append(removed.Removed, item)
+				}
+				sort.Strings(removed.Removed)
+				api.delta[name] = removed
+			}
+		}
+	}
+	return delta
+}
+
+// applySnapshotFile applies a delta from deltaSnapshotFile to a full newer file.
+func applySnapshotFile(newer, delta *rawSnapshotFile) *rawSnapshotFile {
+	older := &rawSnapshotFile{Version: delta.Version, V2: map[string]rawResources{}, V3: map[string]rawResources{}}
+	for _, api := range []struct{ newer, delta, older map[string]rawResources }{
+		{newer.V2, delta.V2, older.V2},
+		{newer.V3, delta.V3, older.V3},
+	} {
+		for name, resources := range api.newer {
+			api.older[name] = resources
+		}
+		for name, d := range api.delta {
+			api.older[name] = applyResources(api.newer[name], d)
+		}
+	}
+	return older
+}
+
+func readRawSnapshotFile(filename string) (*rawSnapshotFile, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw rawSnapshotFile
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &raw, nil
+}
+
+var snapshotFileRE = regexp.MustCompile(`^ambex-([0-9]+)\.json$`)
+
+// loadRawSnapshotFile reads an ambex-N.json file, applying it to the newer files if it's a delta.
+func loadRawSnapshotFile(filename string) (*rawSnapshotFile, error) {
+	raw, err := readRawSnapshotFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !raw.Delta {
+		return raw, nil
+	}
+	match := snapshotFileRE.FindStringSubmatch(filepath.Base(filename))
+	if match == nil {
+		return nil, fmt.Errorf("%s: a snapshot delta must be named ambex-N.json, to find the newer snapshot that it applies to", filename)
+	}
+	n, _ := strconv.Atoi(match[1])
+	newer, err := loadRawSnapshotFile(filepath.Join(filepath.Dir(filename), fmt.Sprintf("ambex-%d.json", n-1)))
+	if err != nil {
+		return nil, err
+	}
+	return applySnapshotFile(newer, raw), nil
+}
+
+// LoadSnapshotFile reads an ambex-N.json file that csDump wrote. If the file is a delta, the newer
+// files in the same directory are read too.
+func LoadSnapshotFile(filename string) (*combinedSnapshot, error) {
+	raw, err := loadRawSnapshotFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var cs combinedSnapshot
+	if err := json.Unmarshal(bs, &cs); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &cs, nil
+}
+
+// csDelta replaces the previous newest snapshot, ambex-1.json, with a delta from the snapshot that
+// csDump just marshaled.
+func csDelta(snapdirPath string, newest []byte) error {
+	previousPath := filepath.Join(snapdirPath, "ambex-1.json")
+	previous, err := readRawSnapshotFile(previousPath)
+	if err != nil {
+		return err
+	}
+	if previous.Delta {
+		// Deltas must have been turned on with the previous newest snapshot already rotated.
+		return fmt.Errorf("%s is already a delta", previousPath)
+	}
+	var raw rawSnapshotFile
+	if err := json.Unmarshal(newest, &raw); err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(deltaSnapshotFile(&raw, previous), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(previousPath, bs, 0644)
+}
@@ -0,0 +1,305 @@
+package ambex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	protoV1 "github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	"github.com/datawire/dlib/dhttp"
+	"github.com/datawire/dlib/dlog"
+)
+
+// statusServer serves what we know about how Envoy is getting its configuration:
+//
+//   - /status is a JSON list of the ACK/NACK status of each Envoy node for each xDS type.
+//   - /metrics is the same thing, as Prometheus metrics, along with the Updater's metrics (see
+//     UpdaterMetrics).
+//   - /nodes is a JSON list of the node groups in the V3 snapshot cache, with the watches that
+//     their Envoys have open.
+//   - /snapshot?node=NODE&type=TYPE is the V3 resources of one type that we're currently serving
+//     to a node group (or to the group of the Envoy with that node ID), with secrets redacted.
+//   - /diff?from=GEN&to=GEN[&node=NODE][&type=TYPE] is what changed between two generations of
+//     snapshots that we still have in the snapshot history, field by field (see SnapshotDiff).
+//
+// TYPE may be a full type URL, or a short name like "clusters". GEN is a generation number, or a
+// version like "v42".
+type statusServer struct {
+	acks     *AckTracker
+	configv3 ecp_v3_cache.SnapshotCache
+	hasher   HasherV3
+	history  *snapshotHistory
+}
+
+func (s *statusServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, s.acks.Statuses())
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.acks.WriteMetrics(w)
+		updaterMetrics.WriteMetrics(w)
+	})
+	mux.HandleFunc("/nodes", s.handleNodes)
+	mux.HandleFunc("/snapshot", s.handleSnapshot)
+	mux.HandleFunc("/diff", s.handleDiff)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		dlog.Errorf(r.Context(), "Status: encode failure: %v", err)
+	}
+}
+
+// nodeStatus is one entry of the /nodes list.
+type nodeStatus struct {
+	Key                   string      `json:"key"`
+	Node                  *nodeInfo   `json:"node,omitempty"`
+	Version               string      `json:"version,omitempty"`
+	Watches               int         `json:"watches"`
+	LastWatchRequest      *time.Time  `json:"lastWatchRequest,omitempty"`
+	DeltaWatches          int         `json:"deltaWatches"`
+	LastDeltaWatchRequest *time.Time  `json:"lastDeltaWatchRequest,omitempty"`
+	Acks                  []XdsStatus `json:"acks,omitempty"`
+}
+
+// nodeInfo is the interesting part of the last Envoy node that watched a key.
+type nodeInfo struct {
+	ID       string          `json:"id"`
+	Cluster  string          `json:"cluster,omitempty"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (s *statusServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	acks := map[string][]XdsStatus{}
+	for _, st := range s.acks.Statuses() {
+		acks[st.Group] = append(acks[st.Group], st)
+	}
+
+	keys := s.configv3.GetStatusKeys()
+	sort.Strings(keys)
+	nodes := []nodeStatus{}
+	for _, key := range keys {
+		info := s.configv3.GetStatusInfo(key)
+		if info == nil {
+			continue
+		}
+		ns := nodeStatus{
+			Key:                   key,
+			Watches:               info.GetNumWatches(),
+			LastWatchRequest:      timeOrNil(info.GetLastWatchRequestTime()),
+			DeltaWatches:          info.GetNumDeltaWatches(),
+			LastDeltaWatchRequest: timeOrNil(info.GetLastDeltaWatchRequestTime()),
+			Acks:                  acks[key],
+		}
+		if node := info.GetNode(); node != nil {
+			ns.Node = &nodeInfo{ID: node.Id, Cluster: node.Cluster}
+			if node.Metadata != nil {
+				ns.Node.Metadata, _ = protojson.Marshal(node.Metadata)
+			}
+		}
+		if snapshot, err := s.configv3.GetSnapshot(key); err == nil {
+			ns.Version = snapshot.Resources[ecp_cache_types.Listener].Version
+		}
+		nodes = append(nodes, ns)
+	}
+	writeJSON(w, r, nodes)
+}
+
+// typeURLs maps the short names that the API accepts to type URLs.
+var typeURLs = map[string]string{
+	"endpoints": ecp_v3_resource.EndpointType,
+	"clusters":  ecp_v3_resource.ClusterType,
+	"routes":    ecp_v3_resource.RouteType,
+	"listeners": ecp_v3_resource.ListenerType,
+	"runtimes":  ecp_v3_resource.RuntimeType,
+	"secrets":   ecp_v3_resource.SecretType,
+}
+
+// parseTypeURLs returns the type URLs for a type parameter: just the one that it names, or all of
+// them if it's empty.
+func parseTypeURLs(name string) ([]string, error) {
+	switch {
+	case name == "":
+		var all []string
+		for _, typeURL := range typeURLs {
+			all = append(all, typeURL)
+		}
+		sort.Strings(all)
+		return all, nil
+	case typeURLs[name] != "":
+		return []string{typeURLs[name]}, nil
+	case typeURLs[name+"s"] != "":
+		return []string{typeURLs[name+"s"]}, nil
+	case ecp_v3_cache.GetResponseType(name) != ecp_cache_types.UnknownType:
+		return []string{name}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", name)
+	}
+}
+
+// snapshotKey returns the snapshot cache key for a node parameter, which may be a key itself or
+// the ID of an Envoy node.
+func (s *statusServer) snapshotKey(node string) string {
+	if node == "" {
+		return DefaultNodeGroup
+	}
+	for _, key := range s.configv3.GetStatusKeys() {
+		if key == node {
+			return key
+		}
+	}
+	if _, err := s.configv3.GetSnapshot(node); err == nil {
+		return node
+	}
+	return s.hasher.ID(&v3core.Node{Id: node})
+}
+
+// marshalResources turns resources into JSON, indexed by name, with secrets redacted.
+func marshalResources(resources map[string]ecp_cache_types.Resource) (map[string]json.RawMessage, error) {
+	result := make(map[string]json.RawMessage, len(resources))
+	for name, res := range resources {
+		bs, err := protojson.Marshal(protoV1.MessageV2(redactResource(res)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		result[name] = bs
+	}
+	return result, nil
+}
+
+func (s *statusServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	typeURLList, err := parseTypeURLs(r.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := s.snapshotKey(r.URL.Query().Get("node"))
+	snapshot, err := s.configv3.GetSnapshot(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	type typeSnapshot struct {
+		Version   string                     `json:"version"`
+		Resources map[string]json.RawMessage `json:"resources"`
+	}
+	result := map[string]typeSnapshot{}
+	for _, typeURL := range typeURLList {
+		resources, err := marshalResources(snapshot.GetResources(typeURL))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result[typeURL] = typeSnapshot{snapshot.GetVersion(typeURL), resources}
+	}
+	writeJSON(w, r, struct {
+		Key   string                  `json:"key"`
+		Types map[string]typeSnapshot `json:"types"`
+	}{key, result})
+}
+
+// typeName returns the short name for a type URL, if it has one.
+func typeName(typeURL string) string {
+	for name, url := range typeURLs {
+		if url == typeURL {
+			return name
+		}
+	}
+	return typeURL
+}
+
+func parseGeneration(gen string) (string, error) {
+	if _, err := strconv.Atoi(strings.TrimPrefix(gen, "v")); err != nil {
+		return "", fmt.Errorf("bad generation %q", gen)
+	}
+	return "v" + strings.TrimPrefix(gen, "v"), nil
+}
+
+func (s *statusServer) handleDiff(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := parseGeneration(query.Get("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseGeneration(query.Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := s.snapshotKey(query.Get("node"))
+	snapshots := map[string]*ecp_v3_cache.Snapshot{}
+	for _, version := range []string{from, to} {
+		snapshot, _, err := s.history.Get(key, version)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if snapshot == nil {
+			http.Error(w, fmt.Sprintf("no snapshot %s for %q in the snapshot history", version, key), http.StatusNotFound)
+			return
+		}
+		snapshots[version] = snapshot
+	}
+	fromSnapshot, toSnapshot := snapshots[from], snapshots[to]
+
+	typeURLList, err := parseTypeURLs(query.Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	diff := &SnapshotDiff{From: from, To: to, Resources: []ResourceDiff{}}
+	for _, typeURL := range typeURLList {
+		diff.Resources = append(diff.Resources, DiffResources("v3", typeName(typeURL), fromSnapshot.GetResources(typeURL), toSnapshot.GetResources(typeURL))...)
+	}
+	writeJSON(w, r, struct {
+		Key string `json:"key"`
+		*SnapshotDiff
+	}{key, diff})
+}
+
+// runStatusServer starts serving a statusServer at the given address.
+func runStatusServer(ctx context.Context, address string, s *statusServer) error {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	dlog.Infof(ctx, "Serving status on %s", address)
+	go func() {
+		sc := &dhttp.ServerConfig{
+			Handler: s.handler(),
+		}
+		if err := sc.Serve(ctx, lis); err != nil {
+			dlog.Errorf(ctx, "Status server exited: %v", err)
+		}
+	}()
+	return nil
+}
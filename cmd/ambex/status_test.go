@@ -0,0 +1,84 @@
+package ambex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v3clusterconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+func TestStatusServer(t *testing.T) {
+	snapshot := func(version string, clusters ...ecp_cache_types.Resource) *ecp_v3_cache.Snapshot {
+		snap := ecp_v3_cache.NewSnapshot(version, nil, clusters, nil, nil, nil)
+		return &snap
+	}
+	v1 := snapshot("v1", &v3clusterconfig.Cluster{Name: "a"}, &v3clusterconfig.Cluster{Name: "b"})
+	v2 := snapshot("v2", &v3clusterconfig.Cluster{Name: "a", AltStatName: "changed"}, &v3clusterconfig.Cluster{Name: "c"})
+
+	configv3 := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, nil)
+	require.NoError(t, configv3.SetSnapshot(DefaultNodeGroup, *v2))
+	history := newSnapshotHistory(t.TempDir(), 10, false)
+	history.Dump(dlog.NewTestContext(t, false), DefaultNodeGroup, 1, &ecp_v2_cache.Snapshot{}, v1)
+	history.Dump(dlog.NewTestContext(t, false), DefaultNodeGroup, 2, &ecp_v2_cache.Snapshot{}, v2)
+
+	server := httptest.NewServer((&statusServer{
+		acks:     NewAckTracker(HasherV3{}, nil),
+		configv3: configv3,
+		history:  history,
+	}).handler())
+	defer server.Close()
+
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	var snap struct {
+		Key   string
+		Types map[string]struct {
+			Version   string
+			Resources map[string]json.RawMessage
+		}
+	}
+	assert.Equal(t, http.StatusOK, get("/snapshot?type=clusters", &snap))
+	assert.Equal(t, DefaultNodeGroup, snap.Key)
+	assert.Len(t, snap.Types, 1)
+	clusters := snap.Types[ecp_v3_resource.ClusterType]
+	assert.Equal(t, "v2", clusters.Version)
+	assert.JSONEq(t, `{"name":"a","altStatName":"changed"}`, string(clusters.Resources["a"]))
+	assert.Contains(t, clusters.Resources, "c")
+
+	assert.Equal(t, http.StatusBadRequest, get("/snapshot?type=bogus", nil))
+
+	var diff SnapshotDiff
+	assert.Equal(t, http.StatusOK, get("/diff?from=1&to=v2", &diff))
+	require.Len(t, diff.Resources, 3)
+	assert.Equal(t, ResourceDiff{API: "v3", Type: "clusters", Name: "a", Change: Modified, Fields: []FieldDiff{
+		{Path: "alt_stat_name", New: json.RawMessage(`"changed"`)},
+	}}, diff.Resources[0])
+	assert.Equal(t, "b", diff.Resources[1].Name)
+	assert.Equal(t, Removed, diff.Resources[1].Change)
+	assert.Equal(t, "c", diff.Resources[2].Name)
+	assert.Equal(t, Added, diff.Resources[2].Change)
+
+	assert.Equal(t, http.StatusNotFound, get("/diff?from=0&to=2", nil))
+
+	var nodes []nodeStatus
+	assert.Equal(t, http.StatusOK, get("/nodes", &nodes))
+	assert.Empty(t, nodes)
+}
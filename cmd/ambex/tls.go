@@ -0,0 +1,402 @@
+package ambex
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/yaml"
+
+	v2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+// ADSTLSArgs are the files that configure TLS for the ADS listener. If CertFile is empty, the
+// listener is plaintext.
+type ADSTLSArgs struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+
+	// RequireClientCert makes Envoy present a client certificate signed by the client CA.
+	RequireClientCert bool
+
+	// NodeIdentitiesFile, if set, says which client certificate identities may use which Envoy
+	// node IDs. It implies RequireClientCert.
+	NodeIdentitiesFile string
+}
+
+func (a ADSTLSArgs) files() []string {
+	var files []string
+	for _, file := range []string{a.CertFile, a.KeyFile, a.ClientCAFile, a.NodeIdentitiesFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// NodeIdentitiesConfig is the on-disk format of the --ads-tls-node-identities file, which may be
+// either YAML or JSON. For example:
+//
+//	nodes:
+//	- id: "canary-*"
+//	  identities:
+//	  - spiffe://cluster.local/ns/canary/sa/envoy
+//	  groups:
+//	  - canary
+//	- id: "*"
+//	  identities:
+//	  - "envoy.*.svc.cluster.local"
+//
+// The identities of a client certificate are its URI and DNS subject alternative names and its
+// subject common name. A node may use a node ID if one of its identities matches one of the
+// identities of the first entry whose ID matches the node ID. Both IDs and identities may contain
+// "*", which matches any string (including "/"). A node ID that doesn't match any entry is
+// refused.
+//
+// The node's cluster and metadata aren't in its certificate, but they can select its node group
+// (see NodeGroupsConfig). So unless the entry lists the groups that the node may be in (which may
+// also contain "*"), the node must be in the same group that its node ID alone would put it in.
+type NodeIdentitiesConfig struct {
+	Nodes []NodeIdentities `json:"nodes"`
+}
+
+// NodeIdentities lists the client certificate identities that may use a node ID.
+type NodeIdentities struct {
+	ID         string   `json:"id"`
+	Identities []string `json:"identities"`
+	Groups     []string `json:"groups,omitempty"`
+}
+
+// LoadNodeIdentities reads and validates a node identities file.
+func LoadNodeIdentities(filename string) (*NodeIdentitiesConfig, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &NodeIdentitiesConfig{}
+	if err := yaml.Unmarshal(bs, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// wildcardMatch matches a value against a pattern in which "*" matches any string.
+func wildcardMatch(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// Authorize returns an error unless one of the identities may use the node ID, and the node may
+// be in the node group that it's in. idGroup is the group that the node ID alone selects.
+func (cfg *NodeIdentitiesConfig) Authorize(nodeID, group, idGroup string, identities []string) error {
+	for _, node := range cfg.Nodes {
+		if !wildcardMatch(node.ID, nodeID) {
+			continue
+		}
+		if !node.authorized(identities) {
+			return fmt.Errorf("node ID %q may not be used by %q", nodeID, identities)
+		}
+		if len(node.Groups) == 0 {
+			if group != idGroup {
+				return fmt.Errorf("node ID %q may not use its cluster or metadata to join node group %q", nodeID, group)
+			}
+			return nil
+		}
+		for _, pattern := range node.Groups {
+			if wildcardMatch(pattern, group) {
+				return nil
+			}
+		}
+		return fmt.Errorf("node ID %q may not be in node group %q", nodeID, group)
+	}
+	return fmt.Errorf("node ID %q is not allowed", nodeID)
+}
+
+func (node NodeIdentities) authorized(identities []string) bool {
+	for _, pattern := range node.Identities {
+		for _, identity := range identities {
+			if wildcardMatch(pattern, identity) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// certIdentities returns the identities of a client certificate.
+func certIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, cert.DNSNames...)
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return identities
+}
+
+// An adsTLS holds the current TLS configuration of the ADS listener, and reloads it whenever any of
+// its files change.
+type adsTLS struct {
+	args ADSTLSArgs
+	// groups, if set, are the node groups that the node identities are checked against.
+	groups *NodeGroups
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	clientCAs  *x509.CertPool
+	identities *NodeIdentitiesConfig
+}
+
+func newADSTLS(args ADSTLSArgs, groups *NodeGroups) (*adsTLS, error) {
+	if args.KeyFile == "" {
+		return nil, fmt.Errorf("a TLS certificate needs a key")
+	}
+	if args.NodeIdentitiesFile != "" {
+		args.RequireClientCert = true
+	}
+	if args.RequireClientCert && args.ClientCAFile == "" {
+		return nil, fmt.Errorf("requiring a client certificate needs a client CA")
+	}
+	t := &adsTLS{args: args, groups: groups}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// reload re-reads all the files. On error, the previous configuration remains in effect.
+func (t *adsTLS) reload() error {
+	cert, err := tls.LoadX509KeyPair(t.args.CertFile, t.args.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if t.args.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(t.args.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", t.args.ClientCAFile)
+		}
+	}
+
+	var identities *NodeIdentitiesConfig
+	if t.args.NodeIdentitiesFile != "" {
+		identities, err = LoadNodeIdentities(t.args.NodeIdentitiesFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cert = &cert
+	t.clientCAs = clientCAs
+	t.identities = identities
+	return nil
+}
+
+// watch reloads the configuration whenever any of its files change, until the context is
+// canceled. We watch the directories rather than the files themselves, since Kubernetes updates
+// mounted Secrets by swapping symlinks around.
+func (t *adsTLS) watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{}
+	for _, file := range t.args.files() {
+		dirs[filepath.Dir(file)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-watcher.Events:
+				if err := t.reload(); err != nil {
+					dlog.Errorf(ctx, "Error reloading ADS TLS configuration, keeping the previous one: %v", err)
+				} else {
+					dlog.Infof(ctx, "Reloaded ADS TLS configuration")
+				}
+			case err := <-watcher.Errors:
+				dlog.Warnf(ctx, "ADS TLS watcher error: %v", err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *adsTLS) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.cert, nil
+}
+
+// Config returns the tls.Config for the ADS listener. Every handshake uses the configuration
+// that's current at the time.
+func (t *adsTLS) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: t.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: t.getCertificate,
+				NextProtos:     []string{"h2"},
+				ClientCAs:      t.clientCAs,
+			}
+			switch {
+			case t.args.RequireClientCert:
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			case t.clientCAs != nil:
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// authorize checks that the client certificate on a stream may use the node that Envoy sent. A nil
+// node is checked as the empty node ID.
+func (t *adsTLS) authorize(ctx context.Context, node *v3core.Node) error {
+	t.mu.RLock()
+	identities := t.identities
+	t.mu.RUnlock()
+	if identities == nil {
+		return nil
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "no peer")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return status.Error(codes.Unauthenticated, "no client certificate")
+	}
+	var groups *NodeGroupsConfig
+	if t.groups != nil {
+		groups = t.groups.Config()
+	}
+	group := groups.Group(node.GetId(), node.GetCluster(), node.GetMetadata())
+	idGroup := groups.Group(node.GetId(), "", nil)
+	if err := identities.Authorize(node.GetId(), group, idGroup, certIdentities(tlsInfo.State.PeerCertificates[0])); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// UnaryInterceptor returns a gRPC interceptor that refuses any xDS fetch whose request has a node
+// ID (or a node group) that the client certificate isn't allowed to use.
+func (t *adsTLS) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := t.authorize(ctx, requestNode(req)); err != nil {
+			dlog.Errorf(ctx, "Refusing xDS fetch: %v", err)
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor returns a gRPC interceptor that refuses any xDS stream whose Envoy sends a
+// node ID (or a node group) that its client certificate isn't allowed to use.
+func (t *adsTLS) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		stream := &authorizingStream{ServerStream: ss, tls: t}
+		err := handler(srv, stream)
+		// The xDS server treats any error from RecvMsg as the end of the stream, so make sure
+		// that Envoy hears why.
+		if stream.err != nil {
+			return stream.err
+		}
+		return err
+	}
+}
+
+type authorizingStream struct {
+	grpc.ServerStream
+	tls        *adsTLS
+	authorized bool
+	err        error
+}
+
+func (s *authorizingStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	// Only the first request on a stream has to carry the node, but check it whenever it's
+	// there so that a stream can't switch to another node.
+	node := requestNode(m)
+	var err error
+	if node != nil || !s.authorized {
+		err = s.tls.authorize(s.Context(), node)
+	}
+	if err != nil {
+		dlog.Errorf(s.Context(), "Refusing ADS stream: %v", err)
+		s.err = err
+		return err
+	}
+	s.authorized = true
+	return nil
+}
+
+// requestNode returns the node of an xDS request, or nil if it doesn't have one.
+func requestNode(m interface{}) *v3core.Node {
+	switch req := m.(type) {
+	case *v3discovery.DiscoveryRequest:
+		return req.Node
+	case *v3discovery.DeltaDiscoveryRequest:
+		return req.Node
+	case *v2.DiscoveryRequest:
+		if req.Node != nil {
+			// Only the parts of the node that select its node group matter here.
+			return &v3core.Node{Id: req.Node.Id, Cluster: req.Node.Cluster, Metadata: req.Node.Metadata}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package ambex
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	v3secret "github.com/datawire/ambassador/v2/pkg/api/envoy/service/secret/v3"
+	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	ecp_v2_server "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/server/v2"
+	ecp_v3_server "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/server/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func makeTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.pem, c.keyPEM(t))
+	require.NoError(t, err)
+	return cert
+}
+
+func TestNodeIdentitiesAuthorize(t *testing.T) {
+	cfg := &NodeIdentitiesConfig{Nodes: []NodeIdentities{
+		{ID: "canary-*", Identities: []string{"spiffe://cluster.local/ns/canary/*"}, Groups: []string{"canary", "canary-*"}},
+		{ID: "*", Identities: []string{"envoy.*.svc"}},
+	}}
+	canary := []string{"spiffe://cluster.local/ns/canary/sa/envoy"}
+	envoy := []string{"envoy.default.svc"}
+	assert.NoError(t, cfg.Authorize("canary-1", "canary", DefaultNodeGroup, canary))
+	assert.NoError(t, cfg.Authorize("canary-1", "canary-east", "canary", canary))
+	assert.Error(t, cfg.Authorize("canary-1", "east", "canary", canary))
+	assert.Error(t, cfg.Authorize("canary-1", "canary", "canary", envoy))
+	assert.NoError(t, cfg.Authorize("test-id", DefaultNodeGroup, DefaultNodeGroup, envoy))
+	assert.Error(t, cfg.Authorize("test-id", DefaultNodeGroup, DefaultNodeGroup, canary))
+	assert.Error(t, (&NodeIdentitiesConfig{}).Authorize("test-id", DefaultNodeGroup, DefaultNodeGroup, envoy))
+
+	// Without any groups, the cluster and metadata mustn't move the node to another group.
+	assert.Error(t, cfg.Authorize("test-id", "canary", DefaultNodeGroup, envoy))
+}
+
+func TestADSTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	ca := makeTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	serverCert := makeTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ambex"},
+		DNSNames:    []string{"ambex"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	spiffe, err := url.Parse("spiffe://cluster.local/ns/default/sa/envoy")
+	require.NoError(t, err)
+	clientCert := makeTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "envoy"},
+		URIs:        []*url.URL{spiffe},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	dir := t.TempDir()
+	args := ADSTLSArgs{
+		CertFile:           filepath.Join(dir, "tls.crt"),
+		KeyFile:            filepath.Join(dir, "tls.key"),
+		ClientCAFile:       filepath.Join(dir, "ca.crt"),
+		NodeIdentitiesFile: filepath.Join(dir, "identities.yaml"),
+	}
+	require.NoError(t, ioutil.WriteFile(args.CertFile, serverCert.pem, 0600))
+	require.NoError(t, ioutil.WriteFile(args.KeyFile, serverCert.keyPEM(t), 0600))
+	require.NoError(t, ioutil.WriteFile(args.ClientCAFile, ca.pem, 0600))
+	require.NoError(t, ioutil.WriteFile(args.NodeIdentitiesFile, []byte(`
+nodes:
+- id: test-id
+  identities:
+  - spiffe://cluster.local/ns/default/sa/envoy
+`), 0600))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := lis.Addr().String()
+	require.NoError(t, lis.Close())
+
+	configv3 := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, nil)
+	require.NoError(t, configv3.SetSnapshot("test-id", ecp_v3_cache.NewSnapshot("v1", nil, nil, nil, nil, nil)))
+	server := ecp_v2_server.NewServer(ctx, ecp_v2_cache.NewSnapshotCache(true, HasherV2{}, nil), nil)
+	serverv3 := ecp_v3_server.NewServer(ctx, configv3, nil)
+	nodeGroups := NewNodeGroups(writeNodeGroups(t, `
+groups:
+- name: east
+  match:
+    metadata:
+      zone: us-east-1a
+`))
+	require.NoError(t, nodeGroups.Reload())
+	require.NoError(t, runManagementServer(ctx, server, serverv3, "tcp", address, args, nodeGroups))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	request := func(node *v3core.Node, certs ...tls.Certificate) error {
+		conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			ServerName:   "ambex",
+			RootCAs:      roots,
+			Certificates: certs,
+		})))
+		require.NoError(t, err)
+		defer conn.Close()
+		stream, err := v3discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&v3discovery.DiscoveryRequest{
+			Node:    node,
+			TypeUrl: ecp_v3_resource.ListenerType,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+
+	// The right identity gets a response for its node ID...
+	assert.NoError(t, request(&v3core.Node{Id: "test-id"}, clientCert.tlsCertificate(t)))
+
+	// ...but not for any other node ID...
+	err = request(&v3core.Node{Id: "other-id"}, clientCert.tlsCertificate(t))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "%v", err)
+
+	// ...nor with metadata that would put it in another node group...
+	east, err := structpb.NewStruct(map[string]interface{}{"zone": "us-east-1a"})
+	require.NoError(t, err)
+	err = request(&v3core.Node{Id: "test-id", Metadata: east}, clientCert.tlsCertificate(t))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "%v", err)
+
+	// ...and there's no getting in without a client certificate.
+	assert.Error(t, request(&v3core.Node{Id: "test-id"}))
+
+	// The unary Fetch calls are checked too.
+	fetch := func(node *v3core.Node, certs ...tls.Certificate) error {
+		conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			ServerName:   "ambex",
+			RootCAs:      roots,
+			Certificates: certs,
+		})))
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = v3secret.NewSecretDiscoveryServiceClient(conn).FetchSecrets(ctx, &v3discovery.DiscoveryRequest{
+			Node:    node,
+			TypeUrl: ecp_v3_resource.SecretType,
+		})
+		return err
+	}
+	err = fetch(&v3core.Node{Id: "test-id"}, clientCert.tlsCertificate(t))
+	assert.NotEqual(t, codes.PermissionDenied, status.Code(err), "%v", err)
+	err = fetch(&v3core.Node{Id: "other-id"}, clientCert.tlsCertificate(t))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "%v", err)
+
+	// Replacing the server certificate takes effect without a restart.
+	newCert := makeTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "ambex-2"},
+		DNSNames:    []string{"ambex"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	tlsCfg, err := newADSTLS(args, nil)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(args.CertFile, newCert.pem, 0600))
+	require.NoError(t, ioutil.WriteFile(args.KeyFile, newCert.keyPEM(t), 0600))
+	require.NoError(t, tlsCfg.reload())
+	got, err := tlsCfg.getCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, newCert.tlsCertificate(t).Certificate, got.Certificate)
+}
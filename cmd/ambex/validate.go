@@ -0,0 +1,304 @@
+package ambex
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	protoV1 "github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/proto"
+
+	v3clusterconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3listenerconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	v3routeconfig "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
+	v3tcpproxy "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/tcp_proxy/v3"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	ecp_wellknown "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/wellknown"
+	"github.com/datawire/dlib/dlog"
+)
+
+// Snapshot.Consistent only checks that the EDS and RDS names line up. validateSnapshotV3 goes
+// further, looking for things that Envoy will accept but that will break traffic (a route to a
+// cluster that doesn't exist), or that Envoy will reject outright (two listeners on the same
+// port), before the snapshot gets anywhere near Envoy.
+
+// A ValidationProblem is something wrong with one resource in a snapshot.
+type ValidationProblem struct {
+	Source  string // the file that the resource came from
+	Type    string // "clusters", "listeners", etc.
+	Name    string
+	Message string
+}
+
+func (p ValidationProblem) String() string {
+	source := p.Source
+	if source == "" {
+		source = "(unknown file)"
+	}
+	return fmt.Sprintf("%s: %s %q: %s", source, strings.TrimSuffix(p.Type, "s"), p.Name, p.Message)
+}
+
+// A ValidationError is a snapshot with problems, which strict validation rejects.
+type ValidationError struct {
+	Version  string
+	Problems []ValidationProblem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.String())
+	}
+	return fmt.Sprintf("snapshot %s failed validation with %d problem(s):\n  %s", e.Version, len(e.Problems), strings.Join(msgs, "\n  "))
+}
+
+// checkSnapshotV3 validates a node group's V3 snapshot. Problems are only logged, unless strict is
+// set, in which case they're returned as a ValidationError, and the snapshot should be rejected.
+func checkSnapshotV3(ctx context.Context, group string, strict bool, snapshot *ecp_v3_cache.Snapshot, sources map[ecp_cache_types.Resource]string) error {
+	problems := validateSnapshotV3(snapshot, sources)
+	if len(problems) == 0 {
+		return nil
+	}
+	err := &ValidationError{Version: snapshot.Resources[ecp_cache_types.Listener].Version, Problems: problems}
+	if strict {
+		return err
+	}
+	if group != DefaultNodeGroup {
+		dlog.Warnf(ctx, "Node group %q: %v", group, err)
+	} else {
+		dlog.Warnf(ctx, "%v", err)
+	}
+	return nil
+}
+
+type validator struct {
+	snapshot *ecp_v3_cache.Snapshot
+	sources  map[ecp_cache_types.Resource]string
+	problems []ValidationProblem
+}
+
+func (v *validator) problem(typeName string, res ecp_cache_types.Resource, format string, args ...interface{}) {
+	v.problems = append(v.problems, ValidationProblem{
+		Source:  v.sources[res],
+		Type:    typeName,
+		Name:    ecp_v3_cache.GetResourceName(res),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// sortedResources returns the resources of one type in a snapshot in name order, so that problems
+// are always reported in the same order.
+func (v *validator) sortedResources(typeURL string) []ecp_cache_types.Resource {
+	items := v.snapshot.GetResources(typeURL)
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]ecp_cache_types.Resource, 0, len(names))
+	for _, name := range names {
+		result = append(result, items[name])
+	}
+	return result
+}
+
+// validateSnapshotV3 checks that everything in a V3 snapshot that refers to something else refers
+// to something that exists. sources says which file each resource came from, for the problems that
+// it finds.
+func validateSnapshotV3(snapshot *ecp_v3_cache.Snapshot, sources map[ecp_cache_types.Resource]string) []ValidationProblem {
+	v := &validator{snapshot: snapshot, sources: sources}
+	clusters := snapshot.GetResources(ecp_v3_resource.ClusterType)
+
+	for _, res := range v.sortedResources(ecp_v3_resource.RouteType) {
+		for _, cluster := range routeClusters(res.(*v3routeconfig.RouteConfiguration)) {
+			if _, ok := clusters[cluster]; !ok {
+				v.problem("routes", res, "routes to cluster %q, which doesn't exist", cluster)
+			}
+		}
+	}
+
+	addresses := map[string]string{}
+	for _, res := range v.sortedResources(ecp_v3_resource.ListenerType) {
+		listener := res.(*v3listenerconfig.Listener)
+
+		if address := listenerAddress(listener); address != "" {
+			if other, ok := addresses[address]; ok {
+				v.problem("listeners", res, "listens on %s, and so does listener %q", address, other)
+			} else {
+				addresses[address] = listener.Name
+			}
+		}
+
+		v.validateFilterChains(listener, clusters)
+	}
+
+	for _, res := range v.sortedResources(ecp_v3_resource.ClusterType) {
+		cluster := res.(*v3clusterconfig.Cluster)
+		if ts := cluster.GetTransportSocket(); ts != nil {
+			tlsContext := &v3tls.UpstreamTlsContext{}
+			if unmarshalTransportSocket(ts, tlsContext) {
+				v.validateTLS("clusters", res, tlsContext.GetCommonTlsContext())
+			}
+		}
+	}
+
+	return v.problems
+}
+
+// routeClusters returns the names of the clusters that a route configuration sends traffic to.
+func routeClusters(rc *v3routeconfig.RouteConfiguration) []string {
+	var clusters []string
+	for _, vhost := range rc.GetVirtualHosts() {
+		for _, route := range vhost.GetRoutes() {
+			action := route.GetRoute()
+			if action == nil {
+				continue
+			}
+			if cluster := action.GetCluster(); cluster != "" {
+				clusters = append(clusters, cluster)
+			}
+			for _, weighted := range action.GetWeightedClusters().GetClusters() {
+				clusters = append(clusters, weighted.GetName())
+			}
+			for _, mirror := range action.GetRequestMirrorPolicies() {
+				clusters = append(clusters, mirror.GetCluster())
+			}
+		}
+	}
+	return clusters
+}
+
+// listenerAddress returns a listener's address, as a string that's the same for two listeners that
+// can't both listen.
+func listenerAddress(listener *v3listenerconfig.Listener) string {
+	switch {
+	case listener.GetAddress().GetSocketAddress() != nil:
+		sa := listener.GetAddress().GetSocketAddress()
+		return fmt.Sprintf("%s %s:%d", sa.GetProtocol(), sa.GetAddress(), sa.GetPortValue())
+	case listener.GetAddress().GetPipe() != nil:
+		return "pipe " + listener.GetAddress().GetPipe().GetPath()
+	default:
+		return ""
+	}
+}
+
+func (v *validator) validateFilterChains(listener *v3listenerconfig.Listener, clusters map[string]ecp_cache_types.Resource) {
+	listenerFilters := map[string]bool{}
+	for _, filter := range listener.GetListenerFilters() {
+		listenerFilters[filter.GetName()] = true
+	}
+	hasTLSInspector := listenerFilters[ecp_wellknown.TlsInspector] || listenerFilters["envoy.listener.tls_inspector"]
+	hasHTTPInspector := listenerFilters[ecp_wellknown.HttpInspector] || listenerFilters["envoy.listener.http_inspector"]
+
+	for i, chain := range listener.GetFilterChains() {
+		match := chain.GetFilterChainMatch()
+		if match == nil {
+			match = &v3listenerconfig.FilterChainMatch{}
+		}
+
+		for j := 0; j < i; j++ {
+			other := listener.GetFilterChains()[j].GetFilterChainMatch()
+			if other == nil {
+				other = &v3listenerconfig.FilterChainMatch{}
+			}
+			if proto.Equal(protoV1.MessageV2(match), protoV1.MessageV2(other)) {
+				v.problem("listeners", listener, "filter chain %d has the same match as filter chain %d, so it can never match", i, j)
+				break
+			}
+		}
+
+		if !hasTLSInspector && (len(match.GetServerNames()) > 0 || match.GetTransportProtocol() == "tls") {
+			v.problem("listeners", listener, "filter chain %d matches on SNI or the TLS transport protocol, but there's no TLS inspector listener filter, so it can never match", i)
+		}
+		if !hasTLSInspector && !hasHTTPInspector && len(match.GetApplicationProtocols()) > 0 {
+			v.problem("listeners", listener, "filter chain %d matches on application protocols, but there's no TLS or HTTP inspector listener filter, so it can never match", i)
+		}
+
+		for _, filter := range chain.GetFilters() {
+			if filter.GetName() == ecp_wellknown.HTTPConnectionManager {
+				if rc := ecp_v3_resource.GetHTTPConnectionManager(filter).GetRouteConfig(); rc != nil {
+					for _, cluster := range routeClusters(rc) {
+						if _, ok := clusters[cluster]; !ok {
+							v.problem("listeners", listener, "filter chain %d routes to cluster %q, which doesn't exist", i, cluster)
+						}
+					}
+				}
+			}
+			if filter.GetName() == ecp_wellknown.TCPProxy {
+				tcpProxy := &v3tcpproxy.TcpProxy{}
+				if filter.GetTypedConfig().UnmarshalTo(tcpProxy) == nil {
+					for _, cluster := range tcpProxyClusters(tcpProxy) {
+						if _, ok := clusters[cluster]; !ok {
+							v.problem("listeners", listener, "filter chain %d proxies TCP to cluster %q, which doesn't exist", i, cluster)
+						}
+					}
+				}
+			}
+		}
+
+		if ts := chain.GetTransportSocket(); ts != nil {
+			tlsContext := &v3tls.DownstreamTlsContext{}
+			if unmarshalTransportSocket(ts, tlsContext) {
+				v.validateTLS("listeners", listener, tlsContext.GetCommonTlsContext())
+			}
+		}
+	}
+}
+
+func tcpProxyClusters(tcpProxy *v3tcpproxy.TcpProxy) []string {
+	if cluster := tcpProxy.GetCluster(); cluster != "" {
+		return []string{cluster}
+	}
+	var clusters []string
+	for _, weighted := range tcpProxy.GetWeightedClusters().GetClusters() {
+		clusters = append(clusters, weighted.GetName())
+	}
+	return clusters
+}
+
+// unmarshalTransportSocket unmarshals a TLS transport socket's config into tlsContext, returning
+// false if it's not a TLS transport socket.
+func unmarshalTransportSocket(ts *v3core.TransportSocket, tlsContext proto.Message) bool {
+	if ts.GetName() != ecp_wellknown.TransportSocketTls && ts.GetName() != "tls" {
+		return false
+	}
+	return ts.GetTypedConfig().UnmarshalTo(tlsContext) == nil
+}
+
+// validateTLS checks that the certificates and secrets that a TLS context refers to exist.
+func (v *validator) validateTLS(typeName string, res ecp_cache_types.Resource, tlsContext *v3tls.CommonTlsContext) {
+	secrets := v.snapshot.GetResources(ecp_v3_resource.SecretType)
+	checkSecret := func(sds *v3tls.SdsSecretConfig) {
+		if sds == nil {
+			return
+		}
+		if _, ok := secrets[sds.GetName()]; !ok {
+			v.problem(typeName, res, "uses TLS secret %q, which doesn't exist", sds.GetName())
+		}
+	}
+	checkFile := func(what string, ds *v3core.DataSource) {
+		if filename := ds.GetFilename(); filename != "" {
+			if _, err := os.Stat(filename); err != nil {
+				v.problem(typeName, res, "uses TLS %s %q, which can't be read: %v", what, filename, err)
+			}
+		}
+	}
+
+	for _, cert := range tlsContext.GetTlsCertificates() {
+		checkFile("certificate", cert.GetCertificateChain())
+		checkFile("private key", cert.GetPrivateKey())
+	}
+	for _, sds := range tlsContext.GetTlsCertificateSdsSecretConfigs() {
+		checkSecret(sds)
+	}
+	checkFile("CA certificate", tlsContext.GetValidationContext().GetTrustedCa())
+	checkSecret(tlsContext.GetValidationContextSdsSecretConfig())
+	checkFile("CA certificate", tlsContext.GetCombinedValidationContext().GetDefaultValidationContext().GetTrustedCa())
+	checkSecret(tlsContext.GetCombinedValidationContext().GetValidationContextSdsSecretConfig())
+}
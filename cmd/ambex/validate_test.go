@@ -0,0 +1,127 @@
+package ambex
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	"github.com/datawire/dlib/dlog"
+)
+
+func TestValidateSnapshot(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	require.NoError(t, ioutil.WriteFile(certFile, []byte("not really a certificate"), 0600))
+
+	files := map[string]string{
+		"cluster.json": `{
+			"@type": "/envoy.config.cluster.v3.Cluster",
+			"name": "good",
+			"transport_socket": {
+				"name": "envoy.transport_sockets.tls",
+				"typed_config": {
+					"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext",
+					"common_tls_context": {
+						"validation_context": {"trusted_ca": {"filename": "` + filepath.Join(dir, "missing-ca.crt") + `"}}
+					}
+				}
+			}
+		}`,
+		"route.json": `{
+			"@type": "/envoy.config.route.v3.RouteConfiguration",
+			"name": "r",
+			"virtual_hosts": [{
+				"name": "vh",
+				"domains": ["*"],
+				"routes": [
+					{"match": {"prefix": "/good/"}, "route": {"cluster": "good"}},
+					{"match": {"prefix": "/bad/"}, "route": {"weighted_clusters": {"clusters": [
+						{"name": "good", "weight": 50},
+						{"name": "bad", "weight": 50}
+					]}}}
+				]
+			}]
+		}`,
+		"listener-a.json": `{
+			"@type": "/envoy.config.listener.v3.Listener",
+			"name": "a",
+			"address": {"socket_address": {"address": "0.0.0.0", "port_value": 8443}},
+			"filter_chains": [
+				{
+					"filter_chain_match": {"server_names": ["a.example.com"]},
+					"transport_socket": {
+						"name": "envoy.transport_sockets.tls",
+						"typed_config": {
+							"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.DownstreamTlsContext",
+							"common_tls_context": {
+								"tls_certificates": [{
+									"certificate_chain": {"filename": "` + certFile + `"},
+									"private_key": {"filename": "` + filepath.Join(dir, "missing.key") + `"}
+								}],
+								"tls_certificate_sds_secret_configs": [{"name": "missing-secret"}]
+							}
+						}
+					}
+				},
+				{"filter_chain_match": {"server_names": ["a.example.com"]}}
+			]
+		}`,
+		"listener-b.json": `{
+			"@type": "/envoy.config.listener.v3.Listener",
+			"name": "b",
+			"address": {"socket_address": {"address": "0.0.0.0", "port_value": 8443}},
+			"listener_filters": [{"name": "envoy.filters.listener.tls_inspector"}],
+			"filter_chains": [{
+				"filter_chain_match": {"server_names": ["b.example.com"]},
+				"filters": [{
+					"name": "envoy.filters.network.tcp_proxy",
+					"typed_config": {
+						"@type": "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy",
+						"stat_prefix": "b",
+						"cluster": "missing-tcp"
+					}
+				}]
+			}]
+		}`,
+	}
+	for name, contents := range files {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0600))
+	}
+
+	rs := loadResources(ctx, []string{dir})
+	snapshot := ecp_v3_cache.NewSnapshot("v1", nil, rs.clustersv3, rs.routesv3, rs.listenersv3, nil)
+	problems := validateSnapshotV3(&snapshot, rs.sources)
+
+	var got []string
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	assert.Equal(t, []string{
+		filepath.Join(dir, "route.json") + `: route "r": routes to cluster "bad", which doesn't exist`,
+		filepath.Join(dir, "listener-a.json") + `: listener "a": filter chain 0 matches on SNI or the TLS transport protocol, but there's no TLS inspector listener filter, so it can never match`,
+		filepath.Join(dir, "listener-a.json") + `: listener "a": uses TLS private key "` + filepath.Join(dir, "missing.key") + `", which can't be read: stat ` + filepath.Join(dir, "missing.key") + `: no such file or directory`,
+		filepath.Join(dir, "listener-a.json") + `: listener "a": uses TLS secret "missing-secret", which doesn't exist`,
+		filepath.Join(dir, "listener-a.json") + `: listener "a": filter chain 1 has the same match as filter chain 0, so it can never match`,
+		filepath.Join(dir, "listener-a.json") + `: listener "a": filter chain 1 matches on SNI or the TLS transport protocol, but there's no TLS inspector listener filter, so it can never match`,
+		filepath.Join(dir, "listener-b.json") + `: listener "b": listens on TCP 0.0.0.0:8443, and so does listener "a"`,
+		filepath.Join(dir, "listener-b.json") + `: listener "b": filter chain 0 proxies TCP to cluster "missing-tcp", which doesn't exist`,
+		filepath.Join(dir, "cluster.json") + `: cluster "good": uses TLS CA certificate "` + filepath.Join(dir, "missing-ca.crt") + `", which can't be read: stat ` + filepath.Join(dir, "missing-ca.crt") + `: no such file or directory`,
+	}, got)
+
+	// Problems are only logged, unless validation is strict.
+	assert.NoError(t, checkSnapshotV3(ctx, DefaultNodeGroup, false, &snapshot, rs.sources))
+	err := checkSnapshotV3(ctx, DefaultNodeGroup, true, &snapshot, rs.sources)
+	var validationErr *ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "v1", validationErr.Version)
+	assert.Len(t, validationErr.Problems, len(problems))
+
+	// A snapshot without problems passes even strict validation.
+	good := ecp_v3_cache.NewSnapshot("v2", nil, nil, nil, nil, nil)
+	assert.NoError(t, checkSnapshotV3(ctx, DefaultNodeGroup, true, &good, rs.sources))
+}
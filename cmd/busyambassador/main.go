@@ -56,6 +56,7 @@ func main() {
 
 	busy.Main("busyambassador", "Ambassador", version, map[string]busy.Command{
 		"ambex":      {Setup: environment.EnvironmentSetupEntrypoint, Run: ambex.Main},
+		"ambex-diff": {Setup: noop, Run: ambex.DiffMain},
 		"kubestatus": {Setup: environment.EnvironmentSetupEntrypoint, Run: kubestatus.Main},
 		"entrypoint": {Setup: noop, Run: entrypoint.Main},
 		"reproducer": {Setup: noop, Run: reproducer.Main},
@@ -3,13 +3,16 @@ package entrypoint
 import (
 	"context"
 	"reflect"
+	"strings"
 	"sync"
 
 	consulapi "github.com/hashicorp/consul/api"
 
 	amb "github.com/datawire/ambassador/v2/pkg/api/getambassador.io/v3alpha1"
 	"github.com/datawire/ambassador/v2/pkg/consulwatch"
+	"github.com/datawire/ambassador/v2/pkg/kates"
 	snapshotTypes "github.com/datawire/ambassador/v2/pkg/snapshot/v1"
+	"github.com/datawire/dlib/dlog"
 )
 
 // consulMapping contains the necessary subset of Ambassador Mapping and TCPMapping
@@ -19,7 +22,23 @@ type consulMapping struct {
 	Resolver string
 }
 
-func ReconcileConsul(ctx context.Context, consulWatcher *consulWatcher, s *snapshotTypes.KubernetesSnapshot) error {
+// parseConsulService splits the service of a Mapping that uses a ConsulResolver into the name of
+// the Consul service and the tag of the subset of its instances that the Mapping routes to, if any.
+// A subset is written the way Consul's RFC 2782 DNS lookups write it, "_<service>._<tag>", which
+// no service name can be confused with. Tags are case-insensitive, as they are in those lookups,
+// so the tag comes back lowercased.
+func parseConsulService(service string) (name, tag string) {
+	if strings.HasPrefix(service, "_") {
+		if idx := strings.Index(service, "._"); idx > 0 {
+			return service[1:idx], strings.ToLower(service[idx+2:])
+		}
+	}
+	return service, ""
+}
+
+// consulMappings finds the Mappings and TCPMappings in a snapshot, including the ones in
+// annotations, that Consul might have to be watched for.
+func consulMappings(s *snapshotTypes.KubernetesSnapshot) []consulMapping {
 	var mappings []consulMapping
 	for _, list := range s.Annotations {
 		for _, a := range list {
@@ -36,13 +55,6 @@ func ReconcileConsul(ctx context.Context, consulWatcher *consulWatcher, s *snaps
 		}
 	}
 
-	var resolvers []*amb.ConsulResolver
-	for _, cr := range s.ConsulResolvers {
-		if include(cr.Spec.AmbassadorID) {
-			resolvers = append(resolvers, cr)
-		}
-	}
-
 	for _, m := range s.Mappings {
 		if include(m.Spec.AmbassadorID) {
 			mappings = append(mappings, consulMapping{Service: m.Spec.Service, Resolver: m.Spec.Resolver})
@@ -54,8 +66,102 @@ func ReconcileConsul(ctx context.Context, consulWatcher *consulWatcher, s *snaps
 			mappings = append(mappings, consulMapping{Service: tm.Spec.Service, Resolver: tm.Spec.Resolver})
 		}
 	}
+	return mappings
+}
+
+// consulSubsetTags returns the tags, by the name of the Consul service, of the subsets of services
+// that Mappings route to.
+func consulSubsetTags(mappings []consulMapping) map[string]map[string]bool {
+	tags := make(map[string]map[string]bool)
+	for _, m := range mappings {
+		name, tag := parseConsulService(m.Service)
+		if tag == "" {
+			continue
+		}
+		if tags[name] == nil {
+			tags[name] = make(map[string]bool)
+		}
+		tags[name][tag] = true
+	}
+	return tags
+}
+
+// consulCredentials are what a ConsulResolver's Secrets hold for talking to Consul with.
+type consulCredentials struct {
+	Token   string
+	CAPEM   []byte
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// resolverCredentials digs the credentials that a ConsulResolver refers to out of the Secrets that
+// ReconcileSecrets found, with the same secretNamespacing. A Secret that's missing is logged and
+// otherwise ignored, so that the resolver still gets watched (and Consul gets to tell us what's
+// wrong).
+func resolverCredentials(ctx context.Context, cr *amb.ConsulResolver, secretNamespacing bool, secrets []*kates.Secret) consulCredentials {
+	var creds consulCredentials
+	if cr.Spec.TokenSecret != "" {
+		if secret := findConsulSecret(cr, cr.Spec.TokenSecret, secretNamespacing, secrets); secret != nil {
+			creds.Token = string(secret.Data["token"])
+		} else {
+			dlog.Errorf(ctx, "ConsulResolver %s.%s: token secret %s not found", cr.GetName(), cr.GetNamespace(), cr.Spec.TokenSecret)
+		}
+	}
+	if cr.Spec.TLSSecret != "" {
+		if secret := findConsulSecret(cr, cr.Spec.TLSSecret, secretNamespacing, secrets); secret != nil {
+			creds.CAPEM = secret.Data["ca.crt"]
+			creds.CertPEM = secret.Data[kates.TLSCertKey]
+			creds.KeyPEM = secret.Data[kates.TLSPrivateKeyKey]
+		} else {
+			dlog.Errorf(ctx, "ConsulResolver %s.%s: TLS secret %s not found", cr.GetName(), cr.GetNamespace(), cr.Spec.TLSSecret)
+		}
+	}
+	return creds
+}
+
+func findConsulSecret(cr *amb.ConsulResolver, name string, secretNamespacing bool, secrets []*kates.Secret) *kates.Secret {
+	var found *kates.Secret
+	// A ConsulResolver can only refer to a Secret in another namespace with the
+	// `{name}.{namespace}` notation if secretNamespacing allows it.
+	secretRef(cr.GetNamespace(), name, secretNamespacing, func(ref snapshotTypes.SecretRef) {
+		for _, secret := range secrets {
+			if secret.GetNamespace() == ref.Namespace && secret.GetName() == ref.Name {
+				found = secret
+				return
+			}
+		}
+	})
+	return found
+}
+
+func ReconcileConsul(ctx context.Context, consulWatcher *consulWatcher, s *snapshotTypes.KubernetesSnapshot) error {
+	// The Ambassador Module decides whether the ConsulResolvers' Secrets can be in other
+	// namespaces, just as it did for ReconcileSecrets.
+	var modules []kates.Object
+	for _, list := range s.Annotations {
+		for _, a := range list {
+			if m, ok := a.(*amb.Module); ok && include(m.Spec.AmbassadorID) {
+				modules = append(modules, m)
+			}
+		}
+	}
+	for _, m := range s.Modules {
+		if include(m.Spec.AmbassadorID) {
+			modules = append(modules, m)
+		}
+	}
+	secretNamespacing := getSecretNamespacing(ctx, modules)
 
-	return consulWatcher.reconcile(ctx, s.ConsulResolvers, mappings)
+	var resolvers []*amb.ConsulResolver
+	credentials := make(map[string]consulCredentials)
+	for _, cr := range s.ConsulResolvers {
+		if include(cr.Spec.AmbassadorID) {
+			resolvers = append(resolvers, cr)
+			credentials[cr.GetName()] = resolverCredentials(ctx, cr, secretNamespacing, s.Secrets)
+		}
+	}
+
+	return consulWatcher.reconcile(ctx, s.ConsulResolvers, credentials, consulMappings(s))
 }
 
 type consulWatcher struct {
@@ -162,12 +268,12 @@ func (c *consulWatcher) cleanup(ctx context.Context) error {
 		w.Stop()
 	}()*/
 
-	return c.reconcile(ctx, nil, nil)
+	return c.reconcile(ctx, nil, nil, nil)
 }
 
 // Start and stop consul service watches as needed in order to match the supplied set of resolvers
-// and mappings.
-func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulResolver, mappings []consulMapping) error {
+// (along with their credentials, by resolver name) and mappings.
+func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulResolver, credentials map[string]consulCredentials, mappings []consulMapping) error {
 	// ==First we compute resolvers and their related mappings without actualy changing anything.==
 	resolversByName := make(map[string]*amb.ConsulResolver)
 	for _, cr := range resolvers {
@@ -209,16 +315,25 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 	// First we (re)create any new or modified resolvers.
 	for name, cr := range resolversByName {
 		oldr, ok := c.resolvers[name]
+		creds := credentials[name]
 		// The resolver hasn't change so continue. Make sure we only compare the spec, since we
-		// don't want to delete/recreate resolvers on things like label changes.
-		if ok && reflect.DeepEqual(oldr.resolver.Spec, cr.Spec) {
+		// don't want to delete/recreate resolvers on things like label changes. A rotated
+		// token or certificate does count as a change, though.
+		if ok && reflect.DeepEqual(oldr.resolver.Spec, cr.Spec) && reflect.DeepEqual(oldr.credentials, creds) {
 			continue
 		}
 		// It exists, but is different, so we delete/recreate i.
+		newr := newResolver(cr, creds)
 		if ok {
+			// If the new resolver asks Consul the same questions as the old one (say, only its
+			// token changed), its watches can pick up where the old ones left off instead of
+			// fetching every service again.
+			if sameConsulQueries(oldr.resolver, cr) {
+				newr.indexes = oldr.watchIndexes()
+			}
 			oldr.deleted()
 		}
-		c.resolvers[name] = newResolver(cr)
+		c.resolvers[name] = newr
 	}
 
 	// Now we delete unneeded resolvers.
@@ -245,7 +360,8 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 		var keysForBootstrap []string
 		for _, mappings := range mappingsByResolver {
 			for _, m := range mappings {
-				keysForBootstrap = append(keysForBootstrap, m.Service)
+				name, _ := parseConsulService(m.Service)
+				keysForBootstrap = append(keysForBootstrap, name)
 			}
 		}
 		c.mutex.Lock()
@@ -255,35 +371,73 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 	return nil
 }
 
+// sameConsulQueries returns whether two resolvers would get the same answers from Consul, so that
+// blocking-query indexes from one are good for the other.
+func sameConsulQueries(a, b *amb.ConsulResolver) bool {
+	return a.Spec.Address == b.Spec.Address &&
+		a.Spec.Datacenter == b.Spec.Datacenter &&
+		a.Spec.ConsulNamespace == b.Spec.ConsulNamespace &&
+		a.Spec.ConsulPartition == b.Spec.ConsulPartition &&
+		onlyHealthy(a) == onlyHealthy(b) &&
+		a.Spec.Connect == b.Spec.Connect
+}
+
+func onlyHealthy(resolver *amb.ConsulResolver) bool {
+	if resolver.Spec.OnlyHealthy != nil {
+		return *resolver.Spec.OnlyHealthy
+	}
+	return true
+}
+
 type resolver struct {
-	resolver *amb.ConsulResolver
-	watches  map[string]Stopper
+	resolver    *amb.ConsulResolver
+	credentials consulCredentials
+	// All of the resolver's watches share one connection to Consul, which is made when the
+	// resolver first needs to watch something.
+	connection consulConnection
+	watches    map[string]consulServiceWatch
+	// The blocking-query indexes to start new watches of services from.
+	indexes map[string]uint64
 }
 
-func newResolver(spec *amb.ConsulResolver) *resolver {
-	return &resolver{resolver: spec, watches: make(map[string]Stopper)}
+func newResolver(spec *amb.ConsulResolver, credentials consulCredentials) *resolver {
+	return &resolver{resolver: spec, credentials: credentials, watches: make(map[string]consulServiceWatch)}
 }
 
 func (r *resolver) deleted() {
 	for _, w := range r.watches {
 		w.Stop()
 	}
+	if r.connection != nil {
+		r.connection.Stop()
+	}
+}
+
+func (r *resolver) watchIndexes() map[string]uint64 {
+	indexes := make(map[string]uint64, len(r.watches))
+	for svc, w := range r.watches {
+		indexes[svc] = w.Index()
+	}
+	return indexes
 }
 
 func (r *resolver) reconcile(ctx context.Context, watchFunc watchConsulFunc, mappings []consulMapping, endpoints chan consulwatch.Endpoints) error {
 	servicesByName := make(map[string]bool)
 	for _, m := range mappings {
 		// XXX: how to parse this?
-		svc := m.Service
+		//
+		// Mappings to any subset of a service share the watch of the whole service.
+		svc, _ := parseConsulService(m.Service)
 		servicesByName[svc] = true
-		w, ok := r.watches[svc]
-		if !ok {
-			var err error
-			w, err = watchFunc(ctx, r.resolver, svc, endpoints)
-			if err != nil {
-				return err
+		if _, ok := r.watches[svc]; !ok {
+			if r.connection == nil {
+				var err error
+				r.connection, err = watchFunc(ctx, r.resolver, r.credentials, endpoints)
+				if err != nil {
+					return err
+				}
 			}
-			r.watches[svc] = w
+			r.watches[svc] = r.connection.Watch(svc, r.indexes[svc])
 		}
 	}
 
@@ -292,52 +446,90 @@ func (r *resolver) reconcile(ctx context.Context, watchFunc watchConsulFunc, map
 		if !ok {
 			w.Stop()
 			delete(r.watches, name)
+			// Should the service be watched again later, what we know about it by then could
+			// be from any index, so that watch needs to start from scratch.
+			delete(r.indexes, name)
 		}
 	}
 	return nil
 }
 
-type watchConsulFunc func(ctx context.Context, resolver *amb.ConsulResolver, svc string, endpoints chan consulwatch.Endpoints) (Stopper, error)
+// watchConsulFunc connects to the Consul that a resolver points at. The endpoints of the services
+// that get watched through the connection are sent down the endpoints channel.
+type watchConsulFunc func(ctx context.Context, resolver *amb.ConsulResolver, credentials consulCredentials, endpoints chan consulwatch.Endpoints) (consulConnection, error)
+
+type consulConnection interface {
+	Stopper
+	// Watch a service, picking up from the blocking-query index that an earlier watch of it got
+	// to, or from scratch if the index is 0.
+	Watch(svc string, index uint64) consulServiceWatch
+}
+
+type consulServiceWatch interface {
+	Stopper
+	// Index returns the blocking-query index of the last endpoints that the watch sent.
+	Index() uint64
+}
 
 type Stopper interface {
 	Stop()
 }
 
+// consulConfig builds the configuration of the Consul client for a resolver.
+func consulConfig(resolver *amb.ConsulResolver, credentials consulCredentials) *consulapi.Config {
+	config := consulapi.DefaultConfig()
+	config.Address = resolver.Spec.Address
+	if credentials.Token != "" {
+		config.Token = credentials.Token
+	}
+	config.Namespace = resolver.Spec.ConsulNamespace
+	config.Partition = resolver.Spec.ConsulPartition
+	if resolver.Spec.TLSSecret != "" {
+		config.Scheme = "https"
+		config.TLSConfig.CAPem = credentials.CAPEM
+		config.TLSConfig.CertPEM = credentials.CertPEM
+		config.TLSConfig.KeyPEM = credentials.KeyPEM
+	}
+	return config
+}
+
 func watchConsul(
 	ctx context.Context,
 	resolver *amb.ConsulResolver,
-	svc string,
+	credentials consulCredentials,
 	endpointsCh chan consulwatch.Endpoints,
-) (Stopper, error) {
-	// XXX: should this part be shared?
-	consulConfig := consulapi.DefaultConfig()
-	consulConfig.Address = resolver.Spec.Address
-	consul, err := consulapi.NewClient(consulConfig)
+) (consulConnection, error) {
+	consul, err := consulapi.NewClient(consulConfig(resolver, credentials))
 	if err != nil {
 		return nil, err
 	}
 
-	// this part is per service
-	w, err := consulwatch.New(consul, resolver.Spec.Datacenter, svc, true)
-	if err != nil {
-		return nil, err
-	}
-
-	w.Watch(func(endpoints consulwatch.Endpoints, e error) {
-		if endpoints.Id == "" {
-			// For Ambassador, overwrite the Id with the resolver's datacenter -- the
-			// Consul watcher doesn't actually hand back the DC, and we need it.
-			endpoints.Id = resolver.Spec.Datacenter
-		}
-
-		endpointsCh <- endpoints
-	})
-
+	mux := consulwatch.NewMultiplexer(consul, resolver.Spec.Datacenter, onlyHealthy(resolver), resolver.Spec.WatchCatalog, resolver.Spec.Connect)
 	go func() {
-		if err := w.Start(ctx); err != nil {
+		if err := mux.Start(ctx); err != nil {
 			panic(err) // TODO: Find a better way of reporting errors from goroutines.
 		}
 	}()
 
-	return w, nil
+	return &multiplexedConsul{mux: mux, datacenter: resolver.Spec.Datacenter, endpointsCh: endpointsCh}, nil
+}
+
+// multiplexedConsul is a consulConnection that watches services through a Multiplexer.
+type multiplexedConsul struct {
+	mux         *consulwatch.Multiplexer
+	datacenter  string
+	endpointsCh chan consulwatch.Endpoints
+}
+
+func (c *multiplexedConsul) Watch(svc string, index uint64) consulServiceWatch {
+	return c.mux.Subscribe(svc, index, func(endpoints consulwatch.Endpoints) {
+		// For Ambassador, set the Id to the resolver's datacenter -- the Consul watcher
+		// doesn't actually hand back the DC, and we need it.
+		endpoints.Id = c.datacenter
+		c.endpointsCh <- endpoints
+	})
+}
+
+func (c *multiplexedConsul) Stop() {
+	c.mux.Stop()
 }
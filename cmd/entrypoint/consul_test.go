@@ -2,6 +2,7 @@ package entrypoint
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
 
@@ -73,7 +74,7 @@ secret: consultest-client-cert-secret
 
 func TestReconcile(t *testing.T) {
 	ctx, resolvers, mappings, c, tw := setup(t)
-	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, mappings))
 	tw.Assert(
 		"consultest-resolver.default:consultest-consul-service:watch",
 		"consultest-resolver.default:consultest-consul-service-tcp:watch",
@@ -82,21 +83,226 @@ func TestReconcile(t *testing.T) {
 		Service:  "foo",
 		Resolver: "consultest-resolver",
 	}
-	require.NoError(t, c.reconcile(ctx, resolvers, append(mappings, extra)))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, append(mappings, extra)))
 	tw.Assert(
 		"consultest-resolver.default:foo:watch",
 	)
-	require.NoError(t, c.reconcile(ctx, resolvers, nil))
+	// All of a resolver's watches share one connection to Consul.
+	assert.Equal(t, 1, tw.connections)
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, nil))
 	tw.Assert(
 		"consultest-resolver.default:consultest-consul-service-tcp:stop",
 		"consultest-resolver.default:consultest-consul-service:stop",
 		"consultest-resolver.default:foo:stop",
 	)
+	assert.Equal(t, 0, tw.connections)
+}
+
+func TestReconcileSubsets(t *testing.T) {
+	ctx, resolvers, mappings, c, tw := setup(t)
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+	// Mappings to subsets of a service share the watch of the whole service.
+	subsets := []consulMapping{
+		{Service: "_consultest-consul-service._canary", Resolver: "consultest-resolver"},
+		{Service: "_foo._canary", Resolver: "consultest-resolver"},
+		{Service: "_foo._Stable", Resolver: "consultest-resolver"},
+	}
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, append(mappings, subsets...)))
+	tw.Assert(
+		"consultest-resolver.default:foo:watch",
+	)
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, append(mappings, subsets[:1]...)))
+	tw.Assert(
+		"consultest-resolver.default:foo:stop",
+	)
+}
+
+func TestParseConsulService(t *testing.T) {
+	for service, expected := range map[string][2]string{
+		"foo":          {"foo", ""},
+		"_foo._canary": {"foo", "canary"},
+		"_foo._Canary": {"foo", "canary"},
+		"_foo.canary":  {"_foo.canary", ""},
+		"foo._canary":  {"foo._canary", ""},
+		"_foo":         {"_foo", ""},
+	} {
+		name, tag := parseConsulService(service)
+		assert.Equal(t, expected, [2]string{name, tag}, service)
+	}
+}
+
+func TestReconcileCredentials(t *testing.T) {
+	ctx, resolvers, mappings, c, tw := setup(t)
+	creds := map[string]consulCredentials{"consultest-resolver": {Token: "one"}}
+	require.NoError(t, c.reconcile(ctx, resolvers, creds, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+	require.NoError(t, c.reconcile(ctx, resolvers, creds, mappings))
+	tw.Assert()
+
+	for _, w := range c.resolvers["consultest-resolver"].watches {
+		w.(*testStopper).index = 42
+	}
+
+	// A rotated token restarts the resolver's watches, which pick up where the old ones left
+	// off.
+	creds = map[string]consulCredentials{"consultest-resolver": {Token: "two"}}
+	require.NoError(t, c.reconcile(ctx, resolvers, creds, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:stop",
+		"consultest-resolver.default:consultest-consul-service-tcp:stop",
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+	assert.Equal(t, 1, tw.connections)
+	assert.Equal(t, uint64(42), tw.indexes["consultest-consul-service"])
+	assert.Equal(t, uint64(42), tw.indexes["consultest-consul-service-tcp"])
+
+	// Pointing the resolver at another Consul starts its watches from scratch.
+	moved := resolvers[0].DeepCopy()
+	moved.Spec.Address = "elsewhere:8500"
+	require.NoError(t, c.reconcile(ctx, []*amb.ConsulResolver{moved}, creds, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:stop",
+		"consultest-resolver.default:consultest-consul-service-tcp:stop",
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+	assert.Equal(t, uint64(0), tw.indexes["consultest-consul-service"])
+	assert.Equal(t, uint64(0), tw.indexes["consultest-consul-service-tcp"])
+}
+
+func TestResolverCredentials(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	onlyHealthy := false
+	cr := &amb.ConsulResolver{
+		ObjectMeta: kates.ObjectMeta{Name: "consul", Namespace: "default"},
+		Spec: amb.ConsulResolverSpec{
+			Address:         "consul-server:8501",
+			TokenSecret:     "consul-token",
+			TLSSecret:       "consul-tls.consul",
+			ConsulNamespace: "team-a",
+			ConsulPartition: "part-1",
+			OnlyHealthy:     &onlyHealthy,
+		},
+	}
+
+	var refs []snapshotTypes.SecretRef
+	findSecretRefs(ctx, cr, true, func(ref snapshotTypes.SecretRef) {
+		refs = append(refs, ref)
+	})
+	assert.Equal(t, []snapshotTypes.SecretRef{
+		{Namespace: "default", Name: "consul-token"},
+		{Namespace: "consul", Name: "consul-tls"},
+	}, refs)
+
+	secret := func(namespace, name string, data map[string][]byte) *kates.Secret {
+		return &kates.Secret{ObjectMeta: kates.ObjectMeta{Name: name, Namespace: namespace}, Data: data}
+	}
+	secrets := []*kates.Secret{
+		secret("default", "consul-token", map[string][]byte{"token": []byte("s3cr3t")}),
+		secret("default", "consul-tls", map[string][]byte{"ca.crt": []byte("wrong CA")}),
+		secret("consul", "consul-tls", map[string][]byte{
+			"ca.crt":  []byte("CA"),
+			"tls.crt": []byte("cert"),
+			"tls.key": []byte("key"),
+		}),
+	}
+
+	creds := resolverCredentials(ctx, cr, true, secrets)
+	assert.Equal(t, consulCredentials{
+		Token:   "s3cr3t",
+		CAPEM:   []byte("CA"),
+		CertPEM: []byte("cert"),
+		KeyPEM:  []byte("key"),
+	}, creds)
+
+	config := consulConfig(cr, creds)
+	assert.Equal(t, "consul-server:8501", config.Address)
+	assert.Equal(t, "https", config.Scheme)
+	assert.Equal(t, "s3cr3t", config.Token)
+	assert.Equal(t, "team-a", config.Namespace)
+	assert.Equal(t, "part-1", config.Partition)
+	assert.Equal(t, []byte("CA"), config.TLSConfig.CAPem)
+	assert.Equal(t, []byte("cert"), config.TLSConfig.CertPEM)
+	assert.Equal(t, []byte("key"), config.TLSConfig.KeyPEM)
+
+	// Missing secrets leave the credentials empty rather than failing.
+	assert.Equal(t, consulCredentials{}, resolverCredentials(ctx, cr, true, nil))
+}
+
+func TestResolverCredentialsSecretNamespacing(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	cr := &amb.ConsulResolver{
+		ObjectMeta: kates.ObjectMeta{Name: "consul", Namespace: "default"},
+		Spec: amb.ConsulResolverSpec{
+			Address:     "consul-server:8501",
+			TokenSecret: "consul-token.kube-system",
+			TLSSecret:   "consul-tls.consul",
+		},
+	}
+	secret := func(namespace, name string, data map[string][]byte) *kates.Secret {
+		return &kates.Secret{ObjectMeta: kates.ObjectMeta{Name: name, Namespace: namespace}, Data: data}
+	}
+	secrets := []*kates.Secret{
+		secret("kube-system", "consul-token", map[string][]byte{"token": []byte("s3cr3t")}),
+		secret("consul", "consul-tls", map[string][]byte{"ca.crt": []byte("CA")}),
+		secret("default", "consul-tls.consul", map[string][]byte{"ca.crt": []byte("local CA")}),
+	}
+
+	// The Ambassador Module can turn secret namespacing off...
+	module := &amb.Module{
+		ObjectMeta: kates.ObjectMeta{Name: "ambassador", Namespace: "default"},
+		Spec: amb.ModuleSpec{
+			Config: amb.UntypedDict{Values: map[string]json.RawMessage{
+				"defaults": json.RawMessage(`{"tls_secret_namespacing": false}`),
+			}},
+		},
+	}
+	secretNamespacing := getSecretNamespacing(ctx, []kates.Object{module})
+	require.False(t, secretNamespacing)
+
+	// ...in which case a ConsulResolver can only refer to Secrets in its own namespace, whose
+	// names can contain dots.
+	var refs []snapshotTypes.SecretRef
+	findSecretRefs(ctx, cr, secretNamespacing, func(ref snapshotTypes.SecretRef) {
+		refs = append(refs, ref)
+	})
+	assert.Equal(t, []snapshotTypes.SecretRef{
+		{Namespace: "default", Name: "consul-token.kube-system"},
+		{Namespace: "default", Name: "consul-tls.consul"},
+	}, refs)
+	assert.Equal(t, consulCredentials{CAPEM: []byte("local CA")},
+		resolverCredentials(ctx, cr, secretNamespacing, secrets))
+
+	// Without a Module, secret namespacing is on.
+	require.True(t, getSecretNamespacing(ctx, nil))
+	assert.Equal(t, consulCredentials{Token: "s3cr3t", CAPEM: []byte("CA")},
+		resolverCredentials(ctx, cr, true, secrets))
+}
+
+func TestConsulSubsetTags(t *testing.T) {
+	tags := consulSubsetTags([]consulMapping{
+		{Service: "foo", Resolver: "consultest-resolver"},
+		{Service: "_foo._Canary", Resolver: "consultest-resolver"},
+		{Service: "_foo._canary", Resolver: "consultest-resolver"},
+		{Service: "_bar._stable", Resolver: "consultest-resolver"},
+	})
+	assert.Equal(t, map[string]map[string]bool{
+		"foo": {"canary": true},
+		"bar": {"stable": true},
+	}, tags)
 }
 
 func TestCleanup(t *testing.T) {
 	ctx, resolvers, mappings, c, tw := setup(t)
-	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, mappings))
 	tw.Assert(
 		"consultest-resolver.default:consultest-consul-service:watch",
 		"consultest-resolver.default:consultest-consul-service-tcp:watch",
@@ -111,7 +317,7 @@ func TestCleanup(t *testing.T) {
 func TestBootstrap(t *testing.T) {
 	ctx, resolvers, mappings, c, _ := setup(t)
 	assert.False(t, c.isBootstrapped())
-	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	require.NoError(t, c.reconcile(ctx, resolvers, nil, mappings))
 	assert.False(t, c.isBootstrapped())
 	// XXX: break this (maybe use a chan to replace uncoalesced dirties and passing con around?)
 	//
@@ -163,7 +369,7 @@ func setup(t *testing.T) (ctx context.Context, resolvers []*amb.ConsulResolver,
 	assert.Equal(t, 1, len(resolvers))
 	assert.Equal(t, 4, len(mappings))
 
-	tw = &testWatcher{t: t, events: make(map[string]bool)}
+	tw = &testWatcher{t: t, events: make(map[string]bool), indexes: make(map[string]uint64)}
 	c = newConsulWatcher(tw.Watch)
 	grp.Go("consul", c.run)
 	tw.Assert()
@@ -174,6 +380,9 @@ func setup(t *testing.T) (ctx context.Context, resolvers []*amb.ConsulResolver,
 type testWatcher struct {
 	t      *testing.T
 	events map[string]bool
+	// The number of open connections, and the index that each service's last watch started from.
+	connections int
+	indexes     map[string]uint64
 }
 
 func (tw *testWatcher) Log(event string) {
@@ -193,18 +402,38 @@ func (tw *testWatcher) Assert(events ...string) {
 	tw.events = make(map[string]bool)
 }
 
-func (tw *testWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, svc string, _ chan consulwatch.Endpoints) (Stopper, error) {
+func (tw *testWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, _ consulCredentials, _ chan consulwatch.Endpoints) (consulConnection, error) {
 	rname := fmt.Sprintf("%s.%s", resolver.GetName(), resolver.GetNamespace())
-	tw.Logf("%s:%s:watch", rname, svc)
-	return &testStopper{watcher: tw, resolver: rname, service: svc}, nil
+	tw.connections++
+	return &testConnection{watcher: tw, resolver: rname}, nil
+}
+
+type testConnection struct {
+	watcher  *testWatcher
+	resolver string
+}
+
+func (tc *testConnection) Watch(svc string, index uint64) consulServiceWatch {
+	tc.watcher.Logf("%s:%s:watch", tc.resolver, svc)
+	tc.watcher.indexes[svc] = index
+	return &testStopper{watcher: tc.watcher, resolver: tc.resolver, service: svc}
+}
+
+func (tc *testConnection) Stop() {
+	tc.watcher.connections--
 }
 
 type testStopper struct {
 	watcher  *testWatcher
 	resolver string
 	service  string
+	index    uint64
 }
 
 func (ts *testStopper) Stop() {
 	ts.watcher.Logf("%s:%s:stop", ts.resolver, ts.service)
 }
+
+func (ts *testStopper) Index() uint64 {
+	return ts.index
+}
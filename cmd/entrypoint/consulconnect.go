@@ -0,0 +1,265 @@
+package entrypoint
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/datawire/ambassador/v2/pkg/consulwatch"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+	"github.com/datawire/ambassador/v2/pkg/limiter"
+	"github.com/datawire/dlib/dlog"
+)
+
+// Consul Connect certificates work a lot like Istio certificates: Consul hands us a leaf
+// certificate for our service and the CA roots that it chains to, and we supply them to the rest
+// of Ambassador as a thing that looks like a Kubernetes TLS Secret. A TLSContext that uses it as
+// its secret and ca_secret lets Mappings talk to Connect-enabled services over mTLS, with our
+// SPIFFE identity, and only trusts the services that have a SPIFFE identity in Connect's trust
+// domain.
+
+// ConsulConnectCert holds all the state we need to manage a Consul Connect certificate.
+type ConsulConnectCert struct {
+	name      string // Name we'll use when generating our secret
+	namespace string // Namespace in which our secret will appear to be
+
+	leaf  *consulwatch.Certificate
+	roots *consulwatch.CARoots
+
+	// How shall we fetch the current time?
+	fetchTime timeFetcher
+
+	// Where shall we send updates when things happen?
+	updates chan IstioCertUpdate
+}
+
+// NewConsulConnectCert instantiates a ConsulConnectCert to manage a certificate that should have
+// the given "name" and appear to live in K8s namespace "namespace" (see NewIstioCert for why), and
+// will have updates posted to "updateChannel" whenever the cert changes.
+func NewConsulConnectCert(name string, namespace string, updateChannel chan IstioCertUpdate) *ConsulConnectCert {
+	return &ConsulConnectCert{
+		name:      name,
+		namespace: namespace,
+		fetchTime: time.Now, // default to using time.Now for time
+		updates:   updateChannel,
+	}
+}
+
+// String returns a string representation of this ConsulConnectCert.
+func (ccert *ConsulConnectCert) String() string {
+	return fmt.Sprintf("ConsulConnectCert %s.%s", ccert.name, ccert.namespace)
+}
+
+// SetFetchTime will change the function we use to get the current time.
+func (ccert *ConsulConnectCert) SetFetchTime(fetchTime timeFetcher) {
+	ccert.fetchTime = fetchTime
+}
+
+// HandleLeaf tells a ConsulConnectCert about a new leaf certificate. Once it has both a leaf
+// certificate and CA roots, it sends an IstioCertUpdate over the updates channel.
+func (ccert *ConsulConnectCert) HandleLeaf(ctx context.Context, leaf *consulwatch.Certificate) {
+	dlog.Debugf(ctx, "%s: leaf certificate %s, valid before %v", ccert, leaf.SerialNumber, leaf.ValidBefore)
+	if !leaf.ValidBefore.IsZero() && !ccert.fetchTime().Before(leaf.ValidBefore) {
+		dlog.Errorf(ctx, "%s: leaf certificate %s expired at %v", ccert, leaf.SerialNumber, leaf.ValidBefore)
+	}
+	ccert.leaf = leaf
+	ccert.noteUpdate(ctx)
+}
+
+// HandleRoots tells a ConsulConnectCert about new CA roots. Once it has both a leaf certificate
+// and CA roots, it sends an IstioCertUpdate over the updates channel.
+func (ccert *ConsulConnectCert) HandleRoots(ctx context.Context, roots *consulwatch.CARoots) {
+	dlog.Debugf(ctx, "%s: %d CA roots, active root %s", ccert, len(roots.Roots), roots.ActiveRootID)
+	ccert.roots = roots
+	ccert.noteUpdate(ctx)
+}
+
+func (ccert *ConsulConnectCert) noteUpdate(ctx context.Context) {
+	secret, ok := ccert.Secret()
+	if !ok {
+		dlog.Debugf(ctx, "%s: nothing to note", ccert)
+		return
+	}
+
+	dlog.Debugf(ctx, "%s: noting update!", ccert)
+	select {
+	case ccert.updates <- IstioCertUpdate{
+		Op:        "update",
+		Name:      secret.ObjectMeta.Name,
+		Namespace: secret.ObjectMeta.Namespace,
+		Secret:    secret,
+	}:
+	case <-ctx.Done():
+	}
+}
+
+// Secret generates a kates.Secret for this ConsulConnectCert, if it has both a leaf certificate
+// and CA roots. The tls.crt is just the leaf certificate, and the ca.crt is the CA roots (the
+// active root first), so that the Secret can serve as a TLSContext's ca_secret as well as its
+// secret without the leaf certificate being trusted as a CA.
+func (ccert *ConsulConnectCert) Secret() (*kates.Secret, bool) {
+	if ccert.leaf == nil || ccert.roots == nil {
+		return nil, false
+	}
+
+	rootIDs := make([]string, 0, len(ccert.roots.Roots))
+	for id := range ccert.roots.Roots {
+		rootIDs = append(rootIDs, id)
+	}
+	sort.Slice(rootIDs, func(i, j int) bool {
+		if (rootIDs[i] == ccert.roots.ActiveRootID) != (rootIDs[j] == ccert.roots.ActiveRootID) {
+			return rootIDs[i] == ccert.roots.ActiveRootID
+		}
+		return rootIDs[i] < rootIDs[j]
+	})
+
+	roots := make([]string, 0, len(rootIDs))
+	for _, id := range rootIDs {
+		roots = append(roots, strings.TrimRight(ccert.roots.Roots[id].PEM, "\n")+"\n")
+	}
+
+	var annotations map[string]string
+	if ccert.roots.TrustDomain != "" {
+		annotations = map[string]string{SPIFFETrustDomainAnnotation: ccert.roots.TrustDomain}
+	}
+
+	return &kates.Secret{
+		TypeMeta: kates.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: kates.ObjectMeta{
+			Name:        ccert.name,
+			Namespace:   ccert.namespace,
+			Annotations: annotations,
+		},
+		Type: kates.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.key": []byte(ccert.leaf.PrivateKeyPEM),
+			"tls.crt": []byte(strings.TrimRight(ccert.leaf.PEM, "\n") + "\n"),
+			"ca.crt":  []byte(strings.Join(roots, "")),
+		},
+	}, true
+}
+
+// RefreshTime returns when the leaf certificate should be fetched again: once two thirds of its
+// lifetime has passed, which leaves plenty of time to retry before it expires. It returns the zero
+// time if there's no leaf certificate, or if it doesn't say how long it's valid for.
+func (ccert *ConsulConnectCert) RefreshTime() time.Time {
+	if ccert.leaf == nil || ccert.leaf.ValidAfter.IsZero() || ccert.leaf.ValidBefore.IsZero() {
+		return time.Time{}
+	}
+	lifetime := ccert.leaf.ValidBefore.Sub(ccert.leaf.ValidAfter)
+	return ccert.leaf.ValidAfter.Add(lifetime * 2 / 3)
+}
+
+// Watch starts watching Consul for the leaf certificate of the given service and for the CA roots,
+// handling them until the context is canceled. Consul's agent renews the leaf certificate itself,
+// but we don't count on hearing about it: when the certificate is due for a refresh, we start a
+// fresh watch of it.
+func (ccert *ConsulConnectCert) Watch(ctx context.Context, consul *consulapi.Client, service string) error {
+	leafCh := make(chan *consulwatch.Certificate)
+	rootsCh := make(chan *consulwatch.CARoots)
+
+	rootsWatcher, err := consulwatch.NewConnectCARootsWatcher(consul)
+	if err != nil {
+		return err
+	}
+	rootsWatcher.Watch(func(roots *consulwatch.CARoots, err error) {
+		if err != nil {
+			dlog.Errorf(ctx, "%s: watching CA roots: %v", ccert, err)
+			return
+		}
+		select {
+		case rootsCh <- roots:
+		case <-ctx.Done():
+		}
+	})
+
+	watchLeaf := func() (*consulwatch.ConnectLeafWatcher, error) {
+		leafWatcher, err := consulwatch.NewConnectLeafWatcher(consul, service)
+		if err != nil {
+			return nil, err
+		}
+		leafWatcher.Watch(func(leaf *consulwatch.Certificate, err error) {
+			if err != nil {
+				dlog.Errorf(ctx, "%s: watching leaf certificate for %s: %v", ccert, service, err)
+				return
+			}
+			select {
+			case leafCh <- leaf:
+			case <-ctx.Done():
+			}
+		})
+		go func() {
+			if err := leafWatcher.Start(ctx); err != nil {
+				dlog.Errorf(ctx, "%s: watching leaf certificate for %s: %v", ccert, service, err)
+			}
+		}()
+		return leafWatcher, nil
+	}
+
+	leafWatcher, err := watchLeaf()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := rootsWatcher.Start(ctx); err != nil {
+			dlog.Errorf(ctx, "%s: watching CA roots: %v", ccert, err)
+		}
+	}()
+
+	go func() {
+		defer func() {
+			rootsWatcher.Stop()
+			leafWatcher.Stop()
+		}()
+
+		// If a refreshed certificate is still due for a refresh, Consul hasn't rotated it
+		// yet, so we back off rather than asking again and again.
+		backoff := limiter.NewBackoff(10*time.Second, 5*time.Minute)
+		var refresh <-chan time.Time
+
+		for {
+			select {
+			case leaf := <-leafCh:
+				ccert.HandleLeaf(ctx, leaf)
+
+				refreshTime := ccert.RefreshTime()
+				if refreshTime.IsZero() {
+					continue
+				}
+				now := ccert.fetchTime()
+				delay := refreshTime.Sub(now)
+				if delay > 0 {
+					backoff.Reset()
+				} else {
+					delay = backoff.Limit(now)
+				}
+				refresh = time.After(delay)
+				dlog.Debugf(ctx, "%s: refreshing leaf certificate in %v", ccert, delay)
+			case roots := <-rootsCh:
+				ccert.HandleRoots(ctx, roots)
+			case <-refresh:
+				dlog.Infof(ctx, "%s: refreshing leaf certificate for %s", ccert, service)
+				refresh = nil
+				leafWatcher.Stop()
+				newWatcher, err := watchLeaf()
+				if err != nil {
+					dlog.Errorf(ctx, "%s: refreshing leaf certificate for %s: %v", ccert, service, err)
+					refresh = time.After(backoff.Limit(ccert.fetchTime()))
+					continue
+				}
+				leafWatcher = newWatcher
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package entrypoint_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/v2/cmd/ambex"
+	"github.com/datawire/ambassador/v2/cmd/entrypoint"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/datawire/ambassador/v2/pkg/consulwatch"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+	"github.com/datawire/dlib/dlog"
+	"github.com/datawire/dlib/dtime"
+)
+
+func TestConsulConnectCert(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	ft := dtime.NewFakeTime()
+	updates := make(chan entrypoint.IstioCertUpdate, 5)
+
+	ccert := entrypoint.NewConsulConnectCert("consul-connect-test", "ambassador", updates)
+	ccert.SetFetchTime(ft.Now)
+
+	leaf := &consulwatch.Certificate{
+		SerialNumber:  "1",
+		PEM:           "leaf-1",
+		PrivateKeyPEM: "key-1",
+		ValidAfter:    ft.Now(),
+		ValidBefore:   ft.Now().Add(72 * time.Hour),
+	}
+
+	// Nothing happens until we have both the leaf certificate and the CA roots.
+	ccert.HandleLeaf(ctx, leaf)
+	assert.Len(t, updates, 0)
+
+	ccert.HandleRoots(ctx, &consulwatch.CARoots{
+		ActiveRootID: "b",
+		TrustDomain:  "11111111-2222-3333-4444-555555555555.consul",
+		Roots: map[string]consulwatch.CARoot{
+			"a": {ID: "a", PEM: "root-a\n"},
+			"b": {ID: "b", PEM: "root-b\n", Active: true},
+		},
+	})
+	require.Len(t, updates, 1)
+	update := <-updates
+	assert.Equal(t, "update", update.Op)
+	assert.Equal(t, "consul-connect-test", update.Name)
+	assert.Equal(t, "ambassador", update.Namespace)
+	assert.Equal(t, kates.SecretTypeTLS, update.Secret.Type)
+	assert.Equal(t, "key-1", string(update.Secret.Data["tls.key"]))
+	// The leaf isn't a CA: the roots, the active one first, are the ca.crt.
+	assert.Equal(t, "leaf-1\n", string(update.Secret.Data["tls.crt"]))
+	assert.Equal(t, "root-b\nroot-a\n", string(update.Secret.Data["ca.crt"]))
+	assert.Equal(t, "11111111-2222-3333-4444-555555555555.consul",
+		update.Secret.Annotations[entrypoint.SPIFFETrustDomainAnnotation])
+
+	// The leaf is due for a refresh two thirds of the way through its lifetime.
+	assert.Equal(t, ft.Now().Add(48*time.Hour), ccert.RefreshTime())
+
+	// A rotated leaf certificate replaces the old one.
+	ft.Step(48 * time.Hour)
+	ccert.HandleLeaf(ctx, &consulwatch.Certificate{
+		SerialNumber:  "2",
+		PEM:           "leaf-2",
+		PrivateKeyPEM: "key-2",
+		ValidAfter:    ft.Now(),
+		ValidBefore:   ft.Now().Add(72 * time.Hour),
+	})
+	require.Len(t, updates, 1)
+	update = <-updates
+	assert.Equal(t, "key-2", string(update.Secret.Data["tls.key"]))
+	assert.Equal(t, "leaf-2\n", string(update.Secret.Data["tls.crt"]))
+	assert.Equal(t, "root-b\nroot-a\n", string(update.Secret.Data["ca.crt"]))
+	assert.Equal(t, ft.Now().Add(48*time.Hour), ccert.RefreshTime())
+}
+
+func TestConsulConnectCertNoLifetime(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	updates := make(chan entrypoint.IstioCertUpdate, 5)
+
+	ccert := entrypoint.NewConsulConnectCert("consul-connect-test", "ambassador", updates)
+	assert.True(t, ccert.RefreshTime().IsZero())
+
+	ccert.HandleLeaf(ctx, &consulwatch.Certificate{PEM: "leaf", PrivateKeyPEM: "key"})
+	assert.True(t, ccert.RefreshTime().IsZero())
+	_, ok := ccert.Secret()
+	assert.False(t, ok)
+}
+
+func TestConsulConnectCertRotation(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: false}, nil)
+	f.AutoFlush(true)
+
+	assert.NoError(t, f.UpsertYAML(`
+---
+apiVersion: getambassador.io/v3alpha1
+kind: TLSContext
+metadata:
+  name: consul-connect
+  namespace: default
+spec:
+  hosts: []
+  secret: consul-connect-certs
+  ca_secret: consul-connect-certs
+`))
+	_, err := f.GetSnapshot(AnySnapshot)
+	require.NoError(t, err)
+
+	updates := make(chan entrypoint.IstioCertUpdate, 5)
+	ccert := entrypoint.NewConsulConnectCert("consul-connect-certs", "default", updates)
+	root, _ := makeTestCertPEM(t, "consul-ca")
+	ccert.HandleRoots(ctx, &consulwatch.CARoots{
+		ActiveRootID: "a",
+		TrustDomain:  "11111111-2222-3333-4444-555555555555.consul",
+		Roots:        map[string]consulwatch.CARoot{"a": {ID: "a", PEM: string(root), Active: true}},
+	})
+
+	// Each new leaf certificate reaches ambex over SDS, under the same name, with the CA roots as
+	// a validation context that only trusts the Connect trust domain.
+	for i, cn := range []string{"leaf-1", "leaf-2"} {
+		cert, key := makeTestCertPEM(t, cn)
+		ccert.HandleLeaf(ctx, &consulwatch.Certificate{
+			SerialNumber:  fmt.Sprint(i + 1),
+			PEM:           string(cert),
+			PrivateKeyPEM: string(key),
+		})
+		require.Len(t, updates, 1)
+		f.SendIstioCertUpdate(<-updates)
+
+		fastpath, err := f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+			return sdsCertificate(fastpath, "consul-connect-certs.default") == string(cert)
+		})
+		require.NoError(t, err, cn)
+
+		var validation *v3tls.CertificateValidationContext
+		for _, secret := range fastpath.Secrets {
+			if secret.Name == "consul-connect-certs.default-ca" {
+				validation = secret.GetValidationContext()
+			}
+		}
+		require.NotNil(t, validation, cn)
+		assert.Equal(t, string(root), string(validation.GetTrustedCa().GetInlineBytes()))
+		require.Len(t, validation.MatchSubjectAltNames, 1)
+		assert.Equal(t, "spiffe://11111111-2222-3333-4444-555555555555.consul/",
+			validation.MatchSubjectAltNames[0].GetPrefix())
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
 
 	"github.com/datawire/ambassador/v2/cmd/ambex"
 	"github.com/datawire/ambassador/v2/pkg/consulwatch"
@@ -18,32 +22,79 @@ func makeEndpoints(ctx context.Context, ksnap *snapshot.KubernetesSnapshot, cons
 		k8sServices[key(svc)] = svc
 	}
 
+	// A service can have any number of EndpointSlices, which are labeled with the name of the
+	// service rather than named after it.
+	k8sSlices := map[string][]*kates.EndpointSlice{}
+	for _, slice := range ksnap.EndpointSlices {
+		svcName := slice.Labels[kates.LabelServiceName]
+		if svcName == "" {
+			continue
+		}
+		svcKey := fmt.Sprintf("%s:%s", slice.Namespace, svcName)
+		k8sSlices[svcKey] = append(k8sSlices[svcKey], slice)
+	}
+
 	result := map[string][]*ambex.Endpoint{}
 
+	for svcKey, slices := range k8sSlices {
+		svc, ok := k8sServices[svcKey]
+		if !ok {
+			continue
+		}
+		for _, ep := range k8sEndpointSlicesToAmbex(slices, svc) {
+			result[ep.ClusterName] = append(result[ep.ClusterName], ep)
+		}
+	}
+
+	// Services without EndpointSlices, e.g. on clusters that are too old to have them, fall back
+	// to their Endpoints.
 	for _, k8sEp := range ksnap.Endpoints {
 		svc, ok := k8sServices[key(k8sEp)]
 		if !ok {
 			continue
 		}
+		if _, ok := k8sSlices[key(k8sEp)]; ok {
+			continue
+		}
 		for _, ep := range k8sEndpointsToAmbex(k8sEp, svc) {
 			result[ep.ClusterName] = append(result[ep.ClusterName], ep)
 		}
 	}
 
+	consulTags := consulSubsetTags(consulMappings(ksnap))
 	for _, consulEp := range consulEndpoints {
-		for _, ep := range consulEndpointsToAmbex(ctx, consulEp) {
+		for _, ep := range consulEndpointsToAmbex(ctx, consulEp, consulTags[consulEp.Service]) {
 			result[ep.ClusterName] = append(result[ep.ClusterName], ep)
 		}
 	}
 
+	if zone := GetLocalZone(); zone != "" {
+		prioritizeZone(result, zone)
+	}
+
 	return &ambex.Endpoints{Entries: result}
 }
 
+// prioritizeZone lowers the priority of the endpoints that are known to be in zones other than the
+// given one. Endpoints whose zone isn't known are treated as local.
+func prioritizeZone(endpoints map[string][]*ambex.Endpoint, zone string) {
+	for _, eps := range endpoints {
+		for _, ep := range eps {
+			if ep.Locality.Zone != "" && ep.Locality.Zone != zone {
+				ep.Priority = 1
+			}
+		}
+	}
+}
+
 func key(resource kates.Object) string {
 	return fmt.Sprintf("%s:%s", resource.GetNamespace(), resource.GetName())
 }
 
-func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*ambex.Endpoint) {
+// servicePortNames maps each of the ways that an endpoint port can refer to a port of the service,
+// i.e. the target port, its name, or "" for a service with just one port, to the names that the
+// port's clusters are known by.
+func servicePortNames(svc *kates.Service) map[string][]string {
 	portmap := map[string][]string{}
 	for _, p := range svc.Spec.Ports {
 		port := fmt.Sprintf("%d", p.Port)
@@ -63,27 +114,47 @@ func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*amb
 			portmap[""] = append(portmap[""], "")
 		}
 	}
+	return portmap
+}
+
+// endpointPortNames returns the names of the clusters of the service port that an endpoint port
+// with the given number and name belongs to.
+func endpointPortNames(portmap map[string][]string, port int32, name string) map[string]bool {
+	portNames := map[string]bool{}
+	candidates := []string{fmt.Sprintf("%d", port), name, ""}
+	for _, c := range candidates {
+		if pns, ok := portmap[c]; ok {
+			for _, pn := range pns {
+				portNames[pn] = true
+			}
+		}
+	}
+	return portNames
+}
+
+func clusterName(svc *kates.Service, portName string) string {
+	sep := "/"
+	if portName == "" {
+		sep = ""
+	}
+	return fmt.Sprintf("k8s/%s/%s%s%s", svc.Namespace, svc.Name, sep, portName)
+}
+
+func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*ambex.Endpoint) {
+	portmap := servicePortNames(svc)
 
 	for _, subset := range ep.Subsets {
 		for _, port := range subset.Ports {
 			if port.Protocol == kates.ProtocolTCP || port.Protocol == kates.ProtocolUDP {
-				portNames := map[string]bool{}
-				candidates := []string{fmt.Sprintf("%d", port.Port), port.Name, ""}
-				for _, c := range candidates {
-					if pns, ok := portmap[c]; ok {
-						for _, pn := range pns {
-							portNames[pn] = true
-						}
-					}
-				}
+				portNames := endpointPortNames(portmap, port.Port, port.Name)
+				// Addresses that aren't ready are left out, rather than sent as unhealthy, since
+				// envoy's panic threshold would send them traffic once enough of them weren't
+				// ready. Endpoints don't say which of them are terminating, so there's nothing
+				// to drain.
 				for _, addr := range subset.Addresses {
 					for pn := range portNames {
-						sep := "/"
-						if pn == "" {
-							sep = ""
-						}
 						result = append(result, &ambex.Endpoint{
-							ClusterName: fmt.Sprintf("k8s/%s/%s%s%s", ep.Namespace, ep.Name, sep, pn),
+							ClusterName: clusterName(svc, pn),
 							Ip:          addr.IP,
 							Port:        uint32(port.Port),
 							Protocol:    string(port.Protocol),
@@ -97,22 +168,152 @@ func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*amb
 	return
 }
 
-func consulEndpointsToAmbex(ctx context.Context, endpoints consulwatch.Endpoints) (result []*ambex.Endpoint) {
+// k8sEndpointSlicesToAmbex merges all the EndpointSlices of a service. An address can briefly be
+// in more than one slice while the slices are rebalanced, in which case it's as healthy as it is in
+// the slice where it's healthiest.
+func k8sEndpointSlicesToAmbex(slices []*kates.EndpointSlice, svc *kates.Service) (result []*ambex.Endpoint) {
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Name < slices[j].Name })
+	portmap := servicePortNames(svc)
+	seen := map[string]*ambex.Endpoint{}
+
+	for _, slice := range slices {
+		if slice.AddressType != kates.AddressTypeIPv4 && slice.AddressType != kates.AddressTypeIPv6 {
+			// FQDN slices aren't made for services with selectors, and there's no IP to route to.
+			continue
+		}
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				// A slice without a port number is for a service without ports.
+				continue
+			}
+			protocol := kates.ProtocolTCP
+			if port.Protocol != nil {
+				protocol = *port.Protocol
+			}
+			if protocol != kates.ProtocolTCP && protocol != kates.ProtocolUDP {
+				continue
+			}
+			name := ""
+			if port.Name != nil {
+				name = *port.Name
+			}
+			portNames := endpointPortNames(portmap, *port.Port, name)
+			for _, endpoint := range slice.Endpoints {
+				health, ok := endpointSliceHealth(endpoint)
+				if !ok {
+					continue
+				}
+				locality := endpointSliceLocality(endpoint)
+				for _, addr := range endpoint.Addresses {
+					for pn := range portNames {
+						ep := &ambex.Endpoint{
+							ClusterName: clusterName(svc, pn),
+							Ip:          addr,
+							Port:        uint32(*port.Port),
+							Protocol:    string(protocol),
+							Health:      health,
+							Locality:    locality,
+						}
+						epKey := fmt.Sprintf("%s:%s:%d", ep.ClusterName, ep.Ip, ep.Port)
+						if prev, ok := seen[epKey]; ok {
+							if health < prev.Health {
+								prev.Health = health
+							}
+							continue
+						}
+						seen[epKey] = ep
+						result = append(result, ep)
+					}
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// endpointSliceHealth translates the conditions of an endpoint to its health, or false if the
+// endpoint should be left out. Unknown readiness means ready. An endpoint that's terminating is
+// drained, whether or not it's still serving, so that the requests it already has can finish. Any
+// other endpoint that isn't ready is left out, rather than sent as unhealthy, since envoy's panic
+// threshold would send it traffic once enough endpoints weren't ready.
+func endpointSliceHealth(endpoint kates.EndpointSliceEndpoint) (ambex.HealthStatus, bool) {
+	conditions := endpoint.Conditions
+	switch {
+	case conditions.Ready == nil || *conditions.Ready:
+		return ambex.Healthy, true
+	case conditions.Terminating != nil && *conditions.Terminating:
+		return ambex.Draining, true
+	default:
+		return 0, false
+	}
+}
+
+// endpointSliceLocality returns the zone of an endpoint, along with the region of its node if the
+// slice copied the node's topology labels.
+func endpointSliceLocality(endpoint kates.EndpointSliceEndpoint) ambex.Locality {
+	locality := ambex.Locality{
+		Region: endpoint.DeprecatedTopology[kates.LabelTopologyRegion],
+		Zone:   endpoint.DeprecatedTopology[kates.LabelTopologyZone],
+	}
+	if endpoint.Zone != nil {
+		locality.Zone = *endpoint.Zone
+	}
+	return locality
+}
+
+// consulEndpointsToAmbex translates the endpoints of a Consul service, including them in the
+// clusters of the subsets of the service with the given (lowercased) tags.
+func consulEndpointsToAmbex(ctx context.Context, endpoints consulwatch.Endpoints, subsetTags map[string]bool) (result []*ambex.Endpoint) {
 	for _, ep := range endpoints.Endpoints {
 		addrs, err := net.LookupHost(ep.Address)
 		if err != nil {
 			dlog.Errorf(ctx, "error resolving consul address %s: %+v", ep.Address, err)
 			continue
 		}
+		// Besides the cluster for the whole service, each endpoint belongs to a cluster for each of
+		// its tags that a Mapping routes to with a service of the form "_<service>._<tag>". Tags
+		// are case-insensitive, as they are in Consul's DNS lookups.
+		clusterNames := []string{fmt.Sprintf("consul/%s/%s", endpoints.Id, endpoints.Service)}
+		tags := map[string]bool{}
+		for _, tag := range ep.Tags {
+			tag = strings.ToLower(tag)
+			if subsetTags[tag] && !tags[tag] {
+				tags[tag] = true
+				clusterNames = append(clusterNames, fmt.Sprintf("consul/%s/_%s._%s", endpoints.Id, endpoints.Service, tag))
+			}
+		}
 		for _, addr := range addrs {
-			result = append(result, &ambex.Endpoint{
-				ClusterName: fmt.Sprintf("consul/%s/%s", endpoints.Id, endpoints.Service),
-				Ip:          addr,
-				Port:        uint32(ep.Port),
-				Protocol:    "TCP",
-			})
+			for _, clusterName := range clusterNames {
+				result = append(result, &ambex.Endpoint{
+					ClusterName: clusterName,
+					Ip:          addr,
+					Port:        uint32(ep.Port),
+					Protocol:    "TCP",
+					Locality: ambex.Locality{
+						Region: ep.NodeMeta["region"],
+						Zone:   ep.NodeMeta["zone"],
+					},
+					Weight: uint32(ep.Weight),
+					Health: consulHealthToAmbex(ep.Health),
+				})
+			}
 		}
 	}
 
 	return
 }
+
+// consulHealthToAmbex translates the aggregated status of a Consul service's health checks to the
+// health of its endpoints. Consul still sends traffic to services whose checks are only warning, and
+// putting a service into maintenance mode is how it's taken out of service gracefully.
+func consulHealthToAmbex(status string) ambex.HealthStatus {
+	switch status {
+	case consulapi.HealthCritical:
+		return ambex.Unhealthy
+	case consulapi.HealthMaint:
+		return ambex.Draining
+	default:
+		return ambex.Healthy
+	}
+}
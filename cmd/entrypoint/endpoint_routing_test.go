@@ -180,6 +180,182 @@ spec:
 	assert.Equal(t, "1.2.3.4", endpoints.Entries["k8s/default/foo/80"][0].Ip)
 }
 
+func TestEndpointRoutingSlices(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+	// The service's Endpoints are ignored, since it has EndpointSlices.
+	subset, err := makeSubset(8080, "9.9.9.9")
+	require.NoError(t, err)
+	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	// An address can be in two slices at once, in which case it's as healthy as either says.
+	assert.NoError(t, f.Upsert(makeEndpointSlice("default", "foo-a", "foo", 8080,
+		makeSliceEndpoint("1.2.3.4", true, true, false),
+		makeSliceEndpoint("1.2.3.5", false, false, false))))
+	assert.NoError(t, f.Upsert(makeEndpointSlice("default", "foo-b", "foo", 8080,
+		makeSliceEndpoint("1.2.3.5", true, true, false),
+		makeSliceEndpoint("1.2.3.6", false, true, true))))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(HasEndpoints("k8s/default/foo/80"))
+	require.NoError(t, err)
+	eps := endpoints.Entries["k8s/default/foo/80"]
+	require.Len(t, eps, 3)
+	assert.Equal(t, "1.2.3.4", eps[0].Ip)
+	assert.Equal(t, uint32(8080), eps[0].Port)
+	assert.Equal(t, ambex.Healthy, eps[0].Health)
+	assert.Equal(t, "1.2.3.5", eps[1].Ip)
+	assert.Equal(t, ambex.Healthy, eps[1].Health)
+	assert.Equal(t, "1.2.3.6", eps[2].Ip)
+	assert.Equal(t, ambex.Draining, eps[2].Health)
+
+	// Deleting a slice takes its addresses away.
+	assert.NoError(t, f.Delete("EndpointSlice", "default", "foo-a"))
+	f.Flush()
+	endpoints, err = f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		return len(endpoints.Entries["k8s/default/foo/80"]) == 2
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.5", endpoints.Entries["k8s/default/foo/80"][0].Ip)
+	assert.Equal(t, "1.2.3.6", endpoints.Entries["k8s/default/foo/80"][1].Ip)
+}
+
+// Test that addresses that aren't ready are left out, unless they are terminating, in which case
+// they're drained.
+func TestEndpointRoutingNotReady(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeMapping("default", "bar", "/bar", "bar", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+	assert.NoError(t, f.Upsert(makeService("default", "bar")))
+	subset, err := makeSubset(8080, "1.2.3.4")
+	require.NoError(t, err)
+	subset.NotReadyAddresses = []kates.EndpointAddress{{IP: "1.2.3.5"}}
+	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	assert.NoError(t, f.Upsert(makeEndpointSlice("default", "bar-a", "bar", 8080,
+		makeSliceEndpoint("1.2.3.6", false, false, false),
+		makeSliceEndpoint("1.2.3.7", false, false, true))))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		return HasEndpoints("k8s/default/foo/80")(endpoints) && HasEndpoints("k8s/default/bar/80")(endpoints)
+	})
+	require.NoError(t, err)
+	eps := endpoints.Entries["k8s/default/foo/80"]
+	require.Len(t, eps, 1)
+	assert.Equal(t, "1.2.3.4", eps[0].Ip)
+	assert.Equal(t, ambex.Healthy, eps[0].Health)
+	eps = endpoints.Entries["k8s/default/bar/80"]
+	require.Len(t, eps, 1)
+	assert.Equal(t, "1.2.3.7", eps[0].Ip)
+	assert.Equal(t, ambex.Draining, eps[0].Health)
+}
+
+// Test that services without EndpointSlices still get endpoints from their Endpoints.
+func TestEndpointRoutingSlicesFallback(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeMapping("default", "bar", "/bar", "bar", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+	assert.NoError(t, f.Upsert(makeService("default", "bar")))
+	subset, err := makeSubset(8080, "1.2.3.4")
+	require.NoError(t, err)
+	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	assert.NoError(t, f.Upsert(makeEndpointSlice("default", "bar-a", "bar", 8080,
+		makeSliceEndpoint("1.2.3.5", true, true, false))))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		return HasEndpoints("k8s/default/foo/80")(endpoints) && HasEndpoints("k8s/default/bar/80")(endpoints)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", endpoints.Entries["k8s/default/foo/80"][0].Ip)
+	assert.Equal(t, "1.2.3.5", endpoints.Entries["k8s/default/bar/80"][0].Ip)
+}
+
+// Test that endpoints in other zones than Ambassador's own get a lower priority.
+func TestEndpointRoutingSlicesZones(t *testing.T) {
+	t.Setenv("AMBASSADOR_ZONE", "us-east-1a")
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+	zoneA, zoneB := "us-east-1a", "us-east-1b"
+	local := makeSliceEndpoint("1.2.3.4", true, true, false)
+	local.Zone = &zoneA
+	remote := makeSliceEndpoint("1.2.3.5", true, true, false)
+	remote.Zone = &zoneB
+	remote.DeprecatedTopology = map[string]string{kates.LabelTopologyRegion: "us-east-1"}
+	unknown := makeSliceEndpoint("1.2.3.6", true, true, false)
+	assert.NoError(t, f.Upsert(makeEndpointSlice("default", "foo-a", "foo", 8080, local, remote, unknown)))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(HasEndpoints("k8s/default/foo/80"))
+	require.NoError(t, err)
+	eps := endpoints.Entries["k8s/default/foo/80"]
+	require.Len(t, eps, 3)
+	assert.Equal(t, ambex.Locality{Zone: "us-east-1a"}, eps[0].Locality)
+	assert.Equal(t, uint32(0), eps[0].Priority)
+	assert.Equal(t, ambex.Locality{Region: "us-east-1", Zone: "us-east-1b"}, eps[1].Locality)
+	assert.Equal(t, uint32(1), eps[1].Priority)
+	assert.Equal(t, ambex.Locality{}, eps[2].Locality)
+	assert.Equal(t, uint32(0), eps[2].Priority)
+}
+
+// Test that the instances of a Consul service with a tag that a Mapping routes to get a cluster of
+// their own, whatever the case of the tag.
+func TestEndpointRoutingConsulTags(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.UpsertYAML(`
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc1
+  namespace: default
+spec:
+  address: consul:8500
+  datacenter: dc1
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: hello-canary
+  namespace: default
+spec:
+  prefix: /hello/
+  service: _hello._canary
+  resolver: consul-dc1
+  load_balancer:
+    policy: round_robin
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: hello-stable
+  namespace: default
+spec:
+  prefix: /hello-stable/
+  service: _hello._Stable
+  resolver: consul-dc1
+  load_balancer:
+    policy: round_robin
+`))
+	f.ConsulEndpoint("dc1", "hello", "1.2.3.4", 8080, "Canary", "v2")
+	f.ConsulEndpoint("dc1", "hello", "1.2.3.5", 8080, "STABLE")
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(HasEndpoints("consul/dc1/_hello._canary"))
+	require.NoError(t, err)
+	require.Len(t, endpoints.Entries["consul/dc1/hello"], 2)
+	require.Len(t, endpoints.Entries["consul/dc1/_hello._canary"], 1)
+	assert.Equal(t, "1.2.3.4", endpoints.Entries["consul/dc1/_hello._canary"][0].Ip)
+	require.Len(t, endpoints.Entries["consul/dc1/_hello._stable"], 1)
+	assert.Equal(t, "1.2.3.5", endpoints.Entries["consul/dc1/_hello._stable"][0].Ip)
+	// No Mapping routes to the v2 subset, so it doesn't get a cluster.
+	assert.NotContains(t, endpoints.Entries, "consul/dc1/_hello._v2")
+	assert.Len(t, endpoints.Entries, 3)
+}
+
 func ClusterNameContains(substring string) func(*v3cluster.Cluster) bool {
 	return func(c *v3cluster.Cluster) bool {
 		return strings.Contains(c.Name, substring)
@@ -250,6 +426,30 @@ func makeEndpoints(namespace, name string, subsets ...kates.EndpointSubset) *kat
 	}
 }
 
+func makeEndpointSlice(namespace, name, service string, port int, endpoints ...kates.EndpointSliceEndpoint) *kates.EndpointSlice {
+	portNumber := int32(port)
+	protocol := kates.ProtocolTCP
+	return &kates.EndpointSlice{
+		TypeMeta: kates.TypeMeta{Kind: "EndpointSlice", APIVersion: "discovery.k8s.io/v1"},
+		ObjectMeta: kates.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{kates.LabelServiceName: service},
+		},
+		AddressType: kates.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []kates.EndpointSlicePort{{Port: &portNumber, Protocol: &protocol}},
+	}
+}
+
+func makeSliceEndpoint(address string, ready, serving, terminating bool) kates.EndpointSliceEndpoint {
+	endpoint := kates.EndpointSliceEndpoint{Addresses: []string{address}}
+	endpoint.Conditions.Ready = &ready
+	endpoint.Conditions.Serving = &serving
+	endpoint.Conditions.Terminating = &terminating
+	return endpoint
+}
+
 // makeSubset provides a convenient way to kubernetes EndpointSubset resources. Any int args are
 // ports, any ip address strings are addresses, and no ip address strings are used as the port name
 // for any ports that follow them in the arg list.
@@ -22,6 +22,10 @@ type endpointRoutingInfo struct {
 	module          moduleResolver
 	endpointWatches map[string]bool // A set to track the subset of kubernetes endpoints we care about.
 	previousWatches map[string]bool
+	// Map from "namespace:name" of each EndpointSlice to the service it belongs to. We keep the
+	// previous one so that we can still find the service of a slice that has just been deleted.
+	sliceServices         map[string]string
+	previousSliceServices map[string]string
 }
 
 type ResolverType int
@@ -69,6 +73,11 @@ func (eri *endpointRoutingInfo) reconcileEndpointWatches(ctx context.Context, s
 	eri.module = moduleResolver{}
 	eri.previousWatches = eri.endpointWatches
 	eri.endpointWatches = map[string]bool{}
+	eri.previousSliceServices = eri.sliceServices
+	eri.sliceServices = make(map[string]string, len(s.EndpointSlices))
+	for _, slice := range s.EndpointSlices {
+		eri.sliceServices[fmt.Sprintf("%s:%s", slice.Namespace, slice.Name)] = slice.Labels[kates.LabelServiceName]
+	}
 
 	// Phase one processes all the configuration stuff that Mappings depend on. Right now this
 	// includes Modules and Resolvers. When we are done with Phase one we have processed enough
@@ -151,6 +160,17 @@ func (eri *endpointRoutingInfo) watchesChanged() bool {
 	return !reflect.DeepEqual(eri.endpointWatches, eri.previousWatches)
 }
 
+// endpointSliceService returns the name of the service that an EndpointSlice belongs to, or false
+// if the slice wasn't in this snapshot or the previous one.
+func (eri *endpointRoutingInfo) endpointSliceService(namespace, name string) (string, bool) {
+	key := fmt.Sprintf("%s:%s", namespace, name)
+	if service, ok := eri.sliceServices[key]; ok {
+		return service, true
+	}
+	service, ok := eri.previousSliceServices[key]
+	return service, ok
+}
+
 // checkResourcePhase1 processes Modules and Resolvers and calls the correct type specific handler.
 func (eri *endpointRoutingInfo) checkResourcePhase1(ctx context.Context, obj kates.Object, source string) {
 	switch v := obj.(type) {
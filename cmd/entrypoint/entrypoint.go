@@ -166,9 +166,22 @@ func Main(ctx context.Context, Version string, args ...string) error {
 	}
 
 	fastpathCh := make(chan *ambex.FastpathSnapshot)
+	ambexArgs := []string{"--ads-listen-address", "127.0.0.1:8003"}
+	if addr := os.Getenv("AMBASSADOR_AMBEX_STATUS_ADDRESS"); addr != "" {
+		ambexArgs = append(ambexArgs, "--status-listen-address", addr)
+	}
+	if envbool("AMBASSADOR_AMBEX_ROLLBACK_ON_NACK") {
+		ambexArgs = append(ambexArgs, "--rollback-on-nack")
+	}
+	if envbool("AMBASSADOR_AMBEX_STRICT_VALIDATION") {
+		ambexArgs = append(ambexArgs, "--strict-validation")
+	}
+	if policy := os.Getenv("AMBASSADOR_AMBEX_UPDATE_POLICY"); policy != "" {
+		ambexArgs = append(ambexArgs, "--update-policy", policy)
+	}
+	ambexArgs = append(ambexArgs, GetEnvoyDir())
 	group.Go("ambex", func(ctx context.Context) error {
-		return ambex.Main2(ctx, Version, usage.PercentUsed, fastpathCh, "--ads-listen-address",
-			"127.0.0.1:8003", GetEnvoyDir())
+		return ambex.Main2(ctx, Version, usage.PercentUsed, fastpathCh, ambexArgs...)
 	})
 
 	group.Go("envoy", func(ctx context.Context) error {
@@ -192,6 +192,13 @@ func ForceEndpoints() bool {
 	return envbool("AMBASSADOR_FORCE_ENDPOINTS")
 }
 
+// GetLocalZone reflects AMBASSADOR_ZONE, the zone that Ambassador itself runs in. When it's set,
+// endpoints known to be in other zones get a lower priority than the rest, so that envoy only
+// fails over to them when the local zone doesn't have enough healthy endpoints.
+func GetLocalZone() string {
+	return env("AMBASSADOR_ZONE", "")
+}
+
 func GetDiagdBindPort() string {
 	return env("AMBASSADOR_DIAGD_BIND_PORT", "8004")
 }
@@ -2,6 +2,7 @@ package entrypoint
 
 import (
 	"context"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -11,6 +12,7 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 
+	"github.com/datawire/ambassador/v2/cmd/ambex"
 	"github.com/datawire/ambassador/v2/pkg/acp"
 	"github.com/datawire/ambassador/v2/pkg/debug"
 	"github.com/datawire/dlib/dhttp"
@@ -47,6 +49,27 @@ func handleCheckReady(w http.ResponseWriter, r *http.Request, ambwatch *acp.Amba
 	}
 }
 
+// handleMetrics serves diagd's metrics (which are really Envoy's), followed by ambex's. If diagd
+// isn't answering, we still serve ambex's metrics: those are the ones that say why Envoy might not
+// be getting updated.
+func handleMetrics(w http.ResponseWriter, r *http.Request, diagdOrigin *url.URL) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, diagdOrigin.ResolveReference(&url.URL{Path: "/metrics"}).String(), nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err == nil {
+			defer resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				_, _ = io.Copy(w, resp.Body)
+			}
+		}
+	}
+
+	ambex.WriteMetrics(w)
+}
+
 func healthCheckHandler(ctx context.Context, ambwatch *acp.AmbassadorWatcher) error {
 	dbg := debug.FromContext(ctx)
 
@@ -96,6 +119,13 @@ func healthCheckHandler(ctx context.Context, ambwatch *acp.AmbassadorWatcher) er
 		},
 	}
 
+	// Serve diagd's metrics along with ambex's.
+	metricsTimer := dbg.Timer("metrics")
+	sm.HandleFunc("/metrics",
+		metricsTimer.TimedHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handleMetrics(w, r, diagdOrigin)
+		}))
+
 	// Finally, use the reverseProxy to handle anything coming in on
 	// the magic catchall path.
 	sm.HandleFunc("/", reverseProxy.ServeHTTP)
@@ -10,14 +10,22 @@ import (
 
 // thingToWatch is... uh... a thing we're gonna watch. Specifically, it's a
 // K8s type name and an optional field selector.
+//
+// If ownSelectors is set, the field and label selectors are used exactly as given (empty meaning
+// "everything"), rather than falling back to AMBASSADOR_FIELD_SELECTOR and
+// AMBASSADOR_LABEL_SELECTOR, which are meant for Ambassador's own configuration.
 type thingToWatch struct {
 	typename      string
 	fieldselector string
+	labelselector string
+	ownSelectors  bool
 }
 
 type thingToMaybeWatch struct {
 	typename      string
 	fieldselector string
+	labelselector string
+	ownSelectors  bool
 	ignoreIf      bool
 }
 
@@ -39,10 +47,13 @@ func GetQueries(ctx context.Context, interestingTypes map[string]thingToWatch) [
 			Name:          snapshotname,
 			Kind:          queryinfo.typename,
 			FieldSelector: queryinfo.fieldselector,
-			LabelSelector: ls,
+			LabelSelector: queryinfo.labelselector,
 		}
-		if query.FieldSelector == "" {
-			query.FieldSelector = fs
+		if !queryinfo.ownSelectors {
+			if query.FieldSelector == "" {
+				query.FieldSelector = fs
+			}
+			query.LabelSelector = ls
 		}
 
 		queries = append(queries, query)
@@ -62,6 +73,15 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 	}
 	configMapFs := fmt.Sprintf("metadata.namespace=%s", GetCloudConnectTokenResourceNamespace())
 
+	var serverTypes map[string]kates.APIResource
+	if serverTypeList != nil {
+		serverTypes = make(map[string]kates.APIResource, len(serverTypeList))
+		for _, typeinfo := range serverTypeList {
+			serverTypes[typeinfo.Name+"."+typeinfo.Version+"."+typeinfo.Group] = typeinfo
+		}
+	}
+	_, haveEndpointSlices := serverTypes["endpointslices.v1.discovery.k8s.io"]
+
 	// We set interestingTypes to the list of types that we'd like to watch (if that type exits
 	// in this cluster).
 	//
@@ -80,9 +100,8 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 		//
 		// Note that we pull `secrets.v1.` in to "K8sSecrets".  ReconcileSecrets will pull
 		// over the ones we need into "Secrets" and "Endpoints" respectively.
-		"Services":   {{typename: "services.v1."}},                             // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
-		"Endpoints":  {{typename: "endpoints.v1.", fieldselector: endpointFs}}, // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
-		"K8sSecrets": {{typename: "secrets.v1."}},                              // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
+		"Services":   {{typename: "services.v1."}}, // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
+		"K8sSecrets": {{typename: "secrets.v1."}},  // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
 		"ConfigMaps": {{typename: "configmaps.v1.", fieldselector: configMapFs}},
 		"Ingresses": {
 			{typename: "ingresses.v1beta1.extensions"},        // New in Kubernetes 1.2.0 (2016-03-16), gone in Kubernetes 1.22.0 (2021-08-04)
@@ -93,20 +112,65 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 			{typename: "ingressclasses.v1beta1.networking.k8s.io", ignoreIf: IsAmbassadorSingleNamespace()}, // New in Kubernetes 1.18.0 (2020-03-25), gone in Kubernetes 1.22.0 (2021-08-04)
 			{typename: "ingressclasses.v1.networking.k8s.io", ignoreIf: IsAmbassadorSingleNamespace()},      // New in Kubernetes 1.19.0 (2020-08-26)
 		},
+		// Every service has EndpointSlices on clusters that serve them, so there's no need to
+		// watch the Endpoints too; makeEndpoints only falls back to Endpoints on clusters that
+		// are too old to have slices.
+		"Endpoints": {{typename: "endpoints.v1.", fieldselector: endpointFs, ignoreIf: haveEndpointSlices}}, // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
+		"EndpointSlices": {
+			{typename: "endpointslices.v1.discovery.k8s.io", fieldselector: endpointFs}, // New in Kubernetes 1.21.0 (2021-04-08)
+		},
 
 		// Gateway API (of which Emissary is one of the implementations)
 		"GatewayClasses": {
 			{typename: "gatewayclasses.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "gatewayclasses.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
 		},
 		"Gateways": {
 			{typename: "gateways.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "gateways.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
 		},
 		"HTTPRoutes": {
 			{typename: "httproutes.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "httproutes.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
 		},
+		"TCPRoutes": {
+			{typename: "tcproutes.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
+		},
+		"TLSRoutes": {
+			{typename: "tlsroutes.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
+		},
+		"UDPRoutes": {
+			{typename: "udproutes.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
+		},
+		"GatewayClassesV1": {
+			{typename: "gatewayclasses.v1beta1.gateway.networking.k8s.io"}, // New in gateway-api 0.5.0 (2022-07-13)
+			{typename: "gatewayclasses.v1.gateway.networking.k8s.io"},      // New in gateway-api 1.0.0 (2023-10-31)
+		},
+		"GatewaysV1": {
+			{typename: "gateways.v1beta1.gateway.networking.k8s.io"}, // New in gateway-api 0.5.0 (2022-07-13)
+			{typename: "gateways.v1.gateway.networking.k8s.io"},      // New in gateway-api 1.0.0 (2023-10-31)
+		},
+		"HTTPRoutesV1": {
+			{typename: "httproutes.v1beta1.gateway.networking.k8s.io"}, // New in gateway-api 0.5.0 (2022-07-13)
+			{typename: "httproutes.v1.gateway.networking.k8s.io"},      // New in gateway-api 1.0.0 (2023-10-31)
+		},
+		"GRPCRoutesV1": {
+			{typename: "grpcroutes.v1.gateway.networking.k8s.io"}, // New in gateway-api 1.1.0 (2024-05-09)
+		},
+		"TCPRoutesV1": {
+			{typename: "tcproutes.v1alpha2.gateway.networking.k8s.io"}, // New in gateway-api 0.4.0 (2021-10-20)
+		},
+		"TLSRoutesV1": {
+			{typename: "tlsroutes.v1alpha2.gateway.networking.k8s.io"}, // New in gateway-api 0.4.0 (2021-10-20)
+		},
+		"UDPRoutesV1": {
+			{typename: "udproutes.v1alpha2.gateway.networking.k8s.io"}, // New in gateway-api 0.4.0 (2021-10-20)
+		},
+		// ReferenceGrants allow routes to refer to backends in other namespaces.
+		"ReferenceGrants": {
+			{typename: "referencegrants.v1beta1.gateway.networking.k8s.io"}, // New in gateway-api 0.6.0
+		},
+		// Namespace labels are used by Gateway listeners that select routes with
+		// `allowedRoutes.namespaces.from: Selector`. The selector can match any namespace,
+		// whatever its labels, so the Ambassador selectors don't apply.
+		"Namespaces": {{typename: "namespaces.v1.", ownSelectors: true, ignoreIf: IsAmbassadorSingleNamespace()}},
 
 		// Knative types
 		//
@@ -132,14 +196,6 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 		"TracingServices":             {{typename: "tracingservices.v3alpha1.getambassador.io"}},
 	}
 
-	var serverTypes map[string]kates.APIResource
-	if serverTypeList != nil {
-		serverTypes = make(map[string]kates.APIResource, len(serverTypeList))
-		for _, typeinfo := range serverTypeList {
-			serverTypes[typeinfo.Name+"."+typeinfo.Version+"."+typeinfo.Group] = typeinfo
-		}
-	}
-
 	ret := make(map[string]thingToWatch)
 	for k, queryinfos := range interestingTypes {
 		var last thingToWatch
@@ -147,7 +203,12 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 			if queryinfo.ignoreIf {
 				continue
 			}
-			last = thingToWatch{queryinfo.typename, queryinfo.fieldselector}
+			last = thingToWatch{
+				typename:      queryinfo.typename,
+				fieldselector: queryinfo.fieldselector,
+				labelselector: queryinfo.labelselector,
+				ownSelectors:  queryinfo.ownSelectors,
+			}
 			if _, haveType := serverTypes[queryinfo.typename]; haveType || serverTypes == nil {
 				ret[k] = last
 			}
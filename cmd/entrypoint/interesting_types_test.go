@@ -0,0 +1,49 @@
+package entrypoint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/v2/pkg/kates"
+	"github.com/datawire/dlib/dlog"
+)
+
+func TestGetQueriesSelectors(t *testing.T) {
+	t.Setenv("AMBASSADOR_LABEL_SELECTOR", "app=ambassador")
+	t.Setenv("AMBASSADOR_FIELD_SELECTOR", "metadata.name!=skip")
+
+	ctx := dlog.NewTestContext(t, false)
+	queries := map[string]kates.Query{}
+	for _, query := range GetQueries(ctx, GetInterestingTypes(ctx, nil)) {
+		queries[query.Name] = query
+	}
+
+	// Ambassador's own configuration gets the Ambassador selectors...
+	require.Contains(t, queries, "Mappings")
+	assert.Equal(t, "app=ambassador", queries["Mappings"].LabelSelector)
+	assert.Equal(t, "metadata.name!=skip", queries["Mappings"].FieldSelector)
+
+	// ...but a Gateway listener's namespace selector can match any namespace, so the Namespaces
+	// query mustn't filter on them.
+	require.Contains(t, queries, "Namespaces")
+	assert.Equal(t, "", queries["Namespaces"].LabelSelector)
+	assert.Equal(t, "", queries["Namespaces"].FieldSelector)
+}
+
+func TestGetInterestingTypesEndpoints(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	endpoints := kates.APIResource{Name: "endpoints", Version: "v1"}
+	slices := kates.APIResource{Name: "endpointslices", Version: "v1", Group: "discovery.k8s.io"}
+
+	// Clusters that serve EndpointSlices only need those...
+	types := GetInterestingTypes(ctx, []kates.APIResource{endpoints, slices})
+	assert.Contains(t, types, "EndpointSlices")
+	assert.NotContains(t, types, "Endpoints")
+
+	// ...and older clusters fall back to Endpoints.
+	types = GetInterestingTypes(ctx, []kates.APIResource{endpoints})
+	assert.NotContains(t, types, "EndpointSlices")
+	assert.Contains(t, types, "Endpoints")
+}
@@ -8,6 +8,8 @@ import (
 	"path"
 	"time"
 
+	consulapi "github.com/hashicorp/consul/api"
+
 	"github.com/datawire/ambassador/v2/pkg/kates"
 	"github.com/datawire/ambassador/v2/pkg/snapshot/v1"
 	snapshotTypes "github.com/datawire/ambassador/v2/pkg/snapshot/v1"
@@ -83,6 +85,22 @@ func (src *istioCertSource) Watch(ctx context.Context) (IstioCertWatcher, error)
 		}
 	}
 
+	// Consul Connect certificates come over the same update channel. They're keyed off the
+	// environment variable AMBASSADOR_CONSUL_CONNECT_SERVICE, which names the Connect service
+	// whose identity we use; the Consul agent to talk to comes from the usual CONSUL_HTTP_ADDR
+	// and friends.
+	if connectService := os.Getenv("AMBASSADOR_CONSUL_CONNECT_SERVICE"); connectService != "" {
+		consul, err := consulapi.NewClient(consulapi.DefaultConfig())
+		if err != nil {
+			return nil, err
+		}
+
+		ccert := NewConsulConnectCert("consul-connect-certs", GetAmbassadorNamespace(), istioCertUpdateChannel)
+		if err := ccert.Watch(ctx, consul, connectService); err != nil {
+			return nil, err
+		}
+	}
+
 	return &istioCertWatcher{
 		updateChannel: istioCertUpdateChannel,
 	}, nil
@@ -0,0 +1,66 @@
+package entrypoint
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+
+	v3core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	v3matcher "github.com/datawire/ambassador/v2/pkg/api/envoy/type/matcher/v3"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+)
+
+// SDSSecretName is the name that ambex serves a Kubernetes Secret under over SDS: "name.namespace",
+// the same way that Ambassador refers to secrets everywhere else. A Secret with a certificate is
+// also served as a validation context, under SDSSecretName + "-ca", for a TLSContext's ca_secret.
+func SDSSecretName(secret *kates.Secret) string {
+	return fmt.Sprintf("%s.%s", secret.GetName(), secret.GetNamespace())
+}
+
+// SPIFFETrustDomainAnnotation marks a Secret whose CA signs SPIFFE identities in a trust domain,
+// such as the Consul Connect certificates. Its validation context only accepts certificates with
+// a URI SAN in that trust domain, rather than anything that the CA has signed.
+const SPIFFETrustDomainAnnotation = "getambassador.io/spiffe-trust-domain"
+
+// makeSDSSecrets turns the secrets that ReconcileSecrets found into secrets for ambex to serve over
+// SDS, so that a new certificate reaches Envoy on the fastpath without changing any listeners.
+func makeSDSSecrets(secrets []*kates.Secret) []*v3tls.Secret {
+	var result []*v3tls.Secret
+	for _, secret := range secrets {
+		name := SDSSecretName(secret)
+		cert, key := secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey]
+		if len(cert) > 0 && len(key) > 0 {
+			result = append(result, &v3tls.Secret{
+				Name: name,
+				Type: &v3tls.Secret_TlsCertificate{TlsCertificate: &v3tls.TlsCertificate{
+					CertificateChain: &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: cert}},
+					PrivateKey:       &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: key}},
+				}},
+			})
+		}
+		// A ca_secret has always been read from tls.crt, so that's the fallback when there's no
+		// ca.crt.
+		ca := secret.Data["ca.crt"]
+		if len(ca) == 0 {
+			ca = cert
+		}
+		if len(ca) > 0 {
+			validation := &v3tls.CertificateValidationContext{
+				TrustedCa: &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: ca}},
+			}
+			if trustDomain := secret.GetAnnotations()[SPIFFETrustDomainAnnotation]; trustDomain != "" {
+				validation.MatchSubjectAltNames = []*v3matcher.StringMatcher{{
+					MatchPattern: &v3matcher.StringMatcher_Prefix{Prefix: "spiffe://" + trustDomain + "/"},
+				}}
+			}
+			result = append(result, &v3tls.Secret{
+				Name: name + "-ca",
+				Type: &v3tls.Secret_ValidationContext{ValidationContext: validation},
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
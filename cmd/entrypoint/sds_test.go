@@ -0,0 +1,58 @@
+package entrypoint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/ambassador/v2/pkg/kates"
+)
+
+func TestMakeSDSSecrets(t *testing.T) {
+	secrets := makeSDSSecrets([]*kates.Secret{
+		{
+			ObjectMeta: kates.ObjectMeta{Name: "tls", Namespace: "default"},
+			Data:       map[string][]byte{"tls.crt": []byte("CERT"), "tls.key": []byte("KEY"), "ca.crt": []byte("CA")},
+		},
+		{
+			ObjectMeta: kates.ObjectMeta{Name: "client-ca", Namespace: "default"},
+			Data:       map[string][]byte{"tls.crt": []byte("CLIENT-CA")},
+		},
+		{
+			ObjectMeta: kates.ObjectMeta{Name: "opaque", Namespace: "default"},
+			Data:       map[string][]byte{"password": []byte("hunter2")},
+		},
+	})
+	require.Len(t, secrets, 3)
+
+	// A secret with only a certificate is still a CA for a TLSContext's ca_secret.
+	assert.Equal(t, "client-ca.default-ca", secrets[0].Name)
+	assert.Equal(t, []byte("CLIENT-CA"), secrets[0].GetValidationContext().GetTrustedCa().GetInlineBytes())
+
+	assert.Equal(t, "tls.default", secrets[1].Name)
+	assert.Equal(t, []byte("CERT"), secrets[1].GetTlsCertificate().GetCertificateChain().GetInlineBytes())
+	assert.Equal(t, []byte("KEY"), secrets[1].GetTlsCertificate().GetPrivateKey().GetInlineBytes())
+
+	assert.Equal(t, "tls.default-ca", secrets[2].Name)
+	assert.Equal(t, []byte("CA"), secrets[2].GetValidationContext().GetTrustedCa().GetInlineBytes())
+}
+
+func TestMakeSDSSecretsSPIFFE(t *testing.T) {
+	secrets := makeSDSSecrets([]*kates.Secret{{
+		ObjectMeta: kates.ObjectMeta{
+			Name:        "consul-connect-certs",
+			Namespace:   "ambassador",
+			Annotations: map[string]string{SPIFFETrustDomainAnnotation: "example.consul"},
+		},
+		Data: map[string][]byte{"tls.crt": []byte("LEAF"), "tls.key": []byte("KEY"), "ca.crt": []byte("ROOTS")},
+	}})
+	require.Len(t, secrets, 2)
+
+	// Only SPIFFE identities in the trust domain are trusted, not everything that the roots sign.
+	assert.Equal(t, "consul-connect-certs.ambassador-ca", secrets[1].Name)
+	validation := secrets[1].GetValidationContext()
+	assert.Equal(t, []byte("ROOTS"), validation.GetTrustedCa().GetInlineBytes())
+	require.Len(t, validation.GetMatchSubjectAltNames(), 1)
+	assert.Equal(t, "spiffe://example.consul/", validation.GetMatchSubjectAltNames()[0].GetPrefix())
+}
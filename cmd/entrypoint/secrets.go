@@ -10,13 +10,16 @@ import (
 	"strconv"
 	"strings"
 
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
 	amb "github.com/datawire/ambassador/v2/pkg/api/getambassador.io/v3alpha1"
+	"github.com/datawire/ambassador/v2/pkg/gateway"
 	"github.com/datawire/ambassador/v2/pkg/kates"
 	"github.com/datawire/ambassador/v2/pkg/kates/k8s_resource_types"
 	snapshotTypes "github.com/datawire/ambassador/v2/pkg/snapshot/v1"
 	"github.com/datawire/dlib/derror"
 	"github.com/datawire/dlib/dlog"
 	v1 "k8s.io/api/core/v1"
+	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
 )
 
 // checkSecret checks whether a secret is valid, and adds it to the list of secrets
@@ -221,35 +224,27 @@ func ReconcileSecrets(ctx context.Context, sh *SnapshotHolder) error {
 		resources = append(resources, i)
 	}
 
-	// OK. Once that's done, we can check to see if we should be
-	// doing secret namespacing or not -- this requires a look into
-	// the Ambassador Module, if it's present.
-	//
-	// XXX Linear searches suck, but whatever, it's just not gonna
-	// be all that many things. We won't bother optimizing this unless
-	// a profiler shows that it's a problem.
-
-	secretNamespacing := true
-	for _, resource := range resources {
-		mod, ok := resource.(*amb.Module)
-		// We don't need to recheck ambassador_id on this Module because
-		// the Module can't have made it into the resources list without
-		// its ambassador_id being checked.
+	// Gateways don't have an ambassador_id either; their listeners' certificates get served over
+	// SDS.
+	for _, g := range sh.k8sSnapshot.Gateways {
+		resources = append(resources, g)
+	}
+	for _, g := range sh.k8sSnapshot.GatewaysV1 {
+		resources = append(resources, g)
+	}
 
-		if ok && mod.GetName() == "ambassador" {
-			// XXX ModuleSecrets is a _godawful_ hack. See the comment on
-			// ModuleSecrets itself for more.
-			secs := ModuleSecrets{}
-			err := convert(mod.Spec.Config, &secs)
-			if err != nil {
-				dlog.Errorf(ctx, "error parsing module: %v", err)
-				continue
-			}
-			secretNamespacing = secs.Defaults.TLSSecretNamespacing
-			break
+	// ConsulResolvers can refer to an ACL token and to TLS credentials for talking to Consul.
+	for _, cr := range sh.k8sSnapshot.ConsulResolvers {
+		if include(cr.Spec.AmbassadorID) {
+			resources = append(resources, cr)
 		}
 	}
 
+	// OK. Once that's done, we can check to see if we should be
+	// doing secret namespacing or not -- this requires a look into
+	// the Ambassador Module, if it's present.
+	secretNamespacing := getSecretNamespacing(ctx, resources)
+
 	// Once we have our list of secrets, go figure out the names of all
 	// the secrets we need. We'll use this "refs" map to hold all the names...
 	refs := map[snapshotTypes.SecretRef]bool{}
@@ -265,6 +260,14 @@ func ReconcileSecrets(ctx context.Context, sh *SnapshotHolder) error {
 	for _, resource := range resources {
 		// ...and for each resource, dig out any secrets being referenced.
 		findSecretRefs(ctx, resource, secretNamespacing, action)
+
+		// v1 Gateways can refer to Secrets in other namespaces, but only where a
+		// ReferenceGrant allows it.
+		if g, ok := resource.(*gwv1.Gateway); ok {
+			for _, ref := range gateway.CertificateRefsV1(g, sh.k8sSnapshot.ReferenceGrants) {
+				secretRef(ref.Namespace, ref.Name, false, action)
+			}
+		}
 	}
 
 	// We _always_ have an implicit references to the cloud-connec-token secret...
@@ -313,6 +316,34 @@ func ReconcileSecrets(ctx context.Context, sh *SnapshotHolder) error {
 	return nil
 }
 
+// getSecretNamespacing returns whether the Ambassador Module among the given resources, if there
+// is one, allows secrets to be referred to with the `{name}.{namespace}` notation.
+//
+// XXX Linear searches suck, but whatever, it's just not gonna
+// be all that many things. We won't bother optimizing this unless
+// a profiler shows that it's a problem.
+func getSecretNamespacing(ctx context.Context, resources []kates.Object) bool {
+	for _, resource := range resources {
+		mod, ok := resource.(*amb.Module)
+		// We don't need to recheck ambassador_id on this Module because
+		// the Module can't have made it into the resources list without
+		// its ambassador_id being checked.
+
+		if ok && mod.GetName() == "ambassador" {
+			// XXX ModuleSecrets is a _godawful_ hack. See the comment on
+			// ModuleSecrets itself for more.
+			secs := ModuleSecrets{}
+			err := convert(mod.Spec.Config, &secs)
+			if err != nil {
+				dlog.Errorf(ctx, "error parsing module: %v", err)
+				continue
+			}
+			return secs.Defaults.TLSSecretNamespacing
+		}
+	}
+	return true
+}
+
 // Find all the secrets a given Ambassador resource references.
 func findSecretRefs(ctx context.Context, resource kates.Object, secretNamespacing bool, action func(snapshotTypes.SecretRef)) {
 	switch r := resource.(type) {
@@ -385,6 +416,29 @@ func findSecretRefs(ctx context.Context, resource kates.Object, secretNamespacin
 			secretRef(r.GetNamespace(), secs.Client.Secret, secretNamespacing, action)
 		}
 
+	case *amb.ConsulResolver:
+		// ConsulResolver.spec.token_secret and ConsulResolver.spec.tls_secret follow the global
+		// secretNamespacing setting; findConsulSecret has to look them up the same way.
+		if r.Spec.TokenSecret != "" {
+			secretRef(r.GetNamespace(), r.Spec.TokenSecret, secretNamespacing, action)
+		}
+		if r.Spec.TLSSecret != "" {
+			secretRef(r.GetNamespace(), r.Spec.TLSSecret, secretNamespacing, action)
+		}
+
+	case *gw.Gateway:
+		// Gateway listeners refer to their certificates with LocalObjectReferences, so the
+		// Secret is always in the Gateway's namespace.
+		for _, l := range r.Spec.Listeners {
+			if l.TLS == nil || l.TLS.CertificateRef == nil || l.TLS.CertificateRef.Name == "" {
+				continue
+			}
+			if kind := l.TLS.CertificateRef.Kind; kind != "" && kind != "Secret" {
+				continue
+			}
+			secretRef(r.GetNamespace(), l.TLS.CertificateRef.Name, false, action)
+		}
+
 	case *k8s_resource_types.Ingress:
 		// Ingress is pretty straightforward, too, just look in spec.tls.
 		for _, itls := range r.Spec.TLS {
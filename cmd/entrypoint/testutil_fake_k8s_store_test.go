@@ -58,7 +58,7 @@ func (k *K8sStore) Upsert(resource kates.Object) error {
 		return err
 	}
 
-	kind, apiVersion, err := canonGVK(un.GetKind())
+	kind, apiVersion, err := canonGVK(un.GetKind() + "." + un.GroupVersionKind().Group)
 	if err != nil {
 		return err
 	}
@@ -211,10 +211,14 @@ func canonGVK(rawString string) (canonKind string, canonGroupVersion string, err
 		return "Service", "v1", nil
 	case "endpoints":
 		return "Endpoints", "v1", nil
+	case "endpointslice", "endpointslices":
+		return "EndpointSlice", "discovery.k8s.io/v1", nil
 	case "secret", "secrets":
 		return "Secret", "v1", nil
 	case "configmap", "configmaps":
 		return "ConfigMap", "v1", nil
+	case "namespace", "namespaces":
+		return "Namespace", "v1", nil
 	case "ingress", "ingresses":
 		if strings.HasSuffix(rawVG, ".knative.dev") {
 			return "Ingress", "networking.internal.knative.dev/v1alpha1", nil
@@ -224,11 +228,39 @@ func canonGVK(rawString string) (canonKind string, canonGroupVersion string, err
 		return "IngressClass", "networking.k8s.io/v1", nil
 	// Gateway API
 	case "gatewayclass", "gatewayclasses":
+		if strings.HasSuffix(rawVG, "gateway.networking.k8s.io") {
+			return "GatewayClass", "gateway.networking.k8s.io/v1", nil
+		}
 		return "GatewayClass", "networking.x-k8s.io/v1alpha1", nil
 	case "gateway", "gateways":
+		if strings.HasSuffix(rawVG, "gateway.networking.k8s.io") {
+			return "Gateway", "gateway.networking.k8s.io/v1", nil
+		}
 		return "Gateway", "networking.x-k8s.io/v1alpha1", nil
 	case "httproute", "httproutes":
+		if strings.HasSuffix(rawVG, "gateway.networking.k8s.io") {
+			return "HTTPRoute", "gateway.networking.k8s.io/v1", nil
+		}
 		return "HTTPRoute", "networking.x-k8s.io/v1alpha1", nil
+	case "tcproute", "tcproutes":
+		if strings.HasSuffix(rawVG, "gateway.networking.k8s.io") {
+			return "TCPRoute", "gateway.networking.k8s.io/v1alpha2", nil
+		}
+		return "TCPRoute", "networking.x-k8s.io/v1alpha1", nil
+	case "tlsroute", "tlsroutes":
+		if strings.HasSuffix(rawVG, "gateway.networking.k8s.io") {
+			return "TLSRoute", "gateway.networking.k8s.io/v1alpha2", nil
+		}
+		return "TLSRoute", "networking.x-k8s.io/v1alpha1", nil
+	case "udproute", "udproutes":
+		if strings.HasSuffix(rawVG, "gateway.networking.k8s.io") {
+			return "UDPRoute", "gateway.networking.k8s.io/v1alpha2", nil
+		}
+		return "UDPRoute", "networking.x-k8s.io/v1alpha1", nil
+	case "grpcroute", "grpcroutes":
+		return "GRPCRoute", "gateway.networking.k8s.io/v1", nil
+	case "referencegrant", "referencegrants":
+		return "ReferenceGrant", "gateway.networking.k8s.io/v1beta1", nil
 	// Knative types
 	case "clusteringress", "clusteringresses":
 		return "ClusterIngress", "networking.internal.knative.dev/v1alpha1", nil
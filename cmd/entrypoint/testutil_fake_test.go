@@ -13,6 +13,8 @@ import (
 	"testing"
 	"time"
 
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
 	"github.com/datawire/ambassador/v2/cmd/ambex"
 	"github.com/datawire/ambassador/v2/cmd/entrypoint/internal/testqueue"
 	v3bootstrap "github.com/datawire/ambassador/v2/pkg/api/envoy/config/bootstrap/v3"
@@ -273,6 +275,7 @@ func (f *Fake) runWatcher(ctx context.Context) error {
 		f.istioCertSource,
 		f.notifySnapshot,
 		f.notifyFastpath,
+		nil, // statusWriter
 		f.ambassadorMeta,
 	)
 }
@@ -293,6 +296,18 @@ func (f *Fake) GetEndpoints(predicate func(*ambex.Endpoints) bool) (*ambex.Endpo
 	return untyped.(*ambex.FastpathSnapshot).Endpoints, nil
 }
 
+// GetFastpath will return the next fastpath snapshot that satisfies the supplied predicate.
+func (f *Fake) GetFastpath(predicate func(*ambex.FastpathSnapshot) bool) (*ambex.FastpathSnapshot, error) {
+	f.T.Helper()
+	untyped, err := f.fastpath.Get(f.T, func(obj interface{}) bool {
+		return predicate(obj.(*ambex.FastpathSnapshot))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return untyped.(*ambex.FastpathSnapshot), nil
+}
+
 func (f *Fake) AssertEndpointsEmpty(timeout time.Duration) {
 	f.T.Helper()
 	f.fastpath.AssertEmpty(f.T, timeout, "endpoints queue not empty")
@@ -514,15 +529,25 @@ func (f *fakeK8sWatcher) FilteredUpdate(_ context.Context, target interface{}, d
 }
 
 func matches(query kates.Query, obj kates.Object) (bool, error) {
-	queryKind, err := canon(query.Kind)
+	queryKind, queryGroupVersion, err := canonGVK(query.Kind)
+	if err != nil {
+		return false, err
+	}
+	gvk := obj.GetObjectKind().GroupVersionKind()
+	objKind, objGroupVersion, err := canonGVK(gvk.Kind + "." + gvk.Group)
+	if err != nil {
+		return false, err
+	}
+	// The Gateway API kinds exist in more than one group, so the group has to match too.
+	queryGV, err := schema.ParseGroupVersion(queryGroupVersion)
 	if err != nil {
 		return false, err
 	}
-	objKind, err := canon(obj.GetObjectKind().GroupVersionKind().Kind)
+	objGV, err := schema.ParseGroupVersion(objGroupVersion)
 	if err != nil {
 		return false, err
 	}
-	return queryKind == objKind, nil
+	return queryKind == objKind && queryGV.Group == objGV.Group, nil
 }
 
 type fakeWatcher struct {
@@ -530,18 +555,30 @@ type fakeWatcher struct {
 	store *ConsulStore
 }
 
-func (f *fakeWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, svc string, endpoints chan consulwatch.Endpoints) (Stopper, error) {
+func (f *fakeWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, _ consulCredentials, endpoints chan consulwatch.Endpoints) (consulConnection, error) {
+	return &fakeConnection{watcher: f, resolver: resolver, endpoints: endpoints}, nil
+}
+
+type fakeConnection struct {
+	watcher   *fakeWatcher
+	resolver  *amb.ConsulResolver
+	endpoints chan consulwatch.Endpoints
+}
+
+func (f *fakeConnection) Watch(svc string, _ uint64) consulServiceWatch {
 	var sent consulwatch.Endpoints
-	stop := f.fake.consulNotifier.Listen(func() {
-		ep, ok := f.store.Get(resolver.Spec.Datacenter, svc)
+	stop := f.watcher.fake.consulNotifier.Listen(func() {
+		ep, ok := f.watcher.store.Get(f.resolver.Spec.Datacenter, svc)
 		if ok && !reflect.DeepEqual(ep, sent) {
-			endpoints <- ep
+			f.endpoints <- ep
 			sent = ep
 		}
 	})
-	return &fakeStopper{stop}, nil
+	return &fakeStopper{stop}
 }
 
+func (f *fakeConnection) Stop() {}
+
 type fakeStopper struct {
 	stop StopFunc
 }
@@ -550,6 +587,10 @@ func (f *fakeStopper) Stop() {
 	f.stop()
 }
 
+func (f *fakeStopper) Index() uint64 {
+	return 0
+}
+
 type fakeIstioCertSource struct {
 	updateChannel chan IstioCertUpdate
 }
@@ -1,12 +1,21 @@
 package entrypoint_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/datawire/ambassador/v2/cmd/ambex"
 	"github.com/datawire/ambassador/v2/cmd/entrypoint"
 	v3bootstrap "github.com/datawire/ambassador/v2/pkg/api/envoy/config/bootstrap/v3"
 	v3 "github.com/datawire/ambassador/v2/pkg/api/envoy/type/v3"
@@ -325,3 +334,63 @@ func TestFakeIstioCert(t *testing.T) {
 		t.Errorf("needed 2 secrets, got %d", len(k.Secrets))
 	}
 }
+
+// makeTestCertPEM returns a new self-signed certificate and its key, PEM-encoded.
+func makeTestCertPEM(t *testing.T, commonName string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// sdsCertificate returns the certificate chain of the named SDS secret in a fastpath snapshot, or
+// "" if it isn't there.
+func sdsCertificate(fastpath *ambex.FastpathSnapshot, name string) string {
+	for _, secret := range fastpath.Secrets {
+		if secret.Name == name {
+			return string(secret.GetTlsCertificate().GetCertificateChain().GetInlineBytes())
+		}
+	}
+	return ""
+}
+
+func TestFakeIstioCertRotation(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: false}, nil)
+	f.AutoFlush(true)
+
+	assert.NoError(t, f.UpsertFile("testdata/tls-snap.yaml"))
+	_, err := f.GetSnapshot(AnySnapshot)
+	require.NoError(t, err)
+
+	// Each new Istio certificate goes to ambex over SDS, under the same name, without having to
+	// wait for something else to change.
+	for _, cn := range []string{"istio-1", "istio-2"} {
+		cert, key := makeTestCertPEM(t, cn)
+		f.SendIstioCertUpdate(entrypoint.IstioCertUpdate{
+			Op:        "update",
+			Name:      "test-istio-secret",
+			Namespace: "default",
+			Secret: &kates.Secret{
+				TypeMeta:   kates.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+				ObjectMeta: kates.ObjectMeta{Name: "test-istio-secret", Namespace: "default"},
+				Type:       kates.SecretTypeTLS,
+				Data:       map[string][]byte{"tls.crt": cert, "tls.key": key},
+			},
+		})
+		_, err := f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+			return sdsCertificate(fastpath, "test-istio-secret.default") == string(cert)
+		})
+		require.NoError(t, err, cn)
+	}
+}
@@ -8,12 +8,16 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"golang.org/x/time/rate"
 	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
 
 	"github.com/datawire/ambassador/v2/cmd/ambex"
 	"github.com/datawire/ambassador/v2/pkg/acp"
+	v3tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+	gwv1alpha2 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1alpha2"
 	"github.com/datawire/ambassador/v2/pkg/debug"
-	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
 	"github.com/datawire/ambassador/v2/pkg/gateway"
 	"github.com/datawire/ambassador/v2/pkg/kates"
 	"github.com/datawire/ambassador/v2/pkg/snapshot/v1"
@@ -62,6 +66,7 @@ func WatchAllTheThings(
 	k8sSrc := newK8sSource(client)
 	consulSrc := watchConsul
 	istioCertSrc := newIstioCertSource()
+	statusWriter := newGatewayStatusWriter(ctx, client, interestingTypes)
 
 	return watchAllTheThingsInternal(
 		ctx,
@@ -72,10 +77,31 @@ func WatchAllTheThings(
 		istioCertSrc,
 		notify,         // snapshotProcessor
 		fastpathUpdate, // fastpathProcessor
+		statusWriter,
 		ambassadorMeta,
 	)
 }
 
+// newGatewayStatusWriter returns the StatusWriter for Gateway API resources, or nil if we aren't
+// watching any Gateway API resources or writing their status is disabled.
+func newGatewayStatusWriter(ctx context.Context, client *kates.Client, interestingTypes map[string]thingToWatch) *gateway.StatusWriter {
+	if _, ok := interestingTypes["GatewaysV1"]; !ok || envbool("AMBASSADOR_DISABLE_GATEWAY_STATUS") {
+		return nil
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		dlog.Errorf(ctx, "not writing Gateway API status: %v", err)
+		return nil
+	}
+	// Only one replica writes status at a time, so that they don't fight over it.
+	elector := gateway.NewLeaderElector(client, gateway.LeaderElectorConfig{
+		Namespace: GetAmbassadorNamespace(),
+		Name:      fmt.Sprintf("ambassador-gateway-status-%s", GetAmbassadorId()),
+		Identity:  identity,
+	})
+	return gateway.NewStatusWriter(client, elector, rate.Limit(10), 10)
+}
+
 func getAmbassadorMeta(ambassadorID string, clusterID string, version string, client *kates.Client) *snapshot.AmbassadorMetaInfo {
 	ambMeta := &snapshot.AmbassadorMetaInfo{
 		ClusterID:         clusterID,
@@ -175,6 +201,7 @@ func watchAllTheThingsInternal(
 	istioCertSrc IstioCertSource,
 	snapshotProcessor SnapshotProcessor,
 	fastpathProcessor FastpathProcessor,
+	statusWriter *gateway.StatusWriter,
 	ambassadorMeta *snapshot.AmbassadorMetaInfo,
 ) error {
 	// Ambassador has three sources of inputs: kubernetes, consul, and the filesystem. The job
@@ -230,6 +257,13 @@ func watchAllTheThingsInternal(
 		return err
 	}
 
+	// The status of Gateway API resources gets written back to the cluster as the dispatcher
+	// compiles them.
+	if statusWriter != nil {
+		snapshots.statusWriter = statusWriter
+		grp.Go("gatewayStatus", statusWriter.Run)
+	}
+
 	// This points to notifyCh when we have updated information to send and nil when we have no new
 	// information. This is deliberately nil to begin with as we have nothing to send yet.
 	var out chan *SnapshotHolder
@@ -275,7 +309,7 @@ func watchAllTheThingsInternal(
 				out = notifyCh
 			case icertUpdate := <-istio.Changed():
 				// The Istio cert has some changes, so we need to handle them.
-				if _, err := snapshots.IstioUpdate(ctx, istio, icertUpdate); err != nil {
+				if _, err := snapshots.IstioUpdate(ctx, istio, icertUpdate, fastpathProcessor); err != nil {
 					return err
 				}
 				out = notifyCh
@@ -318,6 +352,7 @@ type SnapshotHolder struct {
 
 	endpointRoutingInfo endpointRoutingInfo
 	dispatcher          *gateway.Dispatcher
+	statusWriter        *gateway.StatusWriter
 
 	// Serial number that tracks if we need to send snapshot changes or not. This is incremented
 	// when a change worth sending is made, and we copy it over to snapshotNotifiedCount when the
@@ -343,6 +378,70 @@ func NewSnapshotHolder(ambassadorMeta *snapshot.AmbassadorMetaInfo) (*SnapshotHo
 	if err != nil {
 		return nil, err
 	}
+	err = disp.Register("TCPRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TCPRoute(untyped.(*gw.TCPRoute))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.Register("TLSRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TLSRoute(untyped.(*gw.TLSRoute))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.Register("UDPRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_UDPRoute(untyped.(*gw.UDPRoute))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterTransform("Gateway.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_GatewayV1(untyped.(*gwv1.Gateway), query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterTransform("HTTPRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_HTTPRouteV1(untyped.(*gwv1.HTTPRoute), query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterTransform("GRPCRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_GRPCRouteV1(untyped.(*gwv1.GRPCRoute), query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterTransform("TCPRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TCPRouteV1(untyped.(*gwv1alpha2.TCPRoute), query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterTransform("TLSRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TLSRouteV1(untyped.(*gwv1alpha2.TLSRoute), query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterTransform("UDPRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_UDPRouteV1(untyped.(*gwv1alpha2.UDPRoute), query)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Routes look up ReferenceGrants to see whether they may use backends in other namespaces.
+	err = disp.RegisterQueryable(gateway.ReferenceGrantKind)
+	if err != nil {
+		return nil, err
+	}
+	// Gateway listeners look up the Secrets of their certificateRefs.
+	err = disp.RegisterQueryable(gateway.SecretKind)
+	if err != nil {
+		return nil, err
+	}
 	validator, err := newResourceValidator()
 	if err != nil {
 		return nil, err
@@ -375,8 +474,10 @@ func (sh *SnapshotHolder) K8sUpdate(
 
 	endpointsChanged := false
 	dispatcherChanged := false
+	secretsChanged := false
 	var endpoints *ambex.Endpoints
-	var dispSnapshot *ecp_v2_cache.Snapshot
+	var dispSnapshot *ecp_v3_cache.Snapshot
+	var secrets []*v3tls.Secret
 	changed, err := func() (bool, error) {
 		sh.mutex.Lock()
 		defer sh.mutex.Unlock()
@@ -460,28 +561,51 @@ func (sh *SnapshotHolder) K8sUpdate(
 		for _, delta := range deltas {
 			sh.unsentDeltas = append(sh.unsentDeltas, delta)
 
-			if delta.Kind == "Endpoints" {
-				key := fmt.Sprintf("%s:%s", delta.Namespace, delta.Name)
-				if sh.endpointRoutingInfo.endpointWatches[key] || sh.dispatcher.IsWatched(delta.Namespace, delta.Name) {
+			if delta.Kind == "Endpoints" || delta.Kind == "EndpointSlice" {
+				// EndpointSlices aren't reliably named after their service, so we look up the
+				// service that the slice is labeled with. A slice that we never saw can't be
+				// looked up, so we have to assume that its service is watched.
+				service, found := delta.Name, true
+				if delta.Kind == "EndpointSlice" {
+					service, found = sh.endpointRoutingInfo.endpointSliceService(delta.Namespace, delta.Name)
+				}
+				key := fmt.Sprintf("%s:%s", delta.Namespace, service)
+				if !found || sh.endpointRoutingInfo.endpointWatches[key] || sh.dispatcher.IsWatched(delta.Namespace, service) {
 					endpointsChanged = true
 				}
 			} else {
 				endpointsOnly = false
 			}
 
-			if sh.dispatcher.IsRegistered(delta.Kind) {
+			if delta.Kind == "Secret" {
+				// A new certificate can go straight to Envoy over SDS.
+				secretsChanged = true
+			}
+
+			if kind, ok := sh.dispatcher.RegisteredKind(delta.GroupVersionKind()); ok {
 				dispatcherChanged = true
 				if delta.DeltaType == kates.ObjectDelete {
-					sh.dispatcher.DeleteKey(delta.Kind, delta.Namespace, delta.Name)
+					sh.dispatcher.DeleteKey(kind, delta.Namespace, delta.Name)
 				}
 			}
+
+			if delta.Kind == "Namespace" {
+				// Gateway listeners can select routes by namespace label.
+				dispatcherChanged = true
+			}
+
+			if delta.Kind == "GatewayClass" {
+				// Whether we write the status of a Gateway depends on its GatewayClass.
+				dispatcherChanged = true
+			}
 		}
 		if !endpointsOnly {
 			sh.snapshotChangeCount += 1
 		}
 
-		if endpointsChanged || dispatcherChanged {
+		if endpointsChanged || dispatcherChanged || secretsChanged {
 			endpoints = makeEndpoints(ctx, sh.k8sSnapshot, sh.consulSnapshot.Endpoints)
+			secrets = makeSDSSecrets(sh.k8sSnapshot.Secrets)
 			for _, gwc := range sh.k8sSnapshot.GatewayClasses {
 				if err := sh.dispatcher.Upsert(gwc); err != nil {
 					// TODO: Should this be more severe?
@@ -501,7 +625,75 @@ func (sh *SnapshotHolder) K8sUpdate(
 					dlog.Error(ctx, err)
 				}
 			}
+			for _, tr := range sh.k8sSnapshot.TCPRoutes {
+				if err := sh.dispatcher.Upsert(tr); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, tr := range sh.k8sSnapshot.TLSRoutes {
+				if err := sh.dispatcher.Upsert(tr); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, ur := range sh.k8sSnapshot.UDPRoutes {
+				if err := sh.dispatcher.Upsert(ur); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, gw := range sh.k8sSnapshot.GatewaysV1 {
+				if err := sh.dispatcher.Upsert(gw); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, hr := range sh.k8sSnapshot.HTTPRoutesV1 {
+				if err := sh.dispatcher.Upsert(hr); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, gr := range sh.k8sSnapshot.GRPCRoutesV1 {
+				if err := sh.dispatcher.Upsert(gr); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, tr := range sh.k8sSnapshot.TCPRoutesV1 {
+				if err := sh.dispatcher.Upsert(tr); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, tr := range sh.k8sSnapshot.TLSRoutesV1 {
+				if err := sh.dispatcher.Upsert(tr); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, ur := range sh.k8sSnapshot.UDPRoutesV1 {
+				if err := sh.dispatcher.Upsert(ur); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, rg := range sh.k8sSnapshot.ReferenceGrants {
+				if err := sh.dispatcher.Upsert(rg); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			for _, secret := range sh.k8sSnapshot.Secrets {
+				// Istio's certificates are in the snapshot as Secrets without a kind, and
+				// can't be used by Gateways anyway.
+				if secret.Kind != "Secret" {
+					continue
+				}
+				if err := sh.dispatcher.Upsert(secret); err != nil {
+					dlog.Error(ctx, err)
+				}
+			}
+			sh.dispatcher.SetNamespaces(sh.k8sSnapshot.Namespaces)
 			_, dispSnapshot = sh.dispatcher.GetSnapshot(ctx)
+			if sh.statusWriter != nil {
+				sh.statusWriter.Update(sh.dispatcher.GatewayAPIStatus(
+					sh.k8sSnapshot.GatewayClassesV1,
+					sh.k8sSnapshot.GatewaysV1,
+					gatewayRoutesV1(sh.k8sSnapshot),
+				))
+			}
 		}
 
 		return true, nil
@@ -510,10 +702,11 @@ func (sh *SnapshotHolder) K8sUpdate(
 		return changed, err
 	}
 
-	if endpointsChanged || dispatcherChanged {
+	if endpointsChanged || dispatcherChanged || secretsChanged {
 		fastpath := &ambex.FastpathSnapshot{
 			Endpoints: endpoints,
 			Snapshot:  dispSnapshot,
+			Secrets:   secrets,
 		}
 		fastpathProcessor(ctx, fastpath)
 	}
@@ -521,46 +714,92 @@ func (sh *SnapshotHolder) K8sUpdate(
 	return changed, nil
 }
 
+// gatewayRoutesV1 returns all the routes in the snapshot that attach to v1 Gateways, for writing
+// their status.
+func gatewayRoutesV1(snap *snapshot.KubernetesSnapshot) []kates.Object {
+	var routes []kates.Object
+	for _, r := range snap.HTTPRoutesV1 {
+		routes = append(routes, r)
+	}
+	for _, r := range snap.GRPCRoutesV1 {
+		routes = append(routes, r)
+	}
+	for _, r := range snap.TCPRoutesV1 {
+		routes = append(routes, r)
+	}
+	for _, r := range snap.TLSRoutesV1 {
+		routes = append(routes, r)
+	}
+	for _, r := range snap.UDPRoutesV1 {
+		routes = append(routes, r)
+	}
+	return routes
+}
+
 func (sh *SnapshotHolder) ConsulUpdate(ctx context.Context, consulWatcher *consulWatcher, fastpathProcessor FastpathProcessor) bool {
 	var endpoints *ambex.Endpoints
-	var dispSnapshot *ecp_v2_cache.Snapshot
+	var dispSnapshot *ecp_v3_cache.Snapshot
+	var secrets []*v3tls.Secret
 	func() {
 		sh.mutex.Lock()
 		defer sh.mutex.Unlock()
 		consulWatcher.update(sh.consulSnapshot)
 		endpoints = makeEndpoints(ctx, sh.k8sSnapshot, sh.consulSnapshot.Endpoints)
 		_, dispSnapshot = sh.dispatcher.GetSnapshot(ctx)
+		secrets = makeSDSSecrets(sh.k8sSnapshot.Secrets)
 	}()
 	fastpathProcessor(ctx, &ambex.FastpathSnapshot{
 		Endpoints: endpoints,
 		Snapshot:  dispSnapshot,
+		Secrets:   secrets,
 	})
 	return true
 }
 
 func (sh *SnapshotHolder) IstioUpdate(ctx context.Context, istio *istioCertWatchManager,
-	icertUpdate IstioCertUpdate) (bool, error) {
+	icertUpdate IstioCertUpdate, fastpathProcessor FastpathProcessor) (bool, error) {
 	dbg := debug.FromContext(ctx)
 
 	istioCertUpdateTimer := dbg.Timer("istioCertUpdate")
 	reconcileSecretsTimer := dbg.Timer("reconcileSecrets")
 
-	sh.mutex.Lock()
-	defer sh.mutex.Unlock()
+	var endpoints *ambex.Endpoints
+	var dispSnapshot *ecp_v3_cache.Snapshot
+	var secrets []*v3tls.Secret
+	err := func() error {
+		sh.mutex.Lock()
+		defer sh.mutex.Unlock()
 
-	istioCertUpdateTimer.Time(func() {
-		istio.Update(ctx, icertUpdate, sh.k8sSnapshot)
-	})
+		istioCertUpdateTimer.Time(func() {
+			istio.Update(ctx, icertUpdate, sh.k8sSnapshot)
+		})
 
-	var err error
-	reconcileSecretsTimer.Time(func() {
-		err = ReconcileSecrets(ctx, sh)
-	})
+		var err error
+		reconcileSecretsTimer.Time(func() {
+			err = ReconcileSecrets(ctx, sh)
+		})
+		if err != nil {
+			return err
+		}
+
+		sh.snapshotChangeCount += 1
+
+		// Envoy refers to the certificate by the same SDS name before and after it changes, so
+		// the new one only reaches Envoy if we send it on the fastpath.
+		endpoints = makeEndpoints(ctx, sh.k8sSnapshot, sh.consulSnapshot.Endpoints)
+		_, dispSnapshot = sh.dispatcher.GetSnapshot(ctx)
+		secrets = makeSDSSecrets(sh.k8sSnapshot.Secrets)
+		return nil
+	}()
 	if err != nil {
 		return false, err
 	}
 
-	sh.snapshotChangeCount += 1
+	fastpathProcessor(ctx, &ambex.FastpathSnapshot{
+		Endpoints: endpoints,
+		Snapshot:  dispSnapshot,
+		Secrets:   secrets,
+	})
 	return true, nil
 }
 
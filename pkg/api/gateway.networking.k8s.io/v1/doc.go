@@ -0,0 +1,56 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package v1 contains the parts of the gateway.networking.k8s.io v1 API (Gateway API) that
+// Emissary implements.
+//
+// The types are copied from sigs.k8s.io/gateway-api/apis/v1, with the kubebuilder validation
+// markers and most of the documentation left out; see https://gateway-api.sigs.k8s.io/reference/spec/
+// for those.  We can't just import them, because every release of gateway-api that has them needs
+// a newer k8s.io/apimachinery than we can use.  Fields that we don't use are still here, so that
+// resources survive a round trip through these types (as they do when we write their status).
+//
+// The v1beta1 versions of GatewayClass, Gateway, and HTTPRoute are the same as the v1 versions;
+// the v1beta1 package just makes these types available under that apiVersion too.  GRPCRoute
+// went straight from v1alpha2 to v1, so it's only here.
+//
+// +groupName=gateway.networking.k8s.io
+// +versionName=v1
+// +kubebuilder:object:generate=true
+package v1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is group version used to register these objects
+	GroupVersion = schema.GroupVersion{Group: "gateway.networking.k8s.io", Version: "v1"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types in this group-version to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(
+		&GatewayClass{}, &GatewayClassList{},
+		&Gateway{}, &GatewayList{},
+		&HTTPRoute{}, &HTTPRouteList{},
+		&GRPCRoute{}, &GRPCRouteList{},
+	)
+}
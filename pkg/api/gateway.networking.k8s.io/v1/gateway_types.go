@@ -0,0 +1,199 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Gateway represents an instance of a service-traffic handling infrastructure by binding
+// Listeners to a set of IP addresses.
+//
+// +kubebuilder:object:root=true
+type Gateway struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GatewaySpec   `json:"spec"`
+	Status GatewayStatus `json:"status,omitempty"`
+}
+
+// GatewaySpec defines the desired state of Gateway.
+type GatewaySpec struct {
+	GatewayClassName ObjectName       `json:"gatewayClassName"`
+	Listeners        []Listener       `json:"listeners"`
+	Addresses        []GatewayAddress `json:"addresses,omitempty"`
+}
+
+// Listener embodies the concept of a logical endpoint where a Gateway accepts network
+// connections.
+type Listener struct {
+	// Name is the name of the Listener, unique within the Gateway.  Routes can attach to just
+	// this Listener by using it as the SectionName of their ParentReference.
+	Name SectionName `json:"name"`
+
+	// Hostname specifies the virtual hostname to match for protocol types that define this
+	// concept.  If it's not set, all hostnames match.
+	Hostname *Hostname `json:"hostname,omitempty"`
+
+	Port     PortNumber        `json:"port"`
+	Protocol ProtocolType      `json:"protocol"`
+	TLS      *GatewayTLSConfig `json:"tls,omitempty"`
+
+	// AllowedRoutes defines the types of routes that may be attached to the Listener and the
+	// namespaces they may be in.  It defaults to routes of the kinds that match the Listener's
+	// protocol, in the Gateway's namespace.
+	AllowedRoutes *AllowedRoutes `json:"allowedRoutes,omitempty"`
+}
+
+// ProtocolType defines the application protocol accepted by a Listener.
+type ProtocolType string
+
+const (
+	HTTPProtocolType  ProtocolType = "HTTP"
+	HTTPSProtocolType ProtocolType = "HTTPS"
+	TLSProtocolType   ProtocolType = "TLS"
+	TCPProtocolType   ProtocolType = "TCP"
+	UDPProtocolType   ProtocolType = "UDP"
+)
+
+// GatewayTLSConfig describes a TLS configuration.
+type GatewayTLSConfig struct {
+	Mode            *TLSModeType                      `json:"mode,omitempty"`
+	CertificateRefs []SecretObjectReference           `json:"certificateRefs,omitempty"`
+	Options         map[AnnotationKey]AnnotationValue `json:"options,omitempty"`
+}
+
+// TLSModeType type defines how a Gateway handles TLS sessions.
+type TLSModeType string
+
+const (
+	// TLSModeTerminate terminates TLS at the Gateway.  This is the default.
+	TLSModeTerminate TLSModeType = "Terminate"
+	// TLSModePassthrough passes the TLS session through to the backend.
+	TLSModePassthrough TLSModeType = "Passthrough"
+)
+
+// AllowedRoutes defines which Routes may be attached to this Listener.
+type AllowedRoutes struct {
+	Namespaces *RouteNamespaces `json:"namespaces,omitempty"`
+	Kinds      []RouteGroupKind `json:"kinds,omitempty"`
+}
+
+// FromNamespaces specifies namespace from which Routes may be attached to a Gateway.
+type FromNamespaces string
+
+const (
+	NamespacesFromAll      FromNamespaces = "All"
+	NamespacesFromSelector FromNamespaces = "Selector"
+	NamespacesFromSame     FromNamespaces = "Same"
+)
+
+// RouteNamespaces indicate which namespaces Routes should be selected from.
+type RouteNamespaces struct {
+	// From indicates where Routes will be selected for this Gateway.  It defaults to "Same".
+	From *FromNamespaces `json:"from,omitempty"`
+
+	// Selector must be specified when From is set to "Selector".
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// RouteGroupKind indicates the group and kind of a Route resource.
+type RouteGroupKind struct {
+	Group *Group `json:"group,omitempty"`
+	Kind  Kind   `json:"kind"`
+}
+
+// GatewayAddress describes an address that can be bound to a Gateway.
+type GatewayAddress struct {
+	Type  *AddressType `json:"type,omitempty"`
+	Value string       `json:"value"`
+}
+
+// GatewayStatusAddress describes a network address that is bound to a Gateway.
+type GatewayStatusAddress struct {
+	Type  *AddressType `json:"type,omitempty"`
+	Value string       `json:"value"`
+}
+
+// GatewayStatus defines the observed state of Gateway.
+type GatewayStatus struct {
+	Addresses  []GatewayStatusAddress `json:"addresses,omitempty"`
+	Conditions []metav1.Condition     `json:"conditions,omitempty"`
+	Listeners  []ListenerStatus       `json:"listeners,omitempty"`
+}
+
+// GatewayConditionType is a type of condition associated with a Gateway.
+type GatewayConditionType string
+
+// GatewayConditionReason defines the set of reasons that explain why a particular Gateway
+// condition type has been raised.
+type GatewayConditionReason string
+
+const (
+	GatewayConditionAccepted       GatewayConditionType   = "Accepted"
+	GatewayReasonAccepted          GatewayConditionReason = "Accepted"
+	GatewayReasonListenersNotValid GatewayConditionReason = "ListenersNotValid"
+
+	GatewayConditionProgrammed GatewayConditionType   = "Programmed"
+	GatewayReasonProgrammed    GatewayConditionReason = "Programmed"
+	GatewayReasonInvalid       GatewayConditionReason = "Invalid"
+)
+
+// ListenerStatus is the status associated with a Listener.
+type ListenerStatus struct {
+	Name           SectionName        `json:"name"`
+	SupportedKinds []RouteGroupKind   `json:"supportedKinds"`
+	AttachedRoutes int32              `json:"attachedRoutes"`
+	Conditions     []metav1.Condition `json:"conditions"`
+}
+
+// ListenerConditionType is a type of condition associated with the listener.
+type ListenerConditionType string
+
+// ListenerConditionReason defines the set of reasons that explain why a particular Listener
+// condition type has been raised.
+type ListenerConditionReason string
+
+const (
+	ListenerConditionAccepted         ListenerConditionType   = "Accepted"
+	ListenerReasonAccepted            ListenerConditionReason = "Accepted"
+	ListenerReasonPortUnavailable     ListenerConditionReason = "PortUnavailable"
+	ListenerReasonUnsupportedProtocol ListenerConditionReason = "UnsupportedProtocol"
+
+	ListenerConditionConflicted    ListenerConditionType   = "Conflicted"
+	ListenerReasonHostnameConflict ListenerConditionReason = "HostnameConflict"
+	ListenerReasonProtocolConflict ListenerConditionReason = "ProtocolConflict"
+	ListenerReasonNoConflicts      ListenerConditionReason = "NoConflicts"
+
+	ListenerConditionResolvedRefs       ListenerConditionType   = "ResolvedRefs"
+	ListenerReasonResolvedRefs          ListenerConditionReason = "ResolvedRefs"
+	ListenerReasonInvalidCertificateRef ListenerConditionReason = "InvalidCertificateRef"
+	ListenerReasonInvalidRouteKinds     ListenerConditionReason = "InvalidRouteKinds"
+	ListenerReasonRefNotPermitted       ListenerConditionReason = "RefNotPermitted"
+
+	ListenerConditionProgrammed ListenerConditionType   = "Programmed"
+	ListenerReasonProgrammed    ListenerConditionReason = "Programmed"
+	ListenerReasonInvalid       ListenerConditionReason = "Invalid"
+)
+
+// GatewayList contains a list of Gateways.
+//
+// +kubebuilder:object:root=true
+type GatewayList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Gateway `json:"items"`
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GatewayClass describes a class of Gateways available to the user for creating Gateway
+// resources.
+//
+// +kubebuilder:object:root=true
+type GatewayClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GatewayClassSpec   `json:"spec"`
+	Status GatewayClassStatus `json:"status,omitempty"`
+}
+
+// GatewayClassSpec reflects the configuration of a class of Gateways.
+type GatewayClassSpec struct {
+	// ControllerName is the name of the controller that is managing Gateways of this class.
+	ControllerName GatewayController `json:"controllerName"`
+
+	ParametersRef *ParametersReference `json:"parametersRef,omitempty"`
+	Description   *string              `json:"description,omitempty"`
+}
+
+// ParametersReference identifies an API object containing controller-specific configuration.
+type ParametersReference struct {
+	Group     Group      `json:"group"`
+	Kind      Kind       `json:"kind"`
+	Name      string     `json:"name"`
+	Namespace *Namespace `json:"namespace,omitempty"`
+}
+
+// GatewayClassConditionType is the type of a condition in GatewayClassStatus.
+type GatewayClassConditionType string
+
+// GatewayClassConditionReason is the reason for a condition in GatewayClassStatus.
+type GatewayClassConditionReason string
+
+const (
+	GatewayClassConditionStatusAccepted GatewayClassConditionType   = "Accepted"
+	GatewayClassReasonAccepted          GatewayClassConditionReason = "Accepted"
+	GatewayClassReasonInvalidParameters GatewayClassConditionReason = "InvalidParameters"
+)
+
+// GatewayClassStatus is the current status for the GatewayClass.
+type GatewayClassStatus struct {
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// GatewayClassList contains a list of GatewayClass
+//
+// +kubebuilder:object:root=true
+type GatewayClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GatewayClass `json:"items"`
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GRPCRoute provides a way to route gRPC requests.
+//
+// +kubebuilder:object:root=true
+type GRPCRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GRPCRouteSpec   `json:"spec,omitempty"`
+	Status GRPCRouteStatus `json:"status,omitempty"`
+}
+
+// GRPCRouteSpec defines the desired state of GRPCRoute
+type GRPCRouteSpec struct {
+	CommonRouteSpec `json:",inline"`
+
+	// Hostnames defines a set of hostnames that should match against the HTTP Host header (the
+	// :authority pseudo-header, in HTTP/2) to select a GRPCRoute to process the request.  If it's
+	// empty, all hostnames match.
+	Hostnames []Hostname `json:"hostnames,omitempty"`
+
+	Rules []GRPCRouteRule `json:"rules,omitempty"`
+}
+
+// GRPCRouteRule defines the semantics for matching a gRPC request based on conditions (matches),
+// processing it (filters), and forwarding the request to an API object (backendRefs).
+type GRPCRouteRule struct {
+	// Matches define conditions used for matching the rule against incoming gRPC requests.  If
+	// there are none, the rule matches all requests.
+	Matches     []GRPCRouteMatch  `json:"matches,omitempty"`
+	Filters     []GRPCRouteFilter `json:"filters,omitempty"`
+	BackendRefs []GRPCBackendRef  `json:"backendRefs,omitempty"`
+}
+
+// GRPCRouteMatch defines the predicate used to match requests to a given action.  All of its
+// conditions must be satisfied.
+type GRPCRouteMatch struct {
+	Method  *GRPCMethodMatch  `json:"method,omitempty"`
+	Headers []GRPCHeaderMatch `json:"headers,omitempty"`
+}
+
+// GRPCMethodMatch describes how to select a gRPC route by matching the gRPC request service
+// and/or method.  At least one of Service and Method must be set.
+type GRPCMethodMatch struct {
+	Type    *GRPCMethodMatchType `json:"type,omitempty"`
+	Service *string              `json:"service,omitempty"`
+	Method  *string              `json:"method,omitempty"`
+}
+
+// GRPCMethodMatchType specifies the semantics of how gRPC methods and services are compared.
+type GRPCMethodMatchType string
+
+const (
+	GRPCMethodMatchExact             GRPCMethodMatchType = "Exact"
+	GRPCMethodMatchRegularExpression GRPCMethodMatchType = "RegularExpression"
+)
+
+// GRPCHeaderMatch describes how to select a gRPC route by matching gRPC request headers.
+type GRPCHeaderMatch struct {
+	Type  *GRPCHeaderMatchType `json:"type,omitempty"`
+	Name  GRPCHeaderName       `json:"name"`
+	Value string               `json:"value"`
+}
+
+// GRPCHeaderMatchType specifies the semantics of how gRPC header values should be compared.
+type GRPCHeaderMatchType string
+
+const (
+	GRPCHeaderMatchExact             GRPCHeaderMatchType = "Exact"
+	GRPCHeaderMatchRegularExpression GRPCHeaderMatchType = "RegularExpression"
+)
+
+// GRPCHeaderName is the name of a gRPC header.
+type GRPCHeaderName HTTPHeaderName
+
+// GRPCRouteFilterType identifies a type of GRPCRoute filter.
+type GRPCRouteFilterType string
+
+const (
+	GRPCRouteFilterRequestHeaderModifier  GRPCRouteFilterType = "RequestHeaderModifier"
+	GRPCRouteFilterResponseHeaderModifier GRPCRouteFilterType = "ResponseHeaderModifier"
+	GRPCRouteFilterRequestMirror          GRPCRouteFilterType = "RequestMirror"
+	GRPCRouteFilterExtensionRef           GRPCRouteFilterType = "ExtensionRef"
+)
+
+// GRPCRouteFilter defines processing steps that must be completed during the request or response
+// lifecycle.
+type GRPCRouteFilter struct {
+	Type                   GRPCRouteFilterType      `json:"type"`
+	RequestHeaderModifier  *HTTPHeaderFilter        `json:"requestHeaderModifier,omitempty"`
+	ResponseHeaderModifier *HTTPHeaderFilter        `json:"responseHeaderModifier,omitempty"`
+	RequestMirror          *HTTPRequestMirrorFilter `json:"requestMirror,omitempty"`
+	ExtensionRef           *LocalObjectReference    `json:"extensionRef,omitempty"`
+}
+
+// GRPCBackendRef defines how a GRPCRoute forwards a gRPC request.
+type GRPCBackendRef struct {
+	BackendRef `json:",inline"`
+	Filters    []GRPCRouteFilter `json:"filters,omitempty"`
+}
+
+// GRPCRouteStatus defines the observed state of GRPCRoute.
+type GRPCRouteStatus struct {
+	RouteStatus `json:",inline"`
+}
+
+// GRPCRouteList contains a list of GRPCRoute.
+//
+// +kubebuilder:object:root=true
+type GRPCRouteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []GRPCRoute `json:"items"`
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ParentReference identifies an API object (usually a Gateway) that can be considered a parent of
+// this resource (usually a route).
+type ParentReference struct {
+	Group       *Group       `json:"group,omitempty"`
+	Kind        *Kind        `json:"kind,omitempty"`
+	Namespace   *Namespace   `json:"namespace,omitempty"`
+	Name        ObjectName   `json:"name"`
+	SectionName *SectionName `json:"sectionName,omitempty"`
+	Port        *PortNumber  `json:"port,omitempty"`
+}
+
+// CommonRouteSpec defines the common attributes that all Routes MUST include within their spec.
+type CommonRouteSpec struct {
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+}
+
+// PortNumber defines a network port.
+type PortNumber int32
+
+// BackendRef defines how a Route should forward a request to a Kubernetes resource.
+type BackendRef struct {
+	BackendObjectReference `json:",inline"`
+
+	// Weight specifies the proportion of requests forwarded to the referenced backend.  It
+	// defaults to 1.
+	Weight *int32 `json:"weight,omitempty"`
+}
+
+// RouteConditionType is a type of condition for a route.
+type RouteConditionType string
+
+// RouteConditionReason is a reason for a route condition.
+type RouteConditionReason string
+
+const (
+	RouteConditionAccepted                RouteConditionType   = "Accepted"
+	RouteReasonAccepted                   RouteConditionReason = "Accepted"
+	RouteReasonNotAllowedByListeners      RouteConditionReason = "NotAllowedByListeners"
+	RouteReasonNoMatchingListenerHostname RouteConditionReason = "NoMatchingListenerHostname"
+	RouteReasonNoMatchingParent           RouteConditionReason = "NoMatchingParent"
+	RouteReasonUnsupportedValue           RouteConditionReason = "UnsupportedValue"
+
+	RouteConditionResolvedRefs RouteConditionType   = "ResolvedRefs"
+	RouteReasonResolvedRefs    RouteConditionReason = "ResolvedRefs"
+	RouteReasonRefNotPermitted RouteConditionReason = "RefNotPermitted"
+	RouteReasonInvalidKind     RouteConditionReason = "InvalidKind"
+	RouteReasonBackendNotFound RouteConditionReason = "BackendNotFound"
+)
+
+// RouteParentStatus describes the status of a route with respect to an associated Parent.
+type RouteParentStatus struct {
+	ParentRef      ParentReference    `json:"parentRef"`
+	ControllerName GatewayController  `json:"controllerName"`
+	Conditions     []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// RouteStatus defines the common attributes that all Routes MUST include within their status.
+type RouteStatus struct {
+	Parents []RouteParentStatus `json:"parents"`
+}
+
+// Hostname is the fully qualified domain name of a network host, optionally with a "*." wildcard
+// prefix.
+type Hostname string
+
+// PreciseHostname is the fully qualified domain name of a network host, without a wildcard.
+type PreciseHostname string
+
+// Group refers to a Kubernetes Group.  The empty string is the core API group.
+type Group string
+
+// Kind refers to a Kubernetes Kind.
+type Kind string
+
+// ObjectName refers to the name of a Kubernetes object.
+type ObjectName string
+
+// Namespace refers to a Kubernetes namespace.
+type Namespace string
+
+// SectionName is the name of a section in a Kubernetes resource, like a Gateway's listener.
+type SectionName string
+
+// GatewayController is the name of a Gateway API controller, like "example.net/gateway-controller".
+type GatewayController string
+
+// AnnotationKey is the key of an annotation in Gateway API.
+type AnnotationKey string
+
+// AnnotationValue is the value of an annotation in Gateway API.
+type AnnotationValue string
+
+// AddressType defines how a network address is represented as a text string.
+type AddressType string
+
+const (
+	IPAddressType       AddressType = "IPAddress"
+	HostnameAddressType AddressType = "Hostname"
+)
+
+// LocalObjectReference identifies an API object within the namespace of the referrer.
+type LocalObjectReference struct {
+	Group Group      `json:"group"`
+	Kind  Kind       `json:"kind"`
+	Name  ObjectName `json:"name"`
+}
+
+// SecretObjectReference identifies an API object, including its namespace, defaulting to Secret.
+type SecretObjectReference struct {
+	Group     *Group     `json:"group,omitempty"`
+	Kind      *Kind      `json:"kind,omitempty"`
+	Name      ObjectName `json:"name"`
+	Namespace *Namespace `json:"namespace,omitempty"`
+}
+
+// BackendObjectReference identifies an API object, including its namespace, defaulting to
+// Service.
+type BackendObjectReference struct {
+	Group     *Group      `json:"group,omitempty"`
+	Kind      *Kind       `json:"kind,omitempty"`
+	Name      ObjectName  `json:"name"`
+	Namespace *Namespace  `json:"namespace,omitempty"`
+	Port      *PortNumber `json:"port,omitempty"`
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package v1alpha2 contains the parts of the gateway.networking.k8s.io v1alpha2 API (Gateway API)
+// that Emissary implements: TCPRoute, TLSRoute, and UDPRoute, which haven't made it to v1.
+//
+// Like the v1 package, the types are copied from sigs.k8s.io/gateway-api/apis/v1alpha2, with the
+// kubebuilder validation markers and most of the documentation left out.  They're built from the
+// v1 types that they share with the other routes.
+//
+// +groupName=gateway.networking.k8s.io
+// +versionName=v1alpha2
+// +kubebuilder:object:generate=true
+package v1alpha2
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is group version used to register these objects
+	GroupVersion = schema.GroupVersion{Group: "gateway.networking.k8s.io", Version: "v1alpha2"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types in this group-version to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func init() {
+	SchemeBuilder.Register(
+		&TCPRoute{}, &TCPRouteList{},
+		&TLSRoute{}, &TLSRouteList{},
+		&UDPRoute{}, &UDPRouteList{},
+	)
+}
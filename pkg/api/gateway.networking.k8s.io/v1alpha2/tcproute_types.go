@@ -0,0 +1,59 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+)
+
+// TCPRoute provides a way to route TCP connections.
+//
+// +kubebuilder:object:root=true
+type TCPRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TCPRouteSpec   `json:"spec,omitempty"`
+	Status TCPRouteStatus `json:"status,omitempty"`
+}
+
+// TCPRouteSpec defines the desired state of TCPRoute
+type TCPRouteSpec struct {
+	gwv1.CommonRouteSpec `json:",inline"`
+
+	Rules []TCPRouteRule `json:"rules"`
+}
+
+// TCPRouteRule is the configuration for a given rule.
+type TCPRouteRule struct {
+	// BackendRefs defines the backend(s) where matching connections should be sent.
+	BackendRefs []gwv1.BackendRef `json:"backendRefs,omitempty"`
+}
+
+// TCPRouteStatus defines the observed state of TCPRoute
+type TCPRouteStatus struct {
+	gwv1.RouteStatus `json:",inline"`
+}
+
+// TCPRouteList contains a list of TCPRoute
+//
+// +kubebuilder:object:root=true
+type TCPRouteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TCPRoute `json:"items"`
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+)
+
+// TLSRoute provides a way to route TLS connections, by their SNI.
+//
+// +kubebuilder:object:root=true
+type TLSRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TLSRouteSpec   `json:"spec,omitempty"`
+	Status TLSRouteStatus `json:"status,omitempty"`
+}
+
+// TLSRouteSpec defines the desired state of TLSRoute
+type TLSRouteSpec struct {
+	gwv1.CommonRouteSpec `json:",inline"`
+
+	// Hostnames defines a set of SNI names that should match against the SNI attribute of the TLS
+	// ClientHello message in the TLS handshake.  If it's empty, all SNI names match.
+	Hostnames []gwv1.Hostname `json:"hostnames,omitempty"`
+
+	Rules []TLSRouteRule `json:"rules"`
+}
+
+// TLSRouteRule is the configuration for a given rule.
+type TLSRouteRule struct {
+	// BackendRefs defines the backend(s) where matching connections should be sent.
+	BackendRefs []gwv1.BackendRef `json:"backendRefs,omitempty"`
+}
+
+// TLSRouteStatus defines the observed state of TLSRoute
+type TLSRouteStatus struct {
+	gwv1.RouteStatus `json:",inline"`
+}
+
+// TLSRouteList contains a list of TLSRoute
+//
+// +kubebuilder:object:root=true
+type TLSRouteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TLSRoute `json:"items"`
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+)
+
+// UDPRoute provides a way to route UDP datagrams.
+//
+// +kubebuilder:object:root=true
+type UDPRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   UDPRouteSpec   `json:"spec,omitempty"`
+	Status UDPRouteStatus `json:"status,omitempty"`
+}
+
+// UDPRouteSpec defines the desired state of UDPRoute
+type UDPRouteSpec struct {
+	gwv1.CommonRouteSpec `json:",inline"`
+
+	Rules []UDPRouteRule `json:"rules"`
+}
+
+// UDPRouteRule is the configuration for a given rule.
+type UDPRouteRule struct {
+	// BackendRefs defines the backend(s) where matching datagrams should be sent.
+	BackendRefs []gwv1.BackendRef `json:"backendRefs,omitempty"`
+}
+
+// UDPRouteStatus defines the observed state of UDPRoute
+type UDPRouteStatus struct {
+	gwv1.RouteStatus `json:",inline"`
+}
+
+// UDPRouteList contains a list of UDPRoute
+//
+// +kubebuilder:object:root=true
+type UDPRouteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []UDPRoute `json:"items"`
+}
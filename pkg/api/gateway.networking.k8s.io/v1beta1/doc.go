@@ -0,0 +1,60 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package v1beta1 contains the parts of the gateway.networking.k8s.io v1beta1 API (Gateway API)
+// that Emissary implements.
+//
+// GatewayClass, Gateway, and HTTPRoute are the same in v1beta1 as in v1, so (like upstream's
+// sigs.k8s.io/gateway-api/apis/v1beta1) this package just registers the v1 types under the
+// v1beta1 apiVersion.  ReferenceGrant has no v1 version, so it's defined here.
+//
+// +groupName=gateway.networking.k8s.io
+// +versionName=v1beta1
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+)
+
+var (
+	// GroupVersion is group version used to register these objects
+	GroupVersion = schema.GroupVersion{Group: "gateway.networking.k8s.io", Version: "v1beta1"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types in this group-version to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+type (
+	GatewayClass     = gwv1.GatewayClass
+	GatewayClassList = gwv1.GatewayClassList
+	Gateway          = gwv1.Gateway
+	GatewayList      = gwv1.GatewayList
+	HTTPRoute        = gwv1.HTTPRoute
+	HTTPRouteList    = gwv1.HTTPRouteList
+)
+
+func init() {
+	SchemeBuilder.Register(
+		&GatewayClass{}, &GatewayClassList{},
+		&Gateway{}, &GatewayList{},
+		&HTTPRoute{}, &HTTPRouteList{},
+		&ReferenceGrant{}, &ReferenceGrantList{},
+	)
+}
@@ -0,0 +1,74 @@
+// Copyright 2022 The Kubernetes Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+)
+
+// ReferenceGrant identifies kinds of resources in other namespaces that are trusted to reference
+// the specified kinds of resources in the same namespace as the policy.
+//
+// +kubebuilder:object:generate=true
+// +kubebuilder:object:root=true
+type ReferenceGrant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ReferenceGrantSpec `json:"spec,omitempty"`
+}
+
+// ReferenceGrantSpec identifies a cross namespace relationship that is trusted for Gateway API.
+//
+// +kubebuilder:object:generate=true
+type ReferenceGrantSpec struct {
+	// From describes the trusted namespaces and kinds that can reference the resources described
+	// in "To".
+	From []ReferenceGrantFrom `json:"from"`
+
+	// To describes the resources that may be referenced by the resources described in "From".
+	To []ReferenceGrantTo `json:"to"`
+}
+
+// ReferenceGrantFrom describes trusted namespaces and kinds.
+//
+// +kubebuilder:object:generate=true
+type ReferenceGrantFrom struct {
+	Group     gwv1.Group     `json:"group"`
+	Kind      gwv1.Kind      `json:"kind"`
+	Namespace gwv1.Namespace `json:"namespace"`
+}
+
+// ReferenceGrantTo describes what kinds are allowed as targets of the references.  If there's no
+// Name, every resource of the kind may be referenced.
+//
+// +kubebuilder:object:generate=true
+type ReferenceGrantTo struct {
+	Group gwv1.Group       `json:"group"`
+	Kind  gwv1.Kind        `json:"kind"`
+	Name  *gwv1.ObjectName `json:"name,omitempty"`
+}
+
+// ReferenceGrantList contains a list of ReferenceGrant.
+//
+// +kubebuilder:object:generate=true
+// +kubebuilder:object:root=true
+type ReferenceGrantList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ReferenceGrant `json:"items"`
+}
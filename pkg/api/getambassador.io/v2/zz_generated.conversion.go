@@ -1446,6 +1446,30 @@ func autoConvert_v2_ConsulResolverSpec_To_v3alpha1_ConsulResolverSpec(in *Consul
 		in, out := &in.Datacenter, &out.Datacenter
 		*out = *in
 	}
+	if true {
+		in, out := &in.TokenSecret, &out.TokenSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.TLSSecret, &out.TLSSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.ConsulNamespace, &out.ConsulNamespace
+		*out = *in
+	}
+	if true {
+		in, out := &in.ConsulPartition, &out.ConsulPartition
+		*out = *in
+	}
+	if true {
+		in, out := &in.OnlyHealthy, &out.OnlyHealthy
+		*out = *in
+	}
+	if true {
+		in, out := &in.WatchCatalog, &out.WatchCatalog
+		*out = *in
+	}
 	return nil
 }
 
@@ -1469,6 +1493,30 @@ func autoConvert_v3alpha1_ConsulResolverSpec_To_v2_ConsulResolverSpec(in *v3alph
 		in, out := &in.Datacenter, &out.Datacenter
 		*out = *in
 	}
+	if true {
+		in, out := &in.TokenSecret, &out.TokenSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.TLSSecret, &out.TLSSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.ConsulNamespace, &out.ConsulNamespace
+		*out = *in
+	}
+	if true {
+		in, out := &in.ConsulPartition, &out.ConsulPartition
+		*out = *in
+	}
+	if true {
+		in, out := &in.OnlyHealthy, &out.OnlyHealthy
+		*out = *in
+	}
+	if true {
+		in, out := &in.WatchCatalog, &out.WatchCatalog
+		*out = *in
+	}
 	return nil
 }
 
@@ -83,6 +83,26 @@ type ConsulResolverSpec struct {
 
 	Address    string `json:"address,omitempty"`
 	Datacenter string `json:"datacenter,omitempty"`
+
+	// TokenSecret names a Secret whose "token" key holds the Consul ACL token to use.
+	TokenSecret string `json:"token_secret,omitempty"`
+	// TLSSecret names a Secret holding the CA certificate ("ca.crt") to verify the Consul
+	// server with, and optionally a client certificate and key ("tls.crt" and "tls.key").
+	// Setting it makes Ambassador talk to Consul over HTTPS.
+	TLSSecret string `json:"tls_secret,omitempty"`
+	// ConsulNamespace and ConsulPartition select the Consul Enterprise namespace and admin
+	// partition to look services up in.
+	ConsulNamespace string `json:"consul_namespace,omitempty"`
+	ConsulPartition string `json:"consul_partition,omitempty"`
+	// OnlyHealthy, which defaults to true, leaves out service instances whose health checks
+	// aren't all passing.
+	OnlyHealthy *bool `json:"only_healthy,omitempty"`
+	// WatchCatalog has Ambassador find out about changes to services with one watch of the
+	// whole Consul catalog, rather than a watch per service.
+	WatchCatalog bool `json:"watch_catalog,omitempty"`
+	// Connect has Ambassador route to the Consul Connect proxies of services rather than to the
+	// services themselves, for Mappings that talk to them over mTLS.
+	Connect bool `json:"connect,omitempty"`
 }
 
 // ConsulResolver is the Schema for the ConsulResolver API
@@ -0,0 +1,455 @@
+package consulwatch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/datawire/ambassador/v2/pkg/limiter"
+	"github.com/datawire/dlib/dlog"
+)
+
+const (
+	// Failed queries are retried after a delay that starts at minRetryDelay and doubles up to
+	// maxRetryDelay.
+	minRetryDelay = 1 * time.Second
+	maxRetryDelay = 2 * time.Minute
+	// When watching the whole catalog, the subscribers are refreshed at most this often, so that a
+	// busy catalog doesn't have us hammering Consul with queries.
+	catalogRefreshInterval = 1 * time.Second
+)
+
+// A Multiplexer shares one Consul client between watches of any number of services in a
+// datacenter.
+//
+// Normally each service gets a blocking query of its own. With watchCatalog set, the multiplexer
+// instead keeps blocking queries of the catalog's services and of the health checks of the whole
+// datacenter, which tell it when to look at the services that it has subscribers for. That is two
+// long-polls no matter how many services there are. A change to a health check only has the
+// multiplexer look at the service that the check belongs to, but since the catalog doesn't say
+// which service was registered or deregistered, that, or a change to a node's checks, has it look
+// at every subscribed service.
+//
+// With connect set, the endpoints of a service are those of its Consul Connect proxies rather than
+// of the service itself.
+type Multiplexer struct {
+	consul       *consulapi.Client
+	datacenter   string
+	onlyHealthy  bool
+	watchCatalog bool
+	connect      bool
+
+	// The mutex protects ctx, stopped, and subscriptions.
+	mutex         sync.Mutex
+	ctx           context.Context
+	cancel        context.CancelFunc
+	stopped       bool
+	subscriptions map[*Subscription]struct{}
+}
+
+// NewMultiplexer makes a multiplexer for watching services in a datacenter. If onlyHealthy is set,
+// only instances whose health checks are all passing are watched; otherwise every instance is,
+// along with its health.
+func NewMultiplexer(client *consulapi.Client, datacenter string, onlyHealthy, watchCatalog, connect bool) *Multiplexer {
+	return &Multiplexer{
+		consul:        client,
+		datacenter:    datacenter,
+		onlyHealthy:   onlyHealthy,
+		watchCatalog:  watchCatalog,
+		connect:       connect,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// A Subscription is a watch of one service through a Multiplexer.
+type Subscription struct {
+	Service string
+
+	mux     *Multiplexer
+	handler func(Endpoints)
+	// refresh tells the subscription to look at its service again when the multiplexer is
+	// watching the whole catalog.
+	refresh chan struct{}
+	cancel  context.CancelFunc
+
+	// The mutex protects index.
+	mutex sync.Mutex
+	index uint64
+}
+
+// Subscribe starts watching a service. The handler is called with the service's endpoints
+// whenever they change; failed queries are logged and retried rather than passed to it.
+//
+// If the caller already has the endpoints as of some blocking-query index (say, from an earlier
+// subscription that it's replacing), passing that index saves fetching them again: the handler is
+// only called once they change. Otherwise, pass 0.
+func (m *Multiplexer) Subscribe(service string, index uint64, handler func(Endpoints)) *Subscription {
+	sub := &Subscription{
+		Service: service,
+		mux:     m,
+		handler: handler,
+		refresh: make(chan struct{}, 1),
+		index:   index,
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.stopped {
+		return sub
+	}
+	m.subscriptions[sub] = struct{}{}
+	if m.ctx != nil {
+		m.run(sub)
+	}
+	return sub
+}
+
+// run starts a subscription's goroutine. The caller must hold the multiplexer's mutex.
+func (m *Multiplexer) run(sub *Subscription) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	sub.cancel = cancel
+	if m.watchCatalog {
+		go sub.watchRefreshes(ctx)
+	} else {
+		go sub.watch(ctx)
+	}
+}
+
+// Start runs the watches of all the subscriptions, both those made so far and those made later,
+// until either the context is canceled or Stop is called.
+func (m *Multiplexer) Start(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.stopped {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	ctx = m.ctx
+	for sub := range m.subscriptions {
+		m.run(sub)
+	}
+	m.mutex.Unlock()
+
+	if m.watchCatalog {
+		m.watchWholeCatalog(ctx)
+	} else {
+		<-ctx.Done()
+	}
+	return nil
+}
+
+// Stop all of the multiplexer's watches.
+func (m *Multiplexer) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.stopped = true
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.subscriptions = make(map[*Subscription]struct{})
+}
+
+// watchWholeCatalog refreshes the subscriptions whose services might have changed since the
+// catalog's services or the datacenter's health checks last did.
+func (m *Multiplexer) watchWholeCatalog(ctx context.Context) {
+	var changes catalogChanges
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+
+	go m.poll(ctx, "catalog services", 0, func(opts *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		_, meta, err := m.consul.Catalog().Services(opts)
+		return meta, err
+	}, func(uint64) {
+		changes.add(true, nil)
+		notify()
+	})
+
+	var checks consulapi.HealthChecks
+	previous := make(map[string]*consulapi.HealthCheck)
+	go m.poll(ctx, "health checks", 0, func(opts *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		var meta *consulapi.QueryMeta
+		var err error
+		checks, meta, err = m.consul.Health().State(consulapi.HealthAny, opts)
+		return meta, err
+	}, func(uint64) {
+		current := make(map[string]*consulapi.HealthCheck, len(checks))
+		for _, check := range checks {
+			current[check.Node+"/"+check.CheckID] = check
+		}
+		all, services := changedServices(previous, current)
+		// The checks of a Connect proxy belong to the proxy's own service, which can be named
+		// anything, so there's no telling which service's endpoints they're about.
+		changes.add(all || m.connect, services)
+		previous = current
+		notify()
+	})
+
+	interval := limiter.NewInterval(catalogRefreshInterval)
+	for {
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+		if !sleep(ctx, interval.Limit(time.Now())) {
+			return
+		}
+
+		all, services := changes.take()
+		m.mutex.Lock()
+		for sub := range m.subscriptions {
+			if !all && !services[sub.Service] {
+				continue
+			}
+			select {
+			case sub.refresh <- struct{}{}:
+			default:
+			}
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// catalogChanges gathers up what changed in the catalog between refreshes of the subscriptions.
+type catalogChanges struct {
+	mutex    sync.Mutex
+	all      bool
+	services map[string]bool
+}
+
+func (c *catalogChanges) add(all bool, services map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.all = c.all || all
+	for service := range services {
+		if c.services == nil {
+			c.services = make(map[string]bool)
+		}
+		c.services[service] = true
+	}
+}
+
+func (c *catalogChanges) take() (all bool, services map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	all, services = c.all, c.services
+	c.all, c.services = false, nil
+	return all, services
+}
+
+// changedServices compares two sets of health checks, keyed by node and check ID, and returns the
+// services whose checks were added, removed, or modified. A node's checks apply to every service
+// on the node, so if any of those changed, all is set instead.
+func changedServices(previous, current map[string]*consulapi.HealthCheck) (all bool, services map[string]bool) {
+	services = make(map[string]bool)
+	changed := func(check *consulapi.HealthCheck) {
+		if check.ServiceName == "" {
+			all = true
+		} else {
+			services[check.ServiceName] = true
+		}
+	}
+	for key, check := range current {
+		if old, ok := previous[key]; !ok || old.ModifyIndex != check.ModifyIndex || old.Status != check.Status {
+			changed(check)
+		}
+	}
+	for key, check := range previous {
+		if _, ok := current[key]; !ok {
+			changed(check)
+		}
+	}
+	return all, services
+}
+
+// poll runs a blocking query over and over, starting from the given index, and calls changed with
+// the new index every time that the index moves.
+func (m *Multiplexer) poll(
+	ctx context.Context,
+	what string,
+	index uint64,
+	query func(*consulapi.QueryOptions) (*consulapi.QueryMeta, error),
+	changed func(index uint64),
+) {
+	backoff := limiter.NewBackoff(minRetryDelay, maxRetryDelay)
+	for ctx.Err() == nil {
+		opts := &consulapi.QueryOptions{Datacenter: m.datacenter, WaitIndex: index}
+		meta, err := query(opts.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			delay := backoff.Limit(time.Now())
+			dlog.Errorf(ctx, "consul: watching %s in %q: %v (retrying in %v)", what, m.datacenter, err, delay)
+			sleep(ctx, delay)
+			continue
+		}
+		backoff.Reset()
+
+		if next := nextIndex(index, meta.LastIndex); next != index {
+			index = next
+			changed(index)
+		}
+	}
+}
+
+// nextIndex works out the index to wait for after a blocking query that started at index
+// returned lastIndex, following the rules that Consul's documentation of blocking queries lays
+// out. If the index went backwards (say, because the Consul servers were rebuilt), it starts
+// over from 0 so that the next query won't block.
+func nextIndex(index, lastIndex uint64) uint64 {
+	switch {
+	case lastIndex < index:
+		return 0
+	case lastIndex == 0:
+		return 1
+	default:
+		return lastIndex
+	}
+}
+
+// sleep waits for the given delay, returning false if the context is canceled first.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// health queries the instances of a service, or of its Connect proxies.
+func (m *Multiplexer) health(service string, opts *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+	if m.connect {
+		return m.consul.Health().Connect(service, "", m.onlyHealthy, opts)
+	}
+	return m.consul.Health().Service(service, "", m.onlyHealthy, opts)
+}
+
+// watch keeps a blocking query of the subscription's service.
+func (s *Subscription) watch(ctx context.Context) {
+	var entries []*consulapi.ServiceEntry
+	s.mux.poll(ctx, "service "+s.Service, s.Index(), func(opts *consulapi.QueryOptions) (*consulapi.QueryMeta, error) {
+		var meta *consulapi.QueryMeta
+		var err error
+		entries, meta, err = s.mux.health(s.Service, opts)
+		return meta, err
+	}, func(index uint64) {
+		s.update(index, entries)
+	})
+}
+
+// watchRefreshes looks at the subscription's service right away and then every time that the
+// multiplexer says something in the catalog changed.
+func (s *Subscription) watchRefreshes(ctx context.Context) {
+	backoff := limiter.NewBackoff(minRetryDelay, maxRetryDelay)
+	for {
+		opts := &consulapi.QueryOptions{Datacenter: s.mux.datacenter}
+		entries, meta, err := s.mux.health(s.Service, opts.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			delay := backoff.Limit(time.Now())
+			dlog.Errorf(ctx, "consul: watching service %s in %q: %v (retrying in %v)", s.Service, s.mux.datacenter, err, delay)
+			if !sleep(ctx, delay) {
+				return
+			}
+			continue
+		}
+		backoff.Reset()
+
+		// Nothing else in the datacenter changing doesn't mean that this service changed.
+		if index := s.Index(); index == 0 || meta.LastIndex != index {
+			s.update(meta.LastIndex, entries)
+		}
+
+		select {
+		case <-s.refresh:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Subscription) update(index uint64, entries []*consulapi.ServiceEntry) {
+	s.mutex.Lock()
+	s.index = index
+	s.mutex.Unlock()
+	s.handler(makeEndpoints(s.Service, entries, s.mux.onlyHealthy))
+}
+
+// Index returns the blocking-query index as of which the subscription last called its handler.
+func (s *Subscription) Index() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.index
+}
+
+// Stop watching the service.
+func (s *Subscription) Stop() {
+	s.mux.mutex.Lock()
+	defer s.mux.mutex.Unlock()
+	delete(s.mux.subscriptions, s)
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// makeEndpoints converts what Consul says about the instances of a service into Endpoints. If
+// onlyHealthy is set, the instances should come from a query for passing instances only; anything
+// else is left out all the same. Otherwise every instance is kept, along with its health.
+func makeEndpoints(service string, entries []*consulapi.ServiceEntry, onlyHealthy bool) Endpoints {
+	endpoints := Endpoints{Service: service, Endpoints: make([]Endpoint, 0)}
+	for _, item := range entries {
+		health := item.Checks.AggregatedStatus()
+		if onlyHealthy && health != consulapi.HealthPassing {
+			continue
+		}
+
+		tags := make([]string, 0)
+		if item.Service.Tags != nil {
+			tags = item.Service.Tags
+		}
+
+		// Some Consul services, especially those outside of Kubernetes, will not be registered with a `ServiceAddress`.
+		// Per Consul HTTP API documentation, this okay and we should fallback to the IP of the node in the `Address` field.
+		endpointAddress := item.Service.Address
+		if endpointAddress == "" {
+			endpointAddress = item.Node.Address
+		}
+
+		// Consul gives instances whose checks are only warning a weight of their own.
+		weight := item.Service.Weights.Passing
+		if health == consulapi.HealthWarning {
+			weight = item.Service.Weights.Warning
+		}
+
+		endpoints.Endpoints = append(endpoints.Endpoints, Endpoint{
+			Service:  item.Service.Service,
+			SystemID: fmt.Sprintf("consul::%s", item.Node.ID),
+			ID:       item.Service.ID,
+			Address:  endpointAddress,
+			Port:     item.Service.Port,
+			Tags:     tags,
+			Weight:   weight,
+			NodeMeta: item.Node.Meta,
+			Health:   health,
+		})
+	}
+
+	return endpoints
+}
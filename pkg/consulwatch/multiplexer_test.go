@@ -0,0 +1,392 @@
+package consulwatch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dlog"
+)
+
+// fakeConsul serves just enough of Consul's HTTP API, blocking queries included, for a
+// Multiplexer. Like Consul, it gives each service an index of its own, and the catalog's services
+// and the health checks each have an index that only moves when they change. The Connect proxy of
+// a service "foo" is the service "foo-sidecar-proxy".
+type fakeConsul struct {
+	mutex        sync.Mutex
+	changed      chan struct{}
+	index        uint64
+	catalogIndex uint64
+	healthIndex  uint64
+	serviceIndex map[string]uint64
+	services     map[string][]*consulapi.ServiceEntry
+	// checks are the health checks of the instances at each address, which are passing if there
+	// are none.
+	checks map[string]consulapi.HealthChecks
+	// queries counts the queries of each path, blocking the blocking ones, and passing the
+	// queries for passing instances only.
+	queries  map[string]int
+	blocking map[string]int
+	passing  map[string]int
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, *consulapi.Client) {
+	f := &fakeConsul{
+		changed:      make(chan struct{}),
+		index:        1,
+		catalogIndex: 1,
+		healthIndex:  1,
+		serviceIndex: make(map[string]uint64),
+		services:     make(map[string][]*consulapi.ServiceEntry),
+		checks:       make(map[string]consulapi.HealthChecks),
+		queries:      make(map[string]int),
+		blocking:     make(map[string]int),
+		passing:      make(map[string]int),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	config := consulapi.DefaultConfig()
+	config.Address = strings.TrimPrefix(server.URL, "http://")
+	client, err := consulapi.NewClient(config)
+	require.NoError(t, err)
+	return f, client
+}
+
+func (f *fakeConsul) setService(name string, addresses ...string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var entries []*consulapi.ServiceEntry
+	for _, address := range addresses {
+		entries = append(entries, &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{ID: "node", Node: address, Address: address},
+			Service: &consulapi.AgentService{ID: name + "-" + address, Service: name, Port: 8080},
+			Checks:  f.checks[address],
+		})
+	}
+	f.index++
+	f.services[name] = entries
+	f.serviceIndex[name] = f.index
+	f.catalogIndex = f.index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// setChecks changes the health checks of the instances at an address.
+func (f *fakeConsul) setChecks(address string, checks ...*consulapi.HealthCheck) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.index++
+	for _, check := range checks {
+		check.ModifyIndex = f.index
+	}
+	f.checks[address] = checks
+	for name, entries := range f.services {
+		for _, entry := range entries {
+			if entry.Node.Address == address {
+				entry.Checks = checks
+				f.serviceIndex[name] = f.index
+			}
+		}
+	}
+	f.healthIndex = f.index
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) allQueries(path string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.queries[path]
+}
+
+func (f *fakeConsul) blockingQueries(path string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.blocking[path]
+}
+
+func (f *fakeConsul) passingQueries(path string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.passing[path]
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var service string
+	if name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/"); name != r.URL.Path {
+		service = name
+	} else if name := strings.TrimPrefix(r.URL.Path, "/v1/health/connect/"); name != r.URL.Path {
+		service = name + "-sidecar-proxy"
+	}
+	current := func() uint64 {
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			return f.catalogIndex
+		case "/v1/health/state/any":
+			return f.healthIndex
+		}
+		return f.serviceIndex[service]
+	}
+
+	f.mutex.Lock()
+	f.queries[r.URL.Path]++
+	if index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); index > 0 {
+		f.blocking[r.URL.Path]++
+		for current() <= index {
+			changed := f.changed
+			f.mutex.Unlock()
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+			f.mutex.Lock()
+		}
+	}
+	defer f.mutex.Unlock()
+
+	var body interface{}
+	switch {
+	case service != "":
+		entries := f.services[service]
+		if _, passing := r.URL.Query()["passing"]; passing {
+			f.passing[r.URL.Path]++
+			entries = nil
+			for _, entry := range f.services[service] {
+				if entry.Checks.AggregatedStatus() == consulapi.HealthPassing {
+					entries = append(entries, entry)
+				}
+			}
+		}
+		body = entries
+	case r.URL.Path == "/v1/catalog/services":
+		services := make(map[string][]string)
+		for name := range f.services {
+			services[name] = []string{}
+		}
+		body = services
+	case r.URL.Path == "/v1/health/state/any":
+		checks := consulapi.HealthChecks{}
+		for name, entries := range f.services {
+			for _, entry := range entries {
+				for _, check := range entry.Checks {
+					check := *check
+					check.Node = entry.Node.Node
+					check.ServiceName = name
+					checks = append(checks, &check)
+				}
+			}
+		}
+		body = checks
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(current(), 10))
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func subscribe(m *Multiplexer, service string, index uint64) (*Subscription, chan Endpoints) {
+	ch := make(chan Endpoints, 10)
+	return m.Subscribe(service, index, func(endpoints Endpoints) { ch <- endpoints }), ch
+}
+
+func addresses(t *testing.T, ch chan Endpoints) []string {
+	select {
+	case endpoints := <-ch:
+		var ret []string
+		for _, e := range endpoints.Endpoints {
+			ret = append(ret, e.Address)
+		}
+		return ret
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for endpoints")
+		return nil
+	}
+}
+
+func assertQuiet(t *testing.T, ch chan Endpoints) {
+	select {
+	case endpoints := <-ch:
+		t.Errorf("unexpected endpoints: %v", endpoints)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func startMultiplexer(t *testing.T, m *Multiplexer) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, m.Start(ctx))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestMultiplexer(t *testing.T) {
+	f, client := newFakeConsul(t)
+	f.setService("foo", "1.2.3.4")
+
+	m := NewMultiplexer(client, "dc1", true, false, false)
+	sub, ch := subscribe(m, "foo", 0)
+	startMultiplexer(t, m)
+
+	assert.Equal(t, []string{"1.2.3.4"}, addresses(t, ch))
+	assert.Equal(t, uint64(2), sub.Index())
+
+	f.setService("foo", "1.2.3.4", "1.2.3.5")
+	assert.Equal(t, []string{"1.2.3.4", "1.2.3.5"}, addresses(t, ch))
+	assert.Equal(t, uint64(3), sub.Index())
+
+	// A subscription that picks up from an index only hears about changes after it.
+	sub.Stop()
+	sub, ch = subscribe(m, "foo", sub.Index())
+	assertQuiet(t, ch)
+	f.setService("foo", "1.2.3.5")
+	assert.Equal(t, []string{"1.2.3.5"}, addresses(t, ch))
+	assert.Equal(t, uint64(4), sub.Index())
+}
+
+func TestMultiplexerHealth(t *testing.T) {
+	f, client := newFakeConsul(t)
+	f.checks["1.2.3.5"] = consulapi.HealthChecks{{Status: consulapi.HealthCritical}}
+	f.checks["1.2.3.6"] = consulapi.HealthChecks{{CheckID: "_service_maintenance:foo-1.2.3.6", Status: consulapi.HealthCritical}}
+	f.checks["1.2.3.7"] = consulapi.HealthChecks{{Status: consulapi.HealthWarning}}
+	f.setService("foo", "1.2.3.4", "1.2.3.5", "1.2.3.6", "1.2.3.7")
+
+	// Consul only returns the instances whose checks are all passing...
+	m := NewMultiplexer(client, "dc1", true, false, false)
+	sub, ch := subscribe(m, "foo", 0)
+	startMultiplexer(t, m)
+	assert.Equal(t, []string{"1.2.3.4"}, addresses(t, ch))
+	assert.NotZero(t, f.passingQueries("/v1/health/service/foo"))
+	sub.Stop()
+
+	// ...unless every instance is wanted, along with its health.
+	passing := f.passingQueries("/v1/health/service/foo")
+	m = NewMultiplexer(client, "dc1", false, false, false)
+	_, ch = subscribe(m, "foo", 0)
+	startMultiplexer(t, m)
+	select {
+	case endpoints := <-ch:
+		health := map[string]string{}
+		for _, e := range endpoints.Endpoints {
+			health[e.Address] = e.Health
+		}
+		assert.Equal(t, map[string]string{
+			"1.2.3.4": consulapi.HealthPassing,
+			"1.2.3.5": consulapi.HealthCritical,
+			"1.2.3.6": consulapi.HealthMaint,
+			"1.2.3.7": consulapi.HealthWarning,
+		}, health)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for endpoints")
+	}
+	assert.Equal(t, passing, f.passingQueries("/v1/health/service/foo"))
+}
+
+func TestMultiplexerConnect(t *testing.T) {
+	f, client := newFakeConsul(t)
+	f.setService("foo", "1.2.3.4")
+	f.setService("foo-sidecar-proxy", "1.2.3.5")
+
+	// A Connect-enabled service is reached through its proxy.
+	m := NewMultiplexer(client, "dc1", true, false, true)
+	sub, ch := subscribe(m, "foo", 0)
+	startMultiplexer(t, m)
+	assert.Equal(t, []string{"1.2.3.5"}, addresses(t, ch))
+	assert.Equal(t, "foo", sub.Service)
+	assert.Zero(t, f.allQueries("/v1/health/service/foo"))
+
+	f.setService("foo-sidecar-proxy", "1.2.3.5", "1.2.3.6")
+	assert.Equal(t, []string{"1.2.3.5", "1.2.3.6"}, addresses(t, ch))
+}
+
+func TestMultiplexerWatchCatalog(t *testing.T) {
+	f, client := newFakeConsul(t)
+	f.setService("foo", "1.2.3.4")
+	f.setService("bar", "1.2.3.5")
+
+	m := NewMultiplexer(client, "dc1", true, true, false)
+	_, fooCh := subscribe(m, "foo", 0)
+	_, barCh := subscribe(m, "bar", 0)
+	startMultiplexer(t, m)
+
+	assert.Equal(t, []string{"1.2.3.4"}, addresses(t, fooCh))
+	assert.Equal(t, []string{"1.2.3.5"}, addresses(t, barCh))
+
+	// A change to bar gets to bar's subscriber, but not to foo's.
+	f.setService("bar", "1.2.3.6")
+	assert.Equal(t, []string{"1.2.3.6"}, addresses(t, barCh))
+	assertQuiet(t, fooCh)
+
+	// A change to bar's health checks only has bar looked at again, once the refreshes that the
+	// catalog's changes so far asked for are over with.
+	time.Sleep(catalogRefreshInterval + 200*time.Millisecond)
+	fooQueries := f.allQueries("/v1/health/service/foo")
+	barQueries := f.allQueries("/v1/health/service/bar")
+	f.setChecks("1.2.3.6", &consulapi.HealthCheck{CheckID: "service:bar", Status: consulapi.HealthCritical})
+	assert.Empty(t, addresses(t, barCh))
+	assertQuiet(t, fooCh)
+	assert.Equal(t, fooQueries, f.allQueries("/v1/health/service/foo"))
+	assert.Equal(t, barQueries+1, f.allQueries("/v1/health/service/bar"))
+
+	// The services themselves never get blocking queries.
+	assert.Zero(t, f.blockingQueries("/v1/health/service/foo"))
+	assert.Zero(t, f.blockingQueries("/v1/health/service/bar"))
+	assert.NotZero(t, f.blockingQueries("/v1/catalog/services"))
+	assert.NotZero(t, f.blockingQueries("/v1/health/state/any"))
+}
+
+func TestChangedServices(t *testing.T) {
+	check := func(node, id, service string, index uint64) *consulapi.HealthCheck {
+		return &consulapi.HealthCheck{Node: node, CheckID: id, ServiceName: service, Status: consulapi.HealthPassing, ModifyIndex: index}
+	}
+	previous := map[string]*consulapi.HealthCheck{
+		"a/service:foo": check("a", "service:foo", "foo", 1),
+		"a/service:bar": check("a", "service:bar", "bar", 1),
+		"b/service:baz": check("b", "service:baz", "baz", 1),
+		"b/serfHealth":  check("b", "serfHealth", "", 1),
+	}
+
+	// Modified and removed checks both count.
+	all, services := changedServices(previous, map[string]*consulapi.HealthCheck{
+		"a/service:foo": check("a", "service:foo", "foo", 2),
+		"a/service:bar": check("a", "service:bar", "bar", 1),
+		"b/serfHealth":  check("b", "serfHealth", "", 1),
+	})
+	assert.False(t, all)
+	assert.Equal(t, map[string]bool{"foo": true, "baz": true}, services)
+
+	// A node's check could be any service's.
+	all, _ = changedServices(previous, map[string]*consulapi.HealthCheck{
+		"a/service:foo": check("a", "service:foo", "foo", 1),
+		"a/service:bar": check("a", "service:bar", "bar", 1),
+		"b/service:baz": check("b", "service:baz", "baz", 1),
+		"b/serfHealth":  check("b", "serfHealth", "", 2),
+	})
+	assert.True(t, all)
+}
+
+func TestNextIndex(t *testing.T) {
+	assert.Equal(t, uint64(5), nextIndex(0, 5))
+	assert.Equal(t, uint64(5), nextIndex(5, 5))
+	assert.Equal(t, uint64(6), nextIndex(5, 6))
+	// Going backwards starts over.
+	assert.Equal(t, uint64(0), nextIndex(5, 4))
+	assert.Equal(t, uint64(1), nextIndex(0, 0))
+}
@@ -35,6 +35,15 @@ type Endpoint struct {
 	Address  string   `json:""`
 	Port     int      `json:""`
 	Tags     []string `json:""`
+
+	// Weight is the service's weight while it's passing its health checks, and NodeMeta is the
+	// metadata of the node that it's registered on, which can say where the node is.
+	Weight   int               `json:",omitempty"`
+	NodeMeta map[string]string `json:",omitempty"`
+
+	// Health is the aggregated status of the service's health checks: "passing", "warning",
+	// "critical", or "maintenance".
+	Health string `json:",omitempty"`
 }
 
 type Certificate struct {
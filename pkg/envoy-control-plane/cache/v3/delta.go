@@ -0,0 +1,281 @@
+// Copyright 2020 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/golang/protobuf/ptypes/any"
+
+	discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+)
+
+// DeltaRequest is an alias for the delta discovery request type.
+type DeltaRequest = discovery.DeltaDiscoveryRequest
+
+// DeltaConfigWatcher requests incremental watches for configuration resources
+// by a node. Unlike ConfigWatcher, the watch is scoped by the per-resource
+// versions the client already has, as tracked in StreamState, so the response
+// only carries resources that were added, changed or removed.
+// DeltaConfigWatcher implementation must be thread-safe.
+type DeltaConfigWatcher interface {
+	// CreateDeltaWatch returns a new open incremental watch from a non-empty
+	// request.
+	//
+	// Value channel produces the resource changes relative to the stream
+	// state, once there are any. The channel is never closed by the producer.
+	//
+	// Cancel is an optional function to release resources in the producer. If
+	// provided, the consumer may call this function multiple times.
+	CreateDeltaWatch(DeltaRequest, StreamState) (value chan DeltaResponse, cancel func())
+}
+
+// DeltaResponse is a wrapper around Envoy's DeltaDiscoveryResponse.
+type DeltaResponse interface {
+	// Get the constructed DeltaDiscoveryResponse.
+	GetDeltaDiscoveryResponse() (*discovery.DeltaDiscoveryResponse, error)
+
+	// Get the original request for the response.
+	GetDeltaRequest() *discovery.DeltaDiscoveryRequest
+
+	// Get the system version in the response.
+	GetSystemVersion() (string, error)
+
+	// Get the resource versions the client will have once it applies the
+	// response.
+	GetNextVersionMap() map[string]string
+}
+
+// RawDeltaResponse is a pre-serialized incremental xDS response containing the
+// raw resources to be included in the final DeltaDiscoveryResponse.
+type RawDeltaResponse struct {
+	DeltaResponse
+	// DeltaRequest is the original request.
+	DeltaRequest discovery.DeltaDiscoveryRequest
+
+	// SystemVersionInfo is the snapshot version the response was built from.
+	// It is informational only; clients track the per-resource versions.
+	SystemVersionInfo string
+
+	// Resources to be included in the response, i.e. added or changed.
+	Resources []types.Resource
+
+	// RemovedResources are the names of resources the client should drop.
+	RemovedResources []string
+
+	// NextVersionMap is the full set of resource versions the client will
+	// have after applying this response.
+	NextVersionMap map[string]string
+}
+
+// GetDeltaDiscoveryResponse marshals the resources into a DeltaDiscoveryResponse.
+func (r RawDeltaResponse) GetDeltaDiscoveryResponse() (*discovery.DeltaDiscoveryResponse, error) {
+	marshaledResources := make([]*discovery.Resource, 0, len(r.Resources))
+
+	for _, resource := range r.Resources {
+		name := GetResourceName(resource)
+		marshaledResource, err := MarshalResource(resource)
+		if err != nil {
+			return nil, err
+		}
+		marshaledResources = append(marshaledResources, &discovery.Resource{
+			Name:    name,
+			Version: r.NextVersionMap[name],
+			Resource: &any.Any{
+				TypeUrl: r.DeltaRequest.TypeUrl,
+				Value:   marshaledResource,
+			},
+		})
+	}
+
+	return &discovery.DeltaDiscoveryResponse{
+		SystemVersionInfo: r.SystemVersionInfo,
+		Resources:         marshaledResources,
+		RemovedResources:  r.RemovedResources,
+		TypeUrl:           r.DeltaRequest.TypeUrl,
+	}, nil
+}
+
+// GetDeltaRequest returns the original DeltaDiscoveryRequest.
+func (r RawDeltaResponse) GetDeltaRequest() *discovery.DeltaDiscoveryRequest {
+	return &r.DeltaRequest
+}
+
+// GetSystemVersion returns the system version of the response.
+func (r RawDeltaResponse) GetSystemVersion() (string, error) {
+	return r.SystemVersionInfo, nil
+}
+
+// GetNextVersionMap returns the resource versions after applying the response.
+func (r RawDeltaResponse) GetNextVersionMap() map[string]string {
+	return r.NextVersionMap
+}
+
+// StreamState tracks what a single incremental xDS stream has subscribed to,
+// and which resource versions the client already has, for one type URL.
+type StreamState struct {
+	// Wildcard is set when the client subscribed to all resources of the
+	// type rather than to an explicit list of names.
+	Wildcard bool
+
+	// SubscribedResourceNames are the explicitly subscribed names; it is
+	// ignored in wildcard mode.
+	SubscribedResourceNames map[string]bool
+
+	// ResourceVersions are the versions the client has, indexed by name.
+	ResourceVersions map[string]string
+
+	// First is set until the first response has been sent on the stream, so
+	// that the client is answered even if the snapshot has no resources.
+	First bool
+}
+
+// NewStreamState initializes the state for a new stream, seeding it with the
+// resource versions the client reported having from a previous stream.
+func NewStreamState(wildcard bool, initialResourceVersions map[string]string) StreamState {
+	state := StreamState{
+		Wildcard:                wildcard,
+		SubscribedResourceNames: map[string]bool{},
+		ResourceVersions:        map[string]string{},
+		First:                   true,
+	}
+	for name, version := range initialResourceVersions {
+		state.ResourceVersions[name] = version
+	}
+	return state
+}
+
+// DeltaResponseWatch is a watch record keeping both the delta request and an
+// open channel for the delta response.
+type DeltaResponseWatch struct {
+	// Request is the original request for the watch.
+	Request DeltaRequest
+
+	// Response is the channel to push the delta responses to.
+	Response chan DeltaResponse
+
+	// StreamState is the state of the stream when the watch was opened.
+	StreamState StreamState
+}
+
+// GetResponseTypeURL returns the type URL for a valid enumeration of a response type.
+func GetResponseTypeURL(responseType types.ResponseType) string {
+	switch responseType {
+	case types.Endpoint:
+		return resource.EndpointType
+	case types.Cluster:
+		return resource.ClusterType
+	case types.Route:
+		return resource.RouteType
+	case types.Listener:
+		return resource.ListenerType
+	case types.Secret:
+		return resource.SecretType
+	case types.Runtime:
+		return resource.RuntimeType
+	}
+	return ""
+}
+
+// HashResource computes a stable version string for a single resource from
+// its deterministic serialization.
+func HashResource(resource types.Resource) (string, error) {
+	marshaled, err := MarshalResource(resource)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(marshaled)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ConstructVersionMap computes the per-resource versions of every resource in
+// the snapshot, indexed by type URL and then by resource name.
+func (s *Snapshot) ConstructVersionMap() (map[string]map[string]string, error) {
+	out := make(map[string]map[string]string, types.UnknownType)
+	for typ := types.ResponseType(0); typ < types.UnknownType; typ++ {
+		typeURL := GetResponseTypeURL(typ)
+		versions := make(map[string]string, len(s.Resources[typ].Items))
+		for name, resource := range s.Resources[typ].Items {
+			version, err := HashResource(resource)
+			if err != nil {
+				return nil, err
+			}
+			versions[name] = version
+		}
+		out[typeURL] = versions
+	}
+	return out, nil
+}
+
+// createDeltaResponse computes the resources that changed relative to the
+// stream state. It returns nil if there is nothing to tell the client.
+func createDeltaResponse(request DeltaRequest, state StreamState, resources map[string]types.Resource, versions map[string]string, systemVersion string) *RawDeltaResponse {
+	filtered := make([]types.Resource, 0)
+	removed := make([]string, 0)
+	next := make(map[string]string)
+
+	if state.Wildcard {
+		for name, resource := range resources {
+			version := versions[name]
+			next[name] = version
+			if prev, ok := state.ResourceVersions[name]; !ok || prev != version {
+				filtered = append(filtered, resource)
+			}
+		}
+		for name := range state.ResourceVersions {
+			if _, ok := resources[name]; !ok {
+				removed = append(removed, name)
+			}
+		}
+	} else {
+		for name := range state.SubscribedResourceNames {
+			prev, known := state.ResourceVersions[name]
+			resource, ok := resources[name]
+			if !ok {
+				if known {
+					removed = append(removed, name)
+				}
+				continue
+			}
+			version := versions[name]
+			next[name] = version
+			if !known || prev != version {
+				filtered = append(filtered, resource)
+			}
+		}
+	}
+
+	if len(filtered) == 0 && len(removed) == 0 && !state.First {
+		return nil
+	}
+
+	// Keep the output stable, which makes responses easier to compare.
+	sort.Strings(removed)
+	sort.Slice(filtered, func(i, j int) bool {
+		return GetResourceName(filtered[i]) < GetResourceName(filtered[j])
+	})
+
+	return &RawDeltaResponse{
+		DeltaRequest:      request,
+		SystemVersionInfo: systemVersion,
+		Resources:         filtered,
+		RemovedResources:  removed,
+		NextVersionMap:    next,
+	}
+}
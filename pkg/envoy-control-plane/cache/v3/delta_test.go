@@ -0,0 +1,144 @@
+// Copyright 2020 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package cache_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	rsrc "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/test/resource/v3"
+)
+
+func TestSnapshotCacheDeltaWatch(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+
+	// open wildcard watches before there is a snapshot
+	watches := make(map[string]chan cache.DeltaResponse)
+	for _, typ := range testTypes {
+		watches[typ], _ = c.CreateDeltaWatch(discovery.DeltaDiscoveryRequest{TypeUrl: typ}, cache.NewStreamState(true, nil))
+	}
+	if count := c.GetStatusInfo(key).GetNumDeltaWatches(); count != len(testTypes) {
+		t.Errorf("delta watches should be open until there is a snapshot: %d", count)
+	}
+
+	if err := c.SetSnapshot(key, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	versions := make(map[string]map[string]string)
+	for _, typ := range testTypes {
+		t.Run(typ, func(t *testing.T) {
+			select {
+			case out := <-watches[typ]:
+				if !reflect.DeepEqual(cache.IndexResourcesByName(out.(cache.RawDeltaResponse).Resources), snapshot.GetResources(typ)) {
+					t.Errorf("get resources %v, want %v", out.(cache.RawDeltaResponse).Resources, snapshot.GetResources(typ))
+				}
+				versions[typ] = out.GetNextVersionMap()
+			case <-time.After(time.Second):
+				t.Fatal("failed to receive delta response")
+			}
+		})
+	}
+
+	// a stream that is up to date gets an open watch
+	state := cache.NewStreamState(true, versions[rsrc.EndpointType])
+	state.First = false
+	watch, _ := c.CreateDeltaWatch(discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.EndpointType}, state)
+	if count := c.GetStatusInfo(key).GetNumDeltaWatches(); count != 1 {
+		t.Errorf("delta watch should be open for the latest versions: %d", count)
+	}
+
+	// changing only the endpoints responds with only the endpoints
+	snapshot2 := snapshot
+	snapshot2.Resources[types.Endpoint] = cache.NewResources(version2, []types.Resource{resource.MakeEndpoint(clusterName, 9090)})
+	if err := c.SetSnapshot(key, snapshot2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case out := <-watch:
+		raw := out.(cache.RawDeltaResponse)
+		if len(raw.Resources) != 1 || cache.GetResourceName(raw.Resources[0]) != clusterName {
+			t.Errorf("got resources %v, want only %q", raw.Resources, clusterName)
+		}
+		if out.GetNextVersionMap()[clusterName] == versions[rsrc.EndpointType][clusterName] {
+			t.Errorf("resource version should change along with the resource")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed to receive delta response")
+	}
+
+	// setting the same snapshot again does not respond to an up to date watch
+	state = cache.NewStreamState(true, versions[rsrc.ClusterType])
+	state.First = false
+	watch, cancel := c.CreateDeltaWatch(discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType}, state)
+	if err := c.SetSnapshot(key, snapshot2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case out := <-watch:
+		t.Errorf("unchanged clusters => got %v, want none", out)
+	case <-time.After(time.Second / 4):
+	}
+	cancel()
+	if count := c.GetStatusInfo(key).GetNumDeltaWatches(); count != 0 {
+		t.Errorf("delta watch should be released: %d", count)
+	}
+}
+
+func TestSnapshotCacheDeltaRemoval(t *testing.T) {
+	c := cache.NewSnapshotCache(false, group{}, logger{t: t})
+	if err := c.SetSnapshot(key, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client knows about a route that is not in the snapshot
+	state := cache.NewStreamState(false, map[string]string{"stale": "v0"})
+	state.SubscribedResourceNames = map[string]bool{routeName: true, "stale": true}
+	watch, _ := c.CreateDeltaWatch(discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.RouteType}, state)
+	select {
+	case out := <-watch:
+		raw := out.(cache.RawDeltaResponse)
+		if len(raw.Resources) != 1 || cache.GetResourceName(raw.Resources[0]) != routeName {
+			t.Errorf("got resources %v, want only %q", raw.Resources, routeName)
+		}
+		if !reflect.DeepEqual(raw.RemovedResources, []string{"stale"}) {
+			t.Errorf("got removed resources %v, want %v", raw.RemovedResources, []string{"stale"})
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed to receive delta response")
+	}
+}
+
+func TestSnapshotConstructVersionMap(t *testing.T) {
+	versions, err := snapshot.ConstructVersionMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := snapshot.ConstructVersionMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(versions, again) {
+		t.Errorf("resource versions should be stable: %v != %v", versions, again)
+	}
+	if versions[rsrc.ClusterType][clusterName] == "" {
+		t.Errorf("missing resource version for cluster %q", clusterName)
+	}
+}
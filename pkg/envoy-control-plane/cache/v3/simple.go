@@ -39,6 +39,7 @@ import (
 // can be partial, e.g. only include RDS or EDS resources.
 type SnapshotCache interface {
 	Cache
+	DeltaConfigWatcher
 
 	// SetSnapshot sets a response snapshot for a node. For ADS, the snapshots
 	// should have distinct versions and be internally consistent (e.g. all
@@ -70,6 +71,10 @@ type snapshotCache struct {
 	// snapshots are cached resources indexed by node IDs
 	snapshots map[string]Snapshot
 
+	// versionMaps are the per-resource versions of the snapshots, indexed by
+	// node IDs; they are computed lazily, only once a delta watch needs them
+	versionMaps map[string]map[string]map[string]string
+
 	// status information for all nodes indexed by node IDs
 	status map[string]*statusInfo
 
@@ -79,6 +84,9 @@ type snapshotCache struct {
 	// watchCount is an atomic counter incremented for each watch
 	watchCount int64
 
+	// deltaWatchCount is an atomic counter incremented for each delta watch
+	deltaWatchCount int64
+
 	mu sync.RWMutex
 }
 
@@ -95,11 +103,12 @@ type snapshotCache struct {
 // Logger is optional.
 func NewSnapshotCache(ads bool, hash NodeHash, logger log.Logger) SnapshotCache {
 	return &snapshotCache{
-		log:       logger,
-		ads:       ads,
-		snapshots: make(map[string]Snapshot),
-		status:    make(map[string]*statusInfo),
-		hash:      hash,
+		log:         logger,
+		ads:         ads,
+		snapshots:   make(map[string]Snapshot),
+		versionMaps: make(map[string]map[string]map[string]string),
+		status:      make(map[string]*statusInfo),
+		hash:        hash,
 	}
 }
 
@@ -110,6 +119,7 @@ func (cache *snapshotCache) SetSnapshot(node string, snapshot Snapshot) error {
 
 	// update the existing entry
 	cache.snapshots[node] = snapshot
+	delete(cache.versionMaps, node)
 
 	// trigger existing watches for which version changed
 	if info, ok := cache.status[node]; ok {
@@ -126,6 +136,26 @@ func (cache *snapshotCache) SetSnapshot(node string, snapshot Snapshot) error {
 				delete(info.watches, id)
 			}
 		}
+
+		if len(info.deltaWatches) > 0 {
+			versions, err := cache.versionMap(node)
+			if err != nil {
+				info.mu.Unlock()
+				return err
+			}
+			for id, watch := range info.deltaWatches {
+				typeURL := watch.Request.TypeUrl
+				if cache.respondDelta(watch.Request, watch.Response, watch.StreamState,
+					snapshot.GetResources(typeURL), versions[typeURL], snapshot.GetVersion(typeURL)) {
+					if cache.log != nil {
+						cache.log.Debugf("respond open delta watch %d for %s with new version %q", id, typeURL, snapshot.GetVersion(typeURL))
+					}
+
+					// discard the watch
+					delete(info.deltaWatches, id)
+				}
+			}
+		}
 		info.mu.Unlock()
 	}
 
@@ -150,6 +180,7 @@ func (cache *snapshotCache) ClearSnapshot(node string) {
 	defer cache.mu.Unlock()
 
 	delete(cache.snapshots, node)
+	delete(cache.versionMaps, node)
 	delete(cache.status, node)
 }
 
@@ -215,6 +246,102 @@ func (cache *snapshotCache) CreateWatch(request Request) (chan Response, func())
 	return value, nil
 }
 
+// CreateDeltaWatch returns a watch for an incremental xDS request.
+func (cache *snapshotCache) CreateDeltaWatch(request DeltaRequest, state StreamState) (chan DeltaResponse, func()) {
+	nodeID := cache.hash.ID(request.Node)
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	info, ok := cache.status[nodeID]
+	if !ok {
+		info = newStatusInfo(request.Node)
+		cache.status[nodeID] = info
+	}
+
+	// update last watch request time
+	info.mu.Lock()
+	info.lastDeltaWatchRequestTime = time.Now()
+	info.mu.Unlock()
+
+	// allocate capacity 1 to allow one-time non-blocking use
+	value := make(chan DeltaResponse, 1)
+
+	// if there is a snapshot with changes for this stream, respond immediately
+	if snapshot, exists := cache.snapshots[nodeID]; exists {
+		versions, err := cache.versionMap(nodeID)
+		if err != nil {
+			if cache.log != nil {
+				cache.log.Errorf("failed to compute resource versions for nodeID %q: %v", nodeID, err)
+			}
+		} else if cache.respondDelta(request, value, state, snapshot.GetResources(request.TypeUrl),
+			versions[request.TypeUrl], snapshot.GetVersion(request.TypeUrl)) {
+			return value, nil
+		}
+	}
+
+	// otherwise, leave an open watch until the snapshot changes
+	watchID := cache.nextDeltaWatchID()
+	if cache.log != nil {
+		cache.log.Debugf("open delta watch %d for %s%v from nodeID %q", watchID,
+			request.TypeUrl, request.ResourceNamesSubscribe, nodeID)
+	}
+	info.mu.Lock()
+	info.deltaWatches[watchID] = DeltaResponseWatch{Request: request, Response: value, StreamState: state}
+	info.mu.Unlock()
+	return value, cache.cancelDeltaWatch(nodeID, watchID)
+}
+
+// versionMap returns the per-resource versions for the snapshot of a node,
+// computing them on first use. The cache mutex must be held for writing.
+func (cache *snapshotCache) versionMap(node string) (map[string]map[string]string, error) {
+	if versions, ok := cache.versionMaps[node]; ok {
+		return versions, nil
+	}
+	snapshot := cache.snapshots[node]
+	versions, err := snapshot.ConstructVersionMap()
+	if err != nil {
+		return nil, err
+	}
+	cache.versionMaps[node] = versions
+	return versions, nil
+}
+
+// respondDelta responds to a delta watch if there are changes relative to the
+// stream state, and reports whether it did. The value channel should have
+// capacity not to block.
+func (cache *snapshotCache) respondDelta(request DeltaRequest, value chan DeltaResponse, state StreamState,
+	resources map[string]types.Resource, versions map[string]string, systemVersion string) bool {
+	resp := createDeltaResponse(request, state, resources, versions, systemVersion)
+	if resp == nil {
+		return false
+	}
+	if cache.log != nil {
+		cache.log.Debugf("respond delta %s%v with %d resources and %d removals at version %q",
+			request.TypeUrl, request.ResourceNamesSubscribe, len(resp.Resources), len(resp.RemovedResources), systemVersion)
+	}
+	value <- *resp
+	return true
+}
+
+func (cache *snapshotCache) nextDeltaWatchID() int64 {
+	return atomic.AddInt64(&cache.deltaWatchCount, 1)
+}
+
+// cancellation function for cleaning stale delta watches
+func (cache *snapshotCache) cancelDeltaWatch(nodeID string, watchID int64) func() {
+	return func() {
+		// uses the cache mutex
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		if info, ok := cache.status[nodeID]; ok {
+			info.mu.Lock()
+			delete(info.deltaWatches, watchID)
+			info.mu.Unlock()
+		}
+	}
+}
+
 func (cache *snapshotCache) nextWatchID() int64 {
 	return atomic.AddInt64(&cache.watchCount, 1)
 }
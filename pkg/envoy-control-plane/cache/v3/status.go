@@ -52,6 +52,12 @@ type StatusInfo interface {
 
 	// GetLastWatchRequestTime returns the timestamp of the last discovery watch request.
 	GetLastWatchRequestTime() time.Time
+
+	// GetNumDeltaWatches returns the number of open delta watches.
+	GetNumDeltaWatches() int
+
+	// GetLastDeltaWatchRequestTime returns the timestamp of the last delta discovery watch request.
+	GetLastDeltaWatchRequestTime() time.Time
 }
 
 type statusInfo struct {
@@ -64,6 +70,12 @@ type statusInfo struct {
 	// the timestamp of the last watch request
 	lastWatchRequestTime time.Time
 
+	// deltaWatches are indexed channels for the delta response watches and the original requests.
+	deltaWatches map[int64]DeltaResponseWatch
+
+	// the timestamp of the last delta watch request
+	lastDeltaWatchRequestTime time.Time
+
 	// mutex to protect the status fields.
 	// should not acquire mutex of the parent cache after acquiring this mutex.
 	mu sync.RWMutex
@@ -81,8 +93,9 @@ type ResponseWatch struct {
 // newStatusInfo initializes a status info data structure.
 func newStatusInfo(node *core.Node) *statusInfo {
 	out := statusInfo{
-		node:    node,
-		watches: make(map[int64]ResponseWatch),
+		node:         node,
+		watches:      make(map[int64]ResponseWatch),
+		deltaWatches: make(map[int64]DeltaResponseWatch),
 	}
 	return &out
 }
@@ -104,3 +117,15 @@ func (info *statusInfo) GetLastWatchRequestTime() time.Time {
 	defer info.mu.RUnlock()
 	return info.lastWatchRequestTime
 }
+
+func (info *statusInfo) GetNumDeltaWatches() int {
+	info.mu.RLock()
+	defer info.mu.RUnlock()
+	return len(info.deltaWatches)
+}
+
+func (info *statusInfo) GetLastDeltaWatchRequestTime() time.Time {
+	info.mu.RLock()
+	defer info.mu.RUnlock()
+	return info.lastDeltaWatchRequestTime
+}
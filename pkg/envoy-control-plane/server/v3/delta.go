@@ -0,0 +1,398 @@
+// Copyright 2020 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	clusterservice "github.com/datawire/ambassador/v2/pkg/api/envoy/service/cluster/v3"
+	discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	discoverygrpc "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	endpointservice "github.com/datawire/ambassador/v2/pkg/api/envoy/service/endpoint/v3"
+	listenerservice "github.com/datawire/ambassador/v2/pkg/api/envoy/service/listener/v3"
+	routeservice "github.com/datawire/ambassador/v2/pkg/api/envoy/service/route/v3"
+	runtimeservice "github.com/datawire/ambassador/v2/pkg/api/envoy/service/runtime/v3"
+	secretservice "github.com/datawire/ambassador/v2/pkg/api/envoy/service/secret/v3"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+)
+
+// DeltaCallbacks is a collection of callbacks inserted into the incremental
+// server operation. The callbacks are invoked synchronously. A Callbacks
+// implementation may optionally implement DeltaCallbacks as well; if it does
+// not, incremental streams are served without callbacks.
+type DeltaCallbacks interface {
+	// OnDeltaStreamOpen is called once an incremental xDS stream is open with a stream ID and the type URL (or "" for ADS).
+	// Returning an error will end processing and close the stream. OnDeltaStreamClosed will still be called.
+	OnDeltaStreamOpen(context.Context, int64, string) error
+	// OnDeltaStreamClosed is called immediately prior to closing an incremental xDS stream with a stream ID.
+	OnDeltaStreamClosed(int64)
+	// OnStreamDeltaRequest is called once a request is received on an incremental stream.
+	// Returning an error will end processing and close the stream. OnDeltaStreamClosed will still be called.
+	OnStreamDeltaRequest(int64, *discovery.DeltaDiscoveryRequest) error
+	// OnStreamDeltaResponse is called immediately prior to sending a response on an incremental stream.
+	OnStreamDeltaResponse(int64, *discovery.DeltaDiscoveryRequest, *discovery.DeltaDiscoveryResponse)
+}
+
+// DeltaCallbackFuncs is a convenience type for implementing the DeltaCallbacks interface.
+type DeltaCallbackFuncs struct {
+	DeltaStreamOpenFunc     func(context.Context, int64, string) error
+	DeltaStreamClosedFunc   func(int64)
+	StreamDeltaRequestFunc  func(int64, *discovery.DeltaDiscoveryRequest) error
+	StreamDeltaResponseFunc func(int64, *discovery.DeltaDiscoveryRequest, *discovery.DeltaDiscoveryResponse)
+}
+
+var _ DeltaCallbacks = DeltaCallbackFuncs{}
+
+// OnDeltaStreamOpen invokes DeltaStreamOpenFunc.
+func (c DeltaCallbackFuncs) OnDeltaStreamOpen(ctx context.Context, streamID int64, typeURL string) error {
+	if c.DeltaStreamOpenFunc != nil {
+		return c.DeltaStreamOpenFunc(ctx, streamID, typeURL)
+	}
+
+	return nil
+}
+
+// OnDeltaStreamClosed invokes DeltaStreamClosedFunc.
+func (c DeltaCallbackFuncs) OnDeltaStreamClosed(streamID int64) {
+	if c.DeltaStreamClosedFunc != nil {
+		c.DeltaStreamClosedFunc(streamID)
+	}
+}
+
+// OnStreamDeltaRequest invokes StreamDeltaRequestFunc.
+func (c DeltaCallbackFuncs) OnStreamDeltaRequest(streamID int64, req *discovery.DeltaDiscoveryRequest) error {
+	if c.StreamDeltaRequestFunc != nil {
+		return c.StreamDeltaRequestFunc(streamID, req)
+	}
+
+	return nil
+}
+
+// OnStreamDeltaResponse invokes StreamDeltaResponseFunc.
+func (c DeltaCallbackFuncs) OnStreamDeltaResponse(streamID int64, req *discovery.DeltaDiscoveryRequest, resp *discovery.DeltaDiscoveryResponse) {
+	if c.StreamDeltaResponseFunc != nil {
+		c.StreamDeltaResponseFunc(streamID, req, resp)
+	}
+}
+
+type deltaStream interface {
+	grpc.ServerStream
+
+	Send(*discovery.DeltaDiscoveryResponse) error
+	Recv() (*discovery.DeltaDiscoveryRequest, error)
+}
+
+// deltaWatch is the open incremental watch for a single type URL on a stream.
+type deltaWatch struct {
+	// generation distinguishes this watch from the ones it replaced, so that
+	// a response from a cancelled watch can be recognized and dropped
+	generation int64
+	nonce      string
+	state      cache.StreamState
+
+	cancel func()
+	stop   chan struct{}
+}
+
+// Cancel the watch and stop forwarding its response.
+func (w *deltaWatch) Cancel() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+	if w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
+
+// deltaMuxedResponse tags a response with the watch that produced it.
+type deltaMuxedResponse struct {
+	typeURL    string
+	generation int64
+	response   cache.DeltaResponse
+}
+
+func createDeltaResponse(resp cache.DeltaResponse) (*discovery.DeltaDiscoveryResponse, error) {
+	if resp == nil {
+		return nil, errors.New("missing response")
+	}
+
+	marshalledResponse, err := resp.GetDeltaDiscoveryResponse()
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalledResponse, nil
+}
+
+// processDelta handles a bi-di incremental stream request
+func (s *server) processDelta(str deltaStream, reqCh <-chan *discovery.DeltaDiscoveryRequest, defaultTypeURL string) error {
+	deltaCache, ok := s.cache.(cache.DeltaConfigWatcher)
+	if !ok {
+		return status.Errorf(codes.Unimplemented, "incremental xDS is not supported by the configuration cache")
+	}
+	deltaCallbacks, _ := s.callbacks.(DeltaCallbacks)
+
+	// increment stream count
+	streamID := atomic.AddInt64(&s.streamCount, 1)
+
+	// unique nonce generator for req-resp pairs per xDS stream; the server
+	// ignores stale nonces. nonce is only modified within send() function.
+	var streamNonce int64
+
+	// generation counter for the watches on this stream
+	var watchGeneration int64
+
+	// a collection of watches per request type, all of which are forwarded
+	// to a single channel; there is at most one response in flight per watch
+	watches := make(map[string]*deltaWatch)
+	responses := make(chan deltaMuxedResponse, int(types.UnknownType))
+	defer func() {
+		for _, watch := range watches {
+			watch.Cancel()
+		}
+		if deltaCallbacks != nil {
+			deltaCallbacks.OnDeltaStreamClosed(streamID)
+		}
+	}()
+
+	// sends a response by serializing to protobuf Any
+	send := func(resp cache.DeltaResponse) (string, error) {
+		out, err := createDeltaResponse(resp)
+		if err != nil {
+			return "", err
+		}
+
+		// increment nonce
+		streamNonce = streamNonce + 1
+		out.Nonce = strconv.FormatInt(streamNonce, 10)
+		if deltaCallbacks != nil {
+			deltaCallbacks.OnStreamDeltaResponse(streamID, resp.GetDeltaRequest(), out)
+		}
+		return out.Nonce, str.Send(out)
+	}
+
+	if deltaCallbacks != nil {
+		if err := deltaCallbacks.OnDeltaStreamOpen(str.Context(), streamID, defaultTypeURL); err != nil {
+			return err
+		}
+	}
+
+	// node may only be set on the first discovery request
+	var node = &core.Node{}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+
+		// config watcher can send the requested resources types in any order
+		case muxed := <-responses:
+			watch, ok := watches[muxed.typeURL]
+			if !ok || watch.generation != muxed.generation {
+				// response from a watch that has since been replaced
+				continue
+			}
+			nonce, err := send(muxed.response)
+			if err != nil {
+				return err
+			}
+			watch.nonce = nonce
+			watch.state.ResourceVersions = muxed.response.GetNextVersionMap()
+			watch.state.First = false
+
+		case req, more := <-reqCh:
+			// input stream ended or errored out
+			if !more {
+				return nil
+			}
+			if req == nil {
+				return status.Errorf(codes.Unavailable, "empty request")
+			}
+
+			// node field in discovery request is delta-compressed
+			if req.Node != nil {
+				node = req.Node
+			} else {
+				req.Node = node
+			}
+
+			// type URL is required for ADS but is implicit for xDS
+			if defaultTypeURL == resource.AnyType {
+				if req.TypeUrl == "" {
+					return status.Errorf(codes.InvalidArgument, "type URL is required for ADS")
+				}
+			} else if req.TypeUrl == "" {
+				req.TypeUrl = defaultTypeURL
+			}
+
+			if deltaCallbacks != nil {
+				if err := deltaCallbacks.OnStreamDeltaRequest(streamID, req); err != nil {
+					return err
+				}
+			}
+
+			if cache.GetResponseType(req.TypeUrl) == types.UnknownType {
+				// not a type the cache knows about; leave it alone
+				continue
+			}
+
+			// cancel the existing watch to (re-)request with the updated subscriptions
+			watch, ok := watches[req.TypeUrl]
+			if !ok {
+				// This is the first request for the type on this stream, so it
+				// determines whether the stream is in wildcard mode, and carries
+				// the versions the client has from a previous stream.
+				watch = &deltaWatch{
+					state: cache.NewStreamState(len(req.ResourceNamesSubscribe) == 0, req.InitialResourceVersions),
+				}
+				watches[req.TypeUrl] = watch
+			} else {
+				watch.Cancel()
+			}
+			subscribe(req.ResourceNamesSubscribe, &watch.state)
+			unsubscribe(req.ResourceNamesUnsubscribe, &watch.state)
+
+			watchGeneration++
+			watch.generation = watchGeneration
+			watch.stop = make(chan struct{})
+
+			var value chan cache.DeltaResponse
+			value, watch.cancel = deltaCache.CreateDeltaWatch(*req, copyStreamState(watch.state))
+			go forwardDelta(req.TypeUrl, watch.generation, value, watch.stop, responses)
+		}
+	}
+}
+
+// forwardDelta relays the single response of a watch to the stream's muxed
+// response channel, unless the watch is stopped first.
+func forwardDelta(typeURL string, generation int64, value <-chan cache.DeltaResponse, stop <-chan struct{}, out chan<- deltaMuxedResponse) {
+	select {
+	case resp := <-value:
+		select {
+		case out <- deltaMuxedResponse{typeURL: typeURL, generation: generation, response: resp}:
+		case <-stop:
+		}
+	case <-stop:
+	}
+}
+
+// copyStreamState makes a copy of the stream state that the cache can hold on
+// to without racing against later updates from the stream.
+func copyStreamState(state cache.StreamState) cache.StreamState {
+	out := cache.StreamState{
+		Wildcard:                state.Wildcard,
+		SubscribedResourceNames: make(map[string]bool, len(state.SubscribedResourceNames)),
+		ResourceVersions:        make(map[string]string, len(state.ResourceVersions)),
+		First:                   state.First,
+	}
+	for name := range state.SubscribedResourceNames {
+		out.SubscribedResourceNames[name] = true
+	}
+	for name, version := range state.ResourceVersions {
+		out.ResourceVersions[name] = version
+	}
+	return out
+}
+
+// subscribe adds the names to the stream's subscriptions. A "*" switches the
+// stream to wildcard mode.
+func subscribe(names []string, state *cache.StreamState) {
+	for _, name := range names {
+		if name == "*" {
+			state.Wildcard = true
+			continue
+		}
+		state.SubscribedResourceNames[name] = true
+	}
+}
+
+// unsubscribe removes the names from the stream's subscriptions, and forgets
+// the versions of them, so that a later subscription sends them again.
+func unsubscribe(names []string, state *cache.StreamState) {
+	for _, name := range names {
+		if name == "*" {
+			state.Wildcard = false
+			continue
+		}
+		delete(state.SubscribedResourceNames, name)
+		delete(state.ResourceVersions, name)
+	}
+}
+
+// deltaHandler converts a blocking read call to channels and initiates incremental stream processing
+func (s *server) deltaHandler(str deltaStream, typeURL string) error {
+	// a channel for receiving incoming requests
+	reqCh := make(chan *discovery.DeltaDiscoveryRequest)
+	reqStop := int32(0)
+	go func() {
+		for {
+			req, err := str.Recv()
+			if atomic.LoadInt32(&reqStop) != 0 {
+				return
+			}
+			if err != nil {
+				close(reqCh)
+				return
+			}
+			reqCh <- req
+		}
+	}()
+
+	err := s.processDelta(str, reqCh, typeURL)
+
+	// prevents writing to a closed channel if send failed on blocked recv
+	atomic.StoreInt32(&reqStop, 1)
+
+	return err
+}
+
+func (s *server) DeltaAggregatedResources(str discoverygrpc.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	return s.deltaHandler(str, resource.AnyType)
+}
+
+func (s *server) DeltaEndpoints(str endpointservice.EndpointDiscoveryService_DeltaEndpointsServer) error {
+	return s.deltaHandler(str, resource.EndpointType)
+}
+
+func (s *server) DeltaClusters(str clusterservice.ClusterDiscoveryService_DeltaClustersServer) error {
+	return s.deltaHandler(str, resource.ClusterType)
+}
+
+func (s *server) DeltaRoutes(str routeservice.RouteDiscoveryService_DeltaRoutesServer) error {
+	return s.deltaHandler(str, resource.RouteType)
+}
+
+func (s *server) DeltaListeners(str listenerservice.ListenerDiscoveryService_DeltaListenersServer) error {
+	return s.deltaHandler(str, resource.ListenerType)
+}
+
+func (s *server) DeltaSecrets(str secretservice.SecretDiscoveryService_DeltaSecretsServer) error {
+	return s.deltaHandler(str, resource.SecretType)
+}
+
+func (s *server) DeltaRuntime(str runtimeservice.RuntimeDiscoveryService_DeltaRuntimeServer) error {
+	return s.deltaHandler(str, resource.RuntimeType)
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Envoyproxy Authors
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package server_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	rsrc "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/server/v3"
+	"github.com/datawire/ambassador/v2/pkg/envoy-control-plane/test/resource/v3"
+)
+
+type mockDeltaStream struct {
+	t     *testing.T
+	ctx   context.Context
+	recv  chan *discovery.DeltaDiscoveryRequest
+	sent  chan *discovery.DeltaDiscoveryResponse
+	nonce int
+	grpc.ServerStream
+}
+
+func (stream *mockDeltaStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *mockDeltaStream) Send(resp *discovery.DeltaDiscoveryResponse) error {
+	// check that nonce is monotonically incrementing
+	stream.nonce = stream.nonce + 1
+	if resp.Nonce != fmt.Sprintf("%d", stream.nonce) {
+		stream.t.Errorf("Nonce => got %q, want %d", resp.Nonce, stream.nonce)
+	}
+	// check that type URL matches in resources
+	if resp.TypeUrl == "" {
+		stream.t.Error("TypeUrl => got none, want non-empty")
+	}
+	for _, res := range resp.Resources {
+		if res.Resource.TypeUrl != resp.TypeUrl {
+			stream.t.Errorf("TypeUrl => got %q, want %q", res.Resource.TypeUrl, resp.TypeUrl)
+		}
+		if res.Version == "" {
+			stream.t.Errorf("Version => got none for %q, want non-empty", res.Name)
+		}
+	}
+	stream.sent <- resp
+	return nil
+}
+
+func (stream *mockDeltaStream) Recv() (*discovery.DeltaDiscoveryRequest, error) {
+	req, more := <-stream.recv
+	if !more {
+		return nil, errors.New("empty")
+	}
+	return req, nil
+}
+
+func makeMockDeltaStream(t *testing.T) *mockDeltaStream {
+	return &mockDeltaStream{
+		t:    t,
+		ctx:  context.Background(),
+		sent: make(chan *discovery.DeltaDiscoveryResponse, 10),
+		recv: make(chan *discovery.DeltaDiscoveryRequest, 10),
+	}
+}
+
+func expectDelta(t *testing.T, stream *mockDeltaStream) *discovery.DeltaDiscoveryResponse {
+	t.Helper()
+	select {
+	case resp := <-stream.sent:
+		return resp
+	case <-time.After(1 * time.Second):
+		t.Fatalf("got no response")
+		return nil
+	}
+}
+
+func TestDeltaAggregatedHandler(t *testing.T) {
+	config := cache.NewSnapshotCache(false, cache.IDHash{}, nil)
+	snapshot := cache.NewSnapshot("1",
+		[]types.Resource{endpoint},
+		[]types.Resource{cluster},
+		[]types.Resource{route},
+		[]types.Resource{listener},
+		nil)
+	if err := config.SetSnapshot(node.Id, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	s := server.NewServer(context.Background(), config, server.CallbackFuncs{})
+
+	stream := makeMockDeltaStream(t)
+	go func() {
+		if err := s.DeltaAggregatedResources(stream); err != nil {
+			t.Errorf("DeltaAggregatedResources() => got %v, want no error", err)
+		}
+	}()
+
+	// the initial wildcard request gets all the clusters
+	stream.recv <- &discovery.DeltaDiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType}
+	resp := expectDelta(t, stream)
+	if len(resp.Resources) != 1 || resp.Resources[0].Name != clusterName {
+		t.Errorf("got resources %v, want only %q", resp.Resources, clusterName)
+	}
+
+	// subscribing to a named endpoint gets just that endpoint
+	stream.recv <- &discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.EndpointType, ResourceNamesSubscribe: []string{clusterName}}
+	resp = expectDelta(t, stream)
+	if len(resp.Resources) != 1 || resp.Resources[0].Name != clusterName {
+		t.Errorf("got resources %v, want only %q", resp.Resources, clusterName)
+	}
+	firstVersion := resp.Resources[0].Version
+
+	// acknowledging leaves a watch open, which responds only to the changed endpoint
+	stream.recv <- &discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.EndpointType, ResponseNonce: resp.Nonce}
+	stream.recv <- &discovery.DeltaDiscoveryRequest{TypeUrl: rsrc.ClusterType, ResponseNonce: "1"}
+	snapshot2 := snapshot
+	snapshot2.Resources[types.Endpoint] = cache.NewResources("2", []types.Resource{resource.MakeEndpoint(clusterName, 9090)})
+	time.Sleep(time.Second / 4)
+	if err := config.SetSnapshot(node.Id, snapshot2); err != nil {
+		t.Fatal(err)
+	}
+	resp = expectDelta(t, stream)
+	if resp.TypeUrl != rsrc.EndpointType {
+		t.Errorf("got response for %q, want %q", resp.TypeUrl, rsrc.EndpointType)
+	}
+	if len(resp.Resources) != 1 || resp.Resources[0].Version == firstVersion {
+		t.Errorf("got resources %v, want the changed %q", resp.Resources, clusterName)
+	}
+
+	// nothing else changed, so nothing else is sent
+	select {
+	case resp := <-stream.sent:
+		t.Errorf("got unexpected response %v", resp)
+	case <-time.After(time.Second / 4):
+	}
+	close(stream.recv)
+}
+
+func TestDeltaUnimplementedCache(t *testing.T) {
+	config := makeMockConfigWatcher()
+	s := server.NewServer(context.Background(), config, server.CallbackFuncs{})
+
+	stream := makeMockDeltaStream(t)
+	stream.recv <- &discovery.DeltaDiscoveryRequest{Node: node, TypeUrl: rsrc.ClusterType}
+	if err := s.DeltaAggregatedResources(stream); err == nil {
+		t.Error("DeltaAggregatedResources() => got no error, want an error for a cache without delta support")
+	}
+}
@@ -12,15 +12,20 @@ import (
 	"google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 
-	// envoy api v2
-	apiv2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
-	apiv2_core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
-	apiv2_discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v2"
+	// envoy api v3
+	apiv3_core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	apiv3_cluster "github.com/datawire/ambassador/v2/pkg/api/envoy/service/cluster/v3"
+	apiv3_discovery "github.com/datawire/ambassador/v2/pkg/api/envoy/service/discovery/v3"
+	apiv3_endpoint "github.com/datawire/ambassador/v2/pkg/api/envoy/service/endpoint/v3"
+	apiv3_listener "github.com/datawire/ambassador/v2/pkg/api/envoy/service/listener/v3"
+	apiv3_route "github.com/datawire/ambassador/v2/pkg/api/envoy/service/route/v3"
+	apiv3_secret "github.com/datawire/ambassador/v2/pkg/api/envoy/service/secret/v3"
 
 	// envoy control plane
 	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
-	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
-	ecp_v2_server "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/server/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
+	ecp_v3_server "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/server/v3"
 
 	// first-party-libraries
 	"github.com/datawire/dlib/dhttp"
@@ -33,7 +38,7 @@ import (
 type EnvoyController struct {
 	address string
 
-	configCache ecp_v2_cache.SnapshotCache
+	configCache ecp_v3_cache.SnapshotCache
 
 	// Protects the errors and outstanding fields.
 	cond        *sync.Cond
@@ -69,13 +74,13 @@ func NewEnvoyController(address string) *EnvoyController {
 		errors:      map[string]*errorInfo{},
 		outstanding: map[string]ackInfo{},
 	}
-	result.configCache = ecp_v2_cache.NewSnapshotCache(true, result, result)
+	result.configCache = ecp_v3_cache.NewSnapshotCache(true, result, result)
 	return result
 }
 
 // Configure will update the envoy configuration and block until the reconfiguration either succeeds
 // or signals an error.
-func (e *EnvoyController) Configure(node, version string, snapshot ecp_v2_cache.Snapshot) (*status.Status, error) {
+func (e *EnvoyController) Configure(node, version string, snapshot ecp_v3_cache.Snapshot) (*status.Status, error) {
 	err := e.configCache.SetSnapshot(node, snapshot)
 	if err != nil {
 		return nil, err
@@ -85,17 +90,19 @@ func (e *EnvoyController) Configure(node, version string, snapshot ecp_v2_cache.
 	// requested in order to figure out how to properly check that the entire snapshot was
 	// acked/nacked.
 	typeUrls := []string{}
-	if len(snapshot.Resources[ecp_cache_types.Endpoint].Items) > 0 {
-		typeUrls = append(typeUrls, "type.googleapis.com/envoy.api.v2.ClusterLoadAssignment")
-	}
-	if len(snapshot.Resources[ecp_cache_types.Cluster].Items) > 0 {
-		typeUrls = append(typeUrls, "type.googleapis.com/envoy.api.v2.Cluster")
-	}
-	if len(snapshot.Resources[ecp_cache_types.Route].Items) > 0 {
-		typeUrls = append(typeUrls, "type.googleapis.com/envoy.api.v2.RouteConfiguration")
-	}
-	if len(snapshot.Resources[ecp_cache_types.Listener].Items) > 0 {
-		typeUrls = append(typeUrls, "type.googleapis.com/envoy.api.v2.Listener")
+	for _, t := range []struct {
+		resourceType ecp_cache_types.ResponseType
+		typeUrl      string
+	}{
+		{ecp_cache_types.Endpoint, ecp_v3_resource.EndpointType},
+		{ecp_cache_types.Cluster, ecp_v3_resource.ClusterType},
+		{ecp_cache_types.Route, ecp_v3_resource.RouteType},
+		{ecp_cache_types.Listener, ecp_v3_resource.ListenerType},
+		{ecp_cache_types.Secret, ecp_v3_resource.SecretType},
+	} {
+		if len(snapshot.Resources[t.resourceType].Items) > 0 {
+			typeUrls = append(typeUrls, t.typeUrl)
+		}
 	}
 
 	for _, t := range typeUrls {
@@ -135,13 +142,14 @@ func (e *EnvoyController) Run(ctx context.Context) error {
 	e.logCtx = ctx
 
 	grpcServer := grpc.NewServer()
-	srv := ecp_v2_server.NewServer(ctx, e.configCache, e)
+	srv := ecp_v3_server.NewServer(ctx, e.configCache, e)
 
-	apiv2_discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv)
-	apiv2.RegisterEndpointDiscoveryServiceServer(grpcServer, srv)
-	apiv2.RegisterClusterDiscoveryServiceServer(grpcServer, srv)
-	apiv2.RegisterRouteDiscoveryServiceServer(grpcServer, srv)
-	apiv2.RegisterListenerDiscoveryServiceServer(grpcServer, srv)
+	apiv3_discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, srv)
+	apiv3_endpoint.RegisterEndpointDiscoveryServiceServer(grpcServer, srv)
+	apiv3_cluster.RegisterClusterDiscoveryServiceServer(grpcServer, srv)
+	apiv3_route.RegisterRouteDiscoveryServiceServer(grpcServer, srv)
+	apiv3_listener.RegisterListenerDiscoveryServiceServer(grpcServer, srv)
+	apiv3_secret.RegisterSecretDiscoveryServiceServer(grpcServer, srv)
 
 	lis, err := net.Listen("tcp", e.address)
 	if err != nil {
@@ -180,7 +188,7 @@ func SetupEnvoyController(t *testing.T, address string) *EnvoyController {
 }
 
 // ID is a callback function that the go control plane uses. I don't know what it does.
-func (e EnvoyController) ID(node *apiv2_core.Node) string {
+func (e EnvoyController) ID(node *apiv3_core.Node) string {
 	if node == nil {
 		return "unknown"
 	}
@@ -199,7 +207,7 @@ func (e *EnvoyController) OnStreamClosed(sid int64) {
 }
 
 // OnStreamRequest is called once a request is received on a stream.
-func (e *EnvoyController) OnStreamRequest(sid int64, req *apiv2.DiscoveryRequest) error {
+func (e *EnvoyController) OnStreamRequest(sid int64, req *apiv3_discovery.DiscoveryRequest) error {
 	//e.Infof("Stream request[%v]: %v", sid, req.TypeUrl)
 
 	func() {
@@ -222,7 +230,7 @@ func (e *EnvoyController) OnStreamRequest(sid int64, req *apiv2.DiscoveryRequest
 }
 
 // OnStreamResponse is called immediately prior to sending a response on a stream.
-func (e *EnvoyController) OnStreamResponse(sid int64, req *apiv2.DiscoveryRequest, res *apiv2.DiscoveryResponse) {
+func (e *EnvoyController) OnStreamResponse(sid int64, req *apiv3_discovery.DiscoveryRequest, res *apiv3_discovery.DiscoveryResponse) {
 	//e.Infof("Stream response[%v]: %v -> %v", sid, req.TypeUrl, res.Nonce)
 	func() {
 		e.cond.L.Lock()
@@ -232,13 +240,13 @@ func (e *EnvoyController) OnStreamResponse(sid int64, req *apiv2.DiscoveryReques
 }
 
 // OnFetchRequest is called for each Fetch request
-func (e *EnvoyController) OnFetchRequest(_ context.Context, r *apiv2.DiscoveryRequest) error {
+func (e *EnvoyController) OnFetchRequest(_ context.Context, r *apiv3_discovery.DiscoveryRequest) error {
 	//e.Infof("Fetch request: %v", r)
 	return nil
 }
 
 // OnFetchResponse is called immediately prior to sending a response.
-func (e *EnvoyController) OnFetchResponse(req *apiv2.DiscoveryRequest, res *apiv2.DiscoveryResponse) {
+func (e *EnvoyController) OnFetchResponse(req *apiv3_discovery.DiscoveryRequest, res *apiv3_discovery.DiscoveryResponse) {
 	//e.Infof("Fetch response: %v -> %v", req, res)
 }
 
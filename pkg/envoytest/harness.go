@@ -165,6 +165,7 @@ const bootstrap = `
   "dynamic_resources": {
     "ads_config": {
       "api_type": "GRPC",
+      "transport_api_version": "V3",
       "grpc_services": [
         {
           "envoy_grpc": {
@@ -174,10 +175,12 @@ const bootstrap = `
       ]
     },
     "cds_config": {
-      "ads": {}
+      "ads": {},
+      "resource_api_version": "V3"
     },
     "lds_config": {
-      "ads": {}
+      "ads": {},
+      "resource_api_version": "V3"
     }
   },
   "static_resources": {
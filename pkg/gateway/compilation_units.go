@@ -1,20 +1,27 @@
 package gateway
 
 import (
-	v2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
-	route "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/route"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+
+	v3cluster "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	v3endpoint "github.com/datawire/ambassador/v2/pkg/api/envoy/config/endpoint/v3"
+	v3listener "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	route "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
+
+	"github.com/datawire/ambassador/v2/pkg/kates"
 )
 
 // The types in this file primarily decorate envoy configuration with pointers back to Sources
 // and/or error messages. In the case of CompiledListener there are some additional fields that
-// allow the Dispatcher to automatically assemble RouteConfigurations for a given v2.Listener.
+// allow the Dispatcher to automatically assemble RouteConfigurations for a given v3listener.Listener.
 
 // CompiledItem has fields common to all compilation units.
 type CompiledItem struct {
 	Source    Source // Tracks the source of truth for whatever produced this compiled item.
 	Namespace string // The namespace of whatever produced this item.
 	Error     string // Holds any error associated with this compiled item.
+	Reason    string // A CamelCase reason for the Error, for the status of the resource.
 }
 
 func NewCompiledItem(source Source) CompiledItem {
@@ -36,16 +43,50 @@ type CompiledConfig struct {
 }
 
 // CompiledListener is an envoy Listener plus a Predicate that the dispatcher uses to determine
-// which routes to supply to the listener.
+// which routes to supply to the listener. A listener that couldn't be compiled has an Error and no
+// Listener. The dispatcher merges envoy Listeners on the same address into one.
 type CompiledListener struct {
 	CompiledItem
-	Listener *v2.Listener
+	Listener *v3listener.Listener
 
 	// The predicate determines which routes belong to which listeners. If the listener specifies
 	// and Rds configuration, this Predicate and the Domains below will be used to construct a
 	// RouteConfiguration from all the available CompiledRoutes.
 	Predicate func(route *CompiledRoute) bool
 	Domains   []string
+
+	// If there's a Build function, the dispatcher uses it instead of the Listener above, passing it
+	// the routes that the Predicate selects. This is how TCP and UDP listeners, which proxy whole
+	// connections to the Backends of their routes, get built. A nil Listener means there's nothing
+	// to listen for.
+	Build func(routes []*CompiledRoute) (*v3listener.Listener, error)
+
+	// If there are any VirtualHosts, they are used instead of the Predicate and Domains above.
+	// This is how Gateway API v1 listeners that share a port share an envoy Listener, and how the
+	// routes attached to a v1 TLS listener are passed to its Build function.
+	//
+	// A CompiledListener with no Listener holds the VirtualHosts that couldn't be compiled at
+	// all.
+	VirtualHosts []*CompiledVirtualHost
+}
+
+// CompiledVirtualHost is a Gateway API listener within a CompiledListener. The dispatcher builds
+// an envoy VirtualHost for each hostname that the attached routes have in common with it.
+type CompiledVirtualHost struct {
+	CompiledItem
+	Name     string // The listener's name, which routes can use as the SectionName of a parentRef.
+	Port     int32
+	Hostname string             // The empty string matches all hostnames.
+	Kinds    []schema.GroupKind // The kinds of route that may attach.
+
+	// Attach determines whether a route attaches to this listener. It is passed the labels of
+	// the route's namespace.
+	Attach func(route *CompiledRoute, namespaceLabels kates.LabelSet) bool
+
+	// SingleRoute is set for listeners that can only serve one route, i.e. UDP listeners, since
+	// envoy can only proxy UDP to one cluster. The first route without errors to attach, in the
+	// order of the resources they came from, gets the listener; any others aren't accepted.
+	SingleRoute bool
 }
 
 // CompiledRoute is
@@ -56,28 +97,61 @@ type CompiledRoute struct {
 	// source such as labels kind, namespace, name, etc.
 	HTTPRoute *gw.HTTPRoute
 
+	// The kind of route. Listeners only accept the kinds of route that they know what to do with.
+	GroupKind schema.GroupKind
+
+	// These fields are only used by Gateway API v1 routes, which choose the listeners they attach
+	// to themselves.
+	ParentRefs []ParentRef
+	Hostnames  []string
+
 	Routes      []*route.Route
 	ClusterRefs []*ClusterRef
+
+	// Backends are the weighted clusters of routes that proxy whole connections rather than
+	// requests, i.e. TCPRoutes, TLSRoutes and UDPRoutes, which have no envoy Routes.
+	Backends []*route.WeightedCluster_ClusterWeight
+
+	// Filters has an item for each of the filters of the route's rules, with an Error if the
+	// filter can't be applied. Requests that match a rule with such a filter get a 500.
+	Filters []*CompiledItem
 }
 
-// ClusterRef represents a reference to an envoy v2.Cluster.
+// ParentRef is a route's reference to a Gateway, with the defaults filled in.
+type ParentRef struct {
+	Group       string
+	Kind        string
+	Namespace   string
+	Name        string
+	SectionName string // The empty string refers to every listener.
+	Port        int32  // Zero refers to every port.
+}
+
+// ClusterRef represents a reference to an envoy v3cluster.Cluster.
 type ClusterRef struct {
 	CompiledItem
 	Name string
 
+	// Service is the name of the kubernetes Service that the cluster routes to, if it differs from
+	// Name.
+	Service string
+
+	// HTTP2 is set for backends that must be spoken to over HTTP/2, such as gRPC services.
+	HTTP2 bool
+
 	// These are temporary fields to deal with how endpoints are currently plumbed from the watcher
 	// through to ambex.
 	EndpointPath string
 }
 
-// CompiledCluster decorates an envoy v2.Cluster.
+// CompiledCluster decorates an envoy v3cluster.Cluster.
 type CompiledCluster struct {
 	CompiledItem
-	Cluster *v2.Cluster
+	Cluster *v3cluster.Cluster
 }
 
-// CompiledLoadAssignment decorates an envoy v2.ClusterLoadAssignment.
+// CompiledLoadAssignment decorates an envoy v3endpoint.ClusterLoadAssignment.
 type CompiledLoadAssignment struct {
 	CompiledItem
-	LoadAssignment *v2.ClusterLoadAssignment
+	LoadAssignment *v3endpoint.ClusterLoadAssignment
 }
@@ -4,18 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
-	apiv2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
-	apiv2_core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
-	apiv2_endpoint "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/endpoint"
-	apiv2_route "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/route"
-
+	apiv3_cluster "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	apiv3_core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	apiv3_endpoint "github.com/datawire/ambassador/v2/pkg/api/envoy/config/endpoint/v3"
+	apiv3_listener "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	apiv3_route "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
 	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
-	ecp_v2_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v2"
-	ecp_v2_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v2"
+	ecp_v3_cache "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/resource/v3"
 	ecp_wellknown "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/wellknown"
 
 	"github.com/datawire/ambassador/v2/pkg/kates"
@@ -26,41 +30,75 @@ import (
 // resources and invokes those transforms to produce compiled envoy configurations. It also knows
 // how to assemble the compiled envoy configuration into a complete snapshot.
 //
-// Currently the dispatch process is relatively simple, each resource is processed as an independent
-// unit. This is sufficient for the gateway API since the currently implemented resources are
-// conveniently defined in such a way as to make them independent.
-//
-// Consistency is guaranteed assuming transform functions don't use out of band communication to
-// include information from other resources. This guarantee is achieved because each transform is
-// only passed a single resource and can therefore only use information from that one
-// resource. Changes to any other resource cannot impact the result of that transform.
+// In the simplest case each resource is processed as an independent unit: its transform is only
+// passed that one resource, so changes to any other resource cannot impact the result of that
+// transform. This is sufficient for most of the gateway API, whose resources are conveniently
+// defined in such a way as to make them independent.
 //
-// Not all the edgestack resources are defined as conveniently, so the Dispatcher design is expected
-// to be extended in two ways to handle resources with more complex interdependencies:
+// Resources with more complex interdependencies are handled in two ways:
 //
-//   1. Grouping -- This feature would cover resources that need to be processed as a group,
-//      e.g. Mappings that get grouped together based on prefix. Instead of dispatching at the
-//      granularity of a single resource, the dispatcher will track groups of resources that need to
-//      be processed together via a logical "hash" function provided at registration. Whenever any
-//      item in a given bucket changes, the dispatcher will transform the entire bucket.
+// Grouping covers resources that need to be processed as a group, e.g. Mappings that get grouped
+// together based on prefix. A kind registered with RegisterGroup supplies a function that maps each
+// resource to the name of its group, and whenever any resource in a group changes, the dispatcher
+// transforms the entire group.
 //
-//   2. Dependencies -- This feature would cover resources that need to lookup the contents of other
-//      resources in order to properly implement their transform. This would be done by passing the
-//      transform function a Query API. Any resources queried by the transform would be
-//      automatically tracked as a dependency of that resource. The dependencies would then be used
-//      to perform invalidation whenever a resource is Upsert()ed.
+// Dependencies cover resources that need to look up the contents of other resources in order to
+// implement their transform, e.g. the Secret that a listener's certificateRef refers to. Transforms
+// registered with RegisterTransform or RegisterGroup are passed a Query, and anything looked up
+// with it is tracked as a dependency of whatever is being transformed. Whenever a resource is
+// Upsert()ed or Delete()d, everything that depends on it is transformed again. Kinds that are only
+// ever looked up, and not transformed themselves, are registered with RegisterQueryable.
 //
+// Consistency is guaranteed assuming transform functions don't use out of band communication to
+// include information from other resources: everything a transform can see comes from the
+// resources it is passed and the Query, so the dispatcher knows when its result may have changed.
 type Dispatcher struct {
-	// Map from kind to transform function.
-	transforms map[string]func(kates.Object) (*CompiledConfig, error)
-	configs    map[string]*CompiledConfig
+	// Map from kind to how to transform resources of that kind.
+	transforms map[string]*registration
+
+	// Map from resource key to every resource that has been upserted, so that transforms can
+	// look them up.
+	resources map[string]kates.Object
+
+	// Map from the key of each grouped resource to the key of its group, and from the key of each
+	// group to the keys of its resources.
+	groups       map[string]string
+	groupMembers map[string]map[string]bool
+
+	// Map from unit key (the key of an ungrouped resource, or of a group) to its compiled config.
+	configs map[string]*CompiledConfig
+
+	// Map from unit key to the keys of everything its transform looked up, and from each of those
+	// keys back to the units that looked it up.
+	dependencies map[string][]string
+	dependents   map[string]map[string]bool
+
+	// Map from namespace name to its labels.
+	namespaces map[string]kates.LabelSet
 
 	version         string
 	changeCount     int
-	snapshot        *ecp_v2_cache.Snapshot
+	snapshot        *ecp_v3_cache.Snapshot
 	endpointWatches map[string]bool
 }
 
+// Transform compiles a single resource. Anything it looks up with the query is tracked as a
+// dependency of the resource.
+type Transform func(resource kates.Object, query Query) (*CompiledConfig, error)
+
+// GroupTransform compiles all the resources in a group, which are passed to it in order of their
+// namespaces and names. Anything it looks up with the query is tracked as a dependency of the
+// group.
+type GroupTransform func(group string, resources []kates.Object, query Query) (*CompiledConfig, error)
+
+// registration is how to transform a kind of resource. A kind that is only looked up by other
+// transforms has neither a transform nor a groupTransform.
+type registration struct {
+	transform      Transform
+	groupOf        func(kates.Object) string
+	groupTransform GroupTransform
+}
+
 type ResourceRef struct {
 	Kind      string
 	Namespace string
@@ -68,33 +106,77 @@ type ResourceRef struct {
 }
 
 // resourceKey produces a fully qualified key for a kubernetes resource.
-func resourceKey(resource kates.Object) string {
+func (d *Dispatcher) resourceKey(resource kates.Object) string {
 	gvk := resource.GetObjectKind().GroupVersionKind()
-	return resourceKeyFromParts(gvk.Kind, resource.GetNamespace(), resource.GetName())
+	kind, ok := d.RegisteredKind(gvk)
+	if !ok {
+		kind = gvk.Kind
+	}
+	return resourceKeyFromParts(kind, resource.GetNamespace(), resource.GetName())
 }
 
 func resourceKeyFromParts(kind, namespace, name string) string {
 	return fmt.Sprintf("%s:%s:%s", kind, namespace, name)
 }
 
+// groupKey produces the key of a group of resources of the given kind. A "#" can't appear in a
+// resource key, since neither namespaces nor kinds can contain one.
+func groupKey(kind, group string) string {
+	return fmt.Sprintf("%s#%s", kind, group)
+}
+
 // NewDispatcher creates a new and empty *Dispatcher struct.
 func NewDispatcher() *Dispatcher {
 	return &Dispatcher{
-		transforms: map[string]func(kates.Object) (*CompiledConfig, error){},
-		configs:    map[string]*CompiledConfig{},
+		transforms:   map[string]*registration{},
+		resources:    map[string]kates.Object{},
+		groups:       map[string]string{},
+		groupMembers: map[string]map[string]bool{},
+		configs:      map[string]*CompiledConfig{},
+		dependencies: map[string][]string{},
+		dependents:   map[string]map[string]bool{},
 	}
 }
 
 // Register registers a transform function for the specified kubernetes resource. The transform
 // argument must be a function that takes a single resource of the supplied "kind" and returns a
 // single CompiledConfig object, i.e.: `func(Kind) *CompiledConfig`
+//
+// The kind may be qualified with its group, e.g. "Gateway.gateway.networking.k8s.io", to tell
+// apart kinds with the same name in different groups. A transform registered under the bare kind
+// handles that kind in any group that doesn't have a transform of its own.
 func (d *Dispatcher) Register(kind string, transform func(kates.Object) (*CompiledConfig, error)) error {
+	return d.RegisterTransform(kind, func(resource kates.Object, _ Query) (*CompiledConfig, error) {
+		return transform(resource)
+	})
+}
+
+// RegisterTransform is like Register, for a transform that looks up other resources.
+func (d *Dispatcher) RegisterTransform(kind string, transform Transform) error {
+	return d.register(kind, &registration{transform: transform})
+}
+
+// RegisterGroup registers a transform for resources of the specified kind that need to be
+// compiled together. The groupOf function returns the name of the group that a resource belongs
+// to, and whenever any resource in a group changes, the transform is invoked on the whole group.
+func (d *Dispatcher) RegisterGroup(kind string, groupOf func(kates.Object) string, transform GroupTransform) error {
+	return d.register(kind, &registration{groupOf: groupOf, groupTransform: transform})
+}
+
+// RegisterQueryable registers a kind of resource that transforms can look up with a Query, but
+// that isn't compiled itself. Resources of that kind still need to be Upsert()ed and Delete()d so
+// that the dispatcher knows about them.
+func (d *Dispatcher) RegisterQueryable(kind string) error {
+	return d.register(kind, &registration{})
+}
+
+func (d *Dispatcher) register(kind string, reg *registration) error {
 	_, ok := d.transforms[kind]
 	if ok {
 		return errors.Errorf("duplicate transform: %q", kind)
 	}
 
-	d.transforms[kind] = transform
+	d.transforms[kind] = reg
 
 	return nil
 }
@@ -105,40 +187,183 @@ func (d *Dispatcher) IsRegistered(kind string) bool {
 	return ok
 }
 
-// Upsert processes the given kubernetes resource whether it is new or just updated.
+// RegisteredKind returns the name that the transform for the given kind was registered under,
+// and false if there is no such transform.
+func (d *Dispatcher) RegisteredKind(gvk schema.GroupVersionKind) (string, bool) {
+	if kind := gvk.GroupKind().String(); d.IsRegistered(kind) {
+		return kind, true
+	}
+	if d.IsRegistered(gvk.Kind) {
+		return gvk.Kind, true
+	}
+	return "", false
+}
+
+// Upsert processes the given kubernetes resource whether it is new or just updated. Anything
+// whose transform looked it up gets processed again too.
 func (d *Dispatcher) Upsert(resource kates.Object) error {
 	gvk := resource.GetObjectKind().GroupVersionKind()
-	xform, ok := d.transforms[gvk.Kind]
+	kind, ok := d.RegisteredKind(gvk)
 	if !ok {
 		return errors.Errorf("no transform for kind: %q", gvk.Kind)
 	}
+	namespace, name := resource.GetNamespace(), resource.GetName()
+	key := resourceKeyFromParts(kind, namespace, name)
 
-	key := resourceKey(resource)
+	old := d.resources[key]
+	d.resources[key] = resource
+	// Clear out the snapshot so we regenerate one.
+	d.snapshot = nil
 
-	config, err := xform(resource)
-	if err != nil {
-		return errors.Wrapf(err, "internal error processing %s", key)
+	units := map[string]bool{}
+	reg := d.transforms[kind]
+	switch {
+	case reg.groupOf != nil:
+		group := groupKey(kind, reg.groupOf(resource))
+		if prev, ok := d.groups[key]; ok && prev != group {
+			delete(d.groupMembers[prev], key)
+			units[prev] = true
+		}
+		d.groups[key] = group
+		if d.groupMembers[group] == nil {
+			d.groupMembers[group] = map[string]bool{}
+		}
+		d.groupMembers[group][key] = true
+		units[group] = true
+	case reg.transform != nil:
+		units[key] = true
 	}
 
-	d.configs[key] = config
-	// Clear out the snapshot so we regenerate one.
-	d.snapshot = nil
-	return nil
+	// The watcher upserts the same version of a resource over and over, which can't change
+	// anything that looked it up.
+	if old == nil || resource.GetResourceVersion() == "" || old.GetResourceVersion() != resource.GetResourceVersion() {
+		d.addDependents(units, kind, namespace, name)
+	}
+	return d.compileUnits(units)
 }
 
 // Delete processes the deletion of the given kubernetes resource.
 func (d *Dispatcher) Delete(resource kates.Object) {
-	key := resourceKey(resource)
-	delete(d.configs, key)
-
-	// Clear out the snapshot so we regenerate one.
-	d.snapshot = nil
+	gvk := resource.GetObjectKind().GroupVersionKind()
+	kind, ok := d.RegisteredKind(gvk)
+	if !ok {
+		kind = gvk.Kind
+	}
+	d.DeleteKey(kind, resource.GetNamespace(), resource.GetName())
 }
 
+// DeleteKey processes the deletion of the resource of the given (registered) kind, namespace and
+// name. Anything whose transform looked it up gets processed again; since there's nobody to
+// report errors to, anything that fails to be processed keeps its previous config.
 func (d *Dispatcher) DeleteKey(kind, namespace, name string) {
 	key := resourceKeyFromParts(kind, namespace, name)
-	delete(d.configs, key)
+	delete(d.resources, key)
+	// Clear out the snapshot so we regenerate one.
 	d.snapshot = nil
+
+	units := map[string]bool{}
+	if group, ok := d.groups[key]; ok {
+		delete(d.groups, key)
+		delete(d.groupMembers[group], key)
+		units[group] = true
+	} else {
+		units[key] = true
+	}
+	d.addDependents(units, kind, namespace, name)
+	_ = d.compileUnits(units)
+}
+
+// compileUnits invokes the transforms of the given units, in order, and returns the first error.
+func (d *Dispatcher) compileUnits(units map[string]bool) error {
+	keys := make([]string, 0, len(units))
+	for key := range units {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var result error
+	for _, key := range keys {
+		if err := d.compileUnit(key); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// compileUnit invokes the transform of a single resource or group, replacing its config and its
+// dependencies. A resource or group that no longer exists loses its config.
+func (d *Dispatcher) compileUnit(unit string) error {
+	query := newRecordingQuery(d)
+	var config *CompiledConfig
+	var err error
+	if i := strings.Index(unit, "#"); i >= 0 {
+		members := make([]string, 0, len(d.groupMembers[unit]))
+		for key := range d.groupMembers[unit] {
+			members = append(members, key)
+		}
+		if len(members) == 0 {
+			delete(d.groupMembers, unit)
+			d.dropUnit(unit)
+			return nil
+		}
+		sort.Strings(members)
+		resources := make([]kates.Object, 0, len(members))
+		for _, key := range members {
+			resources = append(resources, d.resources[key])
+		}
+		config, err = d.transforms[unit[:i]].groupTransform(unit[i+1:], resources, query)
+	} else {
+		resource, ok := d.resources[unit]
+		if !ok {
+			d.dropUnit(unit)
+			return nil
+		}
+		config, err = d.transforms[unit[:strings.Index(unit, ":")]].transform(resource, query)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "internal error processing %s", unit)
+	}
+
+	d.configs[unit] = config
+	d.setDependencies(unit, query.keys())
+	return nil
+}
+
+// dropUnit forgets the config and dependencies of a resource or group.
+func (d *Dispatcher) dropUnit(unit string) {
+	delete(d.configs, unit)
+	d.setDependencies(unit, nil)
+}
+
+// SetNamespaces tells the dispatcher about the labels on each namespace, which Gateway listeners
+// can use to select the routes that attach to them.
+func (d *Dispatcher) SetNamespaces(namespaces []*kates.Namespace) {
+	labels := make(map[string]kates.LabelSet, len(namespaces))
+	for _, ns := range namespaces {
+		labels[ns.Name] = kates.LabelSet(ns.Labels)
+	}
+	if !namespaceLabelsEqual(d.namespaces, labels) {
+		d.namespaces = labels
+		d.snapshot = nil
+	}
+}
+
+func namespaceLabelsEqual(a, b map[string]kates.LabelSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, labels := range a {
+		other, ok := b[name]
+		if !ok || len(labels) != len(other) {
+			return false
+		}
+		for k, v := range labels {
+			if ov, ok := other[k]; !ok || ov != v {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 // UpsertYaml parses the supplied yaml and invokes Upsert on the result.
@@ -167,6 +392,11 @@ func (d *Dispatcher) GetErrors() []*CompiledItem {
 			if l.Error != "" {
 				result = append(result, &l.CompiledItem)
 			}
+			for _, vh := range l.VirtualHosts {
+				if vh.Error != "" {
+					result = append(result, &vh.CompiledItem)
+				}
+			}
 		}
 		for _, r := range config.Routes {
 			if r.Error != "" {
@@ -177,6 +407,11 @@ func (d *Dispatcher) GetErrors() []*CompiledItem {
 					result = append(result, &cr.CompiledItem)
 				}
 			}
+			for _, f := range r.Filters {
+				if f.Error != "" {
+					result = append(result, f)
+				}
+			}
 		}
 		for _, c := range config.Clusters {
 			if c.Error != "" {
@@ -193,18 +428,18 @@ func (d *Dispatcher) GetErrors() []*CompiledItem {
 }
 
 // GetSnapshot returns a version and a snapshot.
-func (d *Dispatcher) GetSnapshot(ctx context.Context) (string, *ecp_v2_cache.Snapshot) {
+func (d *Dispatcher) GetSnapshot(ctx context.Context) (string, *ecp_v3_cache.Snapshot) {
 	if d.snapshot == nil {
 		d.buildSnapshot(ctx)
 	}
 	return d.version, d.snapshot
 }
 
-// GetListener returns a *apiv2.Listener with the specified name or nil if none exists.
-func (d *Dispatcher) GetListener(ctx context.Context, name string) *apiv2.Listener {
+// GetListener returns a *apiv3_listener.Listener with the specified name or nil if none exists.
+func (d *Dispatcher) GetListener(ctx context.Context, name string) *apiv3_listener.Listener {
 	_, snap := d.GetSnapshot(ctx)
 	for _, rsrc := range snap.Resources[ecp_cache_types.Listener].Items {
-		l := rsrc.(*apiv2.Listener)
+		l := rsrc.(*apiv3_listener.Listener)
 		if l.Name == name {
 			return l
 		}
@@ -213,12 +448,12 @@ func (d *Dispatcher) GetListener(ctx context.Context, name string) *apiv2.Listen
 
 }
 
-// GetRouteConfiguration returns a *apiv2.RouteConfiguration with the specified name or nil if none
+// GetRouteConfiguration returns a *apiv3_route.RouteConfiguration with the specified name or nil if none
 // exists.
-func (d *Dispatcher) GetRouteConfiguration(ctx context.Context, name string) *apiv2.RouteConfiguration {
+func (d *Dispatcher) GetRouteConfiguration(ctx context.Context, name string) *apiv3_route.RouteConfiguration {
 	_, snap := d.GetSnapshot(ctx)
 	for _, rsrc := range snap.Resources[ecp_cache_types.Route].Items {
-		r := rsrc.(*apiv2.RouteConfiguration)
+		r := rsrc.(*apiv3_route.RouteConfiguration)
 		if r.Name == name {
 			return r
 		}
@@ -234,15 +469,26 @@ func (d *Dispatcher) IsWatched(namespace, name string) bool {
 	return ok
 }
 
-func (d *Dispatcher) buildClusterMap() (map[string]string, map[string]bool) {
-	refs := map[string]string{}
+func (d *Dispatcher) buildClusterMap() (map[string]*ClusterRef, map[string]bool) {
+	refs := map[string]*ClusterRef{}
 	watches := map[string]bool{}
 	for _, config := range d.configs {
 		for _, route := range config.Routes {
 			for _, ref := range route.ClusterRefs {
-				refs[ref.Name] = ref.EndpointPath
-				if route.Namespace != "" {
-					key := fmt.Sprintf("%s:%s", route.Namespace, ref.Name)
+				if ref.Error != "" {
+					continue
+				}
+				refs[ref.Name] = ref
+				namespace := route.Namespace
+				if ref.Namespace != "" {
+					namespace = ref.Namespace
+				}
+				service := ref.Name
+				if ref.Service != "" {
+					service = ref.Service
+				}
+				if namespace != "" {
+					key := fmt.Sprintf("%s:%s", namespace, service)
 					watches[key] = true
 				}
 			}
@@ -251,8 +497,8 @@ func (d *Dispatcher) buildClusterMap() (map[string]string, map[string]bool) {
 	return refs, watches
 }
 
-func (d *Dispatcher) buildEndpointMap() map[string]*apiv2.ClusterLoadAssignment {
-	endpoints := map[string]*apiv2.ClusterLoadAssignment{}
+func (d *Dispatcher) buildEndpointMap() map[string]*apiv3_endpoint.ClusterLoadAssignment {
+	endpoints := map[string]*apiv3_endpoint.ClusterLoadAssignment{}
 	for _, config := range d.configs {
 		for _, la := range config.LoadAssignments {
 			endpoints[la.LoadAssignment.ClusterName] = la.LoadAssignment
@@ -261,14 +507,35 @@ func (d *Dispatcher) buildEndpointMap() map[string]*apiv2.ClusterLoadAssignment
 	return endpoints
 }
 
-func (d *Dispatcher) buildRouteConfigurations() ([]ecp_cache_types.Resource, []ecp_cache_types.Resource) {
-	listeners := []ecp_cache_types.Resource{}
-	routes := []ecp_cache_types.Resource{}
+func (d *Dispatcher) buildRouteConfigurations(ctx context.Context) ([]ecp_cache_types.Resource, []ecp_cache_types.Resource) {
+	var compiled []*apiv3_listener.Listener
+	routeConfigs := map[string]*apiv3_route.RouteConfiguration{}
 	for _, config := range d.configs {
 		for _, lst := range config.Listeners {
-			listeners = append(listeners, lst.Listener)
+			if lst.Build != nil {
+				if l := d.buildListener(ctx, lst); l != nil {
+					compiled = append(compiled, l)
+				}
+				continue
+			}
+			if lst.Listener == nil {
+				continue
+			}
+			compiled = append(compiled, lst.Listener)
 			r := d.buildRouteConfiguration(lst)
 			if r != nil {
+				routeConfigs[r.Name] = r
+			}
+		}
+	}
+
+	listeners := mergeListeners(ctx, compiled)
+	// Leave out the RouteConfigurations of any filter chains that were dropped.
+	routes := []ecp_cache_types.Resource{}
+	for _, l := range listeners {
+		for _, fc := range l.(*apiv3_listener.Listener).FilterChains {
+			name, isRds := getFilterChainRdsName(fc)
+			if r, ok := routeConfigs[name]; isRds && ok {
 				routes = append(routes, r)
 			}
 		}
@@ -276,13 +543,154 @@ func (d *Dispatcher) buildRouteConfigurations() ([]ecp_cache_types.Resource, []e
 	return listeners, routes
 }
 
-func (d *Dispatcher) buildRouteConfiguration(lst *CompiledListener) *apiv2.RouteConfiguration {
+// buildListener builds the envoy Listener of a CompiledListener with a Build function, from the
+// routes that its Predicate selects, or that attach to its VirtualHosts, in the order of the
+// resources they came from.
+func (d *Dispatcher) buildListener(ctx context.Context, lst *CompiledListener) *apiv3_listener.Listener {
+	var routes []*CompiledRoute
+	if len(lst.VirtualHosts) == 0 {
+		for _, key := range d.sortedKeys() {
+			for _, route := range d.configs[key].Routes {
+				if lst.Predicate(route) {
+					routes = append(routes, route)
+				}
+			}
+		}
+	}
+	for _, vh := range lst.VirtualHosts {
+		routes = append(routes, d.attachedTo(vh)...)
+	}
+	listener, err := lst.Build(routes)
+	if err != nil {
+		dlog.Errorf(ctx, "error building %s: %v", lst.Source.Location(), err)
+		return nil
+	}
+	return listener
+}
+
+// attachedTo returns the routes that serve at least one hostname on the listener, in the order of
+// the resources they came from. A listener that can only serve one route gets the first one
+// without errors.
+func (d *Dispatcher) attachedTo(vh *CompiledVirtualHost) []*CompiledRoute {
+	if vh.Attach == nil {
+		return nil
+	}
+	var routes []*CompiledRoute
+	for _, key := range d.sortedKeys() {
+		for _, route := range d.configs[key].Routes {
+			if vh.SingleRoute && route.Error != "" {
+				continue
+			}
+			if vh.Attach(route, d.namespaces[route.Namespace]) && len(intersectHostnames(vh.Hostname, route.Hostnames)) > 0 {
+				routes = append(routes, route)
+				if vh.SingleRoute {
+					return routes
+				}
+			}
+		}
+	}
+	return routes
+}
+
+// mergeListeners merges listeners that share an address into one envoy Listener, named after the
+// first of them, since envoy can only have one Listener on each address. The merged Listener has
+// the filter chains of all of them, in order. A filter chain with the same match as an earlier one
+// would never be used, so it gets dropped.
+func mergeListeners(ctx context.Context, listeners []*apiv3_listener.Listener) []ecp_cache_types.Resource {
+	sort.Slice(listeners, func(i, j int) bool { return listeners[i].Name < listeners[j].Name })
+
+	byAddress := map[string]*apiv3_listener.Listener{}
+	cloned := map[string]bool{}
+	result := []ecp_cache_types.Resource{}
+	for _, l := range listeners {
+		address := listenerAddress(l)
+		merged, ok := byAddress[address]
+		if !ok {
+			byAddress[address] = l
+			result = append(result, l)
+			continue
+		}
+		if !cloned[address] {
+			// Don't modify the compiled Listener, since it won't be recompiled for the next
+			// snapshot.
+			clone := proto.Clone(merged).(*apiv3_listener.Listener)
+			for i, r := range result {
+				if r == merged {
+					result[i] = clone
+				}
+			}
+			merged = clone
+			byAddress[address] = clone
+			cloned[address] = true
+		}
+
+		for _, lf := range l.ListenerFilters {
+			if !hasListenerFilter(merged, lf.Name) {
+				merged.ListenerFilters = append(merged.ListenerFilters, lf)
+			}
+		}
+	chains:
+		for _, fc := range l.FilterChains {
+			for _, other := range merged.FilterChains {
+				if filterChainMatchEqual(fc.FilterChainMatch, other.FilterChainMatch) {
+					dlog.Errorf(ctx, "listener %s on %s conflicts with listener %s, dropping one of its filter chains",
+						l.Name, address, merged.Name)
+					continue chains
+				}
+			}
+			merged.FilterChains = append(merged.FilterChains, fc)
+		}
+	}
+	return result
+}
+
+// listenerAddress returns the address that the listener binds to, or, for a listener that doesn't
+// bind to a socket, its name, so that it doesn't get merged with anything. UDP ports are separate
+// from TCP ones.
+func listenerAddress(l *apiv3_listener.Listener) string {
+	sa := l.GetAddress().GetSocketAddress()
+	if sa == nil {
+		return l.Name
+	}
+	if sa.Protocol == apiv3_core.SocketAddress_UDP {
+		return fmt.Sprintf("%s:%d/udp", sa.Address, sa.GetPortValue())
+	}
+	return fmt.Sprintf("%s:%d", sa.Address, sa.GetPortValue())
+}
+
+func hasListenerFilter(l *apiv3_listener.Listener, name string) bool {
+	for _, lf := range l.ListenerFilters {
+		if lf.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func filterChainMatchEqual(a, b *apiv3_listener.FilterChainMatch) bool {
+	if a == nil {
+		a = &apiv3_listener.FilterChainMatch{}
+	}
+	if b == nil {
+		b = &apiv3_listener.FilterChainMatch{}
+	}
+	return proto.Equal(a, b)
+}
+
+func (d *Dispatcher) buildRouteConfiguration(lst *CompiledListener) *apiv3_route.RouteConfiguration {
 	rdsName, isRds := getRdsName(lst.Listener)
 	if !isRds {
 		return nil
 	}
 
-	var routes []*apiv2_route.Route
+	if len(lst.VirtualHosts) > 0 {
+		return &apiv3_route.RouteConfiguration{
+			Name:         rdsName,
+			VirtualHosts: d.buildVirtualHosts(rdsName, lst),
+		}
+	}
+
+	var routes []*apiv3_route.Route
 	for _, config := range d.configs {
 		for _, route := range config.Routes {
 			if lst.Predicate(route) {
@@ -291,9 +699,9 @@ func (d *Dispatcher) buildRouteConfiguration(lst *CompiledListener) *apiv2.Route
 		}
 	}
 
-	return &apiv2.RouteConfiguration{
+	return &apiv3_route.RouteConfiguration{
 		Name: rdsName,
-		VirtualHosts: []*apiv2_route.VirtualHost{
+		VirtualHosts: []*apiv3_route.VirtualHost{
 			{
 				Name:    rdsName,
 				Domains: lst.Domains,
@@ -303,21 +711,106 @@ func (d *Dispatcher) buildRouteConfiguration(lst *CompiledListener) *apiv2.Route
 	}
 }
 
+// buildVirtualHosts builds an envoy VirtualHost for each hostname that routes attached to the
+// listener's VirtualHosts have in common with them. Envoy only picks one VirtualHost for a
+// request, so each VirtualHost also gets the routes of the more general hostnames that cover it,
+// after its own.
+func (d *Dispatcher) buildVirtualHosts(rdsName string, lst *CompiledListener) []*apiv3_route.VirtualHost {
+	attached := map[string][]*CompiledRoute{}
+	for _, key := range d.sortedKeys() {
+		for _, route := range d.configs[key].Routes {
+			for _, vh := range lst.VirtualHosts {
+				if vh.Attach == nil || !vh.Attach(route, d.namespaces[route.Namespace]) {
+					continue
+				}
+				for _, domain := range intersectHostnames(vh.Hostname, route.Hostnames) {
+					attached[domain] = appendRoute(attached[domain], route)
+				}
+			}
+		}
+	}
+
+	domains := make([]string, 0, len(attached))
+	for domain := range attached {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	var vhosts []*apiv3_route.VirtualHost
+	for _, domain := range domains {
+		var covering []string
+		for _, other := range domains {
+			if other != domain && hostnameCovers(other, domain) {
+				covering = append(covering, other)
+			}
+		}
+		// Longer hostnames are more specific, so "*" comes last.
+		sort.SliceStable(covering, func(i, j int) bool { return len(covering[i]) > len(covering[j]) })
+
+		compiled := attached[domain]
+		for _, other := range covering {
+			for _, route := range attached[other] {
+				compiled = appendRoute(compiled, route)
+			}
+		}
+		var routes []*apiv3_route.Route
+		for _, route := range compiled {
+			routes = append(routes, route.Routes...)
+		}
+
+		vhosts = append(vhosts, &apiv3_route.VirtualHost{
+			Name:    fmt.Sprintf("%s-%s", rdsName, domain),
+			Domains: []string{domain},
+			Routes:  routes,
+		})
+	}
+	return vhosts
+}
+
+// sortedKeys returns the keys of all the compiled configs, in order.
+func (d *Dispatcher) sortedKeys() []string {
+	keys := make([]string, 0, len(d.configs))
+	for key := range d.configs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// appendRoute appends the route to the list if it isn't already in it.
+func appendRoute(routes []*CompiledRoute, route *CompiledRoute) []*CompiledRoute {
+	for _, r := range routes {
+		if r == route {
+			return routes
+		}
+	}
+	return append(routes, route)
+}
+
 // getRdsName returns the RDS route configuration name configured for the listener and a flag
 // indicating whether the listener uses Rds.
-func getRdsName(l *apiv2.Listener) (string, bool) {
+func getRdsName(l *apiv3_listener.Listener) (string, bool) {
 	for _, fc := range l.FilterChains {
-		for _, f := range fc.Filters {
-			if f.Name != ecp_wellknown.HTTPConnectionManager {
-				continue
-			}
+		if name, isRds := getFilterChainRdsName(fc); isRds {
+			return name, true
+		}
+	}
+	return "", false
+}
 
-			hcm := ecp_v2_resource.GetHTTPConnectionManager(f)
-			if hcm != nil {
-				rds := hcm.GetRds()
-				if rds != nil {
-					return rds.RouteConfigName, true
-				}
+// getFilterChainRdsName returns the RDS route configuration name configured for the filter chain
+// and a flag indicating whether the filter chain uses Rds.
+func getFilterChainRdsName(fc *apiv3_listener.FilterChain) (string, bool) {
+	for _, f := range fc.Filters {
+		if f.Name != ecp_wellknown.HTTPConnectionManager {
+			continue
+		}
+
+		hcm := ecp_v3_resource.GetHTTPConnectionManager(f)
+		if hcm != nil {
+			rds := hcm.GetRds()
+			if rds != nil {
+				return rds.RouteConfigName, true
 			}
 		}
 	}
@@ -333,9 +826,9 @@ func (d *Dispatcher) buildSnapshot(ctx context.Context) {
 
 	clusters := []ecp_cache_types.Resource{}
 	endpoints := []ecp_cache_types.Resource{}
-	for name, path := range clusterMap {
-		clusters = append(clusters, makeCluster(name, path))
-		key := path
+	for name, ref := range clusterMap {
+		clusters = append(clusters, makeCluster(name, ref))
+		key := ref.EndpointPath
 		if key == "" {
 			key = name
 		}
@@ -343,16 +836,16 @@ func (d *Dispatcher) buildSnapshot(ctx context.Context) {
 		if ok {
 			endpoints = append(endpoints, la)
 		} else {
-			endpoints = append(endpoints, &apiv2.ClusterLoadAssignment{
+			endpoints = append(endpoints, &apiv3_endpoint.ClusterLoadAssignment{
 				ClusterName: key,
-				Endpoints:   []*apiv2_endpoint.LocalityLbEndpoints{},
+				Endpoints:   []*apiv3_endpoint.LocalityLbEndpoints{},
 			})
 		}
 	}
 
-	listeners, routes := d.buildRouteConfigurations()
+	listeners, routes := d.buildRouteConfigurations(ctx)
 
-	snapshot := ecp_v2_cache.NewSnapshot(d.version, endpoints, clusters, routes, listeners, nil)
+	snapshot := ecp_v3_cache.NewSnapshot(d.version, endpoints, clusters, routes, listeners, nil)
 	if err := snapshot.Consistent(); err != nil {
 		bs, _ := json.MarshalIndent(snapshot, "", "  ")
 		dlog.Errorf(ctx, "Dispatcher Snapshot inconsistency: %v: %s", err, bs)
@@ -362,14 +855,26 @@ func (d *Dispatcher) buildSnapshot(ctx context.Context) {
 	}
 }
 
-func makeCluster(name, path string) *apiv2.Cluster {
-	return &apiv2.Cluster{
+func makeCluster(name string, ref *ClusterRef) *apiv3_cluster.Cluster {
+	cluster := &apiv3_cluster.Cluster{
 		Name:                 name,
 		ConnectTimeout:       &durationpb.Duration{Seconds: 10},
-		ClusterDiscoveryType: &apiv2.Cluster_Type{Type: apiv2.Cluster_EDS},
-		EdsClusterConfig: &apiv2.Cluster_EdsClusterConfig{
-			EdsConfig:   &apiv2_core.ConfigSource{ConfigSourceSpecifier: &apiv2_core.ConfigSource_Ads{}},
-			ServiceName: path,
+		ClusterDiscoveryType: &apiv3_cluster.Cluster_Type{Type: apiv3_cluster.Cluster_EDS},
+		EdsClusterConfig: &apiv3_cluster.Cluster_EdsClusterConfig{
+			EdsConfig:   adsConfigSource(),
+			ServiceName: ref.EndpointPath,
 		},
 	}
+	if ref.HTTP2 {
+		cluster.Http2ProtocolOptions = &apiv3_core.Http2ProtocolOptions{}
+	}
+	return cluster
+}
+
+// adsConfigSource makes a ConfigSource for resources that envoy gets over ADS, with the v3 API.
+func adsConfigSource() *apiv3_core.ConfigSource {
+	return &apiv3_core.ConfigSource{
+		ConfigSourceSpecifier: &apiv3_core.ConfigSource_Ads{Ads: &apiv3_core.AggregatedConfigSource{}},
+		ResourceApiVersion:    apiv3_core.ApiVersion_V3,
+	}
 }
@@ -10,12 +10,13 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/types/known/anypb"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 
-	// envoy api v2
-	apiv2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
-	apiv2_core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
-	apiv2_listener "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/listener"
-	apiv2_httpman "github.com/datawire/ambassador/v2/pkg/api/envoy/config/filter/network/http_connection_manager/v2"
+	// envoy api v3
+	apiv3_core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	apiv3_endpoint "github.com/datawire/ambassador/v2/pkg/api/envoy/config/endpoint/v3"
+	apiv3_listener "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	apiv3_httpman "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/http_connection_manager/v3"
 
 	// envoy control plane
 	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
@@ -54,6 +55,8 @@ func TestDispatcherDuplicateRegister(t *testing.T) {
 	require.NoError(t, err)
 	err = disp.Register("Foo", wrapFooCompiler(compile_Foo))
 	assertErrorContains(t, err, "duplicate")
+	err = disp.RegisterQueryable("Foo")
+	assertErrorContains(t, err, "duplicate")
 }
 
 func TestIsRegistered(t *testing.T) {
@@ -65,6 +68,24 @@ func TestIsRegistered(t *testing.T) {
 	assert.False(t, disp.IsRegistered("Bar"))
 }
 
+func TestRegisteredKind(t *testing.T) {
+	t.Parallel()
+	disp := gateway.NewDispatcher()
+	require.NoError(t, disp.Register("Foo", wrapFooCompiler(compile_Foo)))
+	require.NoError(t, disp.Register("Foo.example.com", wrapFooCompiler(compile_Foo)))
+
+	kind, ok := disp.RegisteredKind(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Foo"})
+	assert.True(t, ok)
+	assert.Equal(t, "Foo.example.com", kind)
+
+	kind, ok = disp.RegisteredKind(schema.GroupVersionKind{Group: "example.net", Version: "v1", Kind: "Foo"})
+	assert.True(t, ok)
+	assert.Equal(t, "Foo", kind)
+
+	_, ok = disp.RegisteredKind(schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Bar"})
+	assert.False(t, ok)
+}
+
 func TestDispatcherFaultIsolation1(t *testing.T) {
 	t.Parallel()
 	disp := gateway.NewDispatcher()
@@ -182,6 +203,123 @@ func TestDispatcherDeleteKey(t *testing.T) {
 	require.Nil(t, l)
 }
 
+func TestDispatcherDependencies(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	disp := gateway.NewDispatcher()
+	require.NoError(t, disp.RegisterQueryable("Bar"))
+	// Each Foo makes a listener named after the Bar that its value names, if there is one.
+	require.NoError(t, disp.RegisterTransform("Foo", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		f := untyped.(*Foo)
+		name := "missing"
+		if bar := query.Get("Bar", f.Namespace, f.Spec.Value); bar != nil {
+			name = bar.(*Foo).Spec.Value
+		}
+		return listenerConfig(f, name), nil
+	}))
+
+	require.NoError(t, disp.Upsert(makeFoo("default", "foo", "bar")))
+	assert.NotNil(t, disp.GetListener(ctx, "missing"))
+
+	bar := makeBar("default", "bar", "first")
+	require.NoError(t, disp.Upsert(bar))
+	assert.Nil(t, disp.GetListener(ctx, "missing"))
+	assert.NotNil(t, disp.GetListener(ctx, "first"))
+
+	require.NoError(t, disp.Upsert(makeBar("default", "bar", "second")))
+	assert.Nil(t, disp.GetListener(ctx, "first"))
+	assert.NotNil(t, disp.GetListener(ctx, "second"))
+
+	// A Bar in another namespace isn't the one that the Foo looked up.
+	require.NoError(t, disp.Upsert(makeBar("other", "bar", "third")))
+	assert.NotNil(t, disp.GetListener(ctx, "second"))
+
+	disp.Delete(bar)
+	assert.Nil(t, disp.GetListener(ctx, "second"))
+	assert.NotNil(t, disp.GetListener(ctx, "missing"))
+
+	// Once the Foo is gone, so is its dependency on the Bar.
+	disp.DeleteKey("Foo", "default", "foo")
+	require.NoError(t, disp.Upsert(makeBar("default", "bar", "fourth")))
+	assert.Nil(t, disp.GetListener(ctx, "fourth"))
+	assert.Nil(t, disp.GetListener(ctx, "missing"))
+}
+
+func TestDispatcherListDependencies(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	disp := gateway.NewDispatcher()
+	require.NoError(t, disp.RegisterQueryable("Bar"))
+	// Each Foo makes a listener named after the values of all the Bars in the namespace its value
+	// names.
+	require.NoError(t, disp.RegisterTransform("Foo", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		f := untyped.(*Foo)
+		name := "bars"
+		for _, bar := range query.List("Bar", f.Spec.Value) {
+			name += "-" + bar.(*Foo).Spec.Value
+		}
+		return listenerConfig(f, name), nil
+	}))
+
+	require.NoError(t, disp.Upsert(makeFoo("default", "foo", "default")))
+	require.NoError(t, disp.Upsert(makeFoo("default", "all", "*")))
+	require.NoError(t, disp.Upsert(makeBar("default", "b", "2")))
+	require.NoError(t, disp.Upsert(makeBar("default", "a", "1")))
+	require.NoError(t, disp.Upsert(makeBar("other", "c", "3")))
+	assert.NotNil(t, disp.GetListener(ctx, "bars-1-2"))
+	assert.NotNil(t, disp.GetListener(ctx, "bars-1-2-3"))
+
+	disp.DeleteKey("Bar", "default", "a")
+	assert.NotNil(t, disp.GetListener(ctx, "bars-2"))
+	assert.NotNil(t, disp.GetListener(ctx, "bars-2-3"))
+}
+
+func TestDispatcherGroups(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	disp := gateway.NewDispatcher()
+	// Foos are grouped by value, and each group makes a listener named after its members.
+	require.NoError(t, disp.RegisterGroup("Foo",
+		func(untyped kates.Object) string { return untyped.(*Foo).Spec.Value },
+		func(group string, resources []kates.Object, _ gateway.Query) (*gateway.CompiledConfig, error) {
+			name := group
+			for _, r := range resources {
+				name += "-" + r.GetName()
+			}
+			return listenerConfig(resources[0].(*Foo), name), nil
+		}))
+
+	require.NoError(t, disp.Upsert(makeFoo("default", "b", "x")))
+	require.NoError(t, disp.Upsert(makeFoo("default", "a", "x")))
+	require.NoError(t, disp.Upsert(makeFoo("default", "c", "y")))
+	assert.NotNil(t, disp.GetListener(ctx, "x-a-b"))
+	assert.NotNil(t, disp.GetListener(ctx, "y-c"))
+
+	// Moving a Foo to another group changes both groups.
+	require.NoError(t, disp.Upsert(makeFoo("default", "b", "y")))
+	assert.Nil(t, disp.GetListener(ctx, "x-a-b"))
+	assert.NotNil(t, disp.GetListener(ctx, "x-a"))
+	assert.NotNil(t, disp.GetListener(ctx, "y-b-c"))
+
+	// A group with no members left has no config.
+	disp.DeleteKey("Foo", "default", "a")
+	assert.Nil(t, disp.GetListener(ctx, "x-a"))
+	assert.NotNil(t, disp.GetListener(ctx, "y-b-c"))
+}
+
+func makeBar(namespace, name, value string) *Foo {
+	bar := makeFoo(namespace, name, value)
+	bar.Kind = "Bar"
+	return bar
+}
+
+func listenerConfig(f *Foo, name string) *gateway.CompiledConfig {
+	return &gateway.CompiledConfig{
+		CompiledItem: gateway.NewCompiledItem(gateway.SourceFromResource(f)),
+		Listeners:    []*gateway.CompiledListener{{Listener: &apiv3_listener.Listener{Name: name}}},
+	}
+}
+
 func compile_Foo(f *Foo) (*gateway.CompiledConfig, error) {
 	if f.Spec.Value == "bang" {
 		return nil, f.Spec.PanicArg
@@ -190,7 +328,7 @@ func compile_Foo(f *Foo) (*gateway.CompiledConfig, error) {
 		CompiledItem: gateway.NewCompiledItem(gateway.SourceFromResource(f)),
 		Listeners: []*gateway.CompiledListener{
 			{
-				Listener: &apiv2.Listener{Name: f.Spec.Value},
+				Listener: &apiv3_listener.Listener{Name: f.Spec.Value},
 			},
 		},
 	}, nil
@@ -239,17 +377,17 @@ func compile_FooWithRouteConfigName(f *Foo) (*gateway.CompiledConfig, error) {
 	name := f.Spec.Value
 	rcName := fmt.Sprintf("%s-routeconfig", name)
 
-	hcm := &apiv2_httpman.HttpConnectionManager{
+	hcm := &apiv3_httpman.HttpConnectionManager{
 		StatPrefix: name,
-		HttpFilters: []*apiv2_httpman.HttpFilter{
+		HttpFilters: []*apiv3_httpman.HttpFilter{
 			{Name: ecp_wellknown.CORS},
 			{Name: ecp_wellknown.Router},
 		},
-		RouteSpecifier: &apiv2_httpman.HttpConnectionManager_Rds{
-			Rds: &apiv2_httpman.Rds{
-				ConfigSource: &apiv2_core.ConfigSource{
-					ConfigSourceSpecifier: &apiv2_core.ConfigSource_Ads{
-						Ads: &apiv2_core.AggregatedConfigSource{},
+		RouteSpecifier: &apiv3_httpman.HttpConnectionManager_Rds{
+			Rds: &apiv3_httpman.Rds{
+				ConfigSource: &apiv3_core.ConfigSource{
+					ConfigSourceSpecifier: &apiv3_core.ConfigSource_Ads{
+						Ads: &apiv3_core.AggregatedConfigSource{},
 					},
 				},
 				RouteConfigName: rcName,
@@ -261,14 +399,14 @@ func compile_FooWithRouteConfigName(f *Foo) (*gateway.CompiledConfig, error) {
 		return nil, err
 	}
 
-	l := &apiv2.Listener{
+	l := &apiv3_listener.Listener{
 		Name: name,
-		FilterChains: []*apiv2_listener.FilterChain{
+		FilterChains: []*apiv3_listener.FilterChain{
 			{
-				Filters: []*apiv2_listener.Filter{
+				Filters: []*apiv3_listener.Filter{
 					{
 						Name:       ecp_wellknown.HTTPConnectionManager,
-						ConfigType: &apiv2_listener.Filter_TypedConfig{TypedConfig: hcmAny},
+						ConfigType: &apiv3_listener.Filter_TypedConfig{TypedConfig: hcmAny},
 					},
 				},
 			},
@@ -302,17 +440,17 @@ func TestDispatcherAssemblyWithEmptyRouteConfigName(t *testing.T) {
 func compile_FooWithEmptyRouteConfigName(f *Foo) (*gateway.CompiledConfig, error) {
 	name := f.Spec.Value
 
-	hcm := &apiv2_httpman.HttpConnectionManager{
+	hcm := &apiv3_httpman.HttpConnectionManager{
 		StatPrefix: name,
-		HttpFilters: []*apiv2_httpman.HttpFilter{
+		HttpFilters: []*apiv3_httpman.HttpFilter{
 			{Name: ecp_wellknown.CORS},
 			{Name: ecp_wellknown.Router},
 		},
-		RouteSpecifier: &apiv2_httpman.HttpConnectionManager_Rds{
-			Rds: &apiv2_httpman.Rds{
-				ConfigSource: &apiv2_core.ConfigSource{
-					ConfigSourceSpecifier: &apiv2_core.ConfigSource_Ads{
-						Ads: &apiv2_core.AggregatedConfigSource{},
+		RouteSpecifier: &apiv3_httpman.HttpConnectionManager_Rds{
+			Rds: &apiv3_httpman.Rds{
+				ConfigSource: &apiv3_core.ConfigSource{
+					ConfigSourceSpecifier: &apiv3_core.ConfigSource_Ads{
+						Ads: &apiv3_core.AggregatedConfigSource{},
 					},
 				},
 			},
@@ -323,14 +461,14 @@ func compile_FooWithEmptyRouteConfigName(f *Foo) (*gateway.CompiledConfig, error
 		return nil, err
 	}
 
-	l := &apiv2.Listener{
+	l := &apiv3_listener.Listener{
 		Name: name,
-		FilterChains: []*apiv2_listener.FilterChain{
+		FilterChains: []*apiv3_listener.FilterChain{
 			{
-				Filters: []*apiv2_listener.Filter{
+				Filters: []*apiv3_listener.Filter{
 					{
 						Name:       ecp_wellknown.HTTPConnectionManager,
-						ConfigType: &apiv2_listener.Filter_TypedConfig{TypedConfig: hcmAny},
+						ConfigType: &apiv3_listener.Filter_TypedConfig{TypedConfig: hcmAny},
 					},
 				},
 			},
@@ -361,9 +499,9 @@ func TestDispatcherAssemblyWithoutRds(t *testing.T) {
 func compile_FooWithoutRds(f *Foo) (*gateway.CompiledConfig, error) {
 	name := f.Spec.Value
 
-	hcm := &apiv2_httpman.HttpConnectionManager{
+	hcm := &apiv3_httpman.HttpConnectionManager{
 		StatPrefix: name,
-		HttpFilters: []*apiv2_httpman.HttpFilter{
+		HttpFilters: []*apiv3_httpman.HttpFilter{
 			{Name: ecp_wellknown.CORS},
 			{Name: ecp_wellknown.Router},
 		},
@@ -373,17 +511,17 @@ func compile_FooWithoutRds(f *Foo) (*gateway.CompiledConfig, error) {
 		return nil, err
 	}
 
-	l := &apiv2.Listener{
+	l := &apiv3_listener.Listener{
 		Name: name,
-		FilterChains: []*apiv2_listener.FilterChain{
+		FilterChains: []*apiv3_listener.FilterChain{
 			{
-				Filters: []*apiv2_listener.Filter{
+				Filters: []*apiv3_listener.Filter{
 					{
 						Name: ecp_wellknown.RateLimit,
 					},
 					{
 						Name:       ecp_wellknown.HTTPConnectionManager,
-						ConfigType: &apiv2_listener.Filter_TypedConfig{TypedConfig: hcmAny},
+						ConfigType: &apiv3_listener.Filter_TypedConfig{TypedConfig: hcmAny},
 					},
 				},
 			},
@@ -408,7 +546,7 @@ func TestDispatcherAssemblyEndpointDefaulting(t *testing.T) {
 	_, snap := disp.GetSnapshot(ctx)
 	found := false
 	for _, r := range snap.Resources[ecp_cache_types.Endpoint].Items {
-		cla := r.(*apiv2.ClusterLoadAssignment)
+		cla := r.(*apiv3_endpoint.ClusterLoadAssignment)
 		if cla.ClusterName == "foo" && len(cla.Endpoints) == 0 {
 			found = true
 		}
@@ -0,0 +1,125 @@
+package gateway
+
+import (
+	// standard library
+	"regexp"
+	"sort"
+	"strings"
+
+	// third-party libraries
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	// envoy api v3
+	apiv3_core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	apiv3_route "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
+	apiv3_matcher "github.com/datawire/ambassador/v2/pkg/api/envoy/type/matcher/v3"
+)
+
+// routeFilters is what the filters of a route rule do to each of the rule's envoy Routes. Both
+// versions of the Gateway API compile their filters into one of these.
+type routeFilters struct {
+	requestHeadersToAdd     []*apiv3_core.HeaderValueOption
+	requestHeadersToRemove  []string
+	responseHeadersToAdd    []*apiv3_core.HeaderValueOption
+	responseHeadersToRemove []string
+
+	// These only apply to routes that forward requests to a backend.
+	mirrors     []*apiv3_route.RouteAction_RequestMirrorPolicy
+	hostRewrite string
+	pathRewrite *pathModifier
+
+	// A redirect replaces forwarding to the backends altogether.
+	redirect     *apiv3_route.RedirectAction
+	redirectPath *pathModifier
+}
+
+// pathModifier replaces either the whole path, or the prefix that a route matched.
+type pathModifier struct {
+	fullPath      *string
+	prefixReplace *string
+}
+
+// apply applies the filters to a route. The prefix is the path prefix that the route matches,
+// which must be set if the filters replace the prefix of the path.
+func (f *routeFilters) apply(route *apiv3_route.Route, prefix string) {
+	route.RequestHeadersToAdd = f.requestHeadersToAdd
+	route.RequestHeadersToRemove = f.requestHeadersToRemove
+	route.ResponseHeadersToAdd = f.responseHeadersToAdd
+	route.ResponseHeadersToRemove = f.responseHeadersToRemove
+
+	if f.redirect != nil {
+		redirect := proto.Clone(f.redirect).(*apiv3_route.RedirectAction)
+		switch {
+		case f.redirectPath == nil:
+		case f.redirectPath.fullPath != nil:
+			redirect.PathRewriteSpecifier = &apiv3_route.RedirectAction_PathRedirect{PathRedirect: *f.redirectPath.fullPath}
+		default:
+			redirect.PathRewriteSpecifier = &apiv3_route.RedirectAction_RegexRewrite{
+				RegexRewrite: prefixRegexRewrite(prefix, *f.redirectPath.prefixReplace),
+			}
+		}
+		route.Action = &apiv3_route.Route_Redirect{Redirect: redirect}
+		return
+	}
+
+	action := route.GetRoute()
+	if action == nil {
+		// There's nowhere to forward the request to.
+		return
+	}
+	action.RequestMirrorPolicies = f.mirrors
+	if f.hostRewrite != "" {
+		action.HostRewriteSpecifier = &apiv3_route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: f.hostRewrite}
+	}
+	switch {
+	case f.pathRewrite == nil:
+	case f.pathRewrite.fullPath != nil:
+		action.RegexRewrite = &apiv3_matcher.RegexMatchAndSubstitute{
+			Pattern:      regexMatcher("^.*$"),
+			Substitution: *f.pathRewrite.fullPath,
+		}
+	default:
+		action.RegexRewrite = prefixRegexRewrite(prefix, *f.pathRewrite.prefixReplace)
+	}
+}
+
+// prefixRegexRewrite replaces the prefix of a path, without its trailing slash, that matches
+// whole path elements the way Compile_HTTPRouteMatchV1 matches them. "/foo" replaced with "/bar"
+// turns "/foo/baz" into "/bar/baz", and replaced with "/" turns it into "/baz".
+func prefixRegexRewrite(prefix, replacement string) *apiv3_matcher.RegexMatchAndSubstitute {
+	replacement = strings.TrimSuffix(replacement, "/")
+	if prefix == "" || replacement == "" {
+		// Keep the slash after the prefix, or at the start of the path.
+		return &apiv3_matcher.RegexMatchAndSubstitute{
+			Pattern:      regexMatcher("^" + regexp.QuoteMeta(prefix) + "/*"),
+			Substitution: replacement + "/",
+		}
+	}
+	return &apiv3_matcher.RegexMatchAndSubstitute{
+		Pattern:      regexMatcher("^" + regexp.QuoteMeta(prefix)),
+		Substitution: replacement,
+	}
+}
+
+// headerValueOptions makes the envoy header options that set and add the given headers.
+func headerValueOptions(set, add map[string]string) []*apiv3_core.HeaderValueOption {
+	var result []*apiv3_core.HeaderValueOption
+	for _, headers := range []struct {
+		values map[string]string
+		append bool
+	}{{set, false}, {add, true}} {
+		names := make([]string, 0, len(headers.values))
+		for name := range headers.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			result = append(result, &apiv3_core.HeaderValueOption{
+				Header: &apiv3_core.HeaderValue{Key: name, Value: headers.values[name]},
+				Append: wrapperspb.Bool(headers.append),
+			})
+		}
+	}
+	return result
+}
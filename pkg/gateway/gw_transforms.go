@@ -3,20 +3,24 @@ package gateway
 import (
 	// standard library
 	"fmt"
+	"strings"
 
 	// third-party libraries
 	"github.com/pkg/errors"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
 
-	// envoy api v2
-	apiv2 "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2"
-	apiv2_core "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/core"
-	apiv2_listener "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/listener"
-	apiv2_route "github.com/datawire/ambassador/v2/pkg/api/envoy/api/v2/route"
-	apiv2_httpman "github.com/datawire/ambassador/v2/pkg/api/envoy/config/filter/network/http_connection_manager/v2"
-	api_matcher "github.com/datawire/ambassador/v2/pkg/api/envoy/type/matcher"
+	// envoy api v3
+	apiv3_core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	apiv3_listener "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	apiv3_route "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
+	apiv3_httpman "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/http_connection_manager/v3"
+	apiv3_tcpproxy "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/tcp_proxy/v3"
+	apiv3_udpproxy "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/udp/udp_proxy/v3"
+	apiv3_tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	apiv3_matcher "github.com/datawire/ambassador/v2/pkg/api/envoy/type/matcher/v3"
 
 	// envoy control plane
 	ecp_wellknown "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/wellknown"
@@ -30,7 +34,7 @@ func Compile_Gateway(gateway *gw.Gateway) (*CompiledConfig, error) {
 	var listeners []*CompiledListener
 	for idx, l := range gateway.Spec.Listeners {
 		name := fmt.Sprintf("%s-%d", getName(gateway), idx)
-		listener, err := Compile_Listener(src, l, name)
+		listener, err := Compile_Listener(src, gateway.Namespace, l, name)
 		if err != nil {
 			return nil, err
 		}
@@ -42,63 +46,403 @@ func Compile_Gateway(gateway *gw.Gateway) (*CompiledConfig, error) {
 	}, nil
 }
 
-func Compile_Listener(parent Source, lst gw.Listener, name string) (*CompiledListener, error) {
-	hcm := &apiv2_httpman.HttpConnectionManager{
+// Compile_Listener compiles one of the listeners of a Gateway in the given namespace. HTTP and
+// HTTPS listeners hand connections to an HttpConnectionManager, TLS listeners proxy them to the
+// cluster named by their SNI, and TCP and UDP listeners proxy them to the backends of their routes.
+// The listener's Hostname, if any, limits the domains and server names that it serves. A listener
+// that can't be compiled has an Error and no Listener.
+func Compile_Listener(parent Source, namespace string, lst gw.Listener, name string) (*CompiledListener, error) {
+	src := Sourcef("listener %s in %s", name, parent)
+	fail := func(format string, args ...interface{}) (*CompiledListener, error) {
+		return &CompiledListener{CompiledItem: NewCompiledItemError(src, fmt.Sprintf(format, args...))}, nil
+	}
+
+	domains := []string{"*"}
+	var serverNames []string
+	if lst.Hostname != nil && *lst.Hostname != "" {
+		domains = []string{string(*lst.Hostname)}
+		serverNames = []string{string(*lst.Hostname)}
+	}
+
+	var listener *apiv3_listener.Listener
+	var build func(routes []*CompiledRoute) (*apiv3_listener.Listener, error)
+	var err error
+	switch lst.Protocol {
+	case gw.HTTPProtocolType:
+		listener, err = makeHttpListener(name, uint32(lst.Port), makeHttpConnectionManager(name))
+	case gw.HTTPSProtocolType:
+		if lst.TLS != nil && lst.TLS.Mode == gw.TLSModePassthrough {
+			return fail("tls passthrough requires protocol %q", gw.TLSProtocolType)
+		}
+		transportSocket, tlsErr := Compile_ListenerTLS(namespace, lst.TLS)
+		if tlsErr != nil {
+			return fail("%v", tlsErr)
+		}
+		listener, err = makeHttpListener(name, uint32(lst.Port), makeHttpConnectionManager(name))
+		if err == nil {
+			makeTlsListener(listener, serverNames, transportSocket)
+		}
+	case gw.TLSProtocolType:
+		transportSocket, tlsErr := Compile_ListenerTLS(namespace, lst.TLS)
+		if tlsErr != nil {
+			return fail("%v", tlsErr)
+		}
+		hostname := ""
+		if lst.Hostname != nil {
+			hostname = string(*lst.Hostname)
+		}
+		build = func(routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+			return makeTlsProxyListener(name, uint32(lst.Port), hostname, transportSocket, routes)
+		}
+	case gw.TCPProtocolType:
+		build = func(routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+			return makeTcpProxyListener(name, uint32(lst.Port), routes)
+		}
+	case gw.UDPProtocolType:
+		build = func(routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+			return makeUdpProxyListener(name, uint32(lst.Port), routes)
+		}
+	default:
+		return fail("unsupported protocol: %q", lst.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kind := listenerRouteKind(lst)
+	return &CompiledListener{
+		CompiledItem: NewCompiledItem(src),
+		Listener:     listener,
+		Predicate: func(route *CompiledRoute) bool {
+			return route.GroupKind == kind
+		},
+		Domains: domains,
+		Build:   build,
+	}, nil
+}
+
+// listenerRouteKind returns the kind of route that a listener accepts. If the listener doesn't
+// say, it's the kind that goes with its protocol.
+func listenerRouteKind(lst gw.Listener) schema.GroupKind {
+	kind := schema.GroupKind{Group: lst.Routes.Group, Kind: lst.Routes.Kind}
+	if kind.Group == "" {
+		kind.Group = gw.GroupVersion.Group
+	}
+	if kind.Kind == "" {
+		switch lst.Protocol {
+		case gw.HTTPProtocolType, gw.HTTPSProtocolType:
+			kind.Kind = "HTTPRoute"
+		case gw.TLSProtocolType:
+			kind.Kind = "TLSRoute"
+		case gw.TCPProtocolType:
+			kind.Kind = "TCPRoute"
+		case gw.UDPProtocolType:
+			kind.Kind = "UDPRoute"
+		}
+	}
+	return kind
+}
+
+// Compile_ListenerTLS compiles the TLS configuration of a listener in the given namespace into a
+// transport socket that terminates TLS with the certificate in the Secret that it refers to. The
+// transport socket is nil for TLS passthrough.
+func Compile_ListenerTLS(namespace string, tls *gw.GatewayTLSConfig) (*apiv3_core.TransportSocket, error) {
+	if tls == nil {
+		return nil, errors.New("missing tls configuration")
+	}
+	switch tls.Mode {
+	case gw.TLSModePassthrough:
+		return nil, nil
+	case gw.TLSModeTerminate, "":
+	default:
+		return nil, errors.Errorf("unknown tls mode: %q", tls.Mode)
+	}
+
+	ref := tls.CertificateRef
+	if ref == nil || ref.Name == "" {
+		return nil, errors.New("tls termination requires a certificateRef")
+	}
+	if (ref.Group != "" && ref.Group != "core") || (ref.Kind != "" && ref.Kind != "Secret") {
+		return nil, errors.Errorf("unsupported certificateRef kind: %q in group %q", ref.Kind, ref.Group)
+	}
+	// The Secret is served over SDS under the same name that Ambassador uses for secrets
+	// everywhere else.
+	return makeTlsTransportSocket(fmt.Sprintf("%s.%s", ref.Name, namespace))
+}
+
+// makeHttpConnectionManager makes an HttpConnectionManager that gets its routes over RDS, from the
+// RouteConfiguration with the given name.
+func makeHttpConnectionManager(name string) *apiv3_httpman.HttpConnectionManager {
+	return &apiv3_httpman.HttpConnectionManager{
 		StatPrefix: name,
-		HttpFilters: []*apiv2_httpman.HttpFilter{
+		HttpFilters: []*apiv3_httpman.HttpFilter{
 			{Name: ecp_wellknown.CORS},
 			{Name: ecp_wellknown.Router},
 		},
-		RouteSpecifier: &apiv2_httpman.HttpConnectionManager_Rds{
-			Rds: &apiv2_httpman.Rds{
-				ConfigSource: &apiv2_core.ConfigSource{
-					ConfigSourceSpecifier: &apiv2_core.ConfigSource_Ads{
-						Ads: &apiv2_core.AggregatedConfigSource{},
-					},
-				},
+		RouteSpecifier: &apiv3_httpman.HttpConnectionManager_Rds{
+			Rds: &apiv3_httpman.Rds{
+				ConfigSource:    adsConfigSource(),
 				RouteConfigName: name,
 			},
 		},
 	}
+}
+
+// makeHttpListener makes an envoy Listener on the given port that hands connections to the given
+// HttpConnectionManager.
+func makeHttpListener(name string, port uint32, hcm *apiv3_httpman.HttpConnectionManager) (*apiv3_listener.Listener, error) {
 	hcmAny, err := anypb.New(hcm)
 	if err != nil {
 		return nil, err
 	}
 
-	return &CompiledListener{
-		CompiledItem: NewCompiledItem(Sourcef("listener %s", lst.Hostname)),
-		Listener: &apiv2.Listener{
-			Name: name,
-			Address: &apiv2_core.Address{Address: &apiv2_core.Address_SocketAddress{SocketAddress: &apiv2_core.SocketAddress{
-				Address:       "0.0.0.0",
-				PortSpecifier: &apiv2_core.SocketAddress_PortValue{PortValue: uint32(lst.Port)},
-			}}},
-			FilterChains: []*apiv2_listener.FilterChain{
-				{
-					Filters: []*apiv2_listener.Filter{
-						{
-							Name:       ecp_wellknown.HTTPConnectionManager,
-							ConfigType: &apiv2_listener.Filter_TypedConfig{TypedConfig: hcmAny},
-						},
+	return &apiv3_listener.Listener{
+		Name: name,
+		Address: &apiv3_core.Address{Address: &apiv3_core.Address_SocketAddress{SocketAddress: &apiv3_core.SocketAddress{
+			Address:       "0.0.0.0",
+			PortSpecifier: &apiv3_core.SocketAddress_PortValue{PortValue: port},
+		}}},
+		FilterChains: []*apiv3_listener.FilterChain{
+			{
+				Filters: []*apiv3_listener.Filter{
+					{
+						Name:       ecp_wellknown.HTTPConnectionManager,
+						ConfigType: &apiv3_listener.Filter_TypedConfig{TypedConfig: hcmAny},
 					},
 				},
 			},
 		},
-		Predicate: func(route *CompiledRoute) bool {
-			return true
+	}, nil
+}
+
+// makeTcpProxyListener makes an envoy Listener on the given port that proxies each connection to
+// one of the backends of the given routes, in proportion to their weights. There's no Listener if
+// there are no backends.
+func makeTcpProxyListener(name string, port uint32, routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+	chain, err := makeTcpProxyFilterChain(name, routes)
+	if err != nil || chain == nil {
+		return nil, err
+	}
+	return &apiv3_listener.Listener{
+		Name:         name,
+		Address:      makeListenerAddress(port),
+		FilterChains: []*apiv3_listener.FilterChain{chain},
+	}, nil
+}
+
+// makeTlsProxyListener makes an envoy Listener on the given port that proxies TLS connections for
+// the given hostname to the backends of the given routes. Routes with hostnames, i.e. TLSRoutes,
+// get a filter chain each, for the server names that their hostnames have in common with the
+// listener's. Routes without, i.e. TCPRoutes, share a filter chain for the listener's hostname.
+// Envoy rejects a Listener with two filter chains for the same server names, so the first route to
+// claim a server name gets it. A non-nil transport socket terminates TLS. There's no Listener if
+// there are no backends.
+func makeTlsProxyListener(name string, port uint32, hostname string, transportSocket *apiv3_core.TransportSocket, routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+	var chains []*apiv3_listener.FilterChain
+	claimed := map[string]bool{}
+	addChain := func(serverNames []string, routes []*CompiledRoute) error {
+		var unclaimed []string
+		for _, serverName := range serverNames {
+			if !claimed[serverName] {
+				unclaimed = append(unclaimed, serverName)
+			}
+		}
+		if len(unclaimed) == 0 {
+			return nil
+		}
+		chain, err := makeTcpProxyFilterChain(name, routes)
+		if err != nil || chain == nil {
+			return err
+		}
+		for _, serverName := range unclaimed {
+			claimed[serverName] = true
+		}
+		chain.FilterChainMatch = &apiv3_listener.FilterChainMatch{
+			ServerNames:       envoyServerNames(unclaimed),
+			TransportProtocol: "tls",
+		}
+		chain.TransportSocket = transportSocket
+		chains = append(chains, chain)
+		return nil
+	}
+
+	var shared []*CompiledRoute
+	for _, route := range routes {
+		if len(route.Hostnames) == 0 {
+			shared = append(shared, route)
+			continue
+		}
+		if err := addChain(intersectHostnames(hostname, route.Hostnames), []*CompiledRoute{route}); err != nil {
+			return nil, err
+		}
+	}
+	if len(shared) > 0 {
+		if err := addChain(intersectHostnames(hostname, nil), shared); err != nil {
+			return nil, err
+		}
+	}
+	if len(chains) == 0 {
+		return nil, nil
+	}
+
+	return &apiv3_listener.Listener{
+		Name:            name,
+		Address:         makeListenerAddress(port),
+		ListenerFilters: []*apiv3_listener.ListenerFilter{{Name: ecp_wellknown.TlsInspector}},
+		FilterChains:    chains,
+	}, nil
+}
+
+// makeTcpProxyFilterChain makes a filter chain that proxies each connection to one of the backends
+// of the given routes, in proportion to their weights. There's no filter chain if there are no
+// backends.
+func makeTcpProxyFilterChain(name string, routes []*CompiledRoute) (*apiv3_listener.FilterChain, error) {
+	var clusters []*apiv3_tcpproxy.TcpProxy_WeightedCluster_ClusterWeight
+	for _, route := range routes {
+		for _, backend := range route.Backends {
+			if backend.Weight.GetValue() > 0 {
+				clusters = append(clusters, &apiv3_tcpproxy.TcpProxy_WeightedCluster_ClusterWeight{
+					Name:   backend.Name,
+					Weight: backend.Weight.GetValue(),
+				})
+			}
+		}
+	}
+
+	tcpProxy := &apiv3_tcpproxy.TcpProxy{StatPrefix: name}
+	switch len(clusters) {
+	case 0:
+		return nil, nil
+	case 1:
+		tcpProxy.ClusterSpecifier = &apiv3_tcpproxy.TcpProxy_Cluster{Cluster: clusters[0].Name}
+	default:
+		tcpProxy.ClusterSpecifier = &apiv3_tcpproxy.TcpProxy_WeightedClusters{
+			WeightedClusters: &apiv3_tcpproxy.TcpProxy_WeightedCluster{Clusters: clusters},
+		}
+	}
+	tcpAny, err := anypb.New(tcpProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiv3_listener.FilterChain{
+		Filters: []*apiv3_listener.Filter{
+			{
+				Name:       ecp_wellknown.TCPProxy,
+				ConfigType: &apiv3_listener.Filter_TypedConfig{TypedConfig: tcpAny},
+			},
+		},
+	}, nil
+}
+
+// makeListenerAddress makes the TCP address of a Listener on the given port.
+func makeListenerAddress(port uint32) *apiv3_core.Address {
+	return &apiv3_core.Address{Address: &apiv3_core.Address_SocketAddress{SocketAddress: &apiv3_core.SocketAddress{
+		Address:       "0.0.0.0",
+		PortSpecifier: &apiv3_core.SocketAddress_PortValue{PortValue: port},
+	}}}
+}
+
+// envoyServerNames returns the server names for a filter chain that serves the given hostnames.
+// Envoy matches all server names when there are none, which is what "*" and "" mean to the
+// Gateway API.
+func envoyServerNames(hostnames []string) []string {
+	var serverNames []string
+	for _, hostname := range hostnames {
+		if hostname == "" || hostname == "*" {
+			return nil
+		}
+		serverNames = append(serverNames, hostname)
+	}
+	return serverNames
+}
+
+// makeUdpProxyListener makes an envoy Listener on the given UDP port that proxies datagrams to the
+// first backend of the given routes, since envoy's UDP proxy only supports one cluster. There's no
+// Listener if there are no backends.
+func makeUdpProxyListener(name string, port uint32, routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+	var cluster string
+	for _, route := range routes {
+		for _, backend := range route.Backends {
+			if backend.Weight.GetValue() > 0 && cluster == "" {
+				cluster = backend.Name
+			}
+		}
+	}
+	if cluster == "" {
+		return nil, nil
+	}
+
+	udpAny, err := anypb.New(&apiv3_udpproxy.UdpProxyConfig{
+		StatPrefix:     name,
+		RouteSpecifier: &apiv3_udpproxy.UdpProxyConfig_Cluster{Cluster: cluster},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiv3_listener.Listener{
+		Name: name,
+		Address: &apiv3_core.Address{Address: &apiv3_core.Address_SocketAddress{SocketAddress: &apiv3_core.SocketAddress{
+			Protocol:      apiv3_core.SocketAddress_UDP,
+			Address:       "0.0.0.0",
+			PortSpecifier: &apiv3_core.SocketAddress_PortValue{PortValue: port},
+		}}},
+		ListenerFilters: []*apiv3_listener.ListenerFilter{
+			{
+				Name:       "envoy.filters.udp_listener.udp_proxy",
+				ConfigType: &apiv3_listener.ListenerFilter_TypedConfig{TypedConfig: udpAny},
+			},
 		},
-		Domains: []string{"*"},
 	}, nil
+}
 
+// makeTlsListener makes the listener inspect the TLS handshake, so that its filter chain only
+// serves the given server names (or all of them, if there are none). A non-nil transport socket
+// terminates TLS.
+func makeTlsListener(listener *apiv3_listener.Listener, serverNames []string, transportSocket *apiv3_core.TransportSocket) {
+	listener.ListenerFilters = []*apiv3_listener.ListenerFilter{{Name: ecp_wellknown.TlsInspector}}
+	for _, fc := range listener.FilterChains {
+		fc.FilterChainMatch = &apiv3_listener.FilterChainMatch{
+			ServerNames:       serverNames,
+			TransportProtocol: "tls",
+		}
+		fc.TransportSocket = transportSocket
+	}
+}
+
+// makeTlsTransportSocket makes a transport socket that terminates TLS with the certificates that
+// are served over SDS under the given names.
+func makeTlsTransportSocket(secretNames ...string) (*apiv3_core.TransportSocket, error) {
+	var sdsConfigs []*apiv3_tls.SdsSecretConfig
+	for _, secretName := range secretNames {
+		sdsConfigs = append(sdsConfigs, &apiv3_tls.SdsSecretConfig{
+			Name:      secretName,
+			SdsConfig: adsConfigSource(),
+		})
+	}
+	tlsAny, err := anypb.New(&apiv3_tls.DownstreamTlsContext{
+		CommonTlsContext: &apiv3_tls.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: sdsConfigs,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &apiv3_core.TransportSocket{
+		Name:       ecp_wellknown.TransportSocketTls,
+		ConfigType: &apiv3_core.TransportSocket_TypedConfig{TypedConfig: tlsAny},
+	}, nil
 }
 
 func Compile_HTTPRoute(httpRoute *gw.HTTPRoute) (*CompiledConfig, error) {
 	src := SourceFromResource(httpRoute)
 	clusterRefs := []*ClusterRef{}
-	var routes []*apiv2_route.Route
+	var filters []*CompiledItem
+	var routes []*apiv3_route.Route
 	for idx, rule := range httpRoute.Spec.Rules {
 		s := Sourcef("rule %d in %s", idx, src)
-		_routes, err := Compile_HTTPRouteRule(s, rule, httpRoute.Namespace, &clusterRefs)
+		_routes, err := Compile_HTTPRouteRule(s, rule, httpRoute.Namespace, &clusterRefs, &filters)
 		if err != nil {
 			return nil, err
 		}
@@ -110,40 +454,238 @@ func Compile_HTTPRoute(httpRoute *gw.HTTPRoute) (*CompiledConfig, error) {
 			{
 				CompiledItem: CompiledItem{Source: src, Namespace: httpRoute.Namespace},
 				HTTPRoute:    httpRoute,
+				GroupKind:    schema.GroupKind{Group: gw.GroupVersion.Group, Kind: "HTTPRoute"},
 				Routes:       routes,
 				ClusterRefs:  clusterRefs,
+				Filters:      filters,
 			},
 		},
 	}, nil
 }
 
-func Compile_HTTPRouteRule(src Source, rule gw.HTTPRouteRule, namespace string, clusterRefs *[]*ClusterRef) ([]*apiv2_route.Route, error) {
-	var clusters []*apiv2_route.WeightedCluster_ClusterWeight
+// Compile_TCPRoute compiles a TCPRoute into the backends that TCP listeners proxy connections to.
+func Compile_TCPRoute(tcpRoute *gw.TCPRoute) (*CompiledConfig, error) {
+	src := SourceFromResource(tcpRoute)
+	clusterRefs := []*ClusterRef{}
+	var backends []*apiv3_route.WeightedCluster_ClusterWeight
+	var errs []string
+	for idx, rule := range tcpRoute.Spec.Rules {
+		s := Sourcef("rule %d in %s", idx, src)
+		for _, match := range rule.Matches {
+			if match.ExtensionRef != nil {
+				errs = append(errs, fmt.Sprintf("%s: extensionRef matches are not supported", s.Location()))
+			}
+		}
+		backends = append(backends, Compile_RouteForwardTos(s, rule.ForwardTo, tcpRoute.Namespace, &clusterRefs)...)
+	}
+	return compiledConnectionRoute(src, tcpRoute.Namespace, "TCPRoute", backends, clusterRefs, errs), nil
+}
+
+// Compile_UDPRoute compiles a UDPRoute into the backend that UDP listeners proxy datagrams to.
+// Envoy can only proxy UDP to one cluster, so a UDPRoute can only forward to one service.
+func Compile_UDPRoute(udpRoute *gw.UDPRoute) (*CompiledConfig, error) {
+	src := SourceFromResource(udpRoute)
+	clusterRefs := []*ClusterRef{}
+	var backends []*apiv3_route.WeightedCluster_ClusterWeight
+	var errs []string
+	for idx, rule := range udpRoute.Spec.Rules {
+		s := Sourcef("rule %d in %s", idx, src)
+		for _, match := range rule.Matches {
+			if match.ExtensionRef != nil {
+				errs = append(errs, fmt.Sprintf("%s: extensionRef matches are not supported", s.Location()))
+			}
+		}
+		backends = append(backends, Compile_RouteForwardTos(s, rule.ForwardTo, udpRoute.Namespace, &clusterRefs)...)
+	}
+	if len(backends) > 1 {
+		errs = append(errs, "a UDPRoute can only forward to one service")
+		backends = backends[:1]
+	}
+	return compiledConnectionRoute(src, udpRoute.Namespace, "UDPRoute", backends, clusterRefs, errs), nil
+}
+
+// compiledConnectionRoute wraps up the backends of a TCPRoute or UDPRoute. A route with errors
+// gets no backends, so that listeners don't proxy anything to it.
+func compiledConnectionRoute(src Source, namespace, kind string, backends []*apiv3_route.WeightedCluster_ClusterWeight, clusterRefs []*ClusterRef, errs []string) *CompiledConfig {
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes:       []*CompiledRoute{compileConnectionRoute(src, namespace, kind, backends, clusterRefs, errs)},
+	}
+}
+
+// compileConnectionRoute is compiledConnectionRoute, for one of several routes from a resource.
+func compileConnectionRoute(src Source, namespace, kind string, backends []*apiv3_route.WeightedCluster_ClusterWeight, clusterRefs []*ClusterRef, errs []string) *CompiledRoute {
+	item := CompiledItem{Source: src, Namespace: namespace}
+	if len(errs) > 0 {
+		item.Error = strings.Join(errs, "; ")
+		backends = nil
+	}
+	return &CompiledRoute{
+		CompiledItem: item,
+		GroupKind:    schema.GroupKind{Group: gw.GroupVersion.Group, Kind: kind},
+		ClusterRefs:  clusterRefs,
+		Backends:     backends,
+	}
+}
+
+// Compile_TLSRoute compiles a TLSRoute into a route for each of its rules, which TLS listeners
+// proxy the connections with the rule's SNIs to. A rule with no SNIs gets the connections for
+// every SNI of the listener.
+func Compile_TLSRoute(tlsRoute *gw.TLSRoute) (*CompiledConfig, error) {
+	src := SourceFromResource(tlsRoute)
+	var routes []*CompiledRoute
+	for idx, rule := range tlsRoute.Spec.Rules {
+		s := Sourcef("rule %d in %s", idx, src)
+		routes = append(routes, Compile_TLSRouteRule(s, rule, tlsRoute.Namespace))
+	}
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes:       routes,
+	}, nil
+}
+
+// Compile_TLSRouteRule compiles a rule of a TLSRoute into a route for its SNIs.
+func Compile_TLSRouteRule(src Source, rule gw.TLSRouteRule, namespace string) *CompiledRoute {
+	var snis, errs []string
+	for _, match := range rule.Matches {
+		if match.ExtensionRef != nil {
+			errs = append(errs, fmt.Sprintf("%s: extensionRef matches are not supported", src.Location()))
+		}
+		for _, sni := range match.SNIs {
+			snis = append(snis, string(sni))
+		}
+	}
+	clusterRefs := []*ClusterRef{}
+	backends := Compile_RouteForwardTos(src, rule.ForwardTo, namespace, &clusterRefs)
+	route := compileConnectionRoute(src, namespace, "TLSRoute", backends, clusterRefs, errs)
+	route.Hostnames = snis
+	return route
+}
+
+// Compile_RouteForwardTos compiles the forwardTos of a TCPRoute, TLSRoute or UDPRoute rule into
+// weighted clusters. A forwardTo that can't be used gets a ClusterRef with an Error, and no
+// cluster. The clusters are named after the namespace as well as the service, since routes in
+// different namespaces can forward to services with the same name.
+func Compile_RouteForwardTos(src Source, forwardTos []gw.RouteForwardTo, namespace string, clusterRefs *[]*ClusterRef) []*apiv3_route.WeightedCluster_ClusterWeight {
+	var result []*apiv3_route.WeightedCluster_ClusterWeight
+	for idx, fwd := range forwardTos {
+		s := Sourcef("forwardTo %d in %s", idx, src)
+		if fwd.ServiceName == nil {
+			*clusterRefs = append(*clusterRefs, &ClusterRef{CompiledItem: NewCompiledItemError(s, "forwardTo requires a serviceName")})
+			continue
+		}
+		clusterName := fmt.Sprintf("%s_%s", namespace, *fwd.ServiceName)
+		path := fmt.Sprintf("k8s/%s/%s", namespace, *fwd.ServiceName)
+		if fwd.Port != nil {
+			clusterName = fmt.Sprintf("%s_%d", clusterName, *fwd.Port)
+			path = fmt.Sprintf("%s/%d", path, *fwd.Port)
+		}
+		*clusterRefs = append(*clusterRefs, &ClusterRef{
+			CompiledItem: CompiledItem{Source: s, Namespace: namespace},
+			Name:         clusterName,
+			Service:      *fwd.ServiceName,
+			EndpointPath: path,
+		})
+		result = append(result, &apiv3_route.WeightedCluster_ClusterWeight{
+			Name:   clusterName,
+			Weight: &wrapperspb.UInt32Value{Value: uint32(fwd.Weight)},
+		})
+	}
+	return result
+}
+
+func Compile_HTTPRouteRule(src Source, rule gw.HTTPRouteRule, namespace string, clusterRefs *[]*ClusterRef, filters *[]*CompiledItem) ([]*apiv3_route.Route, error) {
+	var clusters []*apiv3_route.WeightedCluster_ClusterWeight
+	filtersOK := true
 	for idx, fwd := range rule.ForwardTo {
 		s := Sourcef("forwardTo %d in %s", idx, src)
+		if len(fwd.Filters) > 0 {
+			item := NewCompiledItemError(s, "filters on forwardTo are not supported")
+			*filters = append(*filters, &item)
+			filtersOK = false
+		}
 		clusters = append(clusters, Compile_HTTPRouteForwardTo(s, fwd, namespace, clusterRefs))
 	}
 
-	wc := &apiv2_route.WeightedCluster{Clusters: clusters}
+	wc := &apiv3_route.WeightedCluster{Clusters: clusters}
+
+	compiledFilters := Compile_HTTPRouteFilters(src, rule.Filters, namespace, clusterRefs, filters)
+	if compiledFilters == nil {
+		filtersOK = false
+	}
 
 	matches, err := Compile_HTTPRouteMatches(rule.Matches)
 	if err != nil {
 		return nil, err
 	}
-	var result []*apiv2_route.Route
+	var result []*apiv3_route.Route
 	for _, match := range matches {
-		result = append(result, &apiv2_route.Route{
+		route := &apiv3_route.Route{
 			Match: match,
-			Action: &apiv2_route.Route_Route{Route: &apiv2_route.RouteAction{
-				ClusterSpecifier: &apiv2_route.RouteAction_WeightedClusters{WeightedClusters: wc},
+			Action: &apiv3_route.Route_Route{Route: &apiv3_route.RouteAction{
+				ClusterSpecifier: &apiv3_route.RouteAction_WeightedClusters{WeightedClusters: wc},
 			}},
-		})
+		}
+		if filtersOK {
+			compiledFilters.apply(route, "")
+		} else {
+			// Requests that would have been processed by a filter that we can't apply get a 500.
+			route.Action = &apiv3_route.Route_DirectResponse{DirectResponse: &apiv3_route.DirectResponseAction{Status: 500}}
+		}
+		result = append(result, route)
 	}
 
 	return result, err
 }
 
-func Compile_HTTPRouteForwardTo(src Source, forward gw.HTTPRouteForwardTo, namespace string, clusterRefs *[]*ClusterRef) *apiv2_route.WeightedCluster_ClusterWeight {
+// Compile_HTTPRouteFilters compiles the filters of a rule. Each filter gets an item in items, with
+// an Error if it can't be applied, in which case the result is nil. The v1alpha1 API only has
+// RequestHeaderModifier and RequestMirror filters.
+func Compile_HTTPRouteFilters(src Source, filters []gw.HTTPRouteFilter, namespace string, clusterRefs *[]*ClusterRef, items *[]*CompiledItem) *routeFilters {
+	result := &routeFilters{}
+	ok := true
+	seen := map[gw.HTTPRouteFilterType]bool{}
+	for idx, filter := range filters {
+		s := Sourcef("filter %d in %s", idx, src)
+		var err error
+		switch {
+		case seen[filter.Type] && filter.Type != gw.HTTPRouteFilterRequestMirror:
+			err = errors.Errorf("more than one %s filter", filter.Type)
+		case filter.Type == gw.HTTPRouteFilterRequestHeaderModifier:
+			if filter.RequestHeaderModifier == nil {
+				err = errors.New("missing requestHeaderModifier")
+				break
+			}
+			result.requestHeadersToAdd = headerValueOptions(filter.RequestHeaderModifier.Set, filter.RequestHeaderModifier.Add)
+			result.requestHeadersToRemove = filter.RequestHeaderModifier.Remove
+		case filter.Type == gw.HTTPRouteFilterRequestMirror:
+			mirror := filter.RequestMirror
+			if mirror == nil || mirror.ServiceName == nil {
+				err = errors.New("requestMirror requires a serviceName")
+				break
+			}
+			fwd := gw.HTTPRouteForwardTo{ServiceName: mirror.ServiceName, Port: mirror.Port}
+			cluster := Compile_HTTPRouteForwardTo(s, fwd, namespace, clusterRefs)
+			result.mirrors = append(result.mirrors, &apiv3_route.RouteAction_RequestMirrorPolicy{Cluster: cluster.Name})
+		default:
+			err = errors.Errorf("unsupported filter type: %q", filter.Type)
+		}
+		seen[filter.Type] = true
+
+		item := NewCompiledItem(s)
+		if err != nil {
+			item = NewCompiledItemError(s, err.Error())
+			ok = false
+		}
+		*items = append(*items, &item)
+	}
+	if !ok {
+		return nil
+	}
+	return result
+}
+
+func Compile_HTTPRouteForwardTo(src Source, forward gw.HTTPRouteForwardTo, namespace string, clusterRefs *[]*ClusterRef) *apiv3_route.WeightedCluster_ClusterWeight {
 	suffix := ""
 	clusterName := *forward.ServiceName
 	if forward.Port != nil {
@@ -156,14 +698,14 @@ func Compile_HTTPRouteForwardTo(src Source, forward gw.HTTPRouteForwardTo, names
 		Name:         clusterName,
 		EndpointPath: fmt.Sprintf("k8s/%s/%s%s", namespace, *forward.ServiceName, suffix),
 	})
-	return &apiv2_route.WeightedCluster_ClusterWeight{
+	return &apiv3_route.WeightedCluster_ClusterWeight{
 		Name:   clusterName,
 		Weight: &wrapperspb.UInt32Value{Value: uint32(forward.Weight)},
 	}
 }
 
-func Compile_HTTPRouteMatches(matches []gw.HTTPRouteMatch) ([]*apiv2_route.RouteMatch, error) {
-	var result []*apiv2_route.RouteMatch
+func Compile_HTTPRouteMatches(matches []gw.HTTPRouteMatch) ([]*apiv3_route.RouteMatch, error) {
+	var result []*apiv3_route.RouteMatch
 	for _, match := range matches {
 		item, err := Compile_HTTPRouteMatch(match)
 		if err != nil {
@@ -174,25 +716,25 @@ func Compile_HTTPRouteMatches(matches []gw.HTTPRouteMatch) ([]*apiv2_route.Route
 	return result, nil
 }
 
-func Compile_HTTPRouteMatch(match gw.HTTPRouteMatch) (*apiv2_route.RouteMatch, error) {
+func Compile_HTTPRouteMatch(match gw.HTTPRouteMatch) (*apiv3_route.RouteMatch, error) {
 	headers, err := Compile_HTTPHeaderMatch(match.Headers)
 	if err != nil {
 		return nil, err
 	}
-	result := &apiv2_route.RouteMatch{
+	result := &apiv3_route.RouteMatch{
 		Headers: headers,
 	}
 
 	switch match.Path.Type {
 	case gw.PathMatchExact:
-		result.PathSpecifier = &apiv2_route.RouteMatch_Path{Path: match.Path.Value}
+		result.PathSpecifier = &apiv3_route.RouteMatch_Path{Path: match.Path.Value}
 	case gw.PathMatchPrefix:
-		result.PathSpecifier = &apiv2_route.RouteMatch_Prefix{Prefix: match.Path.Value}
+		result.PathSpecifier = &apiv3_route.RouteMatch_Prefix{Prefix: match.Path.Value}
 	case gw.PathMatchRegularExpression:
-		result.PathSpecifier = &apiv2_route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(match.Path.Value)}
+		result.PathSpecifier = &apiv3_route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(match.Path.Value)}
 	case "":
 		// no path match, but PathSpecifier is required
-		result.PathSpecifier = &apiv2_route.RouteMatch_Prefix{}
+		result.PathSpecifier = &apiv3_route.RouteMatch_Prefix{}
 	default:
 		return nil, errors.Errorf("unknown path match type: %q", match.Path.Type)
 	}
@@ -200,23 +742,23 @@ func Compile_HTTPRouteMatch(match gw.HTTPRouteMatch) (*apiv2_route.RouteMatch, e
 	return result, nil
 }
 
-func Compile_HTTPHeaderMatch(headerMatch *gw.HTTPHeaderMatch) ([]*apiv2_route.HeaderMatcher, error) {
+func Compile_HTTPHeaderMatch(headerMatch *gw.HTTPHeaderMatch) ([]*apiv3_route.HeaderMatcher, error) {
 	if headerMatch == nil {
 		return nil, nil
 	}
 
-	var result []*apiv2_route.HeaderMatcher
+	var result []*apiv3_route.HeaderMatcher
 	for hdr, pattern := range headerMatch.Values {
-		hm := &apiv2_route.HeaderMatcher{
+		hm := &apiv3_route.HeaderMatcher{
 			Name:        hdr,
 			InvertMatch: false,
 		}
 
 		switch headerMatch.Type {
 		case gw.HeaderMatchExact:
-			hm.HeaderMatchSpecifier = &apiv2_route.HeaderMatcher_ExactMatch{ExactMatch: pattern}
+			hm.HeaderMatchSpecifier = &apiv3_route.HeaderMatcher_ExactMatch{ExactMatch: pattern}
 		case gw.HeaderMatchRegularExpression:
-			hm.HeaderMatchSpecifier = &apiv2_route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: regexMatcher(pattern)}
+			hm.HeaderMatchSpecifier = &apiv3_route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: regexMatcher(pattern)}
 		default:
 			return nil, errors.Errorf("unknown header match type: %s", headerMatch.Type)
 		}
@@ -226,9 +768,9 @@ func Compile_HTTPHeaderMatch(headerMatch *gw.HTTPHeaderMatch) ([]*apiv2_route.He
 	return result, nil
 }
 
-func regexMatcher(pattern string) *api_matcher.RegexMatcher {
-	return &api_matcher.RegexMatcher{
-		EngineType: &api_matcher.RegexMatcher_GoogleRe2{GoogleRe2: &api_matcher.RegexMatcher_GoogleRE2{}},
+func regexMatcher(pattern string) *apiv3_matcher.RegexMatcher {
+	return &apiv3_matcher.RegexMatcher{
+		EngineType: &apiv3_matcher.RegexMatcher_GoogleRe2{GoogleRe2: &apiv3_matcher.RegexMatcher_GoogleRE2{}},
 		Regex:      pattern,
 	}
 }
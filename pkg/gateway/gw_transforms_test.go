@@ -10,6 +10,13 @@ import (
 	"github.com/stretchr/testify/require"
 	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
 
+	apiv3_cluster "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	apiv3_core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	apiv3_tcpproxy "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/tcp_proxy/v3"
+	apiv3_udpproxy "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/udp/udp_proxy/v3"
+	apiv3_tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	ecp_wellknown "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/wellknown"
 	"github.com/datawire/ambassador/v2/pkg/envoytest"
 	"github.com/datawire/ambassador/v2/pkg/gateway"
 	"github.com/datawire/ambassador/v2/pkg/kates"
@@ -178,6 +185,320 @@ spec:
 	assertErrorContains(t, err, `processing HTTPRoute:default:my-route: unknown header match type: Bleh`)
 }
 
+func TestHTTPRouteFilters(t *testing.T) {
+	t.Parallel()
+	route, ok := mustParseOne(t, `
+kind: HTTPRoute
+apiVersion: networking.x-k8s.io/v1alpha1
+metadata:
+  name: filters
+  namespace: default
+spec:
+  rules:
+  - matches:
+    - path:
+        type: Prefix
+        value: /foo
+    filters:
+    - type: RequestHeaderModifier
+      requestHeaderModifier:
+        set:
+          x-set: a
+        add:
+          x-add: b
+        remove: [x-remove]
+    - type: RequestMirror
+      requestMirror:
+        serviceName: mirror
+        port: 8080
+    forwardTo:
+    - serviceName: foo
+      port: 80
+      weight: 100
+  - matches:
+    - path:
+        type: Prefix
+        value: /bar
+    filters:
+    - type: RequestRedirect
+    forwardTo:
+    - serviceName: foo
+      port: 80
+      weight: 100
+`).(*gw.HTTPRoute)
+	require.True(t, ok)
+
+	config, err := gateway.Compile_HTTPRoute(route)
+	require.NoError(t, err)
+	routes := config.Routes[0].Routes
+	require.Len(t, routes, 2)
+
+	require.Len(t, routes[0].RequestHeadersToAdd, 2)
+	assert.Equal(t, "x-set", routes[0].RequestHeadersToAdd[0].Header.Key)
+	assert.False(t, routes[0].RequestHeadersToAdd[0].Append.Value)
+	assert.Equal(t, "x-add", routes[0].RequestHeadersToAdd[1].Header.Key)
+	assert.True(t, routes[0].RequestHeadersToAdd[1].Append.Value)
+	assert.Equal(t, []string{"x-remove"}, routes[0].RequestHeadersToRemove)
+	require.Len(t, routes[0].GetRoute().RequestMirrorPolicies, 1)
+	assert.Equal(t, "mirror_8080", routes[0].GetRoute().RequestMirrorPolicies[0].Cluster)
+
+	assert.Equal(t, uint32(500), routes[1].GetDirectResponse().Status)
+	filters := config.Routes[0].Filters
+	require.Len(t, filters, 3)
+	assert.Empty(t, filters[0].Error)
+	assert.Empty(t, filters[1].Error)
+	assert.Equal(t, `unsupported filter type: "RequestRedirect"`, filters[2].Error)
+}
+
+func TestGatewayTLS(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d := makeDispatcher(t)
+
+	err := d.UpsertYaml(`
+---
+kind: Gateway
+apiVersion: networking.x-k8s.io/v1alpha1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  listeners:
+  - protocol: HTTPS
+    port: 8443
+    hostname: foo.example.com
+    tls:
+      certificateRef:
+        group: core
+        kind: Secret
+        name: foo-cert
+  - protocol: TLS
+    port: 8443
+    hostname: bar.example.com
+    tls:
+      mode: Passthrough
+  - protocol: HTTP
+    port: 8080
+    hostname: baz.example.com
+  - protocol: TCP
+    port: 9000
+  - protocol: HTTPS
+    port: 8443
+    tls:
+      certificateRef:
+        kind: ConfigMap
+        name: foo-cert
+  - protocol: HTTPS
+    port: 8443
+    hostname: foo.example.com
+    tls:
+      certificateRef:
+        name: other-cert
+---
+kind: TLSRoute
+apiVersion: networking.x-k8s.io/v1alpha1
+metadata:
+  name: bar
+  namespace: default
+spec:
+  rules:
+  - forwardTo:
+    - serviceName: bar
+      port: 443
+      weight: 1
+`)
+	require.NoError(t, err)
+
+	// The listeners on port 8443 share one envoy Listener, and the last one is dropped because it
+	// serves the same hostname as the first.
+	l := d.GetListener(ctx, "default-my-gateway-0")
+	require.NotNil(t, l)
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-1"))
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-5"))
+	// There are no TCPRoutes, so the TCP listener has nowhere to send connections.
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-3"))
+	require.Len(t, l.ListenerFilters, 1)
+	assert.Equal(t, ecp_wellknown.TlsInspector, l.ListenerFilters[0].Name)
+	require.Len(t, l.FilterChains, 2)
+
+	https := l.FilterChains[0]
+	assert.Equal(t, []string{"foo.example.com"}, https.FilterChainMatch.ServerNames)
+	require.NotNil(t, https.TransportSocket)
+	assert.Equal(t, ecp_wellknown.TransportSocketTls, https.TransportSocket.Name)
+	tlsContext := &apiv3_tls.DownstreamTlsContext{}
+	require.NoError(t, https.TransportSocket.GetTypedConfig().UnmarshalTo(tlsContext))
+	sds := tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs
+	require.Len(t, sds, 1)
+	assert.Equal(t, "foo-cert.default", sds[0].Name)
+	assert.Equal(t, ecp_wellknown.HTTPConnectionManager, https.Filters[0].Name)
+
+	passthrough := l.FilterChains[1]
+	assert.Equal(t, []string{"bar.example.com"}, passthrough.FilterChainMatch.ServerNames)
+	assert.Nil(t, passthrough.TransportSocket)
+	require.Len(t, passthrough.Filters, 1)
+	tcpProxy := &apiv3_tcpproxy.TcpProxy{}
+	require.NoError(t, passthrough.Filters[0].GetTypedConfig().UnmarshalTo(tcpProxy))
+	assert.Equal(t, "default_bar_443", tcpProxy.GetCluster())
+
+	// The hostname limits the domains of plain HTTP listeners too.
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-2")
+	require.NotNil(t, rc)
+	require.Len(t, rc.VirtualHosts, 1)
+	assert.Equal(t, []string{"baz.example.com"}, rc.VirtualHosts[0].Domains)
+	rc = d.GetRouteConfiguration(ctx, "default-my-gateway-0")
+	require.NotNil(t, rc)
+	assert.Equal(t, []string{"foo.example.com"}, rc.VirtualHosts[0].Domains)
+
+	var errs []string
+	for _, item := range d.GetErrors() {
+		errs = append(errs, item.Error)
+	}
+	assert.ElementsMatch(t, []string{
+		`unsupported certificateRef kind: "ConfigMap" in group ""`,
+	}, errs)
+}
+
+func TestGatewayConnectionRoutes(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d := makeDispatcher(t)
+
+	err := d.UpsertYaml(`
+---
+kind: Gateway
+apiVersion: networking.x-k8s.io/v1alpha1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  listeners:
+  - protocol: TCP
+    port: 9000
+  - protocol: UDP
+    port: 9000
+  - protocol: TLS
+    port: 9443
+    tls:
+      mode: Passthrough
+---
+kind: TCPRoute
+apiVersion: networking.x-k8s.io/v1alpha1
+metadata:
+  name: db
+  namespace: default
+spec:
+  rules:
+  - forwardTo:
+    - serviceName: db
+      port: 5432
+      weight: 3
+    - serviceName: db-canary
+      port: 5432
+      weight: 1
+    - serviceName: db-old
+      port: 5432
+      weight: 0
+---
+kind: UDPRoute
+apiVersion: networking.x-k8s.io/v1alpha1
+metadata:
+  name: dns
+  namespace: default
+spec:
+  rules:
+  - forwardTo:
+    - serviceName: dns
+      port: 53
+      weight: 1
+---
+kind: UDPRoute
+apiVersion: networking.x-k8s.io/v1alpha1
+metadata:
+  name: dns-pair
+  namespace: default
+spec:
+  rules:
+  - forwardTo:
+    - serviceName: dns
+      port: 53
+      weight: 1
+    - serviceName: other-dns
+      port: 53
+      weight: 1
+---
+kind: TLSRoute
+apiVersion: networking.x-k8s.io/v1alpha1
+metadata:
+  name: web
+  namespace: default
+spec:
+  rules:
+  - matches:
+    - snis:
+      - foo.example.com
+      - "*.example.com"
+    forwardTo:
+    - serviceName: foo
+      port: 443
+      weight: 1
+  - forwardTo:
+    - serviceName: bar
+      port: 443
+      weight: 1
+`)
+	require.NoError(t, err)
+
+	// TCP connections are split between the weighted backends, whose clusters are named after
+	// the namespace of the route as well as the service.
+	tcp := d.GetListener(ctx, "default-my-gateway-0")
+	require.NotNil(t, tcp)
+	require.Len(t, tcp.FilterChains, 1)
+	require.Len(t, tcp.FilterChains[0].Filters, 1)
+	tcpProxy := &apiv3_tcpproxy.TcpProxy{}
+	require.NoError(t, tcp.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(tcpProxy))
+	clusters := tcpProxy.GetWeightedClusters().GetClusters()
+	require.Len(t, clusters, 2)
+	assert.Equal(t, "default_db_5432", clusters[0].Name)
+	assert.Equal(t, uint32(3), clusters[0].Weight)
+	assert.Equal(t, "default_db-canary_5432", clusters[1].Name)
+
+	// UDP gets a listener of its own on the same port. The route with two backends is rejected,
+	// so the datagrams go to the backend of the other one.
+	udp := d.GetListener(ctx, "default-my-gateway-1")
+	require.NotNil(t, udp)
+	assert.Equal(t, apiv3_core.SocketAddress_UDP, udp.Address.GetSocketAddress().Protocol)
+	require.Len(t, udp.ListenerFilters, 1)
+	udpProxy := &apiv3_udpproxy.UdpProxyConfig{}
+	require.NoError(t, udp.ListenerFilters[0].GetTypedConfig().UnmarshalTo(udpProxy))
+	assert.Equal(t, "default_dns_53", udpProxy.GetCluster())
+
+	// TLS connections go to the backends of the rule matching their SNI, and the rule without
+	// SNIs gets the rest.
+	tls := d.GetListener(ctx, "default-my-gateway-2")
+	require.NotNil(t, tls)
+	require.Len(t, tls.FilterChains, 2)
+	assert.Equal(t, []string{"foo.example.com", "*.example.com"}, tls.FilterChains[0].FilterChainMatch.ServerNames)
+	require.NoError(t, tls.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(tcpProxy))
+	assert.Equal(t, "default_foo_443", tcpProxy.GetCluster())
+	assert.Empty(t, tls.FilterChains[1].FilterChainMatch.ServerNames)
+	require.NoError(t, tls.FilterChains[1].Filters[0].GetTypedConfig().UnmarshalTo(tcpProxy))
+	assert.Equal(t, "default_bar_443", tcpProxy.GetCluster())
+
+	_, snap := d.GetSnapshot(ctx)
+	snapClusters := snap.Resources[ecp_cache_types.Cluster].Items
+	require.Contains(t, snapClusters, "default_foo_443")
+	assert.Equal(t, "k8s/default/foo/443", snapClusters["default_foo_443"].(*apiv3_cluster.Cluster).EdsClusterConfig.ServiceName)
+	assert.True(t, d.IsWatched("default", "foo"))
+
+	var errs []string
+	for _, item := range d.GetErrors() {
+		errs = append(errs, item.Error)
+	}
+	assert.ElementsMatch(t, []string{
+		"a UDPRoute can only forward to one service",
+	}, errs)
+}
+
 func makeDispatcher(t *testing.T) *gateway.Dispatcher {
 	d := gateway.NewDispatcher()
 	err := d.Register("Gateway", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
@@ -188,6 +509,18 @@ func makeDispatcher(t *testing.T) *gateway.Dispatcher {
 		return gateway.Compile_HTTPRoute(untyped.(*gw.HTTPRoute))
 	})
 	require.NoError(t, err)
+	err = d.Register("TCPRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TCPRoute(untyped.(*gw.TCPRoute))
+	})
+	require.NoError(t, err)
+	err = d.Register("TLSRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TLSRoute(untyped.(*gw.TLSRoute))
+	})
+	require.NoError(t, err)
+	err = d.Register("UDPRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_UDPRoute(untyped.(*gw.UDPRoute))
+	})
+	require.NoError(t, err)
 	err = d.Register("Endpoints", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
 		return gateway.Compile_Endpoints(untyped.(*kates.Endpoints))
 	})
@@ -0,0 +1,1150 @@
+package gateway
+
+import (
+	// standard library
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	// third-party libraries
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	// envoy api v3
+	apiv3_core "github.com/datawire/ambassador/v2/pkg/api/envoy/config/core/v3"
+	apiv3_listener "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	apiv3_route "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
+	apiv3_matcher "github.com/datawire/ambassador/v2/pkg/api/envoy/type/matcher/v3"
+
+	// first-party libraries
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+	gwv1alpha2 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1alpha2"
+	gwv1beta1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1beta1"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+)
+
+// The transforms in this file are for the gateway.networking.k8s.io Gateway API (v1, and v1beta1,
+// which is the same thing). Unlike the v1alpha1 API, routes choose the Gateways they attach to with
+// parentRefs, and Gateway listeners choose which of those routes they'll accept, so the dispatcher
+// works out which routes go where when it builds a snapshot.
+
+var (
+	gatewayGroupKind   = schema.GroupKind{Group: gwv1.GroupVersion.Group, Kind: "Gateway"}
+	httpRouteGroupKind = schema.GroupKind{Group: gwv1.GroupVersion.Group, Kind: "HTTPRoute"}
+	grpcRouteGroupKind = schema.GroupKind{Group: gwv1.GroupVersion.Group, Kind: "GRPCRoute"}
+	tcpRouteGroupKind  = schema.GroupKind{Group: gwv1.GroupVersion.Group, Kind: "TCPRoute"}
+	tlsRouteGroupKind  = schema.GroupKind{Group: gwv1.GroupVersion.Group, Kind: "TLSRoute"}
+	udpRouteGroupKind  = schema.GroupKind{Group: gwv1.GroupVersion.Group, Kind: "UDPRoute"}
+	serviceGroupKind   = schema.GroupKind{Kind: "Service"}
+	secretGroupKind    = schema.GroupKind{Kind: "Secret"}
+)
+
+// SecretKind is the kind that Secrets must be registered with the Dispatcher as, with
+// RegisterQueryable, for Gateway listeners to find the certificates of their certificateRefs.
+const SecretKind = "Secret"
+
+// Compile_GatewayV1 compiles a Gateway into envoy Listeners. The Gateway's HTTP listeners on a
+// port share an envoy Listener, each of them a CompiledVirtualHost of it. HTTPS and TLS listeners
+// get a filter chain each, for the server names of their hostname, which the dispatcher merges into
+// one envoy Listener for the port. TCP and UDP listeners get an envoy Listener each. The Secrets of
+// certificateRefs, and the ReferenceGrants that allow referring to Secrets in other namespaces, are
+// looked up with the query.
+func Compile_GatewayV1(gateway *gwv1.Gateway, query Query) (*CompiledConfig, error) {
+	src := SourceFromResource(gateway)
+	from := Referrer{GroupKind: gatewayGroupKind, Namespace: gateway.Namespace, Query: query}
+
+	var listeners []*CompiledListener
+	var httpPorts []gwv1.PortNumber
+	httpVhosts := map[gwv1.PortNumber][]*CompiledVirtualHost{}
+	portProtocols := map[string]gwv1.ProtocolType{}
+	portHostnames := map[gwv1.PortNumber]map[string]bool{}
+	var failed []*CompiledVirtualHost
+	for _, l := range gateway.Spec.Listeners {
+		vh, transportSocket := Compile_ListenerV1(src, gateway, l, from)
+		if vh.Error == "" {
+			vh = checkListenerConflictsV1(vh, l, portProtocols, portHostnames)
+		}
+		if vh.Error != "" {
+			failed = append(failed, vh)
+			continue
+		}
+
+		name := fmt.Sprintf("%s-%d-%s", getName(gateway), l.Port, l.Name)
+		switch l.Protocol {
+		case gwv1.HTTPProtocolType:
+			if _, ok := httpVhosts[l.Port]; !ok {
+				httpPorts = append(httpPorts, l.Port)
+			}
+			httpVhosts[l.Port] = append(httpVhosts[l.Port], vh)
+		case gwv1.HTTPSProtocolType:
+			// Each HTTPS listener gets a RouteConfiguration of its own, so that a connection
+			// for one listener's hostname can't be routed by another's.
+			hcm := makeHttpConnectionManager(name)
+			hcm.StripMatchingHostPort = true
+			listener, err := makeHttpListener(name, uint32(l.Port), hcm)
+			if err != nil {
+				return nil, err
+			}
+			makeTlsListener(listener, envoyServerNames([]string{vh.Hostname}), transportSocket)
+			listeners = append(listeners, &CompiledListener{
+				CompiledItem: NewCompiledItem(vh.Source),
+				Listener:     listener,
+				VirtualHosts: []*CompiledVirtualHost{vh},
+			})
+		case gwv1.TLSProtocolType:
+			port, hostname := uint32(l.Port), vh.Hostname
+			listeners = append(listeners, &CompiledListener{
+				CompiledItem: NewCompiledItem(vh.Source),
+				VirtualHosts: []*CompiledVirtualHost{vh},
+				Build: func(routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+					return makeTlsProxyListener(name, port, hostname, transportSocket, routes)
+				},
+			})
+		case gwv1.TCPProtocolType:
+			port := uint32(l.Port)
+			listeners = append(listeners, &CompiledListener{
+				CompiledItem: NewCompiledItem(vh.Source),
+				VirtualHosts: []*CompiledVirtualHost{vh},
+				Build: func(routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+					return makeTcpProxyListener(name, port, routes)
+				},
+			})
+		case gwv1.UDPProtocolType:
+			port := uint32(l.Port)
+			listeners = append(listeners, &CompiledListener{
+				CompiledItem: NewCompiledItem(vh.Source),
+				VirtualHosts: []*CompiledVirtualHost{vh},
+				Build: func(routes []*CompiledRoute) (*apiv3_listener.Listener, error) {
+					return makeUdpProxyListener(name, port, routes)
+				},
+			})
+		}
+	}
+
+	for _, port := range httpPorts {
+		name := fmt.Sprintf("%s-%d", getName(gateway), port)
+		hcm := makeHttpConnectionManager(name)
+		// Listener and route hostnames never include the port.
+		hcm.StripMatchingHostPort = true
+		listener, err := makeHttpListener(name, uint32(port), hcm)
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, &CompiledListener{
+			CompiledItem: NewCompiledItem(Sourcef("port %d in %s", port, src)),
+			Listener:     listener,
+			VirtualHosts: httpVhosts[port],
+		})
+	}
+	if len(failed) > 0 {
+		// The status of the Gateway reports these.
+		listeners = append(listeners, &CompiledListener{
+			CompiledItem: NewCompiledItem(src),
+			VirtualHosts: failed,
+		})
+	}
+
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Listeners:    listeners,
+	}, nil
+}
+
+// checkListenerConflictsV1 checks a compiled listener against the Gateway's earlier listeners on
+// the same port, returning a failed CompiledVirtualHost if it conflicts with them. HTTP, TCP, and
+// HTTPS or TLS can't share a TCP port; listeners that tell connections apart by their server name
+// can't share a hostname; and TCP and UDP listeners can't share their port with anything.
+func checkListenerConflictsV1(vh *CompiledVirtualHost, lst gwv1.Listener, protocols map[string]gwv1.ProtocolType, hostnames map[gwv1.PortNumber]map[string]bool) *CompiledVirtualHost {
+	family := func(protocol gwv1.ProtocolType) gwv1.ProtocolType {
+		if protocol == gwv1.HTTPSProtocolType {
+			return gwv1.TLSProtocolType
+		}
+		return protocol
+	}
+	// UDP ports are separate from TCP ports.
+	key := fmt.Sprintf("tcp/%d", lst.Port)
+	if lst.Protocol == gwv1.UDPProtocolType {
+		key = fmt.Sprintf("udp/%d", lst.Port)
+	}
+	if other, ok := protocols[key]; ok {
+		switch {
+		case family(other) != family(lst.Protocol):
+			return failedListenerV1(vh.Source, lst, gwv1.ListenerReasonProtocolConflict,
+				fmt.Sprintf("protocol %s conflicts with protocol %s on port %d", lst.Protocol, other, lst.Port))
+		case lst.Protocol == gwv1.TCPProtocolType || lst.Protocol == gwv1.UDPProtocolType:
+			return failedListenerV1(vh.Source, lst, gwv1.ListenerReasonProtocolConflict,
+				fmt.Sprintf("protocol %s can't share port %d with another listener", lst.Protocol, lst.Port))
+		}
+	}
+	protocols[key] = lst.Protocol
+
+	if family(lst.Protocol) == gwv1.TLSProtocolType {
+		hostname := vh.Hostname
+		if hostname == "" {
+			hostname = "*"
+		}
+		if hostnames[lst.Port] == nil {
+			hostnames[lst.Port] = map[string]bool{}
+		}
+		if hostnames[lst.Port][hostname] {
+			return failedListenerV1(vh.Source, lst, gwv1.ListenerReasonHostnameConflict,
+				fmt.Sprintf("hostname %q is already used by another listener on port %d", hostname, lst.Port))
+		}
+		hostnames[lst.Port][hostname] = true
+	}
+	return vh
+}
+
+// failedListenerV1 makes the CompiledVirtualHost of a listener that can't be used.
+func failedListenerV1(src Source, lst gwv1.Listener, reason gwv1.ListenerConditionReason, message string) *CompiledVirtualHost {
+	item := NewCompiledItemError(src, message)
+	item.Reason = string(reason)
+	return &CompiledVirtualHost{
+		CompiledItem: item,
+		Name:         string(lst.Name),
+		Port:         int32(lst.Port),
+	}
+}
+
+// Compile_ListenerV1 compiles one of a Gateway's listeners, along with the transport socket that
+// terminates TLS for it, if it does. If the listener can't be used, the result has an Error and no
+// Attach function.
+func Compile_ListenerV1(parent Source, gateway *gwv1.Gateway, lst gwv1.Listener, from Referrer) (*CompiledVirtualHost, *apiv3_core.TransportSocket) {
+	src := Sourcef("listener %s in %s", lst.Name, parent)
+	fail := func(reason gwv1.ListenerConditionReason, format string, args ...interface{}) (*CompiledVirtualHost, *apiv3_core.TransportSocket) {
+		return failedListenerV1(src, lst, reason, fmt.Sprintf(format, args...)), nil
+	}
+
+	var transportSocket *apiv3_core.TransportSocket
+	defaultKinds := []schema.GroupKind{httpRouteGroupKind, grpcRouteGroupKind}
+	switch lst.Protocol {
+	case gwv1.HTTPProtocolType:
+	case gwv1.TCPProtocolType:
+		defaultKinds = []schema.GroupKind{tcpRouteGroupKind}
+	case gwv1.UDPProtocolType:
+		defaultKinds = []schema.GroupKind{udpRouteGroupKind}
+	case gwv1.HTTPSProtocolType, gwv1.TLSProtocolType:
+		var reason gwv1.ListenerConditionReason
+		var err error
+		transportSocket, reason, err = Compile_ListenerTLSV1(lst, from)
+		if err != nil {
+			return fail(reason, "%v", err)
+		}
+		if lst.Protocol == gwv1.TLSProtocolType {
+			// Terminated TLS connections are proxied like TCP connections; passed-through
+			// ones go wherever the SNI of a TLSRoute says.
+			defaultKinds = []schema.GroupKind{tcpRouteGroupKind}
+			if transportSocket == nil {
+				defaultKinds = []schema.GroupKind{tlsRouteGroupKind}
+			}
+		}
+	default:
+		return fail(gwv1.ListenerReasonUnsupportedProtocol, "unsupported protocol: %q", lst.Protocol)
+	}
+	namespaceAllowed, err := compileAllowedNamespaces(gateway.Namespace, lst.AllowedRoutes)
+	if err != nil {
+		return fail(gwv1.ListenerReasonInvalid, "%v", err)
+	}
+	kindAllowed := compileAllowedKinds(lst.AllowedRoutes, defaultKinds)
+
+	hostname := ""
+	if lst.Hostname != nil {
+		hostname = string(*lst.Hostname)
+	}
+
+	return &CompiledVirtualHost{
+		CompiledItem: NewCompiledItem(src),
+		Name:         string(lst.Name),
+		Port:         int32(lst.Port),
+		Hostname:     hostname,
+		Kinds:        sortedGroupKinds(kindAllowed),
+		SingleRoute:  lst.Protocol == gwv1.UDPProtocolType,
+		Attach: func(route *CompiledRoute, namespaceLabels kates.LabelSet) bool {
+			if !kindAllowed[route.GroupKind] || !namespaceAllowed(route.Namespace, namespaceLabels) {
+				return false
+			}
+			for _, ref := range route.ParentRefs {
+				if ref.Group == gwv1.GroupVersion.Group && ref.Kind == "Gateway" &&
+					ref.Namespace == gateway.Namespace && ref.Name == gateway.Name &&
+					(ref.SectionName == "" || ref.SectionName == string(lst.Name)) &&
+					(ref.Port == 0 || ref.Port == int32(lst.Port)) {
+					return true
+				}
+			}
+			return false
+		},
+	}, transportSocket
+}
+
+// Compile_ListenerTLSV1 compiles the TLS configuration of an HTTPS or TLS listener into a transport
+// socket that terminates TLS with the certificates of its certificateRefs. Ambex serves those over
+// SDS under the "name.namespace" names that Ambassador uses for secrets everywhere else. The
+// transport socket is nil for TLS passthrough. If the configuration can't be used, the error comes
+// with the reason for the listener's status.
+func Compile_ListenerTLSV1(lst gwv1.Listener, from Referrer) (*apiv3_core.TransportSocket, gwv1.ListenerConditionReason, error) {
+	tls := lst.TLS
+	if tls == nil {
+		return nil, gwv1.ListenerReasonInvalid, errors.Errorf("protocol %s requires a tls configuration", lst.Protocol)
+	}
+	mode := gwv1.TLSModeTerminate
+	if tls.Mode != nil {
+		mode = *tls.Mode
+	}
+	switch mode {
+	case gwv1.TLSModePassthrough:
+		if lst.Protocol != gwv1.TLSProtocolType {
+			return nil, gwv1.ListenerReasonInvalid, errors.Errorf("tls passthrough requires protocol %s", gwv1.TLSProtocolType)
+		}
+		return nil, "", nil
+	case gwv1.TLSModeTerminate:
+	default:
+		return nil, gwv1.ListenerReasonInvalid, errors.Errorf("unknown tls mode: %q", mode)
+	}
+
+	if len(tls.CertificateRefs) == 0 {
+		return nil, gwv1.ListenerReasonInvalidCertificateRef, errors.New("tls termination requires a certificateRef")
+	}
+	var secretNames []string
+	for _, ref := range tls.CertificateRefs {
+		gk, namespace, name := certificateRefV1(ref, from.Namespace)
+		if gk != secretGroupKind {
+			return nil, gwv1.ListenerReasonInvalidCertificateRef,
+				errors.Errorf("unsupported certificateRef kind: %s", gk)
+		}
+		if !from.Allows(secretGroupKind, namespace, name) {
+			return nil, gwv1.ListenerReasonRefNotPermitted,
+				errors.Errorf("secret %s.%s is in another namespace, and no ReferenceGrant allows referring to it", name, namespace)
+		}
+		// Envoy won't use the listener at all until it has every certificate, so one that
+		// doesn't exist would take the other listeners on the port down with it.
+		secret, _ := from.Query.Get(SecretKind, namespace, name).(*kates.Secret)
+		if secret == nil || len(secret.Data["tls.crt"]) == 0 || len(secret.Data["tls.key"]) == 0 {
+			return nil, gwv1.ListenerReasonInvalidCertificateRef,
+				errors.Errorf("secret %s.%s doesn't exist, or has no tls.crt and tls.key", name, namespace)
+		}
+		secretNames = append(secretNames, fmt.Sprintf("%s.%s", name, namespace))
+	}
+
+	transportSocket, err := makeTlsTransportSocket(secretNames...)
+	if err != nil {
+		return nil, gwv1.ListenerReasonInvalid, err
+	}
+	return transportSocket, "", nil
+}
+
+// certificateRefV1 returns the kind, namespace and name of the resource that a certificateRef
+// refers to. The core group may be spelled "core".
+func certificateRefV1(ref gwv1.SecretObjectReference, namespace string) (schema.GroupKind, string, string) {
+	gk := secretGroupKind
+	if ref.Group != nil && *ref.Group != "core" {
+		gk.Group = string(*ref.Group)
+	}
+	if ref.Kind != nil {
+		gk.Kind = string(*ref.Kind)
+	}
+	if ref.Namespace != nil {
+		namespace = string(*ref.Namespace)
+	}
+	return gk, namespace, string(ref.Name)
+}
+
+// CertificateRefsV1 returns the Secrets that the listeners of a Gateway may use as certificates,
+// given the ReferenceGrants that allow referring to Secrets in other namespaces. These are the
+// Secrets that have to be loaded for the Gateway.
+func CertificateRefsV1(gateway *gwv1.Gateway, grants []*gwv1beta1.ReferenceGrant) []types.NamespacedName {
+	from := Referrer{GroupKind: gatewayGroupKind, Namespace: gateway.Namespace, Query: grantsQuery(grants)}
+	var refs []types.NamespacedName
+	for _, l := range gateway.Spec.Listeners {
+		if l.TLS == nil {
+			continue
+		}
+		for _, ref := range l.TLS.CertificateRefs {
+			gk, namespace, name := certificateRefV1(ref, gateway.Namespace)
+			if gk == secretGroupKind && from.Allows(gk, namespace, name) {
+				refs = append(refs, types.NamespacedName{Namespace: namespace, Name: name})
+			}
+		}
+	}
+	return refs
+}
+
+// compileAllowedNamespaces returns a function that says whether routes in a namespace (with the
+// given labels) may attach to a listener.
+func compileAllowedNamespaces(gatewayNamespace string, allowed *gwv1.AllowedRoutes) (func(string, kates.LabelSet) bool, error) {
+	from := gwv1.NamespacesFromSame
+	if allowed != nil && allowed.Namespaces != nil && allowed.Namespaces.From != nil {
+		from = *allowed.Namespaces.From
+	}
+
+	switch from {
+	case gwv1.NamespacesFromAll:
+		return func(string, kates.LabelSet) bool { return true }, nil
+	case gwv1.NamespacesFromSame:
+		return func(namespace string, _ kates.LabelSet) bool { return namespace == gatewayNamespace }, nil
+	case gwv1.NamespacesFromSelector:
+		if allowed.Namespaces.Selector == nil {
+			return nil, errors.New("allowedRoutes.namespaces.selector is required when from is Selector")
+		}
+		selector, err := metav1.LabelSelectorAsSelector(allowed.Namespaces.Selector)
+		if err != nil {
+			return nil, errors.Wrap(err, "allowedRoutes.namespaces.selector")
+		}
+		return func(_ string, labels kates.LabelSet) bool { return selector.Matches(labels) }, nil
+	default:
+		return nil, errors.Errorf("unknown allowedRoutes.namespaces.from: %q", from)
+	}
+}
+
+// compileAllowedKinds returns the set of route kinds that may attach to a listener, which defaults
+// to the kinds that go with its protocol. Kinds that we don't compile are harmless, because no
+// routes of those kinds will ever try to attach.
+func compileAllowedKinds(allowed *gwv1.AllowedRoutes, defaults []schema.GroupKind) map[schema.GroupKind]bool {
+	kinds := map[schema.GroupKind]bool{}
+	if allowed == nil || len(allowed.Kinds) == 0 {
+		for _, gk := range defaults {
+			kinds[gk] = true
+		}
+		return kinds
+	}
+	for _, k := range allowed.Kinds {
+		group := gwv1.GroupVersion.Group
+		if k.Group != nil {
+			group = string(*k.Group)
+		}
+		kinds[schema.GroupKind{Group: group, Kind: string(k.Kind)}] = true
+	}
+	return kinds
+}
+
+func sortedGroupKinds(kinds map[schema.GroupKind]bool) []schema.GroupKind {
+	result := make([]schema.GroupKind, 0, len(kinds))
+	for gk := range kinds {
+		result = append(result, gk)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].String() < result[j].String() })
+	return result
+}
+
+// Compile_HTTPRouteV1 compiles an HTTPRoute. Which listeners it ends up on is up to the
+// dispatcher, based on the route's parentRefs and hostnames. Its backends in other namespaces are
+// looked up with the query, in the ReferenceGrants that allow the route to refer to them.
+func Compile_HTTPRouteV1(httpRoute *gwv1.HTTPRoute, query Query) (*CompiledConfig, error) {
+	src := SourceFromResource(httpRoute)
+	from := Referrer{GroupKind: httpRouteGroupKind, Namespace: httpRoute.Namespace, Query: query}
+	clusterRefs := []*ClusterRef{}
+	var filters []*CompiledItem
+	var routes []*apiv3_route.Route
+	for idx, rule := range httpRoute.Spec.Rules {
+		s := Sourcef("rule %d in %s", idx, src)
+		_routes, err := Compile_HTTPRouteRuleV1(s, rule, from, &clusterRefs, &filters)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, _routes...)
+	}
+
+	var hostnames []string
+	for _, hostname := range httpRoute.Spec.Hostnames {
+		hostnames = append(hostnames, string(hostname))
+	}
+
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{
+			{
+				CompiledItem: CompiledItem{Source: src, Namespace: httpRoute.Namespace},
+				GroupKind:    httpRouteGroupKind,
+				ParentRefs:   compileParentRefs(httpRoute.Namespace, httpRoute.Spec.ParentRefs),
+				Hostnames:    hostnames,
+				Routes:       routes,
+				ClusterRefs:  clusterRefs,
+				Filters:      filters,
+			},
+		},
+	}, nil
+}
+
+// compileParentRefs fills in the defaults of a route's parentRefs.
+func compileParentRefs(namespace string, refs []gwv1.ParentReference) []ParentRef {
+	var result []ParentRef
+	for _, ref := range refs {
+		parent := ParentRef{
+			Group:     gwv1.GroupVersion.Group,
+			Kind:      "Gateway",
+			Namespace: namespace,
+			Name:      string(ref.Name),
+		}
+		if ref.Group != nil {
+			parent.Group = string(*ref.Group)
+		}
+		if ref.Kind != nil {
+			parent.Kind = string(*ref.Kind)
+		}
+		if ref.Namespace != nil {
+			parent.Namespace = string(*ref.Namespace)
+		}
+		if ref.SectionName != nil {
+			parent.SectionName = string(*ref.SectionName)
+		}
+		if ref.Port != nil {
+			parent.Port = int32(*ref.Port)
+		}
+		result = append(result, parent)
+	}
+	return result
+}
+
+func Compile_HTTPRouteRuleV1(src Source, rule gwv1.HTTPRouteRule, from Referrer, clusterRefs *[]*ClusterRef, filters *[]*CompiledItem) ([]*apiv3_route.Route, error) {
+	var clusters []*apiv3_route.WeightedCluster_ClusterWeight
+	var totalWeight uint32
+	filtersOK := true
+	for idx, backend := range rule.BackendRefs {
+		s := Sourcef("backendRef %d in %s", idx, src)
+		if len(backend.Filters) > 0 {
+			item := NewCompiledItemError(s, "filters on backendRefs are not supported")
+			item.Reason = string(gwv1.RouteReasonUnsupportedValue)
+			*filters = append(*filters, &item)
+			filtersOK = false
+		}
+		cluster := Compile_BackendRefV1(s, backend.BackendRef, from, clusterRefs)
+		if cluster == nil || cluster.Weight.Value == 0 {
+			continue
+		}
+		clusters = append(clusters, cluster)
+		totalWeight += cluster.Weight.Value
+	}
+
+	compiledFilters := Compile_HTTPRouteFiltersV1(src, rule, from, clusterRefs, filters)
+	if compiledFilters == nil {
+		filtersOK = false
+	}
+
+	matches := rule.Matches
+	if len(matches) == 0 {
+		matches = []gwv1.HTTPRouteMatch{{}}
+	}
+	var result []*apiv3_route.Route
+	for _, match := range matches {
+		m, err := Compile_HTTPRouteMatchV1(match)
+		if err != nil {
+			return nil, err
+		}
+		route := &apiv3_route.Route{Match: m}
+		if totalWeight == 0 || !filtersOK {
+			// The spec says that requests with nowhere to go, or that would have been processed
+			// by a filter that we can't apply, get a 500.
+			route.Action = &apiv3_route.Route_DirectResponse{DirectResponse: &apiv3_route.DirectResponseAction{Status: 500}}
+		} else {
+			route.Action = &apiv3_route.Route_Route{Route: &apiv3_route.RouteAction{
+				ClusterSpecifier: &apiv3_route.RouteAction_WeightedClusters{WeightedClusters: &apiv3_route.WeightedCluster{
+					Clusters:    clusters,
+					TotalWeight: &wrapperspb.UInt32Value{Value: totalWeight},
+				}},
+			}}
+		}
+		if filtersOK {
+			prefix, _ := pathPrefixV1(match)
+			compiledFilters.apply(route, prefix)
+		}
+		result = append(result, route)
+	}
+	return result, nil
+}
+
+// Compile_HTTPRouteFiltersV1 compiles the filters of a rule. Each filter gets an item in filters,
+// with an Error if it can't be applied, in which case the result is nil.
+func Compile_HTTPRouteFiltersV1(src Source, rule gwv1.HTTPRouteRule, from Referrer, clusterRefs *[]*ClusterRef, filters *[]*CompiledItem) *routeFilters {
+	result := &routeFilters{}
+	ok := true
+	seen := map[gwv1.HTTPRouteFilterType]bool{}
+	for idx, filter := range rule.Filters {
+		s := Sourcef("filter %d in %s", idx, src)
+		err := compileHTTPRouteFilterV1(s, filter, rule.Matches, from, clusterRefs, seen, result)
+		item := NewCompiledItem(s)
+		if err != nil {
+			item = NewCompiledItemError(s, err.Error())
+			item.Reason = string(gwv1.RouteReasonUnsupportedValue)
+			ok = false
+		}
+		*filters = append(*filters, &item)
+	}
+	if !ok {
+		return nil
+	}
+	return result
+}
+
+func compileHTTPRouteFilterV1(src Source, filter gwv1.HTTPRouteFilter, matches []gwv1.HTTPRouteMatch, from Referrer, clusterRefs *[]*ClusterRef, seen map[gwv1.HTTPRouteFilterType]bool, result *routeFilters) error {
+	// Only mirrors can be repeated.
+	if seen[filter.Type] && filter.Type != gwv1.HTTPRouteFilterRequestMirror {
+		return errors.Errorf("more than one %s filter", filter.Type)
+	}
+	seen[filter.Type] = true
+	if seen[gwv1.HTTPRouteFilterRequestRedirect] && (seen[gwv1.HTTPRouteFilterURLRewrite] || seen[gwv1.HTTPRouteFilterRequestMirror]) {
+		return errors.Errorf("a %s filter can't be combined with %s or %s filters", gwv1.HTTPRouteFilterRequestRedirect,
+			gwv1.HTTPRouteFilterURLRewrite, gwv1.HTTPRouteFilterRequestMirror)
+	}
+
+	switch filter.Type {
+	case gwv1.HTTPRouteFilterRequestHeaderModifier:
+		if filter.RequestHeaderModifier == nil {
+			return errors.New("missing requestHeaderModifier")
+		}
+		result.requestHeadersToAdd, result.requestHeadersToRemove = compileHeaderFilterV1(filter.RequestHeaderModifier)
+	case gwv1.HTTPRouteFilterResponseHeaderModifier:
+		if filter.ResponseHeaderModifier == nil {
+			return errors.New("missing responseHeaderModifier")
+		}
+		result.responseHeadersToAdd, result.responseHeadersToRemove = compileHeaderFilterV1(filter.ResponseHeaderModifier)
+	case gwv1.HTTPRouteFilterRequestRedirect:
+		redirect := filter.RequestRedirect
+		if redirect == nil {
+			return errors.New("missing requestRedirect")
+		}
+		action := &apiv3_route.RedirectAction{ResponseCode: apiv3_route.RedirectAction_FOUND}
+		if redirect.Scheme != nil {
+			action.SchemeRewriteSpecifier = &apiv3_route.RedirectAction_SchemeRedirect{SchemeRedirect: *redirect.Scheme}
+		}
+		if redirect.Hostname != nil {
+			action.HostRedirect = string(*redirect.Hostname)
+		}
+		if redirect.Port != nil {
+			action.PortRedirect = uint32(*redirect.Port)
+		}
+		if redirect.StatusCode != nil {
+			switch *redirect.StatusCode {
+			case 301:
+				action.ResponseCode = apiv3_route.RedirectAction_MOVED_PERMANENTLY
+			case 302:
+			default:
+				return errors.Errorf("unsupported redirect status code: %d", *redirect.StatusCode)
+			}
+		}
+		path, err := compilePathModifierV1(redirect.Path, matches)
+		if err != nil {
+			return err
+		}
+		result.redirect = action
+		result.redirectPath = path
+	case gwv1.HTTPRouteFilterURLRewrite:
+		rewrite := filter.URLRewrite
+		if rewrite == nil {
+			return errors.New("missing urlRewrite")
+		}
+		path, err := compilePathModifierV1(rewrite.Path, matches)
+		if err != nil {
+			return err
+		}
+		if rewrite.Hostname != nil {
+			result.hostRewrite = string(*rewrite.Hostname)
+		}
+		result.pathRewrite = path
+	case gwv1.HTTPRouteFilterRequestMirror:
+		if filter.RequestMirror == nil {
+			return errors.New("missing requestMirror")
+		}
+		backend := gwv1.BackendRef{BackendObjectReference: filter.RequestMirror.BackendRef}
+		// The backendRef gets a ClusterRef of its own, with an Error if it can't be used.
+		if cluster := Compile_BackendRefV1(src, backend, from, clusterRefs); cluster != nil {
+			result.mirrors = append(result.mirrors, &apiv3_route.RouteAction_RequestMirrorPolicy{Cluster: cluster.Name})
+		}
+	default:
+		return errors.Errorf("unsupported filter type: %q", filter.Type)
+	}
+	return nil
+}
+
+func compileHeaderFilterV1(filter *gwv1.HTTPHeaderFilter) ([]*apiv3_core.HeaderValueOption, []string) {
+	set, add := map[string]string{}, map[string]string{}
+	for _, h := range filter.Set {
+		set[string(h.Name)] = h.Value
+	}
+	for _, h := range filter.Add {
+		add[string(h.Name)] = h.Value
+	}
+	return headerValueOptions(set, add), filter.Remove
+}
+
+// compilePathModifierV1 compiles the path of a redirect or rewrite. Replacing the prefix of the
+// path only works if every match of the rule is a PathPrefix match.
+func compilePathModifierV1(modifier *gwv1.HTTPPathModifier, matches []gwv1.HTTPRouteMatch) (*pathModifier, error) {
+	if modifier == nil {
+		return nil, nil
+	}
+	switch modifier.Type {
+	case gwv1.FullPathHTTPPathModifier:
+		if modifier.ReplaceFullPath == nil {
+			return nil, errors.New("missing replaceFullPath")
+		}
+		return &pathModifier{fullPath: modifier.ReplaceFullPath}, nil
+	case gwv1.PrefixMatchHTTPPathModifier:
+		if modifier.ReplacePrefixMatch == nil {
+			return nil, errors.New("missing replacePrefixMatch")
+		}
+		for _, match := range matches {
+			if _, ok := pathPrefixV1(match); !ok {
+				return nil, errors.Errorf("%s requires a %s path match", gwv1.PrefixMatchHTTPPathModifier, gwv1.PathMatchPathPrefix)
+			}
+		}
+		return &pathModifier{prefixReplace: modifier.ReplacePrefixMatch}, nil
+	default:
+		return nil, errors.Errorf("unknown path modifier type: %q", modifier.Type)
+	}
+}
+
+// pathPrefixV1 returns the path prefix that a match matches, without its trailing slash, and false
+// if it isn't a PathPrefix match.
+func pathPrefixV1(match gwv1.HTTPRouteMatch) (string, bool) {
+	if match.Path == nil {
+		return "", true
+	}
+	if match.Path.Type != nil && *match.Path.Type != gwv1.PathMatchPathPrefix {
+		return "", false
+	}
+	if match.Path.Value == nil {
+		return "", true
+	}
+	return strings.TrimSuffix(*match.Path.Value, "/"), true
+}
+
+// Compile_BackendRefV1 compiles a reference to a Service into a weighted cluster. If the reference
+// can't be used, it records a ClusterRef with an Error and returns nil.
+func Compile_BackendRefV1(src Source, ref gwv1.BackendRef, from Referrer, clusterRefs *[]*ClusterRef) *apiv3_route.WeightedCluster_ClusterWeight {
+	return compileBackendRefV1(src, ref, from, false, clusterRefs)
+}
+
+// compileBackendRefV1 is Compile_BackendRefV1, for a backend that may need to be spoken to over
+// HTTP/2. Those get a cluster of their own, since the Service may also be used over HTTP/1.
+func compileBackendRefV1(src Source, ref gwv1.BackendRef, from Referrer, http2 bool, clusterRefs *[]*ClusterRef) *apiv3_route.WeightedCluster_ClusterWeight {
+	group, kind := "", "Service"
+	if ref.Group != nil {
+		group = string(*ref.Group)
+	}
+	if ref.Kind != nil {
+		kind = string(*ref.Kind)
+	}
+	backendNamespace := from.Namespace
+	if ref.Namespace != nil {
+		backendNamespace = string(*ref.Namespace)
+	}
+
+	var err string
+	var reason gwv1.RouteConditionReason
+	switch {
+	case group != "" || kind != "Service":
+		err = fmt.Sprintf("unsupported backend kind: %s", schema.GroupKind{Group: group, Kind: kind})
+		reason = gwv1.RouteReasonInvalidKind
+	case !from.Allows(serviceGroupKind, backendNamespace, string(ref.Name)):
+		err = fmt.Sprintf("backend %s.%s is in another namespace, and no ReferenceGrant allows referring to it", ref.Name, backendNamespace)
+		reason = gwv1.RouteReasonRefNotPermitted
+	case ref.Port == nil:
+		err = fmt.Sprintf("backend %s.%s has no port", ref.Name, backendNamespace)
+		reason = gwv1.RouteReasonUnsupportedValue
+	}
+	if err != "" {
+		item := NewCompiledItemError(src, err)
+		item.Reason = string(reason)
+		*clusterRefs = append(*clusterRefs, &ClusterRef{CompiledItem: item})
+		return nil
+	}
+
+	clusterName := fmt.Sprintf("%s_%s_%d", backendNamespace, ref.Name, *ref.Port)
+	if http2 {
+		clusterName += "_http2"
+	}
+	*clusterRefs = append(*clusterRefs, &ClusterRef{
+		CompiledItem: CompiledItem{Source: src, Namespace: backendNamespace},
+		Name:         clusterName,
+		Service:      string(ref.Name),
+		HTTP2:        http2,
+		EndpointPath: fmt.Sprintf("k8s/%s/%s/%d", backendNamespace, ref.Name, *ref.Port),
+	})
+
+	weight := int32(1)
+	if ref.Weight != nil && *ref.Weight >= 0 {
+		weight = *ref.Weight
+	}
+	return &apiv3_route.WeightedCluster_ClusterWeight{
+		Name:   clusterName,
+		Weight: &wrapperspb.UInt32Value{Value: uint32(weight)},
+	}
+}
+
+func Compile_HTTPRouteMatchV1(match gwv1.HTTPRouteMatch) (*apiv3_route.RouteMatch, error) {
+	pathType, pathValue := gwv1.PathMatchPathPrefix, "/"
+	if match.Path != nil {
+		if match.Path.Type != nil {
+			pathType = *match.Path.Type
+		}
+		if match.Path.Value != nil {
+			pathValue = *match.Path.Value
+		}
+	}
+
+	result := &apiv3_route.RouteMatch{}
+	switch pathType {
+	case gwv1.PathMatchExact:
+		result.PathSpecifier = &apiv3_route.RouteMatch_Path{Path: pathValue}
+	case gwv1.PathMatchPathPrefix:
+		prefix := strings.TrimSuffix(pathValue, "/")
+		if prefix == "" {
+			result.PathSpecifier = &apiv3_route.RouteMatch_Prefix{Prefix: "/"}
+		} else {
+			// A PathPrefix matches whole path elements: "/foo" matches "/foo/bar", but not
+			// "/foobar".
+			result.PathSpecifier = &apiv3_route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(regexp.QuoteMeta(prefix) + "(/.*)?")}
+		}
+	case gwv1.PathMatchRegularExpression:
+		result.PathSpecifier = &apiv3_route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(pathValue)}
+	default:
+		return nil, errors.Errorf("unknown path match type: %q", pathType)
+	}
+
+	for _, header := range match.Headers {
+		hm := &apiv3_route.HeaderMatcher{Name: string(header.Name)}
+		headerType := gwv1.HeaderMatchExact
+		if header.Type != nil {
+			headerType = *header.Type
+		}
+		switch headerType {
+		case gwv1.HeaderMatchExact:
+			hm.HeaderMatchSpecifier = &apiv3_route.HeaderMatcher_ExactMatch{ExactMatch: header.Value}
+		case gwv1.HeaderMatchRegularExpression:
+			hm.HeaderMatchSpecifier = &apiv3_route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: regexMatcher(header.Value)}
+		default:
+			return nil, errors.Errorf("unknown header match type: %s", headerType)
+		}
+		result.Headers = append(result.Headers, hm)
+	}
+
+	if match.Method != nil {
+		result.Headers = append(result.Headers, &apiv3_route.HeaderMatcher{
+			Name:                 ":method",
+			HeaderMatchSpecifier: &apiv3_route.HeaderMatcher_ExactMatch{ExactMatch: string(*match.Method)},
+		})
+	}
+
+	for _, param := range match.QueryParams {
+		sm := &apiv3_matcher.StringMatcher{}
+		paramType := gwv1.QueryParamMatchExact
+		if param.Type != nil {
+			paramType = *param.Type
+		}
+		switch paramType {
+		case gwv1.QueryParamMatchExact:
+			sm.MatchPattern = &apiv3_matcher.StringMatcher_Exact{Exact: param.Value}
+		case gwv1.QueryParamMatchRegularExpression:
+			sm.MatchPattern = &apiv3_matcher.StringMatcher_SafeRegex{SafeRegex: regexMatcher(param.Value)}
+		default:
+			return nil, errors.Errorf("unknown query param match type: %s", paramType)
+		}
+		result.QueryParameters = append(result.QueryParameters, &apiv3_route.QueryParameterMatcher{
+			Name:                         string(param.Name),
+			QueryParameterMatchSpecifier: &apiv3_route.QueryParameterMatcher_StringMatch{StringMatch: sm},
+		})
+	}
+
+	return result, nil
+}
+
+// Compile_GRPCRouteV1 compiles a GRPCRoute. gRPC requests are HTTP/2 requests to
+// "/<service>/<method>", so they attach to the same listeners as HTTPRoutes, but their backends are
+// spoken to over HTTP/2.
+func Compile_GRPCRouteV1(grpcRoute *gwv1.GRPCRoute, query Query) (*CompiledConfig, error) {
+	src := SourceFromResource(grpcRoute)
+	from := Referrer{GroupKind: grpcRouteGroupKind, Namespace: grpcRoute.Namespace, Query: query}
+	clusterRefs := []*ClusterRef{}
+	var filters []*CompiledItem
+	var routes []*apiv3_route.Route
+	for idx, rule := range grpcRoute.Spec.Rules {
+		s := Sourcef("rule %d in %s", idx, src)
+		_routes, err := Compile_GRPCRouteRuleV1(s, rule, from, &clusterRefs, &filters)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, _routes...)
+	}
+
+	var hostnames []string
+	for _, hostname := range grpcRoute.Spec.Hostnames {
+		hostnames = append(hostnames, string(hostname))
+	}
+
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{
+			{
+				CompiledItem: CompiledItem{Source: src, Namespace: grpcRoute.Namespace},
+				GroupKind:    grpcRouteGroupKind,
+				ParentRefs:   compileParentRefs(grpcRoute.Namespace, grpcRoute.Spec.ParentRefs),
+				Hostnames:    hostnames,
+				Routes:       routes,
+				ClusterRefs:  clusterRefs,
+				Filters:      filters,
+			},
+		},
+	}, nil
+}
+
+func Compile_GRPCRouteRuleV1(src Source, rule gwv1.GRPCRouteRule, from Referrer, clusterRefs *[]*ClusterRef, filters *[]*CompiledItem) ([]*apiv3_route.Route, error) {
+	var clusters []*apiv3_route.WeightedCluster_ClusterWeight
+	var totalWeight uint32
+	filtersOK := true
+	for idx, backend := range rule.BackendRefs {
+		s := Sourcef("backendRef %d in %s", idx, src)
+		if len(backend.Filters) > 0 {
+			item := NewCompiledItemError(s, "filters on backendRefs are not supported")
+			item.Reason = string(gwv1.RouteReasonUnsupportedValue)
+			*filters = append(*filters, &item)
+			filtersOK = false
+		}
+		cluster := compileBackendRefV1(s, backend.BackendRef, from, true, clusterRefs)
+		if cluster == nil || cluster.Weight.Value == 0 {
+			continue
+		}
+		clusters = append(clusters, cluster)
+		totalWeight += cluster.Weight.Value
+	}
+
+	compiledFilters := Compile_GRPCRouteFiltersV1(src, rule, from, clusterRefs, filters)
+	if compiledFilters == nil {
+		filtersOK = false
+	}
+
+	matches := rule.Matches
+	if len(matches) == 0 {
+		matches = []gwv1.GRPCRouteMatch{{}}
+	}
+	var result []*apiv3_route.Route
+	for _, match := range matches {
+		m, err := Compile_GRPCRouteMatchV1(match)
+		if err != nil {
+			return nil, err
+		}
+		route := &apiv3_route.Route{Match: m}
+		if totalWeight == 0 || !filtersOK {
+			route.Action = &apiv3_route.Route_DirectResponse{DirectResponse: &apiv3_route.DirectResponseAction{Status: 500}}
+		} else {
+			route.Action = &apiv3_route.Route_Route{Route: &apiv3_route.RouteAction{
+				ClusterSpecifier: &apiv3_route.RouteAction_WeightedClusters{WeightedClusters: &apiv3_route.WeightedCluster{
+					Clusters:    clusters,
+					TotalWeight: &wrapperspb.UInt32Value{Value: totalWeight},
+				}},
+			}}
+		}
+		if filtersOK {
+			compiledFilters.apply(route, "")
+		}
+		result = append(result, route)
+	}
+	return result, nil
+}
+
+// Compile_GRPCRouteFiltersV1 compiles the filters of a rule. Each filter gets an item in filters,
+// with an Error if it can't be applied, in which case the result is nil.
+func Compile_GRPCRouteFiltersV1(src Source, rule gwv1.GRPCRouteRule, from Referrer, clusterRefs *[]*ClusterRef, filters *[]*CompiledItem) *routeFilters {
+	result := &routeFilters{}
+	ok := true
+	seen := map[gwv1.GRPCRouteFilterType]bool{}
+	for idx, filter := range rule.Filters {
+		s := Sourcef("filter %d in %s", idx, src)
+		err := compileGRPCRouteFilterV1(s, filter, from, clusterRefs, seen, result)
+		item := NewCompiledItem(s)
+		if err != nil {
+			item = NewCompiledItemError(s, err.Error())
+			item.Reason = string(gwv1.RouteReasonUnsupportedValue)
+			ok = false
+		}
+		*filters = append(*filters, &item)
+	}
+	if !ok {
+		return nil
+	}
+	return result
+}
+
+func compileGRPCRouteFilterV1(src Source, filter gwv1.GRPCRouteFilter, from Referrer, clusterRefs *[]*ClusterRef, seen map[gwv1.GRPCRouteFilterType]bool, result *routeFilters) error {
+	// Only mirrors can be repeated.
+	if seen[filter.Type] && filter.Type != gwv1.GRPCRouteFilterRequestMirror {
+		return errors.Errorf("more than one %s filter", filter.Type)
+	}
+	seen[filter.Type] = true
+
+	switch filter.Type {
+	case gwv1.GRPCRouteFilterRequestHeaderModifier:
+		if filter.RequestHeaderModifier == nil {
+			return errors.New("missing requestHeaderModifier")
+		}
+		result.requestHeadersToAdd, result.requestHeadersToRemove = compileHeaderFilterV1(filter.RequestHeaderModifier)
+	case gwv1.GRPCRouteFilterResponseHeaderModifier:
+		if filter.ResponseHeaderModifier == nil {
+			return errors.New("missing responseHeaderModifier")
+		}
+		result.responseHeadersToAdd, result.responseHeadersToRemove = compileHeaderFilterV1(filter.ResponseHeaderModifier)
+	case gwv1.GRPCRouteFilterRequestMirror:
+		if filter.RequestMirror == nil {
+			return errors.New("missing requestMirror")
+		}
+		backend := gwv1.BackendRef{BackendObjectReference: filter.RequestMirror.BackendRef}
+		if cluster := compileBackendRefV1(src, backend, from, true, clusterRefs); cluster != nil {
+			result.mirrors = append(result.mirrors, &apiv3_route.RouteAction_RequestMirrorPolicy{Cluster: cluster.Name})
+		}
+	default:
+		return errors.Errorf("unsupported filter type: %q", filter.Type)
+	}
+	return nil
+}
+
+// Compile_GRPCRouteMatchV1 compiles a GRPCRoute match into a match on the path of the request,
+// which is "/<service>/<method>". It only matches gRPC requests.
+func Compile_GRPCRouteMatchV1(match gwv1.GRPCRouteMatch) (*apiv3_route.RouteMatch, error) {
+	result := &apiv3_route.RouteMatch{
+		PathSpecifier: &apiv3_route.RouteMatch_Prefix{Prefix: "/"},
+		Grpc:          &apiv3_route.RouteMatch_GrpcRouteMatchOptions{},
+	}
+
+	if method := match.Method; method != nil {
+		matchType := gwv1.GRPCMethodMatchExact
+		if method.Type != nil {
+			matchType = *method.Type
+		}
+		service, name := "", ""
+		if method.Service != nil {
+			service = *method.Service
+		}
+		if method.Method != nil {
+			name = *method.Method
+		}
+		if service == "" && name == "" {
+			return nil, errors.New("a method match requires a service or a method")
+		}
+
+		switch matchType {
+		case gwv1.GRPCMethodMatchExact:
+			switch {
+			case name == "":
+				result.PathSpecifier = &apiv3_route.RouteMatch_Prefix{Prefix: "/" + service + "/"}
+			case service == "":
+				result.PathSpecifier = &apiv3_route.RouteMatch_SafeRegex{SafeRegex: regexMatcher("/[^/]+/" + regexp.QuoteMeta(name))}
+			default:
+				result.PathSpecifier = &apiv3_route.RouteMatch_Path{Path: "/" + service + "/" + name}
+			}
+		case gwv1.GRPCMethodMatchRegularExpression:
+			if service == "" {
+				service = "[^/]+"
+			}
+			if name == "" {
+				name = "[^/]+"
+			}
+			result.PathSpecifier = &apiv3_route.RouteMatch_SafeRegex{SafeRegex: regexMatcher("/" + service + "/" + name)}
+		default:
+			return nil, errors.Errorf("unknown method match type: %q", matchType)
+		}
+	}
+
+	for _, header := range match.Headers {
+		hm := &apiv3_route.HeaderMatcher{Name: string(header.Name)}
+		headerType := gwv1.GRPCHeaderMatchExact
+		if header.Type != nil {
+			headerType = *header.Type
+		}
+		switch headerType {
+		case gwv1.GRPCHeaderMatchExact:
+			hm.HeaderMatchSpecifier = &apiv3_route.HeaderMatcher_ExactMatch{ExactMatch: header.Value}
+		case gwv1.GRPCHeaderMatchRegularExpression:
+			hm.HeaderMatchSpecifier = &apiv3_route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: regexMatcher(header.Value)}
+		default:
+			return nil, errors.Errorf("unknown header match type: %s", headerType)
+		}
+		result.Headers = append(result.Headers, hm)
+	}
+
+	return result, nil
+}
+
+// Compile_TCPRouteV1 compiles a TCPRoute into the backends that TCP listeners, and TLS listeners
+// that terminate TLS, proxy connections to.
+func Compile_TCPRouteV1(tcpRoute *gwv1alpha2.TCPRoute, query Query) (*CompiledConfig, error) {
+	var rules [][]gwv1.BackendRef
+	for _, rule := range tcpRoute.Spec.Rules {
+		rules = append(rules, rule.BackendRefs)
+	}
+	from := Referrer{GroupKind: tcpRouteGroupKind, Namespace: tcpRoute.Namespace, Query: query}
+	return compileConnectionRouteV1(tcpRoute, from, tcpRoute.Spec.ParentRefs, nil, rules), nil
+}
+
+// Compile_TLSRouteV1 compiles a TLSRoute into the backends that TLS listeners that pass TLS
+// through proxy the connections for its hostnames to.
+func Compile_TLSRouteV1(tlsRoute *gwv1alpha2.TLSRoute, query Query) (*CompiledConfig, error) {
+	var rules [][]gwv1.BackendRef
+	for _, rule := range tlsRoute.Spec.Rules {
+		rules = append(rules, rule.BackendRefs)
+	}
+	from := Referrer{GroupKind: tlsRouteGroupKind, Namespace: tlsRoute.Namespace, Query: query}
+	return compileConnectionRouteV1(tlsRoute, from, tlsRoute.Spec.ParentRefs, tlsRoute.Spec.Hostnames, rules), nil
+}
+
+// Compile_UDPRouteV1 compiles a UDPRoute into the backend that UDP listeners proxy datagrams to.
+// Envoy can only proxy UDP to one cluster, so a UDPRoute with more than one backend isn't
+// accepted.
+func Compile_UDPRouteV1(udpRoute *gwv1alpha2.UDPRoute, query Query) (*CompiledConfig, error) {
+	var rules [][]gwv1.BackendRef
+	for _, rule := range udpRoute.Spec.Rules {
+		rules = append(rules, rule.BackendRefs)
+	}
+	from := Referrer{GroupKind: udpRouteGroupKind, Namespace: udpRoute.Namespace, Query: query}
+	config := compileConnectionRouteV1(udpRoute, from, udpRoute.Spec.ParentRefs, nil, rules)
+	route := config.Routes[0]
+	weighted := 0
+	for _, backend := range route.Backends {
+		if backend.Weight.GetValue() > 0 {
+			weighted++
+		}
+	}
+	if weighted > 1 {
+		route.Error = "a UDPRoute can only have one backend"
+		route.Reason = string(gwv1.RouteReasonUnsupportedValue)
+		route.Backends = nil
+	}
+	return config, nil
+}
+
+// compileConnectionRouteV1 compiles a route that proxies whole connections to the backends of all
+// of its rules, in proportion to their weights.
+func compileConnectionRouteV1(resource kates.Object, from Referrer, parentRefs []gwv1.ParentReference, hostnames []gwv1.Hostname, rules [][]gwv1.BackendRef) *CompiledConfig {
+	src := SourceFromResource(resource)
+	clusterRefs := []*ClusterRef{}
+	var backends []*apiv3_route.WeightedCluster_ClusterWeight
+	for idx, backendRefs := range rules {
+		s := Sourcef("rule %d in %s", idx, src)
+		for jdx, ref := range backendRefs {
+			cluster := Compile_BackendRefV1(Sourcef("backendRef %d in %s", jdx, s), ref, from, &clusterRefs)
+			if cluster != nil {
+				backends = append(backends, cluster)
+			}
+		}
+	}
+
+	var compiledHostnames []string
+	for _, hostname := range hostnames {
+		compiledHostnames = append(compiledHostnames, string(hostname))
+	}
+
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{
+			{
+				CompiledItem: CompiledItem{Source: src, Namespace: from.Namespace},
+				GroupKind:    from.GroupKind,
+				ParentRefs:   compileParentRefs(from.Namespace, parentRefs),
+				Hostnames:    compiledHostnames,
+				ClusterRefs:  clusterRefs,
+				Backends:     backends,
+			},
+		},
+	}
+}
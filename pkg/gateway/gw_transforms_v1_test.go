@@ -0,0 +1,1098 @@
+package gateway_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+
+	apiv3_cluster "github.com/datawire/ambassador/v2/pkg/api/envoy/config/cluster/v3"
+	apiv3_listener "github.com/datawire/ambassador/v2/pkg/api/envoy/config/listener/v3"
+	apiv3_route "github.com/datawire/ambassador/v2/pkg/api/envoy/config/route/v3"
+	apiv3_tcpproxy "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/network/tcp_proxy/v3"
+	apiv3_udpproxy "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/filters/udp/udp_proxy/v3"
+	apiv3_tls "github.com/datawire/ambassador/v2/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+	gwv1alpha2 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1alpha2"
+	gwv1beta1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1beta1"
+	ecp_cache_types "github.com/datawire/ambassador/v2/pkg/envoy-control-plane/cache/types"
+	"github.com/datawire/ambassador/v2/pkg/gateway"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+	"github.com/datawire/dlib/dlog"
+)
+
+const gatewayV1 = `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: wildcard
+    protocol: HTTP
+    port: 8080
+    hostname: "*.example.com"
+  - name: bar
+    protocol: HTTP
+    port: 8080
+    hostname: bar.example.com
+    allowedRoutes:
+      namespaces:
+        from: Selector
+        selector:
+          matchLabels:
+            team: bar
+  - name: tcp
+    protocol: TCP
+    port: 9090
+`
+
+func TestGatewayV1Attachment(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d := makeDispatcherV1(t)
+
+	require.NoError(t, d.UpsertYaml(gatewayV1+`
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1beta1
+metadata:
+  name: foo
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - foo.example.com
+  - foo.example.net
+  rules:
+  - backendRefs:
+    - name: foo-v1
+      port: 80
+      weight: 1
+    - name: foo-v2
+      port: 80
+      weight: 3
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: bar
+  namespace: bar
+spec:
+  parentRefs:
+  - name: my-gateway
+    namespace: default
+    sectionName: bar
+  rules:
+  - matches:
+    - path:
+        type: Exact
+        value: /bar
+    backendRefs:
+    - name: bar
+      port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: elsewhere
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - elsewhere.example.net
+  rules:
+  - backendRefs:
+    - name: elsewhere
+      port: 80
+`))
+
+	// There is one envoy Listener for the HTTP port, and none for the TCP listener, since there
+	// are no TCPRoutes for it to send connections to.
+	l := d.GetListener(ctx, "default-my-gateway-8080")
+	require.NotNil(t, l)
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-9090-tcp"))
+	assert.Empty(t, d.GetErrors())
+
+	// The foo route only gets the hostname it has in common with the listener, and the bar route
+	// isn't there until its namespace has the right labels. The elsewhere route has no hostnames
+	// in common with the listener.
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+	assert.Equal(t, map[string]int{"foo.example.com": 1}, vhostRouteCounts(rc))
+
+	foo := rc.VirtualHosts[0].Routes[0]
+	assert.Equal(t, "/", foo.Match.GetPrefix())
+	wc := foo.GetRoute().GetWeightedClusters()
+	require.NotNil(t, wc)
+	assert.Equal(t, uint32(4), wc.TotalWeight.Value)
+	require.Len(t, wc.Clusters, 2)
+	assert.Equal(t, "default_foo-v1_80", wc.Clusters[0].Name)
+	assert.Equal(t, uint32(1), wc.Clusters[0].Weight.Value)
+	assert.Equal(t, "default_foo-v2_80", wc.Clusters[1].Name)
+	assert.Equal(t, uint32(3), wc.Clusters[1].Weight.Value)
+	assert.True(t, d.IsWatched("default", "foo-v1"))
+
+	d.SetNamespaces([]*kates.Namespace{
+		{ObjectMeta: kates.ObjectMeta{Name: "default"}},
+		{ObjectMeta: kates.ObjectMeta{Name: "bar", Labels: map[string]string{"team": "bar"}}},
+	})
+	rc = d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+	assert.Equal(t, map[string]int{"foo.example.com": 1, "bar.example.com": 1}, vhostRouteCounts(rc))
+	assert.True(t, d.IsWatched("bar", "bar"))
+}
+
+func TestGatewayV1GeneralHostnames(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d := makeDispatcherV1(t)
+
+	require.NoError(t, d.UpsertYaml(`
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: specific
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: http
+  hostnames:
+  - foo.example.com
+  rules:
+  - backendRefs:
+    - name: foo
+      port: 80
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: wildcard
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    port: 8080
+  hostnames:
+  - "*.example.com"
+  rules:
+  - backendRefs:
+    - name: wildcard
+      port: 80
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: everything
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - backendRefs:
+    - name: everything
+      port: 80
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: wrong-section
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: https
+  rules:
+  - backendRefs:
+    - name: wrong
+      port: 80
+`))
+
+	// More specific hostnames get the routes of the more general ones too, after their own.
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+	assert.Equal(t, map[string]int{"*": 1, "*.example.com": 2, "foo.example.com": 3}, vhostRouteCounts(rc))
+	for _, vh := range rc.VirtualHosts {
+		if vh.Domains[0] == "foo.example.com" {
+			assert.Equal(t, "default_foo_80", vh.Routes[0].GetRoute().GetWeightedClusters().Clusters[0].Name)
+			assert.Equal(t, "default_wildcard_80", vh.Routes[1].GetRoute().GetWeightedClusters().Clusters[0].Name)
+			assert.Equal(t, "default_everything_80", vh.Routes[2].GetRoute().GetWeightedClusters().Clusters[0].Name)
+		}
+	}
+}
+
+func TestHTTPRouteV1Matches(t *testing.T) {
+	t.Parallel()
+	route, ok := mustParseOne(t, `
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: matches
+  namespace: default
+spec:
+  rules:
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo/
+      headers:
+      - name: version
+        value: "2"
+      - name: flavor
+        type: RegularExpression
+        value: "choc.*"
+      queryParams:
+      - name: debug
+        value: "true"
+      method: POST
+  - backendRefs:
+    - name: other
+      namespace: elsewhere
+      port: 80
+`).(*gwv1.HTTPRoute)
+	require.True(t, ok)
+
+	config, err := gateway.Compile_HTTPRouteV1(route, nil)
+	require.NoError(t, err)
+	require.Len(t, config.Routes, 1)
+	routes := config.Routes[0].Routes
+	require.Len(t, routes, 2)
+
+	match := routes[0].Match
+	assert.Equal(t, "/foo(/.*)?", match.GetSafeRegex().Regex)
+	require.Len(t, match.Headers, 3)
+	assert.Equal(t, "version", match.Headers[0].Name)
+	assert.Equal(t, "2", match.Headers[0].GetExactMatch())
+	assert.Equal(t, "flavor", match.Headers[1].Name)
+	assert.Equal(t, "choc.*", match.Headers[1].GetSafeRegexMatch().Regex)
+	assert.Equal(t, ":method", match.Headers[2].Name)
+	assert.Equal(t, "POST", match.Headers[2].GetExactMatch())
+	require.Len(t, match.QueryParameters, 1)
+	assert.Equal(t, "debug", match.QueryParameters[0].Name)
+	assert.Equal(t, "true", match.QueryParameters[0].GetStringMatch().GetExact())
+
+	// Neither rule has anywhere to send requests: the first has no backendRefs, and the second
+	// has a backend in another namespace.
+	assert.Equal(t, uint32(500), routes[0].GetDirectResponse().Status)
+	assert.Equal(t, uint32(500), routes[1].GetDirectResponse().Status)
+	refs := config.Routes[0].ClusterRefs
+	require.Len(t, refs, 1)
+	assert.Equal(t, "backendRef 0 in rule 1 in HTTPRoute matches.default", refs[0].Source.Location())
+	assert.Equal(t, "backend other.elsewhere is in another namespace, and no ReferenceGrant allows referring to it", refs[0].Error)
+}
+
+func TestHTTPRouteV1ReferenceGrant(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d := makeDispatcherV1(t)
+
+	require.NoError(t, d.UpsertYaml(gatewayV1+`
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: foo
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - foo.example.com
+  rules:
+  - backendRefs:
+    - name: shared
+      namespace: other
+      port: 80
+`))
+	route := func() *apiv3_route.Route {
+		rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+		require.NotNil(t, rc)
+		require.Len(t, rc.VirtualHosts, 1)
+		require.Len(t, rc.VirtualHosts[0].Routes, 1)
+		return rc.VirtualHosts[0].Routes[0]
+	}
+	grant := func(fromNamespace string) string {
+		return `
+kind: ReferenceGrant
+apiVersion: gateway.networking.k8s.io/v1beta1
+metadata:
+  name: shared
+  namespace: other
+spec:
+  from:
+  - group: gateway.networking.k8s.io
+    kind: HTTPRoute
+    namespace: ` + fromNamespace + `
+  to:
+  - group: ""
+    kind: Service
+    name: shared
+`
+	}
+
+	// Without a ReferenceGrant, the backend can't be used.
+	assert.Equal(t, uint32(500), route().GetDirectResponse().GetStatus())
+
+	// A ReferenceGrant for routes in some other namespace doesn't help.
+	require.NoError(t, d.UpsertYaml(grant("elsewhere")))
+	assert.Equal(t, uint32(500), route().GetDirectResponse().GetStatus())
+
+	// Once the route's namespace is granted access, requests go to the backend.
+	require.NoError(t, d.UpsertYaml(grant("default")))
+	clusters := route().GetRoute().GetWeightedClusters().GetClusters()
+	require.Len(t, clusters, 1)
+	assert.Equal(t, "other_shared_80", clusters[0].Name)
+	_, snap := d.GetSnapshot(ctx)
+	var serviceNames []string
+	for _, c := range snap.Resources[ecp_cache_types.Cluster].Items {
+		serviceNames = append(serviceNames, c.(*apiv3_cluster.Cluster).EdsClusterConfig.ServiceName)
+	}
+	assert.Equal(t, []string{"k8s/other/shared/80"}, serviceNames)
+
+	// And when the grant goes away, so does the access.
+	d.DeleteKey(gateway.ReferenceGrantKind, "other", "shared")
+	assert.Equal(t, uint32(500), route().GetDirectResponse().GetStatus())
+}
+
+func TestHTTPRouteV1Filters(t *testing.T) {
+	t.Parallel()
+	route, ok := mustParseOne(t, `
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: filters
+  namespace: default
+spec:
+  rules:
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /foo
+    filters:
+    - type: RequestHeaderModifier
+      requestHeaderModifier:
+        set:
+        - name: x-set
+          value: a
+        add:
+        - name: x-add
+          value: b
+        remove: [x-remove]
+    - type: ResponseHeaderModifier
+      responseHeaderModifier:
+        add:
+        - name: x-response
+          value: c
+    - type: URLRewrite
+      urlRewrite:
+        hostname: bar.example.com
+        path:
+          type: ReplacePrefixMatch
+          replacePrefixMatch: /bar
+    - type: RequestMirror
+      requestMirror:
+        backendRef:
+          name: mirror
+          port: 8080
+    backendRefs:
+    - name: foo
+      port: 80
+  - matches:
+    - path:
+        type: Exact
+        value: /old
+    filters:
+    - type: RequestRedirect
+      requestRedirect:
+        scheme: https
+        hostname: new.example.com
+        statusCode: 301
+        path:
+          type: ReplaceFullPath
+          replaceFullPath: /new
+  - matches:
+    - path:
+        type: Exact
+        value: /exact
+    filters:
+    - type: URLRewrite
+      urlRewrite:
+        path:
+          type: ReplacePrefixMatch
+          replacePrefixMatch: /bar
+    backendRefs:
+    - name: foo
+      port: 80
+  - filters:
+    - type: ExtensionRef
+      extensionRef:
+        group: example.com
+        kind: Thing
+        name: thing
+    backendRefs:
+    - name: foo
+      port: 80
+`).(*gwv1.HTTPRoute)
+	require.True(t, ok)
+
+	config, err := gateway.Compile_HTTPRouteV1(route, nil)
+	require.NoError(t, err)
+	require.Len(t, config.Routes, 1)
+	routes := config.Routes[0].Routes
+	require.Len(t, routes, 4)
+
+	rewrite := routes[0]
+	require.Len(t, rewrite.RequestHeadersToAdd, 2)
+	assert.Equal(t, "x-set", rewrite.RequestHeadersToAdd[0].Header.Key)
+	assert.False(t, rewrite.RequestHeadersToAdd[0].Append.Value)
+	assert.Equal(t, "x-add", rewrite.RequestHeadersToAdd[1].Header.Key)
+	assert.True(t, rewrite.RequestHeadersToAdd[1].Append.Value)
+	assert.Equal(t, []string{"x-remove"}, rewrite.RequestHeadersToRemove)
+	require.Len(t, rewrite.ResponseHeadersToAdd, 1)
+	assert.Equal(t, "c", rewrite.ResponseHeadersToAdd[0].Header.Value)
+	action := rewrite.GetRoute()
+	require.NotNil(t, action)
+	assert.Equal(t, "bar.example.com", action.GetHostRewriteLiteral())
+	assert.Equal(t, "^/foo", action.RegexRewrite.Pattern.Regex)
+	assert.Equal(t, "/bar", action.RegexRewrite.Substitution)
+	require.Len(t, action.RequestMirrorPolicies, 1)
+	assert.Equal(t, "default_mirror_8080", action.RequestMirrorPolicies[0].Cluster)
+
+	redirect := routes[1].GetRedirect()
+	require.NotNil(t, redirect)
+	assert.Equal(t, "https", redirect.GetSchemeRedirect())
+	assert.Equal(t, "new.example.com", redirect.HostRedirect)
+	assert.Equal(t, "/new", redirect.GetPathRedirect())
+	assert.Equal(t, apiv3_route.RedirectAction_MOVED_PERMANENTLY, redirect.ResponseCode)
+
+	// Rules with filters that can't be applied return a 500.
+	assert.Equal(t, uint32(500), routes[2].GetDirectResponse().Status)
+	assert.Equal(t, uint32(500), routes[3].GetDirectResponse().Status)
+
+	var refs []string
+	for _, ref := range config.Routes[0].ClusterRefs {
+		refs = append(refs, ref.Name)
+	}
+	assert.Contains(t, refs, "default_mirror_8080")
+
+	var errs []string
+	for _, f := range config.Routes[0].Filters {
+		if f.Error != "" {
+			assert.Equal(t, "UnsupportedValue", f.Reason)
+			errs = append(errs, f.Source.Location()+": "+f.Error)
+		}
+	}
+	assert.Equal(t, []string{
+		"filter 0 in rule 2 in HTTPRoute filters.default: ReplacePrefixMatch requires a PathPrefix path match",
+		`filter 0 in rule 3 in HTTPRoute filters.default: unsupported filter type: "ExtensionRef"`,
+	}, errs)
+}
+
+func TestHTTPRouteV1BadMatchTypes(t *testing.T) {
+	t.Parallel()
+	d := makeDispatcherV1(t)
+	err := d.UpsertYaml(`
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-route
+  namespace: default
+spec:
+  rules:
+  - matches:
+    - path:
+        type: Blah
+        value: /exact
+`)
+	assertErrorContains(t, err, `processing HTTPRoute.gateway.networking.k8s.io:default:my-route: unknown path match type: "Blah"`)
+}
+
+func TestGRPCRouteV1(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d := makeDispatcherV1(t)
+
+	require.NoError(t, d.UpsertYaml(gatewayV1+`
+---
+kind: GRPCRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: greeter
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - grpc.example.com
+  rules:
+  - matches:
+    - method:
+        service: helloworld.Greeter
+        method: SayHello
+      headers:
+      - name: tenant
+        value: a
+    backendRefs:
+    - name: greeter
+      port: 9000
+  - matches:
+    - method:
+        service: helloworld.Greeter
+    - method:
+        type: RegularExpression
+        method: "Say.*"
+    backendRefs:
+    - name: greeter
+      port: 9000
+  - {}
+`))
+
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-8080")
+	require.NotNil(t, rc)
+	require.Len(t, rc.VirtualHosts, 1)
+	assert.Equal(t, []string{"grpc.example.com"}, rc.VirtualHosts[0].Domains)
+	routes := rc.VirtualHosts[0].Routes
+	require.Len(t, routes, 4)
+	for _, r := range routes {
+		assert.NotNil(t, r.Match.Grpc)
+	}
+	assert.Equal(t, "/helloworld.Greeter/SayHello", routes[0].Match.GetPath())
+	require.Len(t, routes[0].Match.Headers, 1)
+	assert.Equal(t, "a", routes[0].Match.Headers[0].GetExactMatch())
+	assert.Equal(t, "/helloworld.Greeter/", routes[1].Match.GetPrefix())
+	assert.Equal(t, "/[^/]+/Say.*", routes[2].Match.GetSafeRegex().Regex)
+	// A rule with no matches matches every gRPC request, but this one has nowhere to send them.
+	assert.Equal(t, "/", routes[3].Match.GetPrefix())
+	assert.Equal(t, uint32(500), routes[3].GetDirectResponse().Status)
+	assert.Equal(t, "default_greeter_9000_http2", routes[0].GetRoute().GetWeightedClusters().Clusters[0].Name)
+
+	// gRPC backends are spoken to over HTTP/2.
+	_, snap := d.GetSnapshot(ctx)
+	clusters := snap.Resources[ecp_cache_types.Cluster].Items
+	require.Len(t, clusters, 1)
+	cluster := clusters["default_greeter_9000_http2"].(*apiv3_cluster.Cluster)
+	assert.NotNil(t, cluster.Http2ProtocolOptions)
+	assert.Equal(t, "k8s/default/greeter/9000", cluster.EdsClusterConfig.ServiceName)
+
+	var errs []string
+	for _, item := range d.GetErrors() {
+		errs = append(errs, item.Error)
+	}
+	assert.Empty(t, errs)
+}
+
+func TestGRPCRouteV1BadMethodMatch(t *testing.T) {
+	t.Parallel()
+	d := makeDispatcherV1(t)
+	err := d.UpsertYaml(`
+---
+kind: GRPCRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-route
+  namespace: default
+spec:
+  rules:
+  - matches:
+    - method:
+        type: RegularExpression
+`)
+	assertErrorContains(t, err, `processing GRPCRoute.gateway.networking.k8s.io:default:my-route: a method match requires a service or a method`)
+}
+
+const gatewayV1TLS = `
+---
+kind: Secret
+apiVersion: v1
+metadata:
+  name: tls-cert
+  namespace: default
+type: kubernetes.io/tls
+data:
+  tls.crt: Y2VydA==
+  tls.key: a2V5
+---
+kind: Secret
+apiVersion: v1
+metadata:
+  name: other-cert
+  namespace: certs
+type: kubernetes.io/tls
+data:
+  tls.crt: Y2VydA==
+  tls.key: a2V5
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: tls-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: foo
+    protocol: HTTPS
+    port: 8443
+    hostname: foo.example.com
+    tls:
+      certificateRefs:
+      - name: tls-cert
+  - name: bar
+    protocol: HTTPS
+    port: 8443
+    hostname: bar.example.com
+    tls:
+      certificateRefs:
+      - name: other-cert
+        namespace: certs
+  - name: missing
+    protocol: HTTPS
+    port: 8443
+    hostname: missing.example.com
+    tls:
+      certificateRefs:
+      - name: missing-cert
+  - name: foo-again
+    protocol: HTTPS
+    port: 8443
+    hostname: foo.example.com
+    tls:
+      certificateRefs:
+      - name: tls-cert
+  - name: http
+    protocol: HTTP
+    port: 8443
+  - name: passthrough
+    protocol: TLS
+    port: 8443
+    hostname: "*.passthrough.example.com"
+    tls:
+      mode: Passthrough
+  - name: terminate
+    protocol: TLS
+    port: 9443
+    tls:
+      certificateRefs:
+      - name: tls-cert
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: foo
+  namespace: default
+spec:
+  parentRefs:
+  - name: tls-gateway
+  rules:
+  - backendRefs:
+    - name: foo
+      port: 80
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: bar
+  namespace: default
+spec:
+  parentRefs:
+  - name: tls-gateway
+    sectionName: bar
+  rules:
+  - backendRefs:
+    - name: bar
+      port: 80
+`
+
+const referenceGrantV1Certs = `
+---
+kind: ReferenceGrant
+apiVersion: gateway.networking.k8s.io/v1beta1
+metadata:
+  name: gateway-certs
+  namespace: certs
+spec:
+  from:
+  - group: gateway.networking.k8s.io
+    kind: Gateway
+    namespace: default
+  to:
+  - group: ""
+    kind: Secret
+`
+
+func TestGatewayV1TLSListeners(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d := makeDispatcherV1(t)
+	require.NoError(t, d.UpsertYaml(gatewayV1TLS))
+
+	errs := map[string]string{}
+	for _, item := range d.GetErrors() {
+		errs[item.Source.Location()] = item.Error
+	}
+	assert.Equal(t, map[string]string{
+		"listener bar in Gateway tls-gateway.default":       "secret other-cert.certs is in another namespace, and no ReferenceGrant allows referring to it",
+		"listener missing in Gateway tls-gateway.default":   "secret missing-cert.default doesn't exist, or has no tls.crt and tls.key",
+		"listener foo-again in Gateway tls-gateway.default": `hostname "foo.example.com" is already used by another listener on port 8443`,
+		"listener http in Gateway tls-gateway.default":      "protocol HTTP conflicts with protocol HTTPS on port 8443",
+	}, errs)
+
+	// Each HTTPS listener gets a filter chain for its hostname, which terminates TLS with the
+	// certificate that ambex serves over SDS, and routes with its own RouteConfiguration. The TLS
+	// listeners have no routes yet, so there's nothing to listen for on 9443.
+	l := d.GetListener(ctx, "default-tls-gateway-8443-foo")
+	require.NotNil(t, l)
+	require.Len(t, l.ListenerFilters, 1)
+	assert.Equal(t, "envoy.filters.listener.tls_inspector", l.ListenerFilters[0].Name)
+	require.Len(t, l.FilterChains, 1)
+	assert.Equal(t, []string{"foo.example.com"}, l.FilterChains[0].FilterChainMatch.ServerNames)
+	assert.Equal(t, []string{"tls-cert.default"}, sdsSecretNames(t, l.FilterChains[0]))
+	assert.Nil(t, d.GetListener(ctx, "default-tls-gateway-9443-terminate"))
+
+	rc := d.GetRouteConfiguration(ctx, "default-tls-gateway-8443-foo")
+	require.NotNil(t, rc)
+	assert.Equal(t, map[string]int{"foo.example.com": 1}, vhostRouteCounts(rc))
+	assert.Nil(t, d.GetRouteConfiguration(ctx, "default-tls-gateway-8443-bar"))
+
+	// Once the bar listener may use the certificate in the certs namespace, it gets a filter chain
+	// of its own, and the bar route is only served there.
+	require.NoError(t, d.UpsertYaml(referenceGrantV1Certs))
+	l = d.GetListener(ctx, "default-tls-gateway-8443-bar")
+	require.NotNil(t, l)
+	require.Len(t, l.FilterChains, 2)
+	assert.Equal(t, []string{"bar.example.com"}, l.FilterChains[0].FilterChainMatch.ServerNames)
+	assert.Equal(t, []string{"other-cert.certs"}, sdsSecretNames(t, l.FilterChains[0]))
+	assert.Equal(t, []string{"foo.example.com"}, l.FilterChains[1].FilterChainMatch.ServerNames)
+
+	rc = d.GetRouteConfiguration(ctx, "default-tls-gateway-8443-bar")
+	require.NotNil(t, rc)
+	assert.Equal(t, map[string]int{"bar.example.com": 2}, vhostRouteCounts(rc))
+}
+
+func TestCertificateRefsV1(t *testing.T) {
+	t.Parallel()
+	var gw *gwv1.Gateway
+	var grant *gwv1beta1.ReferenceGrant
+	objs, err := kates.ParseManifests(gatewayV1TLS + referenceGrantV1Certs)
+	require.NoError(t, err)
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *gwv1.Gateway:
+			gw = o
+		case *gwv1beta1.ReferenceGrant:
+			grant = o
+		}
+	}
+
+	// Secrets in other namespaces don't get loaded without a ReferenceGrant.
+	tlsCert := types.NamespacedName{Namespace: "default", Name: "tls-cert"}
+	missingCert := types.NamespacedName{Namespace: "default", Name: "missing-cert"}
+	otherCert := types.NamespacedName{Namespace: "certs", Name: "other-cert"}
+	assert.Equal(t, []types.NamespacedName{tlsCert, missingCert, tlsCert, tlsCert},
+		gateway.CertificateRefsV1(gw, nil))
+	assert.Equal(t, []types.NamespacedName{tlsCert, otherCert, missingCert, tlsCert, tlsCert},
+		gateway.CertificateRefsV1(gw, []*gwv1beta1.ReferenceGrant{grant}))
+}
+
+const gatewayV1Connections = `
+---
+kind: Secret
+apiVersion: v1
+metadata:
+  name: db-cert
+  namespace: default
+type: kubernetes.io/tls
+data:
+  tls.crt: Y2VydA==
+  tls.key: a2V5
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: conn-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: tcp
+    protocol: TCP
+    port: 9000
+  - name: udp
+    protocol: UDP
+    port: 9000
+  - name: passthrough
+    protocol: TLS
+    port: 9443
+    hostname: "*.example.com"
+    tls:
+      mode: Passthrough
+    allowedRoutes:
+      namespaces:
+        from: All
+  - name: terminate
+    protocol: TLS
+    port: 9444
+    hostname: db.example.com
+    tls:
+      certificateRefs:
+      - name: db-cert
+  - name: custom
+    protocol: example.com/custom
+    port: 9999
+---
+kind: TCPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: db
+  namespace: default
+spec:
+  parentRefs:
+  - name: conn-gateway
+    sectionName: tcp
+  rules:
+  - backendRefs:
+    - name: db
+      port: 5432
+      weight: 3
+    - name: db-canary
+      port: 5432
+      weight: 1
+---
+kind: TCPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: secure-db
+  namespace: default
+spec:
+  parentRefs:
+  - name: conn-gateway
+    sectionName: terminate
+  rules:
+  - backendRefs:
+    - name: db
+      port: 5432
+---
+kind: TLSRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: web
+  namespace: default
+spec:
+  parentRefs:
+  - name: conn-gateway
+  hostnames:
+  - foo.example.com
+  rules:
+  - backendRefs:
+    - name: web
+      port: 443
+---
+kind: TLSRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: web
+  namespace: other
+spec:
+  parentRefs:
+  - name: conn-gateway
+    namespace: default
+  hostnames:
+  - bar.example.com
+  rules:
+  - backendRefs:
+    - name: web
+      port: 443
+---
+kind: UDPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: dns
+  namespace: default
+spec:
+  parentRefs:
+  - name: conn-gateway
+  rules:
+  - backendRefs:
+    - name: dns
+      port: 53
+---
+kind: UDPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: dns-pair
+  namespace: default
+spec:
+  parentRefs:
+  - name: conn-gateway
+  rules:
+  - backendRefs:
+    - name: dns
+      port: 53
+    - name: other-dns
+      port: 53
+---
+kind: UDPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: dns-spare
+  namespace: default
+spec:
+  parentRefs:
+  - name: conn-gateway
+  rules:
+  - backendRefs:
+    - name: other-dns
+      port: 53
+`
+
+func TestGatewayV1ConnectionRoutes(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d := makeDispatcherV1(t)
+	require.NoError(t, d.UpsertYaml(gatewayV1Connections))
+
+	errs := map[string]string{}
+	for _, item := range d.GetErrors() {
+		errs[item.Source.Location()] = item.Error
+	}
+	assert.Equal(t, map[string]string{
+		"listener custom in Gateway conn-gateway.default": `unsupported protocol: "example.com/custom"`,
+		"UDPRoute dns-pair.default":                       "a UDPRoute can only have one backend",
+	}, errs)
+
+	// TCP connections are split between the weighted backends.
+	l := d.GetListener(ctx, "default-conn-gateway-9000-tcp")
+	require.NotNil(t, l)
+	require.Len(t, l.FilterChains, 1)
+	clusters := tcpProxyClusters(t, l.FilterChains[0])
+	assert.Equal(t, map[string]uint32{"default_db_5432": 3, "default_db-canary_5432": 1}, clusters)
+
+	// UDP gets a listener of its own on the same port, which only the first route without errors
+	// gets.
+	l = d.GetListener(ctx, "default-conn-gateway-9000-udp")
+	require.NotNil(t, l)
+	require.Len(t, l.ListenerFilters, 1)
+	udpProxy := &apiv3_udpproxy.UdpProxyConfig{}
+	require.NoError(t, l.ListenerFilters[0].GetTypedConfig().UnmarshalTo(udpProxy))
+	assert.Equal(t, "default_dns_53", udpProxy.GetCluster())
+
+	// Passed-through TLS connections go to the backends of the TLSRoute for their SNI. The routes
+	// in different namespaces have services with the same name, so their clusters have the
+	// namespace in their name.
+	l = d.GetListener(ctx, "default-conn-gateway-9443-passthrough")
+	require.NotNil(t, l)
+	require.Len(t, l.FilterChains, 2)
+	assert.Equal(t, []string{"foo.example.com"}, l.FilterChains[0].FilterChainMatch.ServerNames)
+	assert.Nil(t, l.FilterChains[0].TransportSocket)
+	assert.Equal(t, map[string]uint32{"default_web_443": 1}, tcpProxyClusters(t, l.FilterChains[0]))
+	assert.Equal(t, []string{"bar.example.com"}, l.FilterChains[1].FilterChainMatch.ServerNames)
+	assert.Equal(t, map[string]uint32{"other_web_443": 1}, tcpProxyClusters(t, l.FilterChains[1]))
+	assert.True(t, d.IsWatched("other", "web"))
+
+	// Terminated TLS connections are proxied to the backends of TCPRoutes.
+	l = d.GetListener(ctx, "default-conn-gateway-9444-terminate")
+	require.NotNil(t, l)
+	require.Len(t, l.FilterChains, 1)
+	assert.Equal(t, []string{"db.example.com"}, l.FilterChains[0].FilterChainMatch.ServerNames)
+	assert.Equal(t, []string{"db-cert.default"}, sdsSecretNames(t, l.FilterChains[0]))
+	assert.Equal(t, map[string]uint32{"default_db_5432": 1}, tcpProxyClusters(t, l.FilterChains[0]))
+}
+
+// tcpProxyClusters returns the weights of the clusters that a filter chain proxies connections to.
+func tcpProxyClusters(t *testing.T, fc *apiv3_listener.FilterChain) map[string]uint32 {
+	require.Len(t, fc.Filters, 1)
+	var tcpProxy apiv3_tcpproxy.TcpProxy
+	require.NoError(t, fc.Filters[0].GetTypedConfig().UnmarshalTo(&tcpProxy))
+	if cluster := tcpProxy.GetCluster(); cluster != "" {
+		return map[string]uint32{cluster: 1}
+	}
+	clusters := map[string]uint32{}
+	for _, c := range tcpProxy.GetWeightedClusters().GetClusters() {
+		clusters[c.Name] = c.Weight
+	}
+	return clusters
+}
+
+// sdsSecretNames returns the names of the SDS certificates that a filter chain terminates TLS with.
+func sdsSecretNames(t *testing.T, fc *apiv3_listener.FilterChain) []string {
+	require.NotNil(t, fc.TransportSocket)
+	var tlsContext apiv3_tls.DownstreamTlsContext
+	require.NoError(t, fc.TransportSocket.GetTypedConfig().UnmarshalTo(&tlsContext))
+	var names []string
+	for _, sds := range tlsContext.CommonTlsContext.TlsCertificateSdsSecretConfigs {
+		names = append(names, sds.Name)
+	}
+	return names
+}
+
+func makeDispatcherV1(t *testing.T) *gateway.Dispatcher {
+	d := gateway.NewDispatcher()
+	err := d.RegisterTransform("Gateway.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_GatewayV1(untyped.(*gwv1.Gateway), query)
+	})
+	require.NoError(t, err)
+	err = d.RegisterTransform("HTTPRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_HTTPRouteV1(untyped.(*gwv1.HTTPRoute), query)
+	})
+	require.NoError(t, err)
+	err = d.RegisterTransform("GRPCRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_GRPCRouteV1(untyped.(*gwv1.GRPCRoute), query)
+	})
+	require.NoError(t, err)
+	err = d.RegisterTransform("TCPRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TCPRouteV1(untyped.(*gwv1alpha2.TCPRoute), query)
+	})
+	require.NoError(t, err)
+	err = d.RegisterTransform("TLSRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_TLSRouteV1(untyped.(*gwv1alpha2.TLSRoute), query)
+	})
+	require.NoError(t, err)
+	err = d.RegisterTransform("UDPRoute.gateway.networking.k8s.io", func(untyped kates.Object, query gateway.Query) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_UDPRouteV1(untyped.(*gwv1alpha2.UDPRoute), query)
+	})
+	require.NoError(t, err)
+	err = d.RegisterQueryable(gateway.ReferenceGrantKind)
+	require.NoError(t, err)
+	err = d.RegisterQueryable(gateway.SecretKind)
+	require.NoError(t, err)
+	return d
+}
+
+func mustParseOne(t *testing.T, manifest string) kates.Object {
+	objs, err := kates.ParseManifests(manifest)
+	require.NoError(t, err)
+	require.Len(t, objs, 1)
+	return objs[0]
+}
+
+// vhostRouteCounts returns the number of routes in each VirtualHost, by domain.
+func vhostRouteCounts(rc *apiv3_route.RouteConfiguration) map[string]int {
+	counts := map[string]int{}
+	for _, vh := range rc.VirtualHosts {
+		for _, domain := range vh.Domains {
+			counts[domain] = len(vh.Routes)
+		}
+	}
+	return counts
+}
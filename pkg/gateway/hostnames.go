@@ -0,0 +1,51 @@
+package gateway
+
+import (
+	"strings"
+)
+
+// hostnameCovers returns true if every host that matches the specific hostname also matches the
+// general one. Hostnames may have a "*." wildcard prefix, which matches one or more labels, and
+// "*" matches every host.
+func hostnameCovers(general, specific string) bool {
+	switch {
+	case general == specific, general == "*":
+		return true
+	case strings.HasPrefix(general, "*."):
+		return len(specific) > len(general)-1 && strings.HasSuffix(specific, general[1:])
+	default:
+		return false
+	}
+}
+
+// intersectHostnames returns the hostnames that a route with the given hostnames serves on a
+// listener with the given hostname. An empty listener hostname or an empty list of route
+// hostnames matches every host. The result is empty if the route doesn't serve any hosts on the
+// listener.
+func intersectHostnames(listener string, route []string) []string {
+	if listener == "" {
+		listener = "*"
+	}
+	if len(route) == 0 {
+		return []string{listener}
+	}
+
+	var result []string
+	seen := map[string]bool{}
+	for _, hostname := range route {
+		var match string
+		switch {
+		case hostnameCovers(listener, hostname):
+			match = hostname
+		case hostnameCovers(hostname, listener):
+			match = listener
+		default:
+			continue
+		}
+		if !seen[match] {
+			seen[match] = true
+			result = append(result, match)
+		}
+	}
+	return result
+}
@@ -0,0 +1,222 @@
+package gateway
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/datawire/ambassador/v2/pkg/kates"
+	"github.com/datawire/dlib/dlog"
+)
+
+// LeaseClient is the part of *kates.Client that the LeaderElector uses.
+type LeaseClient interface {
+	Get(ctx context.Context, resource interface{}, target interface{}) error
+	Create(ctx context.Context, resource interface{}, target interface{}) error
+	Update(ctx context.Context, resource interface{}, target interface{}) error
+}
+
+// LeaderElectorConfig configures a LeaderElector.
+type LeaderElectorConfig struct {
+	// The namespace and name of the coordination.k8s.io Lease.
+	Namespace string
+	Name      string
+	// Identity tells this replica apart from the others, e.g. the pod name.
+	Identity string
+
+	// LeaseDuration is how long the other replicas wait after the last renewal of the Lease
+	// before taking it over. The default is 15 seconds.
+	LeaseDuration time.Duration
+	// RetryPeriod is how often the Lease gets renewed, or checked by the replicas that don't hold
+	// it. The default is 2 seconds.
+	RetryPeriod time.Duration
+}
+
+// A LeaderElector uses a Lease to pick one of several replicas to be the leader, so that only one
+// of them writes status. It is a cut-down version of client-go's leaderelection package that works
+// with the kates client.
+type LeaderElector struct {
+	client LeaseClient
+	config LeaderElectorConfig
+
+	mutex  sync.Mutex
+	leader bool
+
+	changed chan struct{}
+
+	// When we last saw the Lease record change, so that we don't depend on the clocks of the
+	// other replicas.
+	observedRecord kates.LeaseSpec
+	observedTime   time.Time
+	lastErr        string
+}
+
+// NewLeaderElector returns a LeaderElector that isn't the leader until Run acquires the Lease.
+func NewLeaderElector(client LeaseClient, config LeaderElectorConfig) *LeaderElector {
+	if config.LeaseDuration == 0 {
+		config.LeaseDuration = 15 * time.Second
+	}
+	if config.RetryPeriod == 0 {
+		config.RetryPeriod = 2 * time.Second
+	}
+	return &LeaderElector{
+		client:  client,
+		config:  config,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// IsLeader returns true if this replica currently holds the Lease.
+func (le *LeaderElector) IsLeader() bool {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.leader
+}
+
+// Changed returns a channel that is notified whenever IsLeader changes.
+func (le *LeaderElector) Changed() <-chan struct{} {
+	return le.changed
+}
+
+// Run tries to acquire and then keep renewing the Lease until the context is canceled.
+func (le *LeaderElector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(le.config.RetryPeriod)
+	defer ticker.Stop()
+	defer le.setLeader(ctx, false)
+
+	lastRenew := time.Time{}
+	for {
+		now := time.Now()
+		acquired, err := le.tryAcquireOrRenew(ctx, now)
+		switch {
+		case err != nil:
+			if err.Error() != le.lastErr {
+				dlog.Errorf(ctx, "leader election: lease %s.%s: %v", le.config.Name, le.config.Namespace, err)
+				le.lastErr = err.Error()
+			}
+			// Hang on to the Lease through brief outages, but let it go well before the other
+			// replicas think it has expired.
+			if now.Sub(lastRenew) > le.config.LeaseDuration*2/3 {
+				le.setLeader(ctx, false)
+			}
+		case acquired:
+			le.lastErr = ""
+			lastRenew = now
+			le.setLeader(ctx, true)
+		default:
+			le.lastErr = ""
+			le.setLeader(ctx, false)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (le *LeaderElector) setLeader(ctx context.Context, leader bool) {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if le.leader == leader {
+		return
+	}
+	le.leader = leader
+	if leader {
+		dlog.Infof(ctx, "leader election: %s is now the leader", le.config.Identity)
+	} else {
+		dlog.Infof(ctx, "leader election: %s is no longer the leader", le.config.Identity)
+	}
+	select {
+	case le.changed <- struct{}{}:
+	default:
+	}
+}
+
+// tryAcquireOrRenew returns true if this replica holds the Lease afterwards.
+func (le *LeaderElector) tryAcquireOrRenew(ctx context.Context, now time.Time) (bool, error) {
+	durationSeconds := int32(le.config.LeaseDuration / time.Second)
+	if durationSeconds < 1 {
+		durationSeconds = 1
+	}
+	identity := le.config.Identity
+	renewTime := kates.MicroTime{Time: now}
+
+	lease := &kates.Lease{
+		TypeMeta:   kates.TypeMeta{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"},
+		ObjectMeta: kates.ObjectMeta{Namespace: le.config.Namespace, Name: le.config.Name},
+	}
+	err := le.client.Get(ctx, lease, lease)
+	if kates.IsNotFound(err) {
+		lease.Spec = kates.LeaseSpec{
+			HolderIdentity:       &identity,
+			LeaseDurationSeconds: &durationSeconds,
+			AcquireTime:          &renewTime,
+			RenewTime:            &renewTime,
+		}
+		err = le.client.Create(ctx, lease, lease)
+		if err != nil {
+			return false, err
+		}
+		le.observe(lease.Spec, now)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !leaseSpecEqual(lease.Spec, le.observedRecord) {
+		le.observe(lease.Spec, now)
+	}
+	holder := ""
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	if holder != "" && holder != identity && now.Before(le.observedTime.Add(le.config.LeaseDuration)) {
+		return false, nil
+	}
+
+	if holder != identity {
+		transitions := int32(0)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+		lease.Spec.AcquireTime = &renewTime
+	}
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.RenewTime = &renewTime
+	err = le.client.Update(ctx, lease, lease)
+	if kates.IsConflict(err) {
+		// Somebody else got there first.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	le.observe(lease.Spec, now)
+	return true, nil
+}
+
+func (le *LeaderElector) observe(spec kates.LeaseSpec, now time.Time) {
+	le.observedRecord = *spec.DeepCopy()
+	le.observedTime = now
+}
+
+func leaseSpecEqual(a, b kates.LeaseSpec) bool {
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	renew := func(t *kates.MicroTime) time.Time {
+		if t == nil {
+			return time.Time{}
+		}
+		return t.Time
+	}
+	return str(a.HolderIdentity) == str(b.HolderIdentity) && renew(a.RenewTime).Equal(renew(b.RenewTime))
+}
@@ -0,0 +1,132 @@
+package gateway_test
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/datawire/ambassador/v2/pkg/gateway"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+	"github.com/datawire/dlib/dlog"
+)
+
+// fakeLeaseClient stores a single Lease, with the optimistic concurrency of the real thing.
+type fakeLeaseClient struct {
+	mutex sync.Mutex
+	lease *kates.Lease
+}
+
+var leasesResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+
+func (c *fakeLeaseClient) copyLease(from, to interface{}) error {
+	bs, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, to)
+}
+
+func (c *fakeLeaseClient) Get(_ context.Context, resource, target interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.lease == nil {
+		return apierrors.NewNotFound(leasesResource, resource.(*kates.Lease).Name)
+	}
+	return c.copyLease(c.lease, target)
+}
+
+func (c *fakeLeaseClient) Create(_ context.Context, resource, target interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lease := resource.(*kates.Lease)
+	if c.lease != nil {
+		return apierrors.NewAlreadyExists(leasesResource, lease.Name)
+	}
+	c.lease = &kates.Lease{}
+	if err := c.copyLease(lease, c.lease); err != nil {
+		return err
+	}
+	c.lease.ResourceVersion = "1"
+	return c.copyLease(c.lease, target)
+}
+
+func (c *fakeLeaseClient) Update(_ context.Context, resource, target interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lease := resource.(*kates.Lease)
+	if c.lease == nil {
+		return apierrors.NewNotFound(leasesResource, lease.Name)
+	}
+	if lease.ResourceVersion != c.lease.ResourceVersion {
+		return apierrors.NewConflict(leasesResource, lease.Name, nil)
+	}
+	version, _ := strconv.Atoi(c.lease.ResourceVersion)
+	if err := c.copyLease(lease, c.lease); err != nil {
+		return err
+	}
+	c.lease.ResourceVersion = strconv.Itoa(version + 1)
+	return c.copyLease(c.lease, target)
+}
+
+func (c *fakeLeaseClient) holder() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.lease == nil || c.lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *c.lease.Spec.HolderIdentity
+}
+
+func TestLeaderElector(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	client := &fakeLeaseClient{}
+
+	elector := func(identity string) *gateway.LeaderElector {
+		return gateway.NewLeaderElector(client, gateway.LeaderElectorConfig{
+			Namespace:     "default",
+			Name:          "status",
+			Identity:      identity,
+			LeaseDuration: time.Second,
+			RetryPeriod:   50 * time.Millisecond,
+		})
+	}
+	run := func(le *gateway.LeaderElector) (context.CancelFunc, <-chan error) {
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() { done <- le.Run(ctx) }()
+		return cancel, done
+	}
+
+	a := elector("a")
+	cancelA, doneA := run(a)
+	defer cancelA()
+	require.Eventually(t, a.IsLeader, 5*time.Second, 10*time.Millisecond)
+	<-a.Changed()
+
+	b := elector("b")
+	cancelB, doneB := run(b)
+	defer cancelB()
+	// b keeps trying, but a keeps renewing the Lease.
+	time.Sleep(1500 * time.Millisecond)
+	require.True(t, a.IsLeader())
+	require.False(t, b.IsLeader())
+	require.Equal(t, "a", client.holder())
+
+	// Once a goes away, b takes over when the Lease expires.
+	cancelA()
+	require.NoError(t, <-doneA)
+	require.False(t, a.IsLeader())
+	require.Eventually(t, b.IsLeader, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "b", client.holder())
+
+	cancelB()
+	require.NoError(t, <-doneB)
+}
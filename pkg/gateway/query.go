@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/datawire/ambassador/v2/pkg/kates"
+)
+
+// Query lets a transform look up resources other than the ones it is compiling. Kinds are named
+// the same way that they were registered with the Dispatcher, e.g. "Secret" or
+// "ReferenceGrant.gateway.networking.k8s.io".
+//
+// Everything that a transform looks up, including things that turn out not to exist, becomes a
+// dependency of whatever it is compiling, which is compiled again whenever the result of the
+// lookup might have changed.
+type Query interface {
+	// Get returns the resource of the given kind with the given namespace and name, or nil if
+	// there is no such resource.
+	Get(kind, namespace, name string) kates.Object
+
+	// List returns all the resources of the given kind in the given namespace, or in every
+	// namespace if the namespace is "*", in order of their namespaces and names.
+	List(kind, namespace string) []kates.Object
+}
+
+// allNamespaces is the namespace that List takes to mean every namespace.
+const allNamespaces = "*"
+
+// A recordingQuery answers queries from the resources that the Dispatcher knows about, and records
+// the key of each lookup. The key of a List has the name "*", which no resource can have.
+type recordingQuery struct {
+	dispatcher *Dispatcher
+	lookups    map[string]bool
+}
+
+func newRecordingQuery(d *Dispatcher) *recordingQuery {
+	return &recordingQuery{dispatcher: d, lookups: map[string]bool{}}
+}
+
+func (q *recordingQuery) Get(kind, namespace, name string) kates.Object {
+	key := resourceKeyFromParts(kind, namespace, name)
+	q.lookups[key] = true
+	return q.dispatcher.resources[key]
+}
+
+func (q *recordingQuery) List(kind, namespace string) []kates.Object {
+	q.lookups[resourceKeyFromParts(kind, namespace, "*")] = true
+
+	prefix := resourceKeyFromParts(kind, namespace, "")
+	if namespace == allNamespaces {
+		prefix = kind + ":"
+	}
+	var keys []string
+	for key := range q.dispatcher.resources {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := make([]kates.Object, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, q.dispatcher.resources[key])
+	}
+	return result
+}
+
+// keys returns the keys of everything that was looked up.
+func (q *recordingQuery) keys() []string {
+	result := make([]string, 0, len(q.lookups))
+	for key := range q.lookups {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// setDependencies replaces the keys of the lookups that a unit's transform made.
+func (d *Dispatcher) setDependencies(unit string, keys []string) {
+	for _, key := range d.dependencies[unit] {
+		delete(d.dependents[key], unit)
+		if len(d.dependents[key]) == 0 {
+			delete(d.dependents, key)
+		}
+	}
+	if len(keys) == 0 {
+		delete(d.dependencies, unit)
+		return
+	}
+	d.dependencies[unit] = keys
+	for _, key := range keys {
+		if d.dependents[key] == nil {
+			d.dependents[key] = map[string]bool{}
+		}
+		d.dependents[key][unit] = true
+	}
+}
+
+// addDependents adds the units whose transforms looked up the given resource, directly or by
+// listing its kind, to the set of units.
+func (d *Dispatcher) addDependents(units map[string]bool, kind, namespace, name string) {
+	for _, key := range []string{
+		resourceKeyFromParts(kind, namespace, name),
+		resourceKeyFromParts(kind, namespace, "*"),
+		resourceKeyFromParts(kind, allNamespaces, "*"),
+	} {
+		for unit := range d.dependents[key] {
+			units[unit] = true
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	gwv1beta1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1beta1"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+)
+
+// ReferenceGrantKind is the kind that ReferenceGrants must be registered with the Dispatcher as,
+// with RegisterQueryable, for references across namespaces to be allowed.
+const ReferenceGrantKind = "ReferenceGrant.gateway.networking.k8s.io"
+
+// Referrer is a resource that refers to other resources, e.g. a route that refers to its backends.
+// It may refer to anything in its own namespace, but it can only refer to things in other
+// namespaces that a ReferenceGrant in that namespace allows it to.
+type Referrer struct {
+	GroupKind schema.GroupKind
+	Namespace string
+
+	// Query is used to look up ReferenceGrants. With no Query, nothing in another namespace can
+	// be referred to.
+	Query Query
+}
+
+// Allows says whether the referrer may refer to the resource of the given kind, namespace and name.
+func (r Referrer) Allows(to schema.GroupKind, namespace, name string) bool {
+	if namespace == r.Namespace {
+		return true
+	}
+	if r.Query == nil {
+		return false
+	}
+	for _, untyped := range r.Query.List(ReferenceGrantKind, namespace) {
+		grant, ok := untyped.(*gwv1beta1.ReferenceGrant)
+		if ok && r.grantedBy(grant, to, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantedBy says whether a ReferenceGrant allows the referrer to refer to the resource with the
+// given kind and name in the grant's namespace.
+func (r Referrer) grantedBy(grant *gwv1beta1.ReferenceGrant, to schema.GroupKind, name string) bool {
+	fromOK := false
+	for _, from := range grant.Spec.From {
+		if string(from.Group) == r.GroupKind.Group && string(from.Kind) == r.GroupKind.Kind &&
+			string(from.Namespace) == r.Namespace {
+			fromOK = true
+			break
+		}
+	}
+	if !fromOK {
+		return false
+	}
+	for _, target := range grant.Spec.To {
+		if string(target.Group) == to.Group && string(target.Kind) == to.Kind &&
+			(target.Name == nil || string(*target.Name) == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantsQuery answers queries for ReferenceGrants from a list of them, for checking references
+// outside of the Dispatcher. Nothing else exists as far as it knows.
+type grantsQuery []*gwv1beta1.ReferenceGrant
+
+func (q grantsQuery) Get(kind, namespace, name string) kates.Object {
+	for _, grant := range q.List(kind, namespace) {
+		if grant.GetName() == name {
+			return grant
+		}
+	}
+	return nil
+}
+
+func (q grantsQuery) List(kind, namespace string) []kates.Object {
+	if kind != ReferenceGrantKind {
+		return nil
+	}
+	var result []kates.Object
+	for _, grant := range q {
+		if namespace == allNamespaces || grant.Namespace == namespace {
+			result = append(result, grant)
+		}
+	}
+	return result
+}
@@ -0,0 +1,330 @@
+package gateway
+
+import (
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+	gwv1alpha2 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1alpha2"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+)
+
+// ControllerName is the controllerName of the GatewayClasses that we implement. Only those
+// GatewayClasses, their Gateways, and the parts of route status for those Gateways get written.
+const ControllerName = gwv1.GatewayController("getambassador.io/gateway-controller")
+
+// GatewayAPIStatus works out the status of the given Gateway API resources from what the
+// dispatcher has compiled for them. The routes may be of any of the kinds that attach to v1
+// Gateways. It returns copies of the resources whose status has changed, with the new status filled
+// in, so the result is empty once everything has been written.
+//
+// Every condition records the generation of the resource it was computed from as its
+// observedGeneration.
+func (d *Dispatcher) GatewayAPIStatus(classes []*gwv1.GatewayClass, gateways []*gwv1.Gateway, routes []kates.Object) []kates.Object {
+	var result []kates.Object
+
+	ours := map[string]bool{}
+	for _, class := range classes {
+		if class.Spec.ControllerName != ControllerName {
+			continue
+		}
+		ours[class.Name] = true
+
+		status := class.Status.DeepCopy()
+		setCondition(&status.Conditions, class.Generation, string(gwv1.GatewayClassConditionStatusAccepted),
+			true, string(gwv1.GatewayClassReasonAccepted), "")
+		if !equality.Semantic.DeepEqual(&class.Status, status) {
+			updated := class.DeepCopy()
+			updated.Status = *status
+			result = append(result, updated)
+		}
+	}
+
+	// Map from each of our Gateways to all of its listeners, including the ones that failed to
+	// compile.
+	listeners := map[types.NamespacedName][]*CompiledVirtualHost{}
+	for _, gateway := range gateways {
+		if !ours[string(gateway.Spec.GatewayClassName)] {
+			continue
+		}
+		config := d.compiledConfig(gateway)
+		if config == nil {
+			continue
+		}
+		var vhosts []*CompiledVirtualHost
+		for _, l := range config.Listeners {
+			vhosts = append(vhosts, l.VirtualHosts...)
+		}
+		listeners[types.NamespacedName{Namespace: gateway.Namespace, Name: gateway.Name}] = vhosts
+
+		status := d.gatewayStatus(gateway, vhosts)
+		if !equality.Semantic.DeepEqual(&gateway.Status, status) {
+			updated := gateway.DeepCopy()
+			updated.Status = *status
+			result = append(result, updated)
+		}
+	}
+
+	for _, route := range routes {
+		config := d.compiledConfig(route)
+		if config == nil || len(config.Routes) == 0 {
+			continue
+		}
+		parentRefs, routeStatus := routeParts(route)
+		if routeStatus == nil {
+			continue
+		}
+		status := d.routeStatus(route.GetGeneration(), routeStatus, parentRefs, config.Routes[0], listeners)
+		if !equality.Semantic.DeepEqual(routeStatus, status) {
+			updated := route.DeepCopyObject().(kates.Object)
+			_, updatedStatus := routeParts(updated)
+			*updatedStatus = *status
+			result = append(result, updated)
+		}
+	}
+
+	return result
+}
+
+// compiledConfig returns the CompiledConfig for the resource, or nil if it hasn't been compiled.
+func (d *Dispatcher) compiledConfig(resource kates.Object) *CompiledConfig {
+	kind, ok := d.RegisteredKind(resource.GetObjectKind().GroupVersionKind())
+	if !ok {
+		return nil
+	}
+	return d.configs[resourceKeyFromParts(kind, resource.GetNamespace(), resource.GetName())]
+}
+
+func (d *Dispatcher) gatewayStatus(gateway *gwv1.Gateway, vhosts []*CompiledVirtualHost) *gwv1.GatewayStatus {
+	generation := gateway.Generation
+	status := gateway.Status.DeepCopy()
+
+	byName := map[string]*CompiledVirtualHost{}
+	for _, vh := range vhosts {
+		byName[vh.Name] = vh
+	}
+
+	var listeners []gwv1.ListenerStatus
+	valid := 0
+	for _, l := range gateway.Spec.Listeners {
+		vh, ok := byName[string(l.Name)]
+		if !ok {
+			continue
+		}
+
+		ls := gwv1.ListenerStatus{Name: l.Name, SupportedKinds: []gwv1.RouteGroupKind{}}
+		for _, old := range status.Listeners {
+			if old.Name == l.Name {
+				ls.Conditions = old.Conditions
+			}
+		}
+
+		if vh.Error != "" {
+			reason := vh.Reason
+			if reason == "" {
+				reason = string(gwv1.ListenerReasonInvalid)
+			}
+			switch gwv1.ListenerConditionReason(reason) {
+			case gwv1.ListenerReasonInvalidCertificateRef, gwv1.ListenerReasonRefNotPermitted:
+				// The listener itself is fine, but it can't be programmed without its
+				// certificates.
+				setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionAccepted), true,
+					string(gwv1.ListenerReasonAccepted), "")
+				setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionResolvedRefs), false, reason, vh.Error)
+			case gwv1.ListenerReasonProtocolConflict, gwv1.ListenerReasonHostnameConflict:
+				setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionAccepted), false, reason, vh.Error)
+				setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionConflicted), true, reason, vh.Error)
+			default:
+				setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionAccepted), false, reason, vh.Error)
+			}
+			setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionProgrammed), false,
+				string(gwv1.ListenerReasonInvalid), vh.Error)
+		} else {
+			valid++
+			for _, gk := range vh.Kinds {
+				group := gwv1.Group(gk.Group)
+				ls.SupportedKinds = append(ls.SupportedKinds, gwv1.RouteGroupKind{Group: &group, Kind: gwv1.Kind(gk.Kind)})
+			}
+			ls.AttachedRoutes = d.attachedRoutes(vh)
+			setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionAccepted), true,
+				string(gwv1.ListenerReasonAccepted), "")
+			setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionResolvedRefs), true,
+				string(gwv1.ListenerReasonResolvedRefs), "")
+			setCondition(&ls.Conditions, generation, string(gwv1.ListenerConditionProgrammed), true,
+				string(gwv1.ListenerReasonProgrammed), "")
+		}
+		listeners = append(listeners, ls)
+	}
+	status.Listeners = listeners
+
+	// The Gateway is still accepted if only some of its listeners are invalid.
+	switch {
+	case valid == len(listeners):
+		setCondition(&status.Conditions, generation, string(gwv1.GatewayConditionAccepted), true,
+			string(gwv1.GatewayReasonAccepted), "")
+	case valid > 0:
+		setCondition(&status.Conditions, generation, string(gwv1.GatewayConditionAccepted), true,
+			string(gwv1.GatewayReasonListenersNotValid), "some listeners are invalid")
+	default:
+		setCondition(&status.Conditions, generation, string(gwv1.GatewayConditionAccepted), false,
+			string(gwv1.GatewayReasonListenersNotValid), "no listeners are valid")
+	}
+	if valid > 0 {
+		setCondition(&status.Conditions, generation, string(gwv1.GatewayConditionProgrammed), true,
+			string(gwv1.GatewayReasonProgrammed), "")
+	} else {
+		setCondition(&status.Conditions, generation, string(gwv1.GatewayConditionProgrammed), false,
+			string(gwv1.GatewayReasonInvalid), "no listeners are valid")
+	}
+
+	return status
+}
+
+// attachedRoutes counts the routes that serve at least one hostname on the listener.
+func (d *Dispatcher) attachedRoutes(vh *CompiledVirtualHost) int32 {
+	return int32(len(d.attachedTo(vh)))
+}
+
+// routeParts returns the parentRefs of a route, and the part of its status that's the same for
+// every kind of route. It returns a nil status for resources that aren't routes.
+func routeParts(route kates.Object) ([]gwv1.ParentReference, *gwv1.RouteStatus) {
+	switch r := route.(type) {
+	case *gwv1.HTTPRoute:
+		return r.Spec.ParentRefs, &r.Status.RouteStatus
+	case *gwv1.GRPCRoute:
+		return r.Spec.ParentRefs, &r.Status.RouteStatus
+	case *gwv1alpha2.TCPRoute:
+		return r.Spec.ParentRefs, &r.Status.RouteStatus
+	case *gwv1alpha2.TLSRoute:
+		return r.Spec.ParentRefs, &r.Status.RouteStatus
+	case *gwv1alpha2.UDPRoute:
+		return r.Spec.ParentRefs, &r.Status.RouteStatus
+	}
+	return nil, nil
+}
+
+func (d *Dispatcher) routeStatus(generation int64, current *gwv1.RouteStatus, parentRefs []gwv1.ParentReference, compiled *CompiledRoute, listeners map[types.NamespacedName][]*CompiledVirtualHost) *gwv1.RouteStatus {
+	status := current.DeepCopy()
+
+	resolved, resolvedReason, resolvedMessage := true, string(gwv1.RouteReasonResolvedRefs), ""
+	for _, ref := range compiled.ClusterRefs {
+		if ref.Error != "" {
+			resolved, resolvedReason, resolvedMessage = false, ref.Reason, ref.Error
+			if resolvedReason == "" {
+				resolvedReason = string(gwv1.RouteReasonBackendNotFound)
+			}
+			break
+		}
+	}
+
+	// The spec says that a route with a filter that we don't support isn't accepted, and neither
+	// is a route that we can't use at all.
+	var routeError *CompiledItem
+	if compiled.Error != "" {
+		routeError = &compiled.CompiledItem
+	}
+	for _, f := range compiled.Filters {
+		if f.Error != "" && routeError == nil {
+			routeError = f
+		}
+	}
+
+	// Other controllers' entries are theirs to look after.
+	parents := []gwv1.RouteParentStatus{}
+	for _, ps := range status.Parents {
+		if ps.ControllerName != ControllerName {
+			parents = append(parents, ps)
+		}
+	}
+
+	for i, ref := range parentRefs {
+		parent := compiled.ParentRefs[i]
+		if parent.Group != gwv1.GroupVersion.Group || parent.Kind != "Gateway" {
+			continue
+		}
+		vhosts, ok := listeners[types.NamespacedName{Namespace: parent.Namespace, Name: parent.Name}]
+		if !ok {
+			continue
+		}
+
+		ps := gwv1.RouteParentStatus{ParentRef: ref, ControllerName: ControllerName}
+		for _, old := range status.Parents {
+			if old.ControllerName == ControllerName && equality.Semantic.DeepEqual(old.ParentRef, ref) {
+				ps.Conditions = old.Conditions
+			}
+		}
+
+		accepted, reason, message := d.routeAcceptance(compiled, parent, vhosts)
+		if accepted && routeError != nil {
+			accepted, reason, message = false, gwv1.RouteConditionReason(routeError.Reason), routeError.Error
+			if reason == "" {
+				reason = gwv1.RouteReasonUnsupportedValue
+			}
+		}
+		setCondition(&ps.Conditions, generation, string(gwv1.RouteConditionAccepted), accepted, string(reason), message)
+		setCondition(&ps.Conditions, generation, string(gwv1.RouteConditionResolvedRefs), resolved, resolvedReason, resolvedMessage)
+		parents = append(parents, ps)
+	}
+	status.Parents = parents
+
+	return status
+}
+
+// routeAcceptance works out whether the route is accepted by the Gateway that the parentRef refers
+// to, given all of the Gateway's listeners.
+func (d *Dispatcher) routeAcceptance(route *CompiledRoute, parent ParentRef, vhosts []*CompiledVirtualHost) (bool, gwv1.RouteConditionReason, string) {
+	// Only the one parentRef counts here, even if the route has others for the same Gateway.
+	single := *route
+	single.ParentRefs = []ParentRef{parent}
+
+	matched, allowed, taken := false, false, false
+	for _, vh := range vhosts {
+		if (parent.SectionName != "" && parent.SectionName != vh.Name) || (parent.Port != 0 && parent.Port != vh.Port) {
+			continue
+		}
+		matched = true
+		if vh.Attach == nil || !vh.Attach(&single, d.namespaces[route.Namespace]) {
+			continue
+		}
+		allowed = true
+		if len(intersectHostnames(vh.Hostname, route.Hostnames)) == 0 {
+			continue
+		}
+		if vh.SingleRoute && route.Error == "" {
+			if attached := d.attachedTo(vh); len(attached) > 0 && attached[0] != route {
+				taken = true
+				continue
+			}
+		}
+		return true, gwv1.RouteReasonAccepted, ""
+	}
+
+	switch {
+	case !matched:
+		return false, gwv1.RouteReasonNoMatchingParent, "no listener matches the parentRef"
+	case !allowed:
+		return false, gwv1.RouteReasonNotAllowedByListeners, "no listener allows the route to attach"
+	case taken:
+		return false, gwv1.RouteReasonNotAllowedByListeners, "the listener can only serve one route, and another route already has it"
+	default:
+		return false, gwv1.RouteReasonNoMatchingListenerHostname, "no listener hostname matches the route's hostnames"
+	}
+}
+
+// setCondition sets the condition of the given type, only changing its lastTransitionTime if its
+// status changes.
+func setCondition(conditions *[]metav1.Condition, generation int64, conditionType string, status bool, reason, message string) {
+	cond := metav1.Condition{
+		Type:               conditionType,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	}
+	if status {
+		cond.Status = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(conditions, cond)
+}
@@ -0,0 +1,455 @@
+package gateway_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+	gwv1alpha2 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1alpha2"
+	"github.com/datawire/ambassador/v2/pkg/gateway"
+	"github.com/datawire/ambassador/v2/pkg/kates"
+	"github.com/datawire/dlib/dlog"
+)
+
+const statusResources = `
+---
+kind: GatewayClass
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: emissary
+  generation: 1
+spec:
+  controllerName: getambassador.io/gateway-controller
+---
+kind: GatewayClass
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: other
+  generation: 1
+spec:
+  controllerName: example.com/other-controller
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: other-gateway
+  namespace: default
+  generation: 1
+spec:
+  gatewayClassName: other
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: foo
+  namespace: default
+  generation: 3
+spec:
+  parentRefs:
+  - name: my-gateway
+  - name: other-gateway
+  hostnames:
+  - foo.example.com
+  rules:
+  - backendRefs:
+    - name: foo
+      port: 80
+    - name: foo
+      namespace: elsewhere
+      port: 80
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: bar
+  namespace: bar
+  generation: 1
+spec:
+  parentRefs:
+  - name: my-gateway
+    namespace: default
+    sectionName: bar
+  rules:
+  - backendRefs:
+    - name: bar
+      port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: elsewhere
+  namespace: default
+  generation: 1
+spec:
+  parentRefs:
+  - name: my-gateway
+  - name: my-gateway
+    sectionName: nope
+  hostnames:
+  - elsewhere.example.net
+  rules:
+  - backendRefs:
+    - name: elsewhere
+      port: 80
+`
+
+func TestGatewayAPIStatus(t *testing.T) {
+	t.Parallel()
+	d := makeDispatcherV1(t)
+
+	objs, err := kates.ParseManifests(gatewayV1 + statusResources)
+	require.NoError(t, err)
+	var classes []*gwv1.GatewayClass
+	var gateways []*gwv1.Gateway
+	var routes []kates.Object
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *gwv1.GatewayClass:
+			classes = append(classes, o)
+		case *gwv1.Gateway:
+			o.Generation = 2
+			gateways = append(gateways, o)
+			require.NoError(t, d.Upsert(o))
+		case *gwv1.HTTPRoute:
+			routes = append(routes, o)
+			require.NoError(t, d.Upsert(o))
+		}
+	}
+
+	updated := statusByName(d.GatewayAPIStatus(classes, gateways, routes))
+	// The other GatewayClass and its Gateway belong to another controller.
+	require.Len(t, updated, 5)
+
+	class := updated["emissary"].(*gwv1.GatewayClass)
+	assertCondition(t, class.Status.Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 1)
+
+	gw := updated["my-gateway"].(*gwv1.Gateway)
+	assertCondition(t, gw.Status.Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 2)
+	assertCondition(t, gw.Status.Conditions, "Programmed", metav1.ConditionTrue, "Programmed", 2)
+	require.Len(t, gw.Status.Listeners, 3)
+	wildcard, bar, tcp := gw.Status.Listeners[0], gw.Status.Listeners[1], gw.Status.Listeners[2]
+	assert.Equal(t, gwv1.SectionName("wildcard"), wildcard.Name)
+	assert.Equal(t, int32(1), wildcard.AttachedRoutes)
+	require.Len(t, wildcard.SupportedKinds, 2)
+	assert.Equal(t, gwv1.Kind("GRPCRoute"), wildcard.SupportedKinds[0].Kind)
+	assert.Equal(t, gwv1.Kind("HTTPRoute"), wildcard.SupportedKinds[1].Kind)
+	assertCondition(t, wildcard.Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 2)
+	assertCondition(t, wildcard.Conditions, "Programmed", metav1.ConditionTrue, "Programmed", 2)
+	assert.Equal(t, int32(0), bar.AttachedRoutes)
+	assert.Equal(t, int32(0), tcp.AttachedRoutes)
+	require.Len(t, tcp.SupportedKinds, 1)
+	assert.Equal(t, gwv1.Kind("TCPRoute"), tcp.SupportedKinds[0].Kind)
+	assertCondition(t, tcp.Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 2)
+
+	// The foo route only gets status for the Gateway that we implement.
+	foo := updated["foo"].(*gwv1.HTTPRoute)
+	require.Len(t, foo.Status.Parents, 1)
+	assert.Equal(t, gwv1.ObjectName("my-gateway"), foo.Status.Parents[0].ParentRef.Name)
+	assert.Equal(t, gateway.ControllerName, foo.Status.Parents[0].ControllerName)
+	assertCondition(t, foo.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 3)
+	assertCondition(t, foo.Status.Parents[0].Conditions, "ResolvedRefs", metav1.ConditionFalse, "RefNotPermitted", 3)
+
+	barRoute := updated["bar"].(*gwv1.HTTPRoute)
+	require.Len(t, barRoute.Status.Parents, 1)
+	assertCondition(t, barRoute.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "NotAllowedByListeners", 1)
+	assertCondition(t, barRoute.Status.Parents[0].Conditions, "ResolvedRefs", metav1.ConditionTrue, "ResolvedRefs", 1)
+
+	elsewhere := updated["elsewhere"].(*gwv1.HTTPRoute)
+	require.Len(t, elsewhere.Status.Parents, 2)
+	assertCondition(t, elsewhere.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "NoMatchingListenerHostname", 1)
+	assertCondition(t, elsewhere.Status.Parents[1].Conditions, "Accepted", metav1.ConditionFalse, "NoMatchingParent", 1)
+
+	// Once the status has been written, there's nothing more to do, until something changes.
+	for _, c := range classes {
+		if u, ok := updated[c.Name]; ok {
+			c.Status = u.(*gwv1.GatewayClass).Status
+		}
+	}
+	for _, g := range gateways {
+		if u, ok := updated[g.Name]; ok {
+			g.Status = u.(*gwv1.Gateway).Status
+		}
+	}
+	for _, r := range routes {
+		r.(*gwv1.HTTPRoute).Status = updated[r.GetName()].(*gwv1.HTTPRoute).Status
+	}
+	assert.Empty(t, d.GatewayAPIStatus(classes, gateways, routes))
+
+	d.SetNamespaces([]*kates.Namespace{
+		{ObjectMeta: kates.ObjectMeta{Name: "default"}},
+		{ObjectMeta: kates.ObjectMeta{Name: "bar", Labels: map[string]string{"team": "bar"}}},
+	})
+	updated = statusByName(d.GatewayAPIStatus(classes, gateways, routes))
+	require.Len(t, updated, 2)
+	assert.Equal(t, int32(1), updated["my-gateway"].(*gwv1.Gateway).Status.Listeners[1].AttachedRoutes)
+	accepted := meta.FindStatusCondition(updated["bar"].(*gwv1.HTTPRoute).Status.Parents[0].Conditions, "Accepted")
+	assert.Equal(t, metav1.ConditionTrue, accepted.Status)
+}
+
+func TestGatewayAPIStatusTLSListeners(t *testing.T) {
+	t.Parallel()
+	d := makeDispatcherV1(t)
+
+	objs, err := kates.ParseManifests(statusResources + gatewayV1TLS)
+	require.NoError(t, err)
+	var classes []*gwv1.GatewayClass
+	var gateways []*gwv1.Gateway
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *gwv1.GatewayClass:
+			classes = append(classes, o)
+		case *gwv1.Gateway:
+			gateways = append(gateways, o)
+			require.NoError(t, d.Upsert(o))
+		case *kates.Secret:
+			require.NoError(t, d.Upsert(o))
+		}
+	}
+
+	gw := statusByName(d.GatewayAPIStatus(classes, gateways, nil))["tls-gateway"].(*gwv1.Gateway)
+	assertCondition(t, gw.Status.Conditions, "Accepted", metav1.ConditionTrue, "ListenersNotValid", 0)
+	listeners := map[gwv1.SectionName]gwv1.ListenerStatus{}
+	for _, ls := range gw.Status.Listeners {
+		listeners[ls.Name] = ls
+	}
+	require.Len(t, listeners, 7)
+
+	assertCondition(t, listeners["foo"].Conditions, "ResolvedRefs", metav1.ConditionTrue, "ResolvedRefs", 0)
+	assertCondition(t, listeners["foo"].Conditions, "Programmed", metav1.ConditionTrue, "Programmed", 0)
+
+	// A listener whose certificate can't be used is accepted, but can't be programmed.
+	for _, name := range []gwv1.SectionName{"bar", "missing"} {
+		assertCondition(t, listeners[name].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 0)
+		assertCondition(t, listeners[name].Conditions, "Programmed", metav1.ConditionFalse, "Invalid", 0)
+	}
+	assertCondition(t, listeners["bar"].Conditions, "ResolvedRefs", metav1.ConditionFalse, "RefNotPermitted", 0)
+	assertCondition(t, listeners["missing"].Conditions, "ResolvedRefs", metav1.ConditionFalse, "InvalidCertificateRef", 0)
+
+	assertCondition(t, listeners["foo-again"].Conditions, "Conflicted", metav1.ConditionTrue, "HostnameConflict", 0)
+	assertCondition(t, listeners["http"].Conditions, "Conflicted", metav1.ConditionTrue, "ProtocolConflict", 0)
+
+	// TLS listeners take TLSRoutes when they pass TLS through, and TCPRoutes when they terminate it.
+	require.Len(t, listeners["passthrough"].SupportedKinds, 1)
+	assert.Equal(t, gwv1.Kind("TLSRoute"), listeners["passthrough"].SupportedKinds[0].Kind)
+	require.Len(t, listeners["terminate"].SupportedKinds, 1)
+	assert.Equal(t, gwv1.Kind("TCPRoute"), listeners["terminate"].SupportedKinds[0].Kind)
+}
+
+func TestGatewayAPIStatusGRPCRoute(t *testing.T) {
+	t.Parallel()
+	d := makeDispatcherV1(t)
+
+	objs, err := kates.ParseManifests(gatewayV1 + statusResources + `
+---
+kind: GRPCRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: greeter
+  namespace: default
+  generation: 1
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: wildcard
+  hostnames:
+  - greeter.example.com
+  rules:
+  - backendRefs:
+    - name: greeter
+      namespace: other
+      port: 9000
+`)
+	require.NoError(t, err)
+	var classes []*gwv1.GatewayClass
+	var gateways []*gwv1.Gateway
+	var routes []kates.Object
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *gwv1.GatewayClass:
+			classes = append(classes, o)
+		case *gwv1.Gateway:
+			gateways = append(gateways, o)
+			require.NoError(t, d.Upsert(o))
+		case *gwv1.GRPCRoute:
+			routes = append(routes, o)
+			require.NoError(t, d.Upsert(o))
+		}
+	}
+
+	// The backend is in another namespace, and no ReferenceGrant allows referring to it.
+	greeter := statusByName(d.GatewayAPIStatus(classes, gateways, routes))["greeter"].(*gwv1.GRPCRoute)
+	require.Len(t, greeter.Status.Parents, 1)
+	assertCondition(t, greeter.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 1)
+	assertCondition(t, greeter.Status.Parents[0].Conditions, "ResolvedRefs", metav1.ConditionFalse, "RefNotPermitted", 1)
+
+	routes[0].(*gwv1.GRPCRoute).Status = greeter.Status
+	require.NoError(t, d.UpsertYaml(`
+---
+kind: ReferenceGrant
+apiVersion: gateway.networking.k8s.io/v1beta1
+metadata:
+  name: greeter
+  namespace: other
+spec:
+  from:
+  - group: gateway.networking.k8s.io
+    kind: GRPCRoute
+    namespace: default
+  to:
+  - group: ""
+    kind: Service
+`))
+	greeter = statusByName(d.GatewayAPIStatus(classes, gateways, routes))["greeter"].(*gwv1.GRPCRoute)
+	assertCondition(t, greeter.Status.Parents[0].Conditions, "ResolvedRefs", metav1.ConditionTrue, "ResolvedRefs", 1)
+}
+
+func TestGatewayAPIStatusConnectionRoutes(t *testing.T) {
+	t.Parallel()
+	d := makeDispatcherV1(t)
+
+	objs, err := kates.ParseManifests(statusResources + gatewayV1Connections)
+	require.NoError(t, err)
+	var classes []*gwv1.GatewayClass
+	var gateways []*gwv1.Gateway
+	var routes []kates.Object
+	for _, obj := range objs {
+		switch o := obj.(type) {
+		case *gwv1.GatewayClass:
+			classes = append(classes, o)
+		case *gwv1.Gateway:
+			gateways = append(gateways, o)
+			require.NoError(t, d.Upsert(o))
+		case *kates.Secret:
+			require.NoError(t, d.Upsert(o))
+		case *gwv1alpha2.TCPRoute, *gwv1alpha2.TLSRoute, *gwv1alpha2.UDPRoute:
+			routes = append(routes, o)
+			require.NoError(t, d.Upsert(o))
+		}
+	}
+
+	updated := map[string]kates.Object{}
+	for _, obj := range d.GatewayAPIStatus(classes, gateways, routes) {
+		updated[obj.GetNamespace()+"/"+obj.GetName()] = obj
+	}
+
+	gw := updated["default/conn-gateway"].(*gwv1.Gateway)
+	listeners := map[gwv1.SectionName]gwv1.ListenerStatus{}
+	for _, ls := range gw.Status.Listeners {
+		listeners[ls.Name] = ls
+	}
+	assert.Equal(t, int32(1), listeners["tcp"].AttachedRoutes)
+	assert.Equal(t, int32(1), listeners["udp"].AttachedRoutes)
+	assert.Equal(t, int32(2), listeners["passthrough"].AttachedRoutes)
+	assert.Equal(t, int32(1), listeners["terminate"].AttachedRoutes)
+	assertCondition(t, listeners["custom"].Conditions, "Accepted", metav1.ConditionFalse, "UnsupportedProtocol", 0)
+
+	for _, name := range []string{"default/db", "default/secure-db"} {
+		tcp := updated[name].(*gwv1alpha2.TCPRoute)
+		require.Len(t, tcp.Status.Parents, 1, name)
+		assertCondition(t, tcp.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 0)
+	}
+	for _, name := range []string{"default/web", "other/web"} {
+		tls := updated[name].(*gwv1alpha2.TLSRoute)
+		require.Len(t, tls.Status.Parents, 1, name)
+		assertCondition(t, tls.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 0)
+	}
+
+	// A UDP listener can only proxy to one backend, so it only serves one route, and that route
+	// can only have one backend.
+	dns := updated["default/dns"].(*gwv1alpha2.UDPRoute)
+	assertCondition(t, dns.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 0)
+	pair := updated["default/dns-pair"].(*gwv1alpha2.UDPRoute)
+	assertCondition(t, pair.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "UnsupportedValue", 0)
+	spare := updated["default/dns-spare"].(*gwv1alpha2.UDPRoute)
+	assertCondition(t, spare.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "NotAllowedByListeners", 0)
+}
+
+func statusByName(objs []kates.Object) map[string]kates.Object {
+	result := map[string]kates.Object{}
+	for _, obj := range objs {
+		result[obj.GetName()] = obj
+	}
+	return result
+}
+
+func assertCondition(t *testing.T, conditions []metav1.Condition, conditionType string, status metav1.ConditionStatus, reason string, generation int64) {
+	t.Helper()
+	cond := meta.FindStatusCondition(conditions, conditionType)
+	if !assert.NotNil(t, cond, "no %s condition", conditionType) {
+		return
+	}
+	assert.Equal(t, status, cond.Status, conditionType)
+	assert.Equal(t, reason, cond.Reason, conditionType)
+	assert.Equal(t, generation, cond.ObservedGeneration, conditionType)
+	assert.False(t, cond.LastTransitionTime.IsZero(), conditionType)
+}
+
+type fakeStatusClient struct {
+	mutex    sync.Mutex
+	written  []string
+	failures map[string]error
+}
+
+func (c *fakeStatusClient) UpdateStatus(_ context.Context, resource, _ interface{}) error {
+	obj := resource.(kates.Object)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err, ok := c.failures[obj.GetName()]; ok {
+		delete(c.failures, obj.GetName())
+		return err
+	}
+	c.written = append(c.written, obj.GetName())
+	return nil
+}
+
+func (c *fakeStatusClient) getWritten() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.written...)
+}
+
+func TestStatusWriter(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	gr := schema.GroupResource{Group: "gateway.networking.k8s.io", Resource: "httproutes"}
+	client := &fakeStatusClient{failures: map[string]error{
+		// This one is out of date, so a newer version will come along with a status of its own.
+		"conflict": apierrors.NewConflict(gr, "conflict", nil),
+	}}
+	w := gateway.NewStatusWriter(client, nil, rate.Inf, 1)
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+
+	route := func(name string) kates.Object {
+		return &gwv1.HTTPRoute{
+			TypeMeta:   kates.TypeMeta{APIVersion: "gateway.networking.k8s.io/v1", Kind: "HTTPRoute"},
+			ObjectMeta: kates.ObjectMeta{Namespace: "default", Name: name},
+		}
+	}
+	w.Update([]kates.Object{route("conflict"), route("foo")})
+	require.Eventually(t, func() bool { return len(client.getWritten()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"foo"}, client.getWritten())
+
+	w.Update([]kates.Object{route("bar")})
+	require.Eventually(t, func() bool { return len(client.getWritten()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"foo", "bar"}, client.getWritten())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
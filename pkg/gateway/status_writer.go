@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/datawire/ambassador/v2/pkg/kates"
+	"github.com/datawire/dlib/dgroup"
+	"github.com/datawire/dlib/dlog"
+)
+
+// StatusClient is the part of *kates.Client that the StatusWriter uses.
+type StatusClient interface {
+	UpdateStatus(ctx context.Context, resource interface{}, target interface{}) error
+}
+
+// How often the StatusWriter retries writes that failed.
+const statusRetryInterval = 10 * time.Second
+
+// A StatusWriter writes the status computed by Dispatcher.GatewayAPIStatus back to the cluster.
+// It only ever holds the latest status for each resource, so if the status of a resource changes
+// several times in quick succession only the last one is written. Writes are rate limited, and
+// only happen while the LeaderElector (if any) says that we are the leader.
+type StatusWriter struct {
+	client  StatusClient
+	elector *LeaderElector
+	limiter *rate.Limiter
+
+	mutex   sync.Mutex
+	pending map[string]kates.Object
+	changed chan struct{}
+}
+
+// NewStatusWriter returns a StatusWriter that writes at most limit statuses per second, with
+// bursts of up to burst. A nil elector means that we are always the leader.
+func NewStatusWriter(client StatusClient, elector *LeaderElector, limit rate.Limit, burst int) *StatusWriter {
+	return &StatusWriter{
+		client:  client,
+		elector: elector,
+		limiter: rate.NewLimiter(limit, burst),
+		pending: map[string]kates.Object{},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Update replaces the statuses waiting to be written with the given resources, which should be
+// the complete result of Dispatcher.GatewayAPIStatus.
+func (w *StatusWriter) Update(resources []kates.Object) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = make(map[string]kates.Object, len(resources))
+	for _, resource := range resources {
+		w.pending[statusKey(resource)] = resource
+	}
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+func statusKey(resource kates.Object) string {
+	gk := resource.GetObjectKind().GroupVersionKind().GroupKind()
+	return fmt.Sprintf("%s:%s:%s", gk, resource.GetNamespace(), resource.GetName())
+}
+
+// Run writes statuses until the context is canceled. It also runs the LeaderElector, if any.
+func (w *StatusWriter) Run(ctx context.Context) error {
+	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
+	if w.elector != nil {
+		grp.Go("leader", w.elector.Run)
+	}
+	grp.Go("writer", w.run)
+	return grp.Wait()
+}
+
+func (w *StatusWriter) run(ctx context.Context) error {
+	var leaderChanged <-chan struct{}
+	if w.elector != nil {
+		leaderChanged = w.elector.Changed()
+	}
+	ticker := time.NewTicker(statusRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.changed:
+		case <-leaderChanged:
+		case <-ticker.C:
+		}
+		if w.elector != nil && !w.elector.IsLeader() {
+			continue
+		}
+		if err := w.flush(ctx); err != nil {
+			// The context was canceled while we were waiting on the rate limiter.
+			return nil
+		}
+	}
+}
+
+// flush writes all the pending statuses. A status that fails to be written stays pending, unless
+// it was for an out of date version of the resource, in which case the newer version will get a
+// status of its own.
+func (w *StatusWriter) flush(ctx context.Context) error {
+	w.mutex.Lock()
+	keys := make([]string, 0, len(w.pending))
+	for key := range w.pending {
+		keys = append(keys, key)
+	}
+	w.mutex.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		w.mutex.Lock()
+		resource, ok := w.pending[key]
+		w.mutex.Unlock()
+		if !ok {
+			continue
+		}
+		if w.elector != nil && !w.elector.IsLeader() {
+			return nil
+		}
+		if err := w.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		err := w.client.UpdateStatus(ctx, resource, nil)
+		if err != nil && !kates.IsConflict(err) && !kates.IsNotFound(err) {
+			dlog.Errorf(ctx, "error updating status of %s: %v", key, err)
+			continue
+		}
+		w.mutex.Lock()
+		// Leave it alone if a newer status arrived while we were writing this one.
+		if w.pending[key] == resource {
+			delete(w.pending, key)
+		}
+		w.mutex.Unlock()
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package kates
 
 import (
 	appsv1 "k8s.io/api/apps/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	xv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -59,6 +61,8 @@ type Secret = corev1.Secret
 
 const SecretTypeServiceAccountToken = corev1.SecretTypeServiceAccountToken
 const SecretTypeTLS = corev1.SecretTypeTLS
+const TLSCertKey = corev1.TLSCertKey
+const TLSPrivateKeyKey = corev1.TLSPrivateKeyKey
 
 type Service = corev1.Service
 type ServiceSpec = corev1.ServiceSpec
@@ -68,6 +72,14 @@ type EndpointSubset = corev1.EndpointSubset
 type EndpointAddress = corev1.EndpointAddress
 type EndpointPort = corev1.EndpointPort
 
+type EndpointSlice = discoveryv1.EndpointSlice
+type EndpointSliceEndpoint = discoveryv1.Endpoint
+type EndpointSlicePort = discoveryv1.EndpointPort
+
+var AddressTypeIPv4 = discoveryv1.AddressTypeIPv4
+var AddressTypeIPv6 = discoveryv1.AddressTypeIPv6
+var LabelServiceName = discoveryv1.LabelServiceName
+
 type Protocol = corev1.Protocol
 
 var ProtocolTCP = corev1.ProtocolTCP
@@ -103,8 +115,14 @@ var PodFailed = corev1.PodFailed
 var PodReady = corev1.PodReady
 var CoreConditionTrue = corev1.ConditionTrue
 
+var LabelTopologyRegion = corev1.LabelTopologyRegion
+var LabelTopologyZone = corev1.LabelTopologyZone
+
 type Node = corev1.Node
 
+type Lease = coordinationv1.Lease
+type LeaseSpec = coordinationv1.LeaseSpec
+
 const NodeUnreachablePodReason = k8s_util_node.NodeUnreachablePodReason
 
 type Volume = corev1.Volume
@@ -141,6 +159,7 @@ var MustParseQuantity = resource.MustParse
 type Quantity = resource.Quantity
 type IntOrString = intstr.IntOrString
 type Time = metav1.Time
+type MicroTime = metav1.MicroTime
 
 var Int = intstr.Int
 
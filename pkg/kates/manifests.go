@@ -15,6 +15,9 @@ import (
 	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
 	"sigs.k8s.io/yaml"
 
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+	gwv1alpha2 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1alpha2"
+	gwv1beta1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1beta1"
 	amb "github.com/datawire/ambassador/v2/pkg/api/getambassador.io/v3alpha1"
 )
 
@@ -33,6 +36,15 @@ func init() {
 	if err := gw.AddToScheme(sch); err != nil {
 		panic(err) // panic is ok in init() I guess
 	}
+	if err := gwv1beta1.AddToScheme(sch); err != nil {
+		panic(err) // panic is ok in init() I guess
+	}
+	if err := gwv1.AddToScheme(sch); err != nil {
+		panic(err) // panic is ok in init() I guess
+	}
+	if err := gwv1alpha2.AddToScheme(sch); err != nil {
+		panic(err) // panic is ok in init() I guess
+	}
 }
 
 func NewObject(kind, version string) (Object, error) {
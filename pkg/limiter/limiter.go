@@ -109,3 +109,47 @@ func NewUnlimited() Limiter {
 }
 
 func (u *unlimited) Limit(now time.Time) time.Duration { return 0 }
+
+// A Backoff limits how often something that keeps failing gets retried. Each event is a
+// failure, and the delay before retrying doubles with each one, from min up to max. Call
+// Reset once the retried thing succeeds.
+type Backoff struct {
+	min      time.Duration
+	max      time.Duration
+	delay    time.Duration
+	deadline time.Time
+}
+
+// Constructs a new backoff that will wait between min and max before
+// each retry.
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{
+		min: min,
+		max: max,
+	}
+}
+
+func (b *Backoff) Limit(now time.Time) time.Duration {
+	if b.deadline.After(now) {
+		// we are still waiting to retry after an earlier failure,
+		// so this one doesn't back us off any further
+		return b.deadline.Sub(now)
+	}
+	switch {
+	case b.delay == 0:
+		b.delay = b.min
+	case b.delay*2 > b.max:
+		b.delay = b.max
+	default:
+		b.delay *= 2
+	}
+	b.deadline = now.Add(b.delay)
+	return b.delay
+}
+
+// Reset the backoff, so that the next failure is retried after the
+// minimum delay again.
+func (b *Backoff) Reset() {
+	b.delay = 0
+	b.deadline = time.Time{}
+}
@@ -34,3 +34,17 @@ func TestIntervalLimiter(fool *testing.T) {
 	t.expect(-1, l.Limit(start.Add(2999*time.Millisecond)))
 	t.expect(0, l.Limit(start.Add(3000*time.Millisecond)))
 }
+
+func TestBackoff(fool *testing.T) {
+	t := pity(fool)
+	l := NewBackoff(1*time.Second, 5*time.Second)
+	start := time.Now()
+	t.expect(1*time.Second, l.Limit(start))
+	t.expect(500*time.Millisecond, l.Limit(start.Add(500*time.Millisecond)))
+	t.expect(2*time.Second, l.Limit(start.Add(1000*time.Millisecond)))
+	t.expect(4*time.Second, l.Limit(start.Add(3000*time.Millisecond)))
+	t.expect(5*time.Second, l.Limit(start.Add(7000*time.Millisecond)))
+	t.expect(5*time.Second, l.Limit(start.Add(12000*time.Millisecond)))
+	l.Reset()
+	t.expect(1*time.Second, l.Limit(start.Add(13000*time.Millisecond)))
+}
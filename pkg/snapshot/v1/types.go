@@ -3,6 +3,9 @@ package snapshot
 import (
 	"encoding/json"
 
+	gwv1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1"
+	gwv1alpha2 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1alpha2"
+	gwv1beta1 "github.com/datawire/ambassador/v2/pkg/api/gateway.networking.k8s.io/v1beta1"
 	amb "github.com/datawire/ambassador/v2/pkg/api/getambassador.io/v3alpha1"
 	"github.com/datawire/ambassador/v2/pkg/consulwatch"
 	"github.com/datawire/ambassador/v2/pkg/kates"
@@ -56,10 +59,11 @@ type ConsulSnapshot struct {
 
 type KubernetesSnapshot struct {
 	// k8s resources
-	IngressClasses []*IngressClass    `json:"ingressclasses"`
-	Ingresses      []*Ingress         `json:"ingresses"`
-	Services       []*kates.Service   `json:"service"`
-	Endpoints      []*kates.Endpoints `json:"Endpoints"`
+	IngressClasses []*IngressClass        `json:"ingressclasses"`
+	Ingresses      []*Ingress             `json:"ingresses"`
+	Services       []*kates.Service       `json:"service"`
+	Endpoints      []*kates.Endpoints     `json:"Endpoints"`
+	EndpointSlices []*kates.EndpointSlice `json:"EndpointSlices"`
 
 	// ambassador resources
 	Listeners   []*amb.Listener   `json:"Listener"`
@@ -85,6 +89,22 @@ type KubernetesSnapshot struct {
 	GatewayClasses []*gw.GatewayClass
 	Gateways       []*gw.Gateway
 	HTTPRoutes     []*gw.HTTPRoute
+	TCPRoutes      []*gw.TCPRoute
+	TLSRoutes      []*gw.TLSRoute
+	UDPRoutes      []*gw.UDPRoute
+
+	// gateway api at gateway.networking.k8s.io/v1 (or v1beta1, if that's what the cluster has)
+	GatewayClassesV1 []*gwv1.GatewayClass
+	GatewaysV1       []*gwv1.Gateway
+	HTTPRoutesV1     []*gwv1.HTTPRoute
+	GRPCRoutesV1     []*gwv1.GRPCRoute
+	TCPRoutesV1      []*gwv1alpha2.TCPRoute
+	TLSRoutesV1      []*gwv1alpha2.TLSRoute
+	UDPRoutesV1      []*gwv1alpha2.UDPRoute
+	ReferenceGrants  []*gwv1beta1.ReferenceGrant
+
+	// Namespaces are only used to select routes for Gateway listeners by namespace label.
+	Namespaces []*kates.Namespace `json:"-"`
 
 	// It is safe to ignore AmbassadorInstallation, ambassador doesn't need to look at those, just
 	// the operator.
@@ -3,6 +3,7 @@ set -e
 
 busyprograms=(
     ambex
+    ambex-diff
     #entrypoint
     kubestatus
     watt
@@ -9,6 +9,7 @@ from ...ir.ircluster import IRCluster
 from ...ir.irlogservice import IRLogService
 from ...ir.irratelimit import IRRateLimit
 from ...ir.irtracing import IRTracing
+from ...utils import parse_bool
 
 from .v3cluster import V3Cluster
 
@@ -19,6 +20,11 @@ if TYPE_CHECKING:
 class V3Bootstrap(dict):
     def __init__(self, config: 'V3Config') -> None:
         api_version = "V3"
+
+        # Incremental ("delta") xDS only sends Envoy the resources that actually changed, rather
+        # than every Cluster and ClusterLoadAssignment on every update. Ambex serves both.
+        api_type = "DELTA_GRPC" if parse_bool(os.environ.get("AMBASSADOR_DELTA_XDS")) else "GRPC"
+
         super().__init__(**{
             "node": {
                 "cluster": config.ir.ambassador_nodename,
@@ -27,7 +33,7 @@ class V3Bootstrap(dict):
             "static_resources": {},     # Filled in later
             "dynamic_resources": {
                 "ads_config": {
-                    "api_type": "GRPC",
+                    "api_type": api_type,
                     "transport_api_version": api_version,
                     "grpc_services": [ {
                         "envoy_grpc": {
@@ -12,7 +12,7 @@
 # See the License for the specific language governing permissions and
 # limitations under the License
 
-from typing import Callable, Dict, List, Optional, Union, TYPE_CHECKING
+from typing import Any, Callable, Dict, List, Optional, Tuple, Union, TYPE_CHECKING
 from typing import cast as typecast
 
 import os
@@ -115,6 +115,25 @@ class V3TLSContext(Dict):
         src: EnvoyCoreSource = { 'filename': value }
         validation[key] = src
 
+    def update_sds_certs(self, key: str, value: str) -> None:
+        common = self.get_common()
+        common[key] = [ self.sds_config(value) ]
+
+    def update_sds_validation(self, key: str, value: str) -> None:
+        common = self.get_common()
+        common[key] = self.sds_config(value)
+
+    @staticmethod
+    def sds_config(name: str) -> Dict[str, Any]:
+        return {
+            'name': name,
+            'sds_config': {
+                'ads': {},
+                # Envoy may default to an older API version if we are not explicit about V3 here.
+                'resource_api_version': 'V3'
+            }
+        }
+
     def add_context(self, ctx: IRTLSContext) -> None:
         if TYPE_CHECKING:
             # This is needed because otherwise self.__setitem__ confuses things.
@@ -123,13 +142,28 @@ class V3TLSContext(Dict):
         if ctx.is_fallback:
             self.is_fallback = True
 
-        for secretinfokey, handler, hkey in [
-            ( 'cert_chain_file', self.update_cert_zero, 'certificate_chain' ),
-            ( 'private_key_file', self.update_cert_zero, 'private_key' ),
-            ( 'cacert_chain_file', self.update_validation, 'trusted_ca' ),
-        ]:
-            if secretinfokey in ctx['secret_info']:
-                handler(hkey, ctx['secret_info'][secretinfokey])
+        secret_info = ctx['secret_info']
+        cert_keys: List[Tuple[str, ElementHandler, str]]
+
+        # A secret that ambex serves over SDS is referred to by name rather than by its files, so
+        # that a new certificate doesn't change the listener (which would drain it).
+        if 'sds_secret' in secret_info:
+            self.update_sds_certs('tls_certificate_sds_secret_configs', secret_info['sds_secret'])
+            cert_keys = []
+        else:
+            cert_keys = [
+                ( 'cert_chain_file', self.update_cert_zero, 'certificate_chain' ),
+                ( 'private_key_file', self.update_cert_zero, 'private_key' ),
+            ]
+
+        if 'sds_validation_secret' in secret_info:
+            self.update_sds_validation('validation_context_sds_secret_config', secret_info['sds_validation_secret'])
+        else:
+            cert_keys.append(( 'cacert_chain_file', self.update_validation, 'trusted_ca' ))
+
+        for secretinfokey, handler, hkey in cert_keys:
+            if secretinfokey in secret_info:
+                handler(hkey, secret_info[secretinfokey])
 
         for ctxkey, handler, hkey in [
             ( 'alpn_protocols', self.update_alpn, 'alpn_protocols' ),
@@ -167,6 +201,11 @@ class V3TLSContext(Dict):
             basename = os.path.basename(filename)[0:8] + "..."
             dirname = os.path.basename(os.path.dirname(filename))
             filename = f".../{dirname}/{basename}"
+        else:
+            sds_certs = common_ctx.get("tls_certificate_sds_secret_configs", [])
+
+            if sds_certs:
+                filename = f"sds:{sds_certs[0]['name']}"
 
         return "<V3TLSContext%s chain_file %s>" % \
                (" (fallback)" if self.is_fallback else "", filename)
@@ -403,6 +403,12 @@ spec:
 
         normalized_endpoints: Dict[str, List[Dict[str, Any]]] = {}
 
+        # Each tag of the service's instances also gets a Service of its own, named the way that
+        # Mappings refer to a subset of the service: "_<service>._<tag>". Tags are case-insensitive,
+        # so they're lowercased here, as they are in the Mappings' services (see
+        # parse_consul_service in irserviceresolver.py).
+        subset_endpoints: Dict[str, Dict[str, List[Dict[str, Any]]]] = {}
+
         for ep in endpoints:
             ep_addr = ep.get('Address')
             ep_port = ep.get('Port')
@@ -413,25 +419,31 @@ spec:
 
             # Consul services don't have the weird indirections that Kube services do, so just
             # lump all the endpoints together under the same source port of '*'.
-            svc_eps = normalized_endpoints.setdefault('*', [])
-            svc_eps.append({
+            target = {
                 'ip': ep_addr,
                 'port': ep_port,
                 'target_kind': 'Consul'
-            })
-
-        spec = {
-            'ambassador_id': Config.ambassador_id,
-            'datacenter': consul_object.get('Id') or 'dc1',
-            'endpoints': normalized_endpoints,
-        }
-
-        self.manager.emit(NormalizedResource.from_data(
-            'Service',
-            name,
-            spec=spec,
-            rkey=f"consul-{name}-{spec['datacenter']}",
-        ))
+            }
+            normalized_endpoints.setdefault('*', []).append(target)
+
+            for tag in set(tag.lower() for tag in (ep.get('Tags') or [])):
+                subset_endpoints.setdefault(f"_{name}._{tag}", {}).setdefault('*', []).append(target)
+
+        datacenter = consul_object.get('Id') or 'dc1'
+
+        for svc_name, svc_endpoints in [(name, normalized_endpoints)] + sorted(subset_endpoints.items()):
+            spec = {
+                'ambassador_id': Config.ambassador_id,
+                'datacenter': datacenter,
+                'endpoints': svc_endpoints,
+            }
+
+            self.manager.emit(NormalizedResource.from_data(
+                'Service',
+                svc_name,
+                spec=spec,
+                rkey=f"consul-{svc_name}-{datacenter}",
+            ))
 
     def finalize(self) -> None:
         self.k8s_processor.finalize()
@@ -116,9 +116,13 @@ class InternalEndpointsProcessor (ManagedKubernetesProcessor):
         self.discovered_endpoints = {}
 
     def kinds(self) -> FrozenSet[KubernetesGVK]:
-        return frozenset([KubernetesGVK('v1', 'Endpoints')])
+        return frozenset([KubernetesGVK('v1', 'Endpoints'), KubernetesGVK('discovery.k8s.io/v1', 'EndpointSlice')])
 
     def _process(self, obj: KubernetesObject) -> None:
+        if obj.kind == 'EndpointSlice':
+            self._process_slice(obj)
+            return
+
         resource_subsets = obj.get('subsets')
         if not resource_subsets:
             self.logger.debug(f"ignoring Kubernetes Endpoints {obj.name}.{obj.namespace} with no subsets")
@@ -191,6 +195,61 @@ class InternalEndpointsProcessor (ManagedKubernetesProcessor):
 
             self.discovered_endpoints[obj.key] = Endpoints(addresses, port_dict, obj.labels)
 
+    def _process_slice(self, obj: KubernetesObject) -> None:
+        # On clusters that serve EndpointSlices, we don't watch Endpoints at all. A service can
+        # have any number of slices, labeled with the name of the service, so we merge them all
+        # under the key that the service's Endpoints would have had.
+        svc_name = obj.labels.get('kubernetes.io/service-name')
+        if not svc_name:
+            self.logger.debug(f"ignoring EndpointSlice {obj.name}.{obj.namespace} with no service")
+            return
+
+        if obj.get('addressType', 'IPv4') not in ('IPv4', 'IPv6'):
+            return
+
+        addresses: List[EndpointAddress] = []
+
+        for endpoint in obj.get('endpoints') or []:
+            # An endpoint with no ready condition is to be treated as ready.
+            if (endpoint.get('conditions') or {}).get('ready') is False:
+                continue
+
+            target_ref: Optional[KubernetesObjectKey] = None
+            try:
+                target_ref = KubernetesObjectKey.from_object_reference(endpoint.get('targetRef', {}))
+            except KeyError:
+                pass
+
+            for ip in endpoint.get('addresses') or []:
+                addresses.append(EndpointAddress(ip, node=endpoint.get('nodeName'), target=target_ref))
+
+        port_dict: Dict[str, int] = {}
+
+        for port in obj.get('ports') or []:
+            port_name = port.get('name', None)
+            port_number = port.get('port', None)
+            port_proto = port.get('protocol', 'TCP').upper()
+
+            if port_proto != 'TCP' or port_number is None:
+                continue
+
+            port_dict[str(port_number)] = port_number
+
+            if port_name:
+                port_dict[port_name] = port_number
+
+        if not addresses or not port_dict:
+            return
+
+        key = KubernetesObjectKey(KubernetesGVK('v1', 'Endpoints'), obj.namespace, svc_name)
+        existing = self.discovered_endpoints.get(key)
+
+        if existing:
+            addresses = existing.addresses + addresses
+            port_dict = {**existing.ports, **port_dict}
+
+        self.discovered_endpoints[key] = Endpoints(addresses, port_dict, obj.labels)
+
 
 class ServiceProcessor (ManagedKubernetesProcessor):
     """
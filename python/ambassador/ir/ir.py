@@ -102,6 +102,9 @@ class IR:
     saved_secrets: Dict[str, SavedSecret]
     secret_handler: SecretHandler
     secret_root: str
+    sds_certs: Dict[str, bool]
+    sds_ca_certs: Dict[str, bool]
+    sds_tls_secrets: bool
     sidecar_cluster_name: Optional[str]
     tls_contexts: Dict[str, IRTLSContext]
     tls_module: Optional[IRAmbassadorTLS]
@@ -258,6 +261,8 @@ class IR:
         # Also, we have no saved secret stuff yet...
         self.saved_secrets = {}
         self.secret_info: Dict[str, SecretInfo] = {}
+        self.sds_certs = {}
+        self.sds_ca_certs = {}
 
         # ...and the initial IR state is empty _except for k8s_status_updates_.
         #
@@ -281,6 +286,8 @@ class IR:
         self.resolvers = {}
         self.saved_secrets = {}
         self.secret_info = {}
+        self.sds_certs = {}
+        self.sds_ca_certs = {}
         self.services = {}
         self.sidecar_cluster_name = None
         self.tls_contexts = {}
@@ -300,6 +307,10 @@ class IR:
         self.edge_stack_allowed = parse_bool(os.environ.get('EDGE_STACK', 'false')) or os.path.exists('/ambassador/.edge_stack')
         self.agent_origination_ctx = None
 
+        # Ambex always serves the TLS secrets over SDS, but for now listeners only refer to them
+        # that way if AMBASSADOR_SDS_TLS_SECRETS is set: otherwise they use the secret files.
+        self.sds_tls_secrets = parse_bool(os.environ.get('AMBASSADOR_SDS_TLS_SECRETS', 'false'))
+
         # OK, time to get this show on the road. First things first: set up the
         # Ambassador module.
         #
@@ -736,6 +747,17 @@ class IR:
                 self.logger.debug('saving "%s.%s" (from %s) in secret_info', secret_name, secret_namespace, secret_key)
                 self.secret_info[f'{secret_name}.{secret_namespace}'] = secret_info
 
+                # Ambex serves these same secrets over SDS, under the same "name.namespace" names
+                # (see makeSDSSecrets in cmd/entrypoint/sds.go): as a certificate if the secret has
+                # both tls.crt and tls.key, and as a CA under "name.namespace-ca" from its ca.crt
+                # or, failing that, its tls.crt. Only the SDS CA has the ca.crt, so a ca_secret
+                # has to be referred to that way.
+                if self.sds_tls_secrets and aconf_secret.get('tls_crt'):
+                    if aconf_secret.get('tls_key'):
+                        self.sds_certs[f'{secret_name}.{secret_namespace}'] = True
+
+                    self.sds_ca_certs[f'{secret_name}.{secret_namespace}'] = True
+
     def save_tls_context(self, ctx: IRTLSContext) -> None:
         extant_ctx = self.tls_contexts.get(ctx.name, None)
         is_valid = True
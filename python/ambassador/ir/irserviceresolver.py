@@ -98,7 +98,11 @@ class IRServiceResolver(IRResource):
 
         valid = True
 
-        if mapping.service.find('.') >= 0:
+        # A Mapping to the subset of a service's instances with a tag is allowed the dots of
+        # "_<service>._<tag>", though.
+        svc_name, _ = parse_consul_service(mapping.service)
+
+        if svc_name.find('.') >= 0:
             mapping.post_error('The Consul resolver does not allow dots in service names')
             valid = False
 
@@ -159,7 +163,7 @@ class IRServiceResolver(IRResource):
         # We ignore the port in the lookup (we should've already posted a warning about the port
         # being present, actually).
 
-        return self.get_endpoints(ir, f'consul-{svc_name}-{self.datacenter}', None)
+        return self.get_endpoints(ir, f'consul-{consul_service_key(svc_name)}-{self.datacenter}', None)
 
     def get_endpoints(self, ir: 'IR', key: str, port: Optional[int]) -> Optional[SvcEndpointSet]:
         # OK. Do we have a Service by this key?
@@ -262,7 +266,7 @@ class IRServiceResolver(IRResource):
             'service': svc_name,
             'datacenter': self.datacenter,
             'kind': self.kind,
-            'endpoint_path': 'consul/%s/%s' % (self.datacenter, svc_name)
+            'endpoint_path': 'consul/%s/%s' % (self.datacenter, consul_service_key(svc_name))
         }
 
 class IRServiceResolverFactory:
@@ -373,3 +377,25 @@ def is_ip_address(addr: str) -> bool:
         return True
     except ValueError:
         return False
+
+def parse_consul_service(service: str) -> Tuple[str, str]:
+    # A Mapping routes to the subset of a Consul service's instances with a tag using a service
+    # of the form "_<service>._<tag>", the way Consul's DNS lookups write it. Tags are
+    # case-insensitive there, so the tag comes back lowercased.
+    if service.startswith('_'):
+        idx = service.find('._')
+
+        if idx > 0:
+            return service[1:idx], service[idx+2:].lower()
+
+    return service, ''
+
+def consul_service_key(service: str) -> str:
+    # The name that the fetcher gives the Service of a Consul service, or of the subset of one,
+    # and that the endpoints of its cluster are published under.
+    svc_name, tag = parse_consul_service(service)
+
+    if tag:
+        return f'_{svc_name}._{tag}'
+
+    return svc_name
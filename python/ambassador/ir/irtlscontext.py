@@ -216,6 +216,13 @@ class IRTLSContext(IRResource):
                 if ss.root_cert_path:
                     self.secret_info['cacert_chain_file'] = ss.root_cert_path
 
+                # If ambex serves this secret over SDS, refer to it by name instead of by its
+                # files, so that a new certificate doesn't change the listener.
+                sds_name = f"{ss.secret_name}.{ss.namespace}"
+
+                if self.ir.sds_certs.get(sds_name):
+                    self.secret_info['sds_secret'] = sds_name
+
         self.ir.logger.debug("TLSContext - successfully processed the cert_chain_file, private_key_file, and cacert_chain_file: %s" % self.secret_info)
 
         # OK. Repeat for the ca_secret_name.
@@ -245,6 +252,11 @@ class IRTLSContext(IRResource):
                 self.ir.logger.debug("TLSContext %s saved CA secret %s" % (self.name, ss.name))
                 self.secret_info['cacert_chain_file'] = ss.cert_path
 
+                sds_name = f"{ss.secret_name}.{ss.namespace}"
+
+                if self.ir.sds_ca_certs.get(sds_name):
+                    self.secret_info['sds_validation_secret'] = f"{sds_name}-ca"
+
                 # While we're here, did they set cert_required _in the secret_?
                 if ss.cert_data:
                     cert_required = ss.cert_data.get('cert_required')
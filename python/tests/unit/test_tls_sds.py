@@ -0,0 +1,158 @@
+import os
+
+from tests.selfsigned import TLSCerts
+from tests.utils import econf_compile
+
+import pytest
+
+def setup_function(function):
+    os.environ['AMBASSADOR_SDS_TLS_SECRETS'] = 'true'
+
+def teardown_function(function):
+    if 'AMBASSADOR_SDS_TLS_SECRETS' in os.environ:
+        del os.environ['AMBASSADOR_SDS_TLS_SECRETS']
+
+def tls_manifests(cert_name: str, client_ca_crt: str='') -> str:
+    cert = TLSCerts[cert_name]
+
+    return f'''
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: tls-cert
+  namespace: default
+type: kubernetes.io/tls
+data:
+  tls.crt: {cert.k8s_crt}
+  tls.key: {cert.k8s_key}
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: client-ca
+  namespace: default
+type: kubernetes.io/tls
+data:
+  tls.crt: {TLSCerts["master.datawire.io"].k8s_crt}
+{client_ca_crt}
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Listener
+metadata:
+  name: ambassador-https-listener
+  namespace: default
+spec:
+  port: 8443
+  protocol: HTTPS
+  securityModel: XFP
+  hostBinding:
+    namespace:
+      from: ALL
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Host
+metadata:
+  name: sds-host
+  namespace: default
+spec:
+  hostname: tls-context-host-1
+  tlsSecret:
+    name: tls-cert
+  tlsContext:
+    name: sds-context
+---
+apiVersion: getambassador.io/v3alpha1
+kind: TLSContext
+metadata:
+  name: sds-context
+  namespace: default
+spec:
+  hosts:
+  - tls-context-host-1
+  secret: tls-cert
+  ca_secret: client-ca
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: sds-mapping
+  namespace: default
+spec:
+  hostname: tls-context-host-1
+  prefix: /sds/
+  service: sds-service
+'''
+
+def _https_listener(econf):
+    listeners = [ l for l in econf['static_resources']['listeners']
+                  if l['address']['socket_address']['port_value'] == 8443 ]
+    assert len(listeners) == 1
+
+    return listeners[0]
+
+def _tls_contexts(listener):
+    contexts = []
+
+    for chain in listener['filter_chains']:
+        transport_socket = chain.get('transport_socket')
+
+        if transport_socket:
+            contexts.append(transport_socket['typed_config']['common_tls_context'])
+
+    return contexts
+
+@pytest.mark.compilertest
+def test_tls_sds_names():
+    listener = _https_listener(econf_compile(tls_manifests("tls-context-host-1"), envoy_version="V3"))
+    contexts = _tls_contexts(listener)
+    assert contexts
+
+    for common in contexts:
+        # No files, and so no private keys, in the listener: just the names that ambex serves the
+        # secrets under.
+        assert 'tls_certificates' not in common
+        assert 'validation_context' not in common
+
+        sds_certs = common['tls_certificate_sds_secret_configs']
+        assert [ c['name'] for c in sds_certs ] == [ 'tls-cert.default' ]
+        assert sds_certs[0]['sds_config'] == { 'ads': {}, 'resource_api_version': 'V3' }
+
+        assert common['validation_context_sds_secret_config']['name'] == 'client-ca.default-ca'
+
+@pytest.mark.compilertest
+def test_tls_sds_disabled():
+    # Without AMBASSADOR_SDS_TLS_SECRETS, the listener refers to the secret files, as it always
+    # has.
+    del os.environ['AMBASSADOR_SDS_TLS_SECRETS']
+    listener = _https_listener(econf_compile(tls_manifests("tls-context-host-1"), envoy_version="V3"))
+    contexts = _tls_contexts(listener)
+    assert contexts
+
+    for common in contexts:
+        assert 'tls_certificate_sds_secret_configs' not in common
+        assert 'validation_context_sds_secret_config' not in common
+        assert common['tls_certificates'][0]['certificate_chain']['filename']
+        assert common['validation_context']['trusted_ca']['filename']
+
+@pytest.mark.compilertest
+def test_tls_sds_cert_change_keeps_listener():
+    # A new certificate goes to Envoy over SDS, so it mustn't change the listener, which would
+    # drain it.
+    before = _https_listener(econf_compile(tls_manifests("tls-context-host-1"), envoy_version="V3"))
+    after = _https_listener(econf_compile(tls_manifests("tls-context-host-2"), envoy_version="V3"))
+
+    assert before == after
+
+@pytest.mark.compilertest
+def test_tls_sds_ca_crt():
+    # A ca_secret with a ca.crt is a CA by way of its ca.crt, which only ambex serves; its tls.crt
+    # (say, a leaf certificate) is no CA at all.
+    ca_crt = f'  ca.crt: {TLSCerts["acook"].k8s_crt}'
+    listener = _https_listener(econf_compile(tls_manifests("tls-context-host-1", ca_crt), envoy_version="V3"))
+    contexts = _tls_contexts(listener)
+    assert contexts
+
+    for common in contexts:
+        assert 'validation_context' not in common
+        assert common['validation_context_sds_secret_config']['name'] == 'client-ca.default-ca'